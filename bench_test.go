@@ -2,9 +2,14 @@ package xslate
 
 import (
 	"bytes"
+	"fmt"
 	ht "html/template"
+	"io/ioutil"
+	"runtime"
 	"testing"
 	tt "text/template"
+
+	"github.com/lestrrat/go-xslate/vm"
 )
 
 func BenchmarkXslateHelloWorld(b *testing.B) {
@@ -51,3 +56,87 @@ func BenchmarkTextTemplateHelloWorld(b *testing.B) {
 		t.ExecuteTemplate(buf, "T", "Bob")
 	}
 }
+
+const benchLoopTemplate = `<ul>
+[% FOREACH item IN items %]
+  <li class="[% loop.parity %]">[% loop.count %]. [% item.name %]: [% item.price * item.quantity %][% IF item.quantity > 10 %] (bulk)[% END %]</li>
+[% END %]
+</ul>`
+
+func benchmarkXslateBackend(b *testing.B, backend vm.Backend) {
+	c := newTestCtx(b)
+	defer c.Cleanup()
+
+	c.File("xslate/loop.tx").WriteString(benchLoopTemplate)
+
+	lcfg, _ := c.XslateArgs.Get("Loader")
+	lcfg.(Args)["CacheLevel"] = 2
+	c.XslateArgs["VM"] = Args{"Backend": backend}
+	tx := c.CreateTx()
+
+	items := make([]map[string]interface{}, 50)
+	for i := range items {
+		items[i] = map[string]interface{}{"name": fmt.Sprintf("item %d", i), "price": i * 3, "quantity": i % 20}
+	}
+	vars := Vars{"items": items}
+	buf := bytes.Buffer{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := tx.RenderInto(&buf, "xslate/loop.tx", vars); err != nil {
+			b.Fatalf("Failed to render template: %s", err)
+		}
+	}
+}
+
+func BenchmarkXslateLoopInterpreter(b *testing.B) {
+	benchmarkXslateBackend(b, vm.BackendInterpreter)
+}
+
+func BenchmarkXslateLoopClosure(b *testing.B) {
+	benchmarkXslateBackend(b, vm.BackendClosure)
+}
+
+// benchPrintCount is the number of values printed by benchPrintTemplate
+const benchPrintCount = 100 * 4
+
+const benchPrintTemplate = `[% FOREACH i IN items %][% name %][% i %][% price %][% ok %][% END %]`
+
+func benchmarkXslatePrint(b *testing.B, backend vm.Backend) {
+	c := newTestCtx(b)
+	defer c.Cleanup()
+
+	c.File("xslate/print.tx").WriteString(benchPrintTemplate)
+
+	lcfg, _ := c.XslateArgs.Get("Loader")
+	lcfg.(Args)["CacheLevel"] = 2
+	c.XslateArgs["VM"] = Args{"Backend": backend}
+	tx := c.CreateTx()
+
+	items := make([]interface{}, 100)
+	for i := range items {
+		items[i] = int64(i * 1000)
+	}
+	vars := Vars{"items": items, "name": "Bob & <Alice>", "price": 12.5, "ok": true}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tx.RenderInto(ioutil.Discard, "xslate/print.tx", vars); err != nil {
+			b.Fatalf("Failed to render template: %s", err)
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N)/benchPrintCount, "allocs/print")
+}
+
+func BenchmarkXslatePrintInterpreter(b *testing.B) {
+	benchmarkXslatePrint(b, vm.BackendInterpreter)
+}
+
+func BenchmarkXslatePrintClosure(b *testing.B) {
+	benchmarkXslatePrint(b, vm.BackendClosure)
+}
@@ -4,16 +4,36 @@ import (
 	"flag"
 	"fmt"
 	"github.com/lestrrat/go-xslate"
+	"github.com/lestrrat/go-xslate/compiler"
+	"github.com/lestrrat/go-xslate/gen"
+	"github.com/lestrrat/go-xslate/i18n"
+	"github.com/lestrrat/go-xslate/parser"
+	"github.com/lestrrat/go-xslate/parser/kolonish"
+	"github.com/lestrrat/go-xslate/parser/tterse"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage: xslate [options...] [input-files]\n")
+	fmt.Fprintf(os.Stderr, "       xslate extract [options...] [input-files]\n")
+	fmt.Fprintf(os.Stderr, "       xslate gen [options...] [input-files]\n")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "extract" {
+		extract(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gen" {
+		generate(os.Args[2:])
+		return
+	}
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -39,3 +59,127 @@ func main() {
 		fmt.Fprintf(os.Stdout, output)
 	}
 }
+
+// extract collects localizable messages from templates, and writes
+// them out as a .pot file
+func extract(argv []string) {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	output := fs.String("o", "", "write the .pot file to this file instead of stdout")
+	syntax := fs.String("syntax", "TTerse", "template syntax (TTerse or Kolon)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: xslate extract [options...] [input-files]\n")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	fs.Parse(argv)
+
+	files := fs.Args()
+	if len(files) < 1 {
+		fmt.Fprintf(os.Stderr, "Input file is missing.\n")
+		os.Exit(1)
+	}
+
+	e := i18n.NewExtractor(newParser(*syntax))
+	for _, file := range files {
+		if err := e.ExtractFile(file); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to extract messages: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %s\n", *output, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if err := e.WritePOT(out); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write .pot file: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// generate compiles templates to Go source code, with one render function
+// per template
+func generate(argv []string) {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	output := fs.String("o", "", "write the Go source to this file instead of stdout")
+	pkg := fs.String("package", "templates", "package name of the generated source")
+	root := fs.String("root", "", "directory to read the templates from. Templates are named relative to it")
+	syntax := fs.String("syntax", "TTerse", "template syntax (TTerse or Kolon)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: xslate gen [options...] [input-files]\n")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	fs.Parse(argv)
+
+	files := fs.Args()
+	if len(files) < 1 {
+		fmt.Fprintf(os.Stderr, "Input file is missing.\n")
+		os.Exit(1)
+	}
+
+	p := newParser(*syntax)
+	c := compiler.New()
+	g := gen.New(*pkg)
+	for _, file := range files {
+		template, err := ioutil.ReadFile(filepath.Join(*root, file))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %s\n", file, err)
+			os.Exit(1)
+		}
+		ast, err := p.Parse(file, template)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse %s: %s\n", file, err)
+			os.Exit(1)
+		}
+		bc, err := c.Compile(ast)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to compile %s: %s\n", file, err)
+			os.Exit(1)
+		}
+		if err := g.Add(filepath.ToSlash(file), bc); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	src, err := g.Generate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate Go source: %s\n", err)
+		os.Exit(1)
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %s\n", *output, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+	if _, err := out.Write(src); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write Go source: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func newParser(syntax string) parser.Parser {
+	switch strings.ToLower(syntax) {
+	case "tterse":
+		return tterse.New()
+	case "kolon", "kolonish":
+		return kolonish.New()
+	}
+	fmt.Fprintf(os.Stderr, "Unknown syntax %s\n", syntax)
+	os.Exit(1)
+	return nil
+}
@@ -9,9 +9,33 @@ import (
 	"github.com/lestrrat/go-xslate/vm"
 )
 
+// PushBlock records that the code compiled from now on is inside a
+// block of type t
+func (ctx *context) PushBlock(t node.NodeType, label string) *block {
+	b := &block{NodeType: t, label: label}
+	ctx.blocks = append(ctx.blocks, b)
+	return b
+}
+
+// PopBlock leaves the innermost block
+func (ctx *context) PopBlock() {
+	ctx.blocks = ctx.blocks[:len(ctx.blocks)-1]
+}
+
+// PatchJumps sets the destination of the gotos at positions to dest
+func (ctx *context) PatchJumps(positions []int, dest int) {
+	for _, pos := range positions {
+		op := ctx.ByteCode.Get(pos)
+		op.SetArg(dest - pos)
+		op.SetComment("Jump to " + strconv.Itoa(dest))
+	}
+}
+
 // AppendOp creates and appends a new op to the current set of ByteCode
 func (ctx *context) AppendOp(o vm.OpType, args ...interface{}) vm.Op {
-	return ctx.ByteCode.AppendOp(o, args...)
+	op := ctx.ByteCode.AppendOp(o, args...)
+	op.SetLine(ctx.line)
+	return op
 }
 
 // New creates a new BasicCompiler instance
@@ -24,6 +48,7 @@ func New() *BasicCompiler {
 func (c *BasicCompiler) Compile(ast *parser.AST) (*vm.ByteCode, error) {
 	ctx := &context{
 		ByteCode: vm.NewByteCode(),
+		AST:      ast,
 	}
 	for _, n := range ast.Root.Nodes {
 		compile(ctx, n)
@@ -32,21 +57,33 @@ func (c *BasicCompiler) Compile(ast *parser.AST) (*vm.ByteCode, error) {
 	// When we're done compiling, always append an END op
 	ctx.ByteCode.AppendOp(vm.TXOPEnd)
 
-	opt := &NaiveOptimizer{}
-	opt.Optimize(ctx.ByteCode)
+	var opt Optimizer = c.Optimizer
+	if opt == nil {
+		opt = NewOptimizer(OptimizeFull)
+	}
+	if err := opt.Optimize(ctx.ByteCode); err != nil {
+		return nil, err
+	}
 
 	ctx.ByteCode.Name = ast.Name
 	return ctx.ByteCode, nil
 }
 
 func compile(ctx *context, n node.Node) {
+	if line := ctx.AST.LineOf(n.Pos()); line > 0 {
+		defer func(line int) { ctx.line = line }(ctx.line)
+		ctx.line = line
+	}
+
 	switch n.Type() {
-	case node.Int, node.Text:
+	case node.Int, node.Float, node.Text:
 		compileLiteral(ctx, n)
 	case node.FetchSymbol:
 		compileFetchSymbol(ctx, n.(*node.TextNode))
 	case node.FetchField:
 		compileFetchField(ctx, n.(*node.FetchFieldNode))
+	case node.FetchSlice:
+		compileFetchSlice(ctx, n.(*node.FetchSliceNode))
 	case node.FetchArrayElement:
 		compileFetchArrayElement(ctx, n.(*node.BinaryNode))
 	case node.LocalVar:
@@ -67,28 +104,42 @@ func compile(ctx *context, n node.Node) {
 		compileElse(ctx, n.(*node.ElseNode))
 	case node.MakeArray:
 		compileMakeArray(ctx, n.(*node.UnaryNode))
+	case node.MakeHash:
+		compileMakeHash(ctx, n.(*node.UnaryNode))
 	case node.Range:
 		compileRange(ctx, n.(*node.BinaryNode))
 	case node.List:
 		compileList(ctx, n.(*node.ListNode))
 	case node.FunCall:
 		compileFunCall(ctx, n.(*node.FunCallNode))
+	case node.Lambda:
+		compileLambda(ctx, n.(*node.LambdaNode))
 	case node.MethodCall:
 		compileMethodCall(ctx, n.(*node.MethodCallNode))
 	case node.Include:
 		compileInclude(ctx, n.(*node.IncludeNode))
 	case node.Group:
 		compile(ctx, n.(*node.UnaryNode).Child)
-	case node.Equals, node.NotEquals, node.LT, node.GT:
+	case node.Equals, node.NotEquals, node.LT, node.GT, node.StringLT, node.StringGT, node.StringLE, node.StringGE, node.StringCmp:
 		compileComparison(ctx, n.(*node.BinaryNode))
 	case node.Plus, node.Minus, node.Mul, node.Div:
 		compileBinaryArithmetic(ctx, n.(*node.BinaryNode))
+	case node.Concat, node.Repeat:
+		compileStringOperator(ctx, n.(*node.BinaryNode))
 	case node.Filter:
 		compileFilter(ctx, n.(*node.FilterNode))
 	case node.Wrapper:
 		compileWrapper(ctx, n.(*node.WrapperNode))
 	case node.Macro:
 		compileMacro(ctx, n.(*node.MacroNode))
+	case node.Ternary:
+		compileTernary(ctx, n.(*node.TernaryNode))
+	case node.DefinedOr:
+		compileDefinedOr(ctx, n.(*node.BinaryNode))
+	case node.Last, node.Next:
+		compileLoopControl(ctx, n.(*node.LoopControlNode))
+	case node.Try:
+		compileTry(ctx, n.(*node.ListNode))
 	default:
 		fmt.Printf("Unknown node: %s\n", n.Type())
 	}
@@ -105,6 +156,16 @@ func compileComparison(ctx *context, n *node.BinaryNode) {
 		ctx.AppendOp(vm.TXOPLessThan)
 	case node.GT:
 		ctx.AppendOp(vm.TXOPGreaterThan)
+	case node.StringLT:
+		ctx.AppendOp(vm.TXOPStringLessThan)
+	case node.StringGT:
+		ctx.AppendOp(vm.TXOPStringGreaterThan)
+	case node.StringLE:
+		ctx.AppendOp(vm.TXOPStringLessThanEquals)
+	case node.StringGE:
+		ctx.AppendOp(vm.TXOPStringGreaterThanEquals)
+	case node.StringCmp:
+		ctx.AppendOp(vm.TXOPStringCompare)
 	default:
 		panic("Unknown operator")
 	}
@@ -120,6 +181,18 @@ func compileFetchArrayElement(ctx *context, n *node.BinaryNode) {
 	ctx.AppendOp(vm.TXOPPopmark)
 }
 
+func compileFetchSlice(ctx *context, n *node.FetchSliceNode) {
+	ctx.AppendOp(vm.TXOPPushmark).SetComment("fetch slice")
+	compile(ctx, n.End)
+	ctx.AppendOp(vm.TXOPPush)
+	compile(ctx, n.Start)
+	ctx.AppendOp(vm.TXOPPush)
+	compile(ctx, n.Container)
+	ctx.AppendOp(vm.TXOPPush)
+	ctx.AppendOp(vm.TXOPFetchSlice)
+	ctx.AppendOp(vm.TXOPPopmark)
+}
+
 func compileFetchField(ctx *context, n *node.FetchFieldNode) {
 	compile(ctx, n.Container)
 	ctx.AppendOp(vm.TXOPFetchFieldSymbol, n.FieldName)
@@ -130,11 +203,41 @@ func compileFetchSymbol(ctx *context, n *node.TextNode) {
 }
 
 func compileFilter(ctx *context, n *node.FilterNode) {
+	if n.Name == "default" {
+		compileDefaultFilter(ctx, n)
+		return
+	}
+
+	ctx.AppendOp(vm.TXOPPushmark).SetComment("Begin filter")
 	compile(ctx, n.Child)
+	ctx.AppendOp(vm.TXOPPush)
+	if n.Args != nil {
+		for _, child := range n.Args.Nodes {
+			compile(ctx, child)
+			ctx.AppendOp(vm.TXOPPush)
+		}
+	}
 	ctx.AppendOp(vm.TXOPFilter, n.Name)
+	ctx.AppendOp(vm.TXOPPopmark).SetComment("End filter")
+}
+
+// compileDefaultFilter compiles `expr | default(value)`. value is only
+// evaluated when expr is undefined or empty
+func compileDefaultFilter(ctx *context, n *node.FilterNode) {
+	compile(ctx, n.Child)
+	defop := ctx.AppendOp(vm.TXOPDefault, 0)
+	pos := ctx.ByteCode.Len()
+	if n.Args != nil && len(n.Args.Nodes) > 0 {
+		compile(ctx, n.Args.Nodes[0])
+	} else {
+		ctx.AppendOp(vm.TXOPLiteral, "")
+	}
+	defop.SetArg(ctx.ByteCode.Len() - pos + 1)
+	defop.SetComment("Jump to " + strconv.Itoa(ctx.ByteCode.Len()) + " if value is not empty")
 }
 
 func compileFunCall(ctx *context, n *node.FunCallNode) {
+	ctx.AppendOp(vm.TXOPPushmark).SetComment("Begin function call")
 	if len(n.Args.Nodes) > 0 {
 		ctx.AppendOp(vm.TXOPNoop).SetComment("Setting up function arguments")
 		for _, child := range n.Args.Nodes {
@@ -146,12 +249,31 @@ func compileFunCall(ctx *context, n *node.FunCallNode) {
 	if inv := n.Invocant; inv != nil {
 		compile(ctx, inv)
 	}
-	ctx.AppendOp(vm.TXOPFunCallOmni)
+
+	// Tell the VM the name of the function, for error messages
+	switch inv := n.Invocant.(type) {
+	case *node.LocalVarNode:
+		ctx.AppendOp(vm.TXOPFunCallOmni, inv.Name)
+	case *node.TextNode:
+		ctx.AppendOp(vm.TXOPFunCallOmni, inv.Text)
+	default:
+		ctx.AppendOp(vm.TXOPFunCallOmni)
+	}
+	ctx.AppendOp(vm.TXOPPopmark).SetComment("End function call")
 }
 
 func compileMakeArray(ctx *context, n *node.UnaryNode) {
+	ctx.AppendOp(vm.TXOPPushmark)
 	compile(ctx, n.Child)
 	ctx.AppendOp(vm.TXOPMakeArray)
+	ctx.AppendOp(vm.TXOPPopmark)
+}
+
+func compileMakeHash(ctx *context, n *node.UnaryNode) {
+	ctx.AppendOp(vm.TXOPPushmark)
+	compile(ctx, n.Child)
+	ctx.AppendOp(vm.TXOPMakeHash)
+	ctx.AppendOp(vm.TXOPPopmark)
 }
 
 func compileMethodCall(ctx *context, n *node.MethodCallNode) {
@@ -162,10 +284,29 @@ func compileMethodCall(ctx *context, n *node.MethodCallNode) {
 		compile(ctx, child)
 		ctx.AppendOp(vm.TXOPPush)
 	}
-	ctx.AppendOp(vm.TXOPMethodCall, n.MethodName)
+	if isSymbolChain(n.Invocant) {
+		// Could be a call to a registered function namespace, such as
+		// `time.Now()`. The VM decides at runtime, since namespaces are
+		// registered against the Xslate instance, not the template
+		ctx.AppendOp(vm.TXOPFunCallSymbol, n.MethodName)
+	} else {
+		ctx.AppendOp(vm.TXOPMethodCall, n.MethodName)
+	}
 	ctx.AppendOp(vm.TXOPPopmark).SetComment("End method call")
 }
 
+// isSymbolChain returns true if n is a symbol, or a field lookup on a
+// symbol chain (e.g. `foo`, `foo.bar.baz`)
+func isSymbolChain(n node.Node) bool {
+	switch n.Type() {
+	case node.FetchSymbol:
+		return true
+	case node.FetchField:
+		return isSymbolChain(n.(*node.FetchFieldNode).Container)
+	}
+	return false
+}
+
 func compilePrint(ctx *context, n *node.ListNode) {
 	compile(ctx, n.Nodes[0])
 	ctx.AppendOp(vm.TXOPPrint)
@@ -198,6 +339,8 @@ func compileList(ctx *context, n *node.ListNode) {
 
 func compileIf(ctx *context, n *node.IfNode) {
 	ctx.AppendOp(vm.TXOPPushmark).SetComment("BEGIN IF")
+	ctx.PushBlock(n.Type(), "")
+	defer ctx.PopBlock()
 	compile(ctx, n.BooleanExpression)
 	ifop := ctx.AppendOp(vm.TXOPAnd, 0)
 	pos := ctx.ByteCode.Len()
@@ -225,6 +368,30 @@ func compileIf(ctx *context, n *node.IfNode) {
 	ctx.AppendOp(vm.TXOPPopmark).SetComment("END IF")
 }
 
+func compileTernary(ctx *context, n *node.TernaryNode) {
+	compile(ctx, n.Condition)
+	andop := ctx.AppendOp(vm.TXOPAnd, 0)
+	pos := ctx.ByteCode.Len()
+	compile(ctx, n.Then)
+	gotoOp := ctx.AppendOp(vm.TXOPGoto, 0)
+	andop.SetArg(ctx.ByteCode.Len() - pos + 1)
+	andop.SetComment("Jump to " + strconv.Itoa(ctx.ByteCode.Len()) + " when condition fails")
+
+	pos = ctx.ByteCode.Len()
+	compile(ctx, n.Else)
+	gotoOp.SetArg(ctx.ByteCode.Len() - pos + 1)
+	gotoOp.SetComment("Jump to end of ternary at " + strconv.Itoa(ctx.ByteCode.Len()))
+}
+
+func compileDefinedOr(ctx *context, n *node.BinaryNode) {
+	compile(ctx, n.Left)
+	dorop := ctx.AppendOp(vm.TXOPDefinedOr, 0)
+	pos := ctx.ByteCode.Len()
+	compile(ctx, n.Right)
+	dorop.SetArg(ctx.ByteCode.Len() - pos + 1)
+	dorop.SetComment("Jump to " + strconv.Itoa(ctx.ByteCode.Len()) + " if value is defined")
+}
+
 func compileElse(ctx *context, n *node.ElseNode) {
 	gotoOp := ctx.AppendOp(vm.TXOPGoto, 0)
 	pos := ctx.ByteCode.Len()
@@ -234,9 +401,46 @@ func compileElse(ctx *context, n *node.ElseNode) {
 	gotoOp.SetArg(ctx.ByteCode.Len() - pos + 1)
 }
 
+// compileTry compiles TRY blocks. If an error is raised while running
+// the block, its output is discarded, and the CATCH block is run instead
+func compileTry(ctx *context, n *node.ListNode) {
+	tryop := ctx.AppendOp(vm.TXOPTry, 0)
+	pos := ctx.ByteCode.Len()
+
+	var catchNode node.Node
+	ctx.PushBlock(n.Type(), "")
+	for _, child := range n.Nodes {
+		if child.Type() == node.Catch {
+			catchNode = child
+		} else {
+			compile(ctx, child)
+		}
+	}
+	ctx.PopBlock()
+	ctx.AppendOp(vm.TXOPEndTry)
+	gotoOp := ctx.AppendOp(vm.TXOPGoto, 0)
+
+	tryop.SetArg(ctx.ByteCode.Len() - pos + 1)
+	tryop.SetComment("Jump to CATCH at " + strconv.Itoa(ctx.ByteCode.Len()) + " on error")
+
+	pos = ctx.ByteCode.Len()
+	if catchNode != nil {
+		x := catchNode.(*node.CatchNode)
+		// The VM puts the error in sa when it jumps here
+		ctx.AppendOp(vm.TXOPSaveToLvar, x.ErrorVarIdx).SetComment("Saving to local var 'error'")
+		for _, child := range x.Nodes {
+			compile(ctx, child)
+		}
+	}
+	gotoOp.SetArg(ctx.ByteCode.Len() - pos + 1)
+	gotoOp.SetComment("Jump to end of TRY at " + strconv.Itoa(ctx.ByteCode.Len()))
+}
+
 func compileBinaryOperands(ctx *context, x *node.BinaryNode) {
-	if x.Right.Type() == node.Group {
-		// Grouped node
+	if !isSimpleOperand(x.Right) {
+		// Compiling the right hand side may clobber register sb (as in
+		// 1 + 2 + 3, or grouped expressions), so evaluate it first and
+		// keep it on the stack
 		compile(ctx, x.Right)
 		ctx.AppendOp(vm.TXOPPush)
 		compile(ctx, x.Left)
@@ -249,6 +453,15 @@ func compileBinaryOperands(ctx *context, x *node.BinaryNode) {
 	}
 }
 
+// isSimpleOperand returns true if compiling n does not touch register sb
+func isSimpleOperand(n node.Node) bool {
+	switch n.Type() {
+	case node.Int, node.Float, node.Text, node.LocalVar, node.FetchSymbol:
+		return true
+	}
+	return false
+}
+
 func compileAssignmentNodes(ctx *context, assignnodes []node.Node) {
 	if len(assignnodes) <= 0 {
 		return
@@ -271,17 +484,26 @@ func compileForeach(ctx *context, x *node.ForeachNode) {
 	ctx.AppendOp(vm.TXOPPushFrame).SetComment("BEGIN new scope")
 	compile(ctx, x.List)
 	ctx.AppendOp(vm.TXOPForStart, x.IndexVarIdx)
+	if x.MaxIteration > 0 {
+		ctx.AppendOp(vm.TXOPLiteral, x.IndexVarIdx)
+		ctx.AppendOp(vm.TXOPForLimit, x.MaxIteration)
+	}
+	// for_iter expects the location of the index variable in sa
 	ctx.AppendOp(vm.TXOPLiteral, x.IndexVarIdx)
 
 	iter := ctx.AppendOp(vm.TXOPForIter, 0)
 	pos := ctx.ByteCode.Len()
 
+	b := ctx.PushBlock(x.Type(), x.IndexVarName)
 	children := x.Nodes
 	for _, v := range children {
 		compile(ctx, v)
 	}
+	ctx.PopBlock()
 
 	ctx.AppendOp(vm.TXOPGoto, -1*(ctx.ByteCode.Len()-pos+2)).SetComment("Jump back to for_iter at " + strconv.Itoa(pos))
+	ctx.PatchJumps(b.nexts, pos-2)
+	ctx.PatchJumps(b.lasts, ctx.ByteCode.Len())
 	ctx.AppendOp(vm.TXOPPopFrame).SetComment("END scope")
 
 	// Tell for iter to jump to this position when
@@ -295,7 +517,7 @@ func compileWhile(ctx *context, x *node.WhileNode) {
 	ctx.AppendOp(vm.TXOPPushmark)
 	ctx.AppendOp(vm.TXOPPushFrame)
 	ctx.AppendOp(vm.TXOPLiteral, 0)
-	ctx.AppendOp(vm.TXOPSaveToLvar, 0)
+	ctx.AppendOp(vm.TXOPSaveToLvar, x.LoopVarIdx)
 
 	condPos := ctx.ByteCode.Len() + 1
 
@@ -306,18 +528,66 @@ func compileWhile(ctx *context, x *node.WhileNode) {
 	ifop := ctx.AppendOp(vm.TXOPAnd, 0)
 	ifPos := ctx.ByteCode.Len()
 
+	b := ctx.PushBlock(x.Type(), "")
 	children := x.Nodes
 	for _, v := range children {
 		compile(ctx, v)
 	}
+	ctx.PopBlock()
 
 	// Go back to condPos
 	ctx.AppendOp(vm.TXOPGoto, -1*(ctx.ByteCode.Len()-condPos+1)).SetComment("Jump to " + strconv.Itoa(condPos))
 	ifop.SetArg(ctx.ByteCode.Len() - ifPos + 1)
-	ifop.SetComment("Jump to " + strconv.Itoa(ctx.ByteCode.Len()+1))
+	ifop.SetComment("Jump to " + strconv.Itoa(ctx.ByteCode.Len()))
+	ctx.PatchJumps(b.nexts, condPos-1)
+	ctx.PatchJumps(b.lasts, ctx.ByteCode.Len())
+	ctx.AppendOp(vm.TXOPPopFrame)
 	ctx.AppendOp(vm.TXOPPopmark)
 }
 
+// compileLoopControl compiles LAST and NEXT. Marks and frames pushed by
+// the blocks between here and the target loop are popped, and then we
+// jump to the end of the loop (LAST) or to the point where it fetches
+// the next item (NEXT). The jump destination is filled in by the loop
+// once it's compiled
+func compileLoopControl(ctx *context, n *node.LoopControlNode) {
+	target := -1
+	for i := len(ctx.blocks) - 1; i >= 0; i-- {
+		b := ctx.blocks[i]
+		if b.NodeType == node.Foreach || (b.NodeType == node.While && n.Label == "") {
+			if n.Label == "" || b.label == n.Label {
+				target = i
+				break
+			}
+		}
+	}
+	if target < 0 {
+		// The parser doesn't let this happen
+		return
+	}
+
+	for i := len(ctx.blocks) - 1; i > target; i-- {
+		switch ctx.blocks[i].NodeType {
+		case node.Foreach, node.While:
+			ctx.AppendOp(vm.TXOPPopFrame).SetComment("Unwind " + n.Type().String())
+			ctx.AppendOp(vm.TXOPPopmark)
+		case node.If:
+			ctx.AppendOp(vm.TXOPPopmark).SetComment("Unwind " + n.Type().String())
+		case node.Try:
+			ctx.AppendOp(vm.TXOPEndTry).SetComment("Unwind " + n.Type().String())
+		}
+	}
+
+	b := ctx.blocks[target]
+	pos := ctx.ByteCode.Len()
+	ctx.AppendOp(vm.TXOPGoto, 0)
+	if n.Type() == node.Last {
+		b.lasts = append(b.lasts, pos)
+	} else {
+		b.nexts = append(b.nexts, pos)
+	}
+}
+
 func compileWrapper(ctx *context, x *node.WrapperNode) {
 	// Save the current io.Writer to the stack
 	// This also creates pushes a bytes.Buffer into the stack
@@ -347,10 +617,6 @@ func compileWrapper(ctx *context, x *node.WrapperNode) {
 }
 
 func compileMacro(ctx *context, x *node.MacroNode) {
-	// The VM is responsible for passing arguments, which do not need
-	// to be declared as variables in the template. n.Arguments exists,
-	// but it's left untouched
-
 	// This goto effectively forces the VM to "ignore" this block of
 	// MACRO definition.
 	gotoOp := ctx.AppendOp(vm.TXOPGoto, 0)
@@ -367,11 +633,47 @@ func compileMacro(ctx *context, x *node.MacroNode) {
 	ctx.AppendOp(vm.TXOPEnd) // This END forces termination
 	gotoOp.SetArg(ctx.ByteCode.Len() - start + 1)
 
-	// Now remember about this definition
-	ctx.AppendOp(vm.TXOPLiteral, entryPoint)
+	// Now remember about this definition. The entry point is relative,
+	// like jumps, so that the optimizer can relocate it. The names of
+	// the parameters are passed on the stack, as the VM binds the
+	// arguments to them when the macro is called
+	ctx.AppendOp(vm.TXOPPushmark).SetComment("BEGIN macro")
+	for _, arg := range x.Arguments {
+		ctx.AppendOp(vm.TXOPLiteral, arg).SetComment("Argument '" + arg + "'")
+		ctx.AppendOp(vm.TXOPPush)
+	}
+	ctx.AppendOp(vm.TXOPMakeMacro, entryPoint-ctx.ByteCode.Len()).SetComment("Macro body at " + strconv.Itoa(entryPoint))
+	ctx.AppendOp(vm.TXOPPopmark).SetComment("END macro")
 	ctx.AppendOp(vm.TXOPSaveToLvar, x.LocalVar.Offset)
 }
 
+func compileLambda(ctx *context, x *node.LambdaNode) {
+	// Like MACRO, the body of the lambda lives inline, and we jump over it.
+	// The body is executed by the closure that make_closure creates
+	gotoOp := ctx.AppendOp(vm.TXOPGoto, 0)
+	start := ctx.ByteCode.Len()
+
+	compile(ctx, x.Child)
+	ctx.AppendOp(vm.TXOPEnd) // The result of the lambda is in sa
+	gotoOp.SetArg(ctx.ByteCode.Len() - start + 1)
+
+	// The stack holds the number of arguments, the local variable slots
+	// of the arguments, and then the slots of the captured variables
+	ctx.AppendOp(vm.TXOPPushmark).SetComment("BEGIN lambda")
+	ctx.AppendOp(vm.TXOPLiteral, len(x.Arguments))
+	ctx.AppendOp(vm.TXOPPush)
+	for _, arg := range x.Arguments {
+		ctx.AppendOp(vm.TXOPLiteral, arg.Offset).SetComment("Argument '" + arg.Name + "'")
+		ctx.AppendOp(vm.TXOPPush)
+	}
+	for _, v := range x.Captures {
+		ctx.AppendOp(vm.TXOPLiteral, v.Offset).SetComment("Capture '" + v.Name + "'")
+		ctx.AppendOp(vm.TXOPPush)
+	}
+	ctx.AppendOp(vm.TXOPMakeClosure, start-ctx.ByteCode.Len()).SetComment("Lambda body at " + strconv.Itoa(start))
+	ctx.AppendOp(vm.TXOPPopmark).SetComment("END lambda")
+}
+
 func compileInclude(ctx *context, x *node.IncludeNode) {
 	compile(ctx, x.IncludeTarget)
 	ctx.AppendOp(vm.TXOPPush)
@@ -379,6 +681,10 @@ func compileInclude(ctx *context, x *node.IncludeNode) {
 	// in the OUTER context, but the variables need to be set in the
 	// include context
 	compileAssignmentNodes(ctx, x.AssignmentNodes)
+	if x.Vars != nil {
+		compile(ctx, x.Vars)
+		ctx.AppendOp(vm.TXOPMoveToSb)
+	}
 	ctx.AppendOp(vm.TXOPPop)
 	ctx.AppendOp(vm.TXOPPushmark)
 	ctx.AppendOp(vm.TXOPInclude)
@@ -404,13 +710,30 @@ func compileBinaryArithmetic(ctx *context, n *node.BinaryNode) {
 	ctx.AppendOp(optype).SetComment("Execute " + optype.String() + " on registers sa and sb")
 }
 
+func compileStringOperator(ctx *context, n *node.BinaryNode) {
+	var optype vm.OpType
+	switch n.Type() {
+	case node.Concat:
+		optype = vm.TXOPConcat
+	case node.Repeat:
+		optype = vm.TXOPRepeat
+	default:
+		panic("Unknown string operator")
+	}
+	ctx.AppendOp(vm.TXOPNoop).SetComment("BEGIN " + optype.String())
+	compileBinaryOperands(ctx, n)
+	ctx.AppendOp(optype).SetComment("Execute " + optype.String() + " on registers sa and sb")
+}
+
 func compileLiteral(ctx *context, n node.Node) {
 	var op vm.Op
 	switch n.Type() {
 	case node.Int:
 		op = ctx.AppendOp(vm.TXOPLiteral, n.(*node.NumberNode).Value.Int())
+	case node.Float:
+		op = ctx.AppendOp(vm.TXOPLiteral, n.(*node.NumberNode).Value.Float())
 	case node.Text:
-		op = ctx.AppendOp(vm.TXOPLiteral, n.(*node.TextNode).Text)
+		op = ctx.AppendOp(vm.TXOPLiteral, string(n.(*node.TextNode).Text))
 	default:
 		panic("unknown literal value")
 	}
@@ -419,10 +742,9 @@ func compileLiteral(ctx *context, n node.Node) {
 
 func compileAssignment(ctx *context, n *node.AssignmentNode) {
 	compile(ctx, n.Expression)
-	// XXX this 0 must be pre-computed
-	ctx.AppendOp(vm.TXOPSaveToLvar, 0).SetComment("Saving to local var 0")
+	ctx.AppendOp(vm.TXOPSaveToLvar, n.Assignee.Offset).SetComment("Saving to local var '" + n.Assignee.Name + "'")
 }
 
 func compileLoadLvar(ctx *context, n *node.LocalVarNode) {
-	ctx.AppendOp(vm.TXOPLoadLvar, n).SetComment("Load variable '" + n.Name + "' to sa")
+	ctx.AppendOp(vm.TXOPLoadLvar, n.Offset).SetComment("Load variable '" + n.Name + "' to sa")
 }
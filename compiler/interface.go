@@ -1,6 +1,7 @@
 package compiler
 
 import (
+	"github.com/lestrrat/go-xslate/node"
 	"github.com/lestrrat/go-xslate/parser"
 	"github.com/lestrrat/go-xslate/vm"
 )
@@ -13,15 +14,37 @@ type Compiler interface {
 
 type context struct {
 	ByteCode *vm.ByteCode
+	AST      *parser.AST
+	// line is the line of the template that the node being compiled is
+	// on. Ops are tagged with it, so that errors can report their location
+	line int
+	// blocks are the enclosing blocks that push marks or frames onto the
+	// VM stacks, innermost last. LAST and NEXT use them to find their
+	// loop, and to unwind the stacks before jumping out
+	blocks []*block
+}
+
+// block is a construct that must be unwound when LAST or NEXT jumps
+// out of it
+type block struct {
+	node.NodeType        // Foreach, While, If or Try
+	label         string // name of the loop variable for FOREACH
+	lasts         []int  // positions of the gotos for LAST
+	nexts         []int  // positions of the gotos for NEXT
 }
 
 // BasicCompiler is the default compiler used by Xslate
-type BasicCompiler struct{}
+type BasicCompiler struct {
+	// Optimizer is applied to the compiled ByteCode. If nil, the
+	// optimizations of OptimizeFull are applied
+	Optimizer Optimizer
+}
 
 // Optimizer is the interface of things that can optimize the ByteCode
 type Optimizer interface {
 	Optimize(*vm.ByteCode) error
 }
 
-// NaiveOptimizer is the default ByteCode optimizer
+// NaiveOptimizer is a ByteCode optimizer that only applies the
+// optimizations of OptimizeBasic. See NewOptimizer
 type NaiveOptimizer struct{}
@@ -1,26 +1,409 @@
 package compiler
 
 import (
-	"errors"
-
 	"github.com/lestrrat/go-xslate/vm"
+	"github.com/pkg/errors"
 )
 
-// Optimize modifies the ByteCode in place to an optimized version
-func (o *NaiveOptimizer) Optimize(bc *vm.ByteCode) error {
-	for i := 0; i < bc.Len(); i++ {
-		op := bc.Get(i)
-		if op == nil {
-			return errors.New("failed to fetch op '" + op.String() + "'")
-		}
-		switch op.Type() {
-		case vm.TXOPLiteral:
-			if i+1 < bc.Len() && bc.Get(i+1).Type() == vm.TXOPPrintRaw {
-				bc.OpList[i] = vm.NewOp(vm.TXOPPrintRawConst, op.ArgString())
-				bc.OpList[i+1] = vm.NewOp(vm.TXOPNoop)
-				i++
+// OptimizationLevel selects the optimizations applied to compiled ByteCode
+type OptimizationLevel int
+
+const (
+	// OptimizeNone leaves the ByteCode as it was generated
+	OptimizeNone OptimizationLevel = iota
+	// OptimizeBasic removes noops, and prints raw text with print_raw_const,
+	// merging adjacent ones
+	OptimizeBasic
+	// OptimizeFull also folds constant expressions, removes branches that
+	// can never be taken along with code that can never be reached, and
+	// removes redundant jumps and stack operations. This is the default
+	OptimizeFull
+)
+
+// maxFoldedLength is the length of the longest string that constant
+// folding produces, so that things like `"a" x 100000` don't bloat the
+// ByteCode
+const maxFoldedLength = 1024
+
+// maxOptimizeRounds limits the number of times passes are repeated
+const maxOptimizeRounds = 16
+
+// Pass is a single optimization. It modifies p, and returns true if it
+// changed anything
+type Pass func(p *Program) bool
+
+// PassOptimizer is an Optimizer that runs its passes in order, over and
+// over until none of them change the ByteCode
+type PassOptimizer struct {
+	Passes []Pass
+}
+
+// NewOptimizer creates an Optimizer that applies the optimizations of
+// the given level
+func NewOptimizer(level OptimizationLevel) *PassOptimizer {
+	o := &PassOptimizer{}
+	if level >= OptimizeBasic {
+		o.Passes = append(o.Passes, RemoveNoops, PrintRawConst, MergePrints)
+	}
+	if level >= OptimizeFull {
+		o.Passes = append(o.Passes, FoldConstants, FoldBranches, RemoveUnreachable, RemoveRedundantJumps, RemovePushPop)
+	}
+	return o
+}
+
+// Optimize runs the passes on bc. Jumps are relocated to account for
+// the ops that the passes remove
+func (o *PassOptimizer) Optimize(bc *vm.ByteCode) error {
+	if len(o.Passes) == 0 {
+		return nil
+	}
+
+	p, err := NewProgram(bc)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < maxOptimizeRounds; i++ {
+		changed := false
+		for _, pass := range o.Passes {
+			if pass(p) {
+				changed = true
 			}
+			p.compact()
+		}
+		if !changed {
+			break
 		}
 	}
+	p.store(bc)
 	return nil
 }
+
+// Optimize modifies the ByteCode in place to an optimized version. It
+// applies the optimizations of OptimizeBasic
+func (o *NaiveOptimizer) Optimize(bc *vm.ByteCode) error {
+	return NewOptimizer(OptimizeBasic).Optimize(bc)
+}
+
+// Program is the ByteCode being optimized. The destinations of jumps are
+// kept as absolute positions while passes remove and replace ops, and are
+// converted back to relative offsets when the optimization is done
+type Program struct {
+	ops     []vm.Op
+	dests   []int  // destination of ops[i] if it's a jump, -1 otherwise
+	labels  []bool // true if ops[i] is the destination of a jump
+	removed []bool
+}
+
+// NewProgram creates a Program from bc
+func NewProgram(bc *vm.ByteCode) (*Program, error) {
+	p := &Program{
+		ops:   make([]vm.Op, bc.Len()),
+		dests: make([]int, bc.Len()),
+	}
+	copy(p.ops, bc.OpList)
+	for i, op := range p.ops {
+		p.dests[i] = -1
+		if !op.Type().IsJump() {
+			continue
+		}
+		dest := i + op.ArgInt()
+		if dest < 0 || dest > len(p.ops) {
+			return nil, errors.Errorf("op %d (%s) jumps out of the ByteCode", i, op.Type())
+		}
+		p.dests[i] = dest
+	}
+	p.compact()
+	return p, nil
+}
+
+// Len returns the number of ops
+func (p *Program) Len() int {
+	return len(p.ops)
+}
+
+// Op returns the op at position i
+func (p *Program) Op(i int) vm.Op {
+	return p.ops[i]
+}
+
+// Dest returns the position that the op at i jumps to, or -1 if it's
+// not a jump
+func (p *Program) Dest(i int) int {
+	return p.dests[i]
+}
+
+// IsLabel returns true if some op jumps to position i. Ops that are
+// jumped to can't be merged with the ops that precede them
+func (p *Program) IsLabel(i int) bool {
+	return p.labels[i]
+}
+
+// Is returns true if the ops starting at position i are of the given
+// types, and none of them but the first are jumped to
+func (p *Program) Is(i int, types ...vm.OpType) bool {
+	if i+len(types) > len(p.ops) {
+		return false
+	}
+	for j, t := range types {
+		if p.removed[i+j] || p.ops[i+j].Type() != t || (j > 0 && p.labels[i+j]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove removes the op at position i. Jumps to it go to the op that
+// follows instead
+func (p *Program) Remove(i int) {
+	p.removed[i] = true
+}
+
+// Replace replaces the op at position i with op, which takes over its
+// line number
+func (p *Program) Replace(i int, op vm.Op) {
+	op.SetLine(p.ops[i].Line())
+	p.ops[i] = op
+	p.dests[i] = -1
+}
+
+// ReplaceJump is like Replace, but op is a jump to dest
+func (p *Program) ReplaceJump(i int, op vm.Op, dest int) {
+	p.Replace(i, op)
+	p.dests[i] = dest
+}
+
+// compact drops the removed ops, and updates the jump destinations
+func (p *Program) compact() {
+	newpos := make([]int, len(p.ops)+1)
+	n := 0
+	for i := range p.ops {
+		newpos[i] = n
+		if p.removed == nil || !p.removed[i] {
+			p.ops[n] = p.ops[i]
+			p.dests[n] = p.dests[i]
+			n++
+		}
+	}
+	newpos[len(p.ops)] = n
+
+	p.ops = p.ops[:n]
+	p.dests = p.dests[:n]
+	p.removed = make([]bool, n)
+	p.labels = make([]bool, n+1)
+	for i, dest := range p.dests {
+		if dest >= 0 {
+			p.dests[i] = newpos[dest]
+			p.labels[p.dests[i]] = true
+		}
+	}
+}
+
+// store writes the ops back to bc, converting the jump destinations to
+// relative offsets
+func (p *Program) store(bc *vm.ByteCode) {
+	for i, op := range p.ops {
+		if dest := p.dests[i]; dest >= 0 {
+			op.SetArg(dest - i)
+		}
+	}
+	bc.OpList = p.ops
+}
+
+// RemoveNoops removes noop ops
+func RemoveNoops(p *Program) bool {
+	changed := false
+	for i := 0; i < p.Len(); i++ {
+		if p.Is(i, vm.TXOPNoop) {
+			p.Remove(i)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// PrintRawConst rewrites literal + print_raw into print_raw_const
+func PrintRawConst(p *Program) bool {
+	changed := false
+	for i := 0; i < p.Len(); i++ {
+		if p.Is(i, vm.TXOPLiteral, vm.TXOPPrintRaw) {
+			p.Replace(i, vm.NewOp(vm.TXOPPrintRawConst, p.Op(i).ArgString()))
+			p.Remove(i + 1)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// MergePrints merges adjacent print_raw_const ops into one
+func MergePrints(p *Program) bool {
+	changed := false
+	for i := 0; i < p.Len(); i++ {
+		if !p.Is(i, vm.TXOPPrintRawConst) {
+			continue
+		}
+		text := p.Op(i).ArgString()
+		j := i + 1
+		for ; j < p.Len() && p.Is(j, vm.TXOPPrintRawConst) && !p.IsLabel(j); j++ {
+			text += p.Op(j).ArgString()
+			p.Remove(j)
+		}
+		if j > i+1 {
+			p.Replace(i, vm.NewOp(vm.TXOPPrintRawConst, text))
+			changed = true
+		}
+		i = j - 1
+	}
+	return changed
+}
+
+// isFoldable returns true if ops of type t compute sa from sa and sb,
+// and nothing else
+func isFoldable(t vm.OpType) bool {
+	switch t {
+	case vm.TXOPAdd, vm.TXOPSub, vm.TXOPMul, vm.TXOPDiv,
+		vm.TXOPEquals, vm.TXOPNotEquals, vm.TXOPLessThan, vm.TXOPGreaterThan,
+		vm.TXOPConcat, vm.TXOPRepeat,
+		vm.TXOPStringLessThan, vm.TXOPStringGreaterThan, vm.TXOPStringLessThanEquals, vm.TXOPStringGreaterThanEquals, vm.TXOPStringCompare:
+		return true
+	}
+	return false
+}
+
+// isConstant returns true if v can be the argument of a literal op
+func isConstant(v interface{}) bool {
+	switch v := v.(type) {
+	case int64, float64, bool:
+		return true
+	case string:
+		return len(v) <= maxFoldedLength
+	}
+	return false
+}
+
+// FoldConstants evaluates arithmetic, comparisons and string operators
+// whose operands are both literals, replacing them with the result
+func FoldConstants(p *Program) bool {
+	changed := false
+	for i := 0; i < p.Len(); i++ {
+		var lhs, rhs vm.Op
+		var n int
+		switch {
+		case p.Is(i, vm.TXOPLiteral, vm.TXOPMoveToSb, vm.TXOPLiteral):
+			lhs, rhs, n = p.Op(i), p.Op(i+2), 3
+		case p.Is(i, vm.TXOPLiteral, vm.TXOPPush, vm.TXOPLiteral, vm.TXOPMoveToSb, vm.TXOPPop):
+			// The right hand side is evaluated first when it isn't simple
+			lhs, rhs, n = p.Op(i+2), p.Op(i), 5
+		default:
+			continue
+		}
+		if i+n >= p.Len() || p.IsLabel(i+n) || !isFoldable(p.Op(i+n).Type()) {
+			continue
+		}
+
+		result, _, ok := vm.EvalConst(p.Op(i+n), rhs.Arg(), lhs.Arg())
+		if !ok || !isConstant(result) {
+			continue
+		}
+		p.Replace(i, vm.NewOp(vm.TXOPLiteral, result))
+		for j := 1; j <= n; j++ {
+			p.Remove(i + j)
+		}
+		changed = true
+		i += n
+	}
+	return changed
+}
+
+// FoldBranches evaluates conditional jumps on literals. Jumps that are
+// always taken become gotos, and those that are never taken are removed
+func FoldBranches(p *Program) bool {
+	changed := false
+	for i := 0; i+1 < p.Len(); i++ {
+		if !p.Is(i, vm.TXOPLiteral) || p.IsLabel(i+1) {
+			continue
+		}
+		next := p.Op(i + 1)
+		switch next.Type() {
+		case vm.TXOPAnd, vm.TXOPDefinedOr, vm.TXOPDefault:
+		default:
+			continue
+		}
+
+		_, advance, ok := vm.EvalConst(next, p.Op(i).Arg(), nil)
+		if !ok {
+			continue
+		}
+		if advance != 1 {
+			p.ReplaceJump(i+1, vm.NewOp(vm.TXOPGoto, 0), p.Dest(i+1))
+		} else {
+			p.Remove(i + 1)
+		}
+		// The value of a // b and the default filter is in sa, but the
+		// condition of IF and WHILE is not used after the jump
+		if next.Type() == vm.TXOPAnd {
+			p.Remove(i)
+		}
+		changed = true
+		i++
+	}
+	return changed
+}
+
+// RemoveUnreachable removes the ops that can't be reached from the start
+// of the ByteCode, like the other side of branches that FoldBranches
+// made unconditional. The final end op is always kept
+func RemoveUnreachable(p *Program) bool {
+	reached := make([]bool, p.Len())
+	todo := []int{0}
+	for len(todo) > 0 {
+		i := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for i < p.Len() && !reached[i] {
+			reached[i] = true
+			if dest := p.Dest(i); dest >= 0 {
+				todo = append(todo, dest)
+			}
+			t := p.Op(i).Type()
+			if t == vm.TXOPGoto || t == vm.TXOPEnd {
+				break
+			}
+			i++
+		}
+	}
+
+	changed := false
+	for i := 0; i < p.Len()-1; i++ {
+		if !reached[i] {
+			p.Remove(i)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// RemoveRedundantJumps removes gotos to the op that follows them
+func RemoveRedundantJumps(p *Program) bool {
+	changed := false
+	for i := 0; i < p.Len(); i++ {
+		if p.Is(i, vm.TXOPGoto) && p.Dest(i) == i+1 {
+			p.Remove(i)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// RemovePushPop removes pushes that are immediately popped, and marks
+// that are immediately removed
+func RemovePushPop(p *Program) bool {
+	changed := false
+	for i := 0; i+1 < p.Len(); i++ {
+		if p.Is(i, vm.TXOPPush, vm.TXOPPop) || p.Is(i, vm.TXOPPushmark, vm.TXOPPopmark) {
+			p.Remove(i)
+			p.Remove(i + 1)
+			changed = true
+			i++
+		}
+	}
+	return changed
+}
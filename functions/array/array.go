@@ -1,19 +1,43 @@
 package array
 
 import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
 	"github.com/lestrrat/go-xslate/functions"
 )
 
 var depot = functions.NewFuncDepot("array")
 
 func init() {
+	depot.Set("First", First)
+	depot.Set("Grep", Grep)
 	depot.Set("Item", Item)
+	depot.Set("Join", Join)
+	depot.Set("Last", Last)
+	depot.Set("Map", Map)
+	depot.Set("Merge", Merge)
+	depot.Set("Reverse", Reverse)
 	depot.Set("Size", Size)
+	depot.Set("Slice", Slice)
+	depot.Set("Sort", Sort)
+	depot.Set("SortBy", SortBy)
+	depot.Set("Uniq", Uniq)
 }
 
-// Item returns the `i`-th item in the list
-func Item(l []interface{}, i int) interface{} {
-	return l[i]
+// Item returns the `i`-th item in the list. Negative indices count
+// from the end of the list. Returns nil if the index is out of range
+func Item(l []interface{}, i interface{}) interface{} {
+	idx := functions.ToInt(i)
+	if idx < 0 {
+		idx += len(l)
+	}
+	if idx < 0 || idx >= len(l) {
+		return nil
+	}
+	return l[idx]
 }
 
 // Size returns the size of the list
@@ -21,16 +45,196 @@ func Size(l []interface{}) int {
 	return len(l)
 }
 
-// First returns the first element
+// First returns the first element, or nil if the list is empty
 func First(l []interface{}) interface{} {
+	if len(l) == 0 {
+		return nil
+	}
 	return l[0]
 }
 
-// Last returns the last element
+// Last returns the last element, or nil if the list is empty
 func Last(l []interface{}) interface{} {
+	if len(l) == 0 {
+		return nil
+	}
 	return l[len(l)-1]
 }
 
+// Join returns the string representation of each element, joined by `sep`
+func Join(l []interface{}, sep interface{}) string {
+	s := make([]string, len(l))
+	for i, v := range l {
+		s[i] = functions.ToString(v)
+	}
+	return strings.Join(s, functions.ToString(sep))
+}
+
+// Reverse returns a new list with the elements in reverse order
+func Reverse(l []interface{}) []interface{} {
+	r := make([]interface{}, len(l))
+	for i, v := range l {
+		r[len(l)-i-1] = v
+	}
+	return r
+}
+
+// Sort returns a new list with the elements sorted. If `cmp` is nil,
+// the elements are compared using functions.Compare. Otherwise `cmp`
+// must be a function that receives two elements, and returns a negative
+// number, zero, or a positive number, as in Perl's sort blocks
+func Sort(l []interface{}, cmp interface{}) []interface{} {
+	r := make([]interface{}, len(l))
+	copy(r, l)
+	if cmp == nil {
+		sort.SliceStable(r, func(i, j int) bool {
+			return functions.Compare(r[i], r[j]) < 0
+		})
+	} else {
+		sort.SliceStable(r, func(i, j int) bool {
+			return functions.ToInt(functions.Call(cmp, r[i], r[j])) < 0
+		})
+	}
+	return r
+}
+
+// SortBy returns a new list sorted by the given key. If `key` is a
+// function, it is called for each element and its return values are
+// compared. Otherwise it is used as the name of the map key or struct
+// field to compare
+func SortBy(l []interface{}, key interface{}) []interface{} {
+	extract := func(v interface{}) interface{} {
+		return functions.Field(v, functions.ToString(key))
+	}
+	if reflect.ValueOf(key).Kind() == reflect.Func {
+		extract = func(v interface{}) interface{} {
+			return functions.Call(key, v)
+		}
+	}
+
+	keys := make([]interface{}, len(l))
+	for i, v := range l {
+		keys[i] = extract(v)
+	}
+
+	idx := make([]int, len(l))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return functions.Compare(keys[idx[i]], keys[idx[j]]) < 0
+	})
+
+	r := make([]interface{}, len(l))
+	for i, x := range idx {
+		r[i] = l[x]
+	}
+	return r
+}
+
+// Map returns a new list containing the results of calling `fn` on
+// each element
+func Map(l []interface{}, fn interface{}) []interface{} {
+	r := make([]interface{}, len(l))
+	for i, v := range l {
+		r[i] = functions.Call(fn, v)
+	}
+	return r
+}
+
+// Grep returns a new list containing the elements that match `cond`.
+// `cond` may be a function returning a bool, a *regexp.Regexp or a
+// string containing a regular expression, which is matched against the
+// string representation of each element
+func Grep(l []interface{}, cond interface{}) []interface{} {
+	var match func(interface{}) bool
+	switch c := cond.(type) {
+	case *regexp.Regexp:
+		match = func(v interface{}) bool { return c.MatchString(functions.ToString(v)) }
+	case string:
+		re, err := regexp.Compile(c)
+		if err != nil {
+			return []interface{}{}
+		}
+		match = func(v interface{}) bool { return re.MatchString(functions.ToString(v)) }
+	default:
+		match = func(v interface{}) bool { return truthy(functions.Call(cond, v)) }
+	}
+
+	r := []interface{}{}
+	for _, v := range l {
+		if match(v) {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// Slice returns the elements from index `from` to `to`, inclusive.
+// Negative indices count from the end of the list
+func Slice(l []interface{}, from, to interface{}) []interface{} {
+	start, end := functions.ToInt(from), functions.ToInt(to)
+	if start < 0 {
+		start += len(l)
+	}
+	if end < 0 {
+		end += len(l)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= len(l) {
+		end = len(l) - 1
+	}
+	if start > end {
+		return []interface{}{}
+	}
+
+	r := make([]interface{}, end-start+1)
+	copy(r, l[start:end+1])
+	return r
+}
+
+// Merge returns a new list containing the elements of `l` followed by
+// the elements of `other`. If `other` is not a list, it is appended as is
+func Merge(l []interface{}, other interface{}) []interface{} {
+	o := functions.ToList(other)
+	r := make([]interface{}, 0, len(l)+len(o))
+	r = append(r, l...)
+	return append(r, o...)
+}
+
+// Uniq returns a new list with duplicate elements removed. The first
+// occurrence of each element is kept
+func Uniq(l []interface{}) []interface{} {
+	seen := make(map[interface{}]struct{})
+	r := make([]interface{}, 0, len(l))
+	for _, v := range l {
+		key := v
+		if v != nil && !reflect.TypeOf(v).Comparable() {
+			// Can't use this as a map key, compare by representation
+			key = functions.ToString(v)
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		r = append(r, v)
+	}
+	return r
+}
+
+func truthy(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Bool {
+		return rv.Bool()
+	}
+	return !rv.IsZero()
+}
+
 // Depot returns the FuncDepot for "array"
 func Depot() *functions.FuncDepot {
 	return depot
@@ -0,0 +1,212 @@
+package functions
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Convert converts v, an argument passed from a template, to type t
+// so that it can be passed to a Go function. The following conversions
+// are done:
+//
+//   - nil becomes the zero value of t
+//   - numbers are converted to other numeric types, as long as they fit.
+//     Floats are only converted to integers if they have no fraction
+//   - strings are parsed as numbers, and numbers and booleans are
+//     formatted as strings
+//   - strings and []byte are converted to each other
+//   - lists and hashes (e.g. []interface{}) are converted to typed slices
+//     and maps, converting each element
+//
+// Values of named types are converted to and from their underlying type,
+// so a string can be passed as a `type Color string`
+func Convert(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	if !v.IsValid() {
+		return reflect.Zero(t), nil
+	}
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Zero(t), nil
+		}
+		v = v.Elem()
+	}
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := toInt64(v)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out := reflect.New(t).Elem()
+		if out.OverflowInt(i) {
+			return reflect.Value{}, errors.Errorf("%d overflows %s", i, t)
+		}
+		out.SetInt(i)
+		return out, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := toUint64(v)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out := reflect.New(t).Elem()
+		if out.OverflowUint(u) {
+			return reflect.Value{}, errors.Errorf("%d overflows %s", u, t)
+		}
+		out.SetUint(u)
+		return out, nil
+	case reflect.Float32, reflect.Float64:
+		f, err := toFloat64(v)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out := reflect.New(t).Elem()
+		if out.OverflowFloat(f) {
+			return reflect.Value{}, errors.Errorf("%g overflows %s", f, t)
+		}
+		out.SetFloat(f)
+		return out, nil
+	case reflect.String:
+		switch {
+		case v.Kind() == reflect.String, isByteSlice(v.Type()):
+			return v.Convert(t), nil
+		case isNumeric(v), v.Kind() == reflect.Bool:
+			return reflect.ValueOf(ToString(v.Interface())).Convert(t), nil
+		}
+		if s, ok := v.Interface().(fmt.Stringer); ok {
+			return reflect.ValueOf(s.String()).Convert(t), nil
+		}
+	case reflect.Slice:
+		if isByteSlice(t) && v.Kind() == reflect.String {
+			return v.Convert(t), nil
+		}
+		if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+			return convertSlice(v, t)
+		}
+	case reflect.Map:
+		if v.Kind() == reflect.Map {
+			return convertMap(v, t)
+		}
+	case reflect.Bool:
+		if v.Kind() == reflect.Bool {
+			return v.Convert(t), nil
+		}
+	default:
+		return convertByKind(v, t)
+	}
+	return reflect.Value{}, errors.Errorf("cannot convert %s to %s", v.Type(), t)
+}
+
+// convertByKind converts v to t if they have the same kind, e.g. from
+// a named type to its underlying type
+func convertByKind(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	if v.Kind() == t.Kind() && v.Type().ConvertibleTo(t) {
+		return v.Convert(t), nil
+	}
+	return reflect.Value{}, errors.Errorf("cannot convert %s to %s", v.Type(), t)
+}
+
+func convertSlice(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	out := reflect.MakeSlice(t, v.Len(), v.Len())
+	for i := 0; i < v.Len(); i++ {
+		e, err := Convert(v.Index(i), t.Elem())
+		if err != nil {
+			return reflect.Value{}, errors.Wrapf(err, "element %d", i)
+		}
+		out.Index(i).Set(e)
+	}
+	return out, nil
+}
+
+func convertMap(v reflect.Value, t reflect.Type) (reflect.Value, error) {
+	out := reflect.MakeMapWithSize(t, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		k, err := Convert(iter.Key(), t.Key())
+		if err != nil {
+			return reflect.Value{}, errors.Wrapf(err, "key %v", iter.Key())
+		}
+		e, err := Convert(iter.Value(), t.Elem())
+		if err != nil {
+			return reflect.Value{}, errors.Wrapf(err, "value of key %v", iter.Key())
+		}
+		out.SetMapIndex(k, e)
+	}
+	return out, nil
+}
+
+func toInt64(v reflect.Value) (int64, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := v.Uint(); u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+		return 0, errors.Errorf("%d overflows int64", v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return 0, errors.Errorf("%g is not an integer", f)
+		}
+		return int64(f), nil
+	case reflect.String:
+		i, err := strconv.ParseInt(v.String(), 10, 64)
+		if err != nil {
+			return 0, errors.Errorf("%q is not an integer", v.String())
+		}
+		return i, nil
+	}
+	return 0, errors.Errorf("cannot convert %s to an integer", v.Type())
+}
+
+func toFloat64(v reflect.Value) (float64, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return 0, errors.Errorf("%q is not a number", v.String())
+		}
+		return f, nil
+	}
+	return 0, errors.Errorf("cannot convert %s to a number", v.Type())
+}
+
+func toUint64(v reflect.Value) (uint64, error) {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	}
+	i, err := toInt64(v)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, errors.Errorf("%d is negative", i)
+	}
+	return uint64(i), nil
+}
+
+func isByteSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+}
+
+func isNumeric(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
@@ -9,11 +9,18 @@ import (
 type FuncDepot struct {
 	namespace string
 	depot     map[string]reflect.Value
+	children  map[string]*FuncDepot
 }
 
-// NewFuncDepot creates a new FuncDepot under the given `namespace`
+// NewFuncDepot creates a new FuncDepot under the given `namespace`.
+// Nested namespaces are separated by a dot, as in "encoding.json"
 func NewFuncDepot(namespace string) *FuncDepot {
-	return &FuncDepot{namespace, make(map[string]reflect.Value)}
+	return &FuncDepot{namespace, make(map[string]reflect.Value), make(map[string]*FuncDepot)}
+}
+
+// Namespace returns the namespace that this FuncDepot was created with
+func (fc *FuncDepot) Namespace() string {
+	return fc.namespace
 }
 
 // Map returns the map of string to function
@@ -33,3 +40,20 @@ func (fc *FuncDepot) Get(key string) (reflect.Value, bool) {
 func (fc *FuncDepot) Set(key string, v interface{}) {
 	fc.depot[key] = reflect.ValueOf(v)
 }
+
+// Depot returns the nested FuncDepot stored under the name `key`
+func (fc *FuncDepot) Depot(key string) (*FuncDepot, bool) {
+	child, ok := fc.children[key]
+	return child, ok
+}
+
+// Depots returns the map of name to nested FuncDepot
+func (fc *FuncDepot) Depots() map[string]*FuncDepot {
+	return fc.children
+}
+
+// SetDepot stores `child` as a nested namespace under the name `key`,
+// so that its functions can be called as `key.Func()` relative to `fc`
+func (fc *FuncDepot) SetDepot(key string, child *FuncDepot) {
+	fc.children[key] = child
+}
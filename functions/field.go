@@ -0,0 +1,238 @@
+package functions
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+
+// LookupField resolves `v.name` as templates do. Pointers and interfaces
+// are followed (nil ones resolve to nil), struct fields are looked up as
+// described in structFields, and methods that take no arguments can be
+// used as properties. Maps are looked up by key, which is converted to
+// the map's key type, before their methods are.
+//
+// The bool return value is false if v has no such field. The error is
+// the one returned by a method used as a property, if any
+func LookupField(v reflect.Value, name string) (interface{}, bool, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, true, nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, true, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if index, ok := cachedStructFields(v.Type()).lookup(name); ok {
+			f, err := v.FieldByIndexErr(index)
+			if err != nil {
+				// Field promoted from a nil embedded pointer
+				return nil, true, nil
+			}
+			return fieldValue(f), true, nil
+		}
+	case reflect.Map:
+		// Keys take precedence over the methods of named map types
+		if key, ok := MapKey(name, v.Type().Key()); ok {
+			if f := v.MapIndex(key); f.IsValid() {
+				return fieldValue(f), true, nil
+			}
+		}
+	}
+
+	if m, ok, err := fieldMethod(v, name); ok {
+		return m, true, err
+	}
+
+	// Missing keys are not an error
+	return nil, v.Kind() == reflect.Map, nil
+}
+
+// Field returns the value of `v.name`, resolved as in LookupField, or nil
+// if there is no such field
+func Field(v interface{}, name string) interface{} {
+	f, _, _ := LookupField(reflect.ValueOf(v), name)
+	return f
+}
+
+// structFields maps the names by which the fields of a struct type can
+// be accessed from templates to their indexes. In order of precedence,
+// a field can be accessed by
+//
+//   * the name in its `xslate:"name"` tag, or if it has none, in its
+//     `json:"name"` tag
+//   * its Go name, with or without the first character in upper case
+//   * its Go name in snake case (CreatedAt as created_at)
+//
+// Fields of embedded structs are included, with the shallower fields
+// taking precedence. Fields tagged with `xslate:"-"` are not accessible
+type structFields map[string][]int
+
+var structFieldsCache sync.Map // reflect.Type -> structFields
+
+func cachedStructFields(t reflect.Type) structFields {
+	if fields, ok := structFieldsCache.Load(t); ok {
+		return fields.(structFields)
+	}
+	fields, _ := structFieldsCache.LoadOrStore(t, newStructFields(t))
+	return fields.(structFields)
+}
+
+func newStructFields(t reflect.Type) structFields {
+	type candidate struct {
+		index []int
+		rank  int
+	}
+	candidates := make(map[string]candidate)
+	add := func(name string, f reflect.StructField, rank int) {
+		if name == "" {
+			return
+		}
+		// Names from fields that are nested deeper lose, regardless of
+		// how they were derived
+		rank += len(f.Index) * 10
+		if c, ok := candidates[name]; ok && c.rank <= rank {
+			return
+		}
+		candidates[name] = candidate{index: f.Index, rank: rank}
+	}
+
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() {
+			continue
+		}
+
+		tag, ok := f.Tag.Lookup("xslate")
+		if !ok {
+			tag = f.Tag.Get("json")
+		}
+		tag, _, _ = strings.Cut(tag, ",")
+		if tag == "-" {
+			if ok {
+				continue
+			}
+			// Fields that are not marshaled to JSON are still
+			// accessible by name
+			tag = ""
+		}
+
+		add(tag, f, 0)
+		add(f.Name, f, 1)
+		add(snakeCase(f.Name), f, 2)
+	}
+
+	fields := make(structFields, len(candidates))
+	for name, c := range candidates {
+		fields[name] = c.index
+	}
+	return fields
+}
+
+func (fields structFields) lookup(name string) ([]int, bool) {
+	if index, ok := fields[name]; ok {
+		return index, true
+	}
+	index, ok := fields[ucfirst(name)]
+	return index, ok
+}
+
+// fieldMethod calls the method name of v, if it exists and can be used
+// as a property: it takes no arguments, and returns either a single value
+// or a value and an error
+func fieldMethod(v reflect.Value, name string) (interface{}, bool, error) {
+	m := methodByName(v, ucfirst(name))
+	if !m.IsValid() {
+		// user.full_name calls user.FullName()
+		m = methodByName(v, Camelize(name))
+	}
+	if !m.IsValid() {
+		return nil, false, nil
+	}
+
+	mt := m.Type()
+	if mt.NumIn() != 0 {
+		return nil, false, nil
+	}
+	switch {
+	case mt.NumOut() == 1:
+	case mt.NumOut() == 2 && mt.Out(1) == errorType:
+	default:
+		return nil, false, nil
+	}
+
+	ret := m.Call(nil)
+	if len(ret) == 2 && !ret[1].IsNil() {
+		return nil, true, errors.Wrapf(ret[1].Interface().(error), "method '%s' failed", name)
+	}
+	return fieldValue(ret[0]), true, nil
+}
+
+func methodByName(v reflect.Value, name string) reflect.Value {
+	m := v.MethodByName(name)
+	if !m.IsValid() && v.CanAddr() {
+		// Methods with pointer receivers
+		m = v.Addr().MethodByName(name)
+	}
+	return m
+}
+
+// fieldValue returns the value of f. Values such as sql.NullString,
+// which implement driver.Valuer and have a Valid field, are replaced by
+// the value they hold, or nil
+func fieldValue(f reflect.Value) interface{} {
+	switch f.Kind() {
+	case reflect.Invalid:
+		return nil
+	case reflect.Interface, reflect.Ptr:
+		if f.IsNil() {
+			return nil
+		}
+	case reflect.Struct:
+		if !f.Type().Implements(valuerType) {
+			break
+		}
+		if valid := f.FieldByName("Valid"); valid.Kind() == reflect.Bool {
+			v, err := f.Interface().(driver.Valuer).Value()
+			if err != nil {
+				return nil
+			}
+			return v
+		}
+	}
+	return f.Interface()
+}
+
+func ucfirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// snakeCase converts CamelCase names to snake_case. Acronyms are kept
+// together, so UserID becomes user_id and HTTPServer becomes http_server
+func snakeCase(s string) string {
+	var buf bytes.Buffer
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && runes[i-1] != '_' && (!unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				buf.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
@@ -1,17 +1,31 @@
 package hash
 
 import (
+	"reflect"
+	"sort"
+
 	"github.com/lestrrat/go-xslate/functions"
 )
 
 var depot = functions.NewFuncDepot("hash")
 
 func init() {
+	depot.Set("Exists", Exists)
 	depot.Set("Keys", Keys)
+	depot.Set("Kv", Kv)
+	depot.Set("Merge", Merge)
+	depot.Set("Size", Size)
+	depot.Set("Values", Values)
+}
+
+// Pair is a key/value pair, as returned by Kv
+type Pair struct {
+	Key   interface{}
+	Value interface{}
 }
 
-// Keys returns the list of keys in this map. You can use this from a template
-// like so `[% FOREACH key IN hash.Keys(mymap) %]...[% END %]` or
+// Keys returns the sorted list of keys in this map. You can use this from
+// a template like so `[% FOREACH key IN mymap.keys() %]...[% END %]`
 func Keys(m map[interface{}]interface{}) []interface{} {
 	l := make([]interface{}, len(m))
 	i := 0
@@ -19,9 +33,72 @@ func Keys(m map[interface{}]interface{}) []interface{} {
 		l[i] = k
 		i++
 	}
+	sort.SliceStable(l, func(i, j int) bool {
+		return functions.Compare(l[i], l[j]) < 0
+	})
+	return l
+}
+
+// Values returns the list of values in this map, in the order of
+// their (sorted) keys
+func Values(m map[interface{}]interface{}) []interface{} {
+	keys := Keys(m)
+	l := make([]interface{}, len(keys))
+	for i, k := range keys {
+		l[i] = m[k]
+	}
+	return l
+}
+
+// Kv returns the list of key/value pairs in this map, sorted by key.
+// Each element can be accessed as `pair.key` and `pair.value`
+func Kv(m map[interface{}]interface{}) []interface{} {
+	keys := Keys(m)
+	l := make([]interface{}, len(keys))
+	for i, k := range keys {
+		l[i] = Pair{Key: k, Value: m[k]}
+	}
 	return l
 }
 
+// Size returns the number of elements in this map
+func Size(m map[interface{}]interface{}) int {
+	return len(m)
+}
+
+// Exists returns true if `key` exists in this map
+func Exists(m map[interface{}]interface{}, key interface{}) bool {
+	if key != nil && reflect.TypeOf(key).Comparable() {
+		if _, ok := m[key]; ok {
+			return true
+		}
+	}
+
+	// Keys from templates are usually strings or int64, which may not
+	// match the original key type. Compare by representation
+	s := functions.ToString(key)
+	for k := range m {
+		if functions.ToString(k) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge returns a new map containing the elements of both maps. Values
+// in `other` take precedence
+func Merge(m map[interface{}]interface{}, other interface{}) map[interface{}]interface{} {
+	o := functions.ToMap(other)
+	r := make(map[interface{}]interface{}, len(m)+len(o))
+	for k, v := range m {
+		r[k] = v
+	}
+	for k, v := range o {
+		r[k] = v
+	}
+	return r
+}
+
 // Depot returns the Depot for hash package
 func Depot() *functions.FuncDepot {
 	return depot
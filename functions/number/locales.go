@@ -0,0 +1,61 @@
+package number
+
+// localeData describes how numbers are formatted in a locale. The values
+// are taken from the CLDR (http://cldr.unicode.org/), simplified to what
+// the formatting functions in this package need
+type localeData struct {
+	decimal string // decimal separator
+	group   string // grouping separator
+	// secondaryGroup is the size of the groups after the first one. This
+	// is 2 for Indian style grouping (12,34,567), and 0 for the usual 3
+	secondaryGroup int
+
+	currency      string // default currency code
+	currencyAfter bool   // true if the symbol follows the number
+	currencySpace string // separator between the number and the symbol
+	percentSpace  string // separator between the number and the % sign
+}
+
+const (
+	nbsp       = "\u00a0"
+	narrowNbsp = "\u202f"
+)
+
+var locales = map[string]*localeData{
+	"en":    {decimal: ".", group: ",", currency: "USD"},
+	"en_GB": {decimal: ".", group: ",", currency: "GBP"},
+	"en_IN": {decimal: ".", group: ",", secondaryGroup: 2, currency: "INR"},
+	"hi":    {decimal: ".", group: ",", secondaryGroup: 2, currency: "INR"},
+	"ja":    {decimal: ".", group: ",", currency: "JPY"},
+	"zh":    {decimal: ".", group: ",", currency: "CNY"},
+	"ko":    {decimal: ".", group: ",", currency: "KRW"},
+	"de":    {decimal: ",", group: ".", currency: "EUR", currencyAfter: true, currencySpace: nbsp, percentSpace: nbsp},
+	"de_CH": {decimal: ".", group: "’", currency: "CHF", currencySpace: nbsp},
+	"fr":    {decimal: ",", group: narrowNbsp, currency: "EUR", currencyAfter: true, currencySpace: nbsp, percentSpace: narrowNbsp},
+	"es":    {decimal: ",", group: ".", currency: "EUR", currencyAfter: true, currencySpace: nbsp, percentSpace: nbsp},
+	"it":    {decimal: ",", group: ".", currency: "EUR", currencyAfter: true, currencySpace: nbsp},
+	"nl":    {decimal: ",", group: ".", currency: "EUR", currencySpace: nbsp},
+	"pt":    {decimal: ",", group: ".", currency: "BRL", currencySpace: nbsp},
+	"ru":    {decimal: ",", group: nbsp, currency: "RUB", currencyAfter: true, currencySpace: nbsp, percentSpace: nbsp},
+	"sv":    {decimal: ",", group: nbsp, currency: "SEK", currencyAfter: true, currencySpace: nbsp, percentSpace: nbsp},
+}
+
+// currencyData describes a currency
+type currencyData struct {
+	symbol string
+	digits int // number of fraction digits
+}
+
+var currencies = map[string]*currencyData{
+	"BRL": {"R$", 2},
+	"CHF": {"CHF", 2},
+	"CNY": {"¥", 2},
+	"EUR": {"€", 2},
+	"GBP": {"£", 2},
+	"INR": {"₹", 2},
+	"JPY": {"¥", 0},
+	"KRW": {"₩", 0},
+	"RUB": {"₽", 2},
+	"SEK": {"kr", 2},
+	"USD": {"$", 2},
+}
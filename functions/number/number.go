@@ -0,0 +1,233 @@
+/*
+Package number formats numbers, currencies and percentages according to
+the conventions of a locale.
+
+These are available as filters from templates, using the locale given by
+the "locale" template variable:
+
+  [% 1234567.891 | commify %]      1,234,567.891
+  [% 1234.5 | number(2) %]         1,234.50
+  [% 1234.56 | currency("JPY") %]  ¥1,235
+  [% 0.256 | percent(1) %]         25.6%
+  [% 1536 | bytes %]               1.5 KB
+*/
+package number
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lestrrat/go-xslate/functions"
+)
+
+// DefaultLocale is used for locales that are not known to this package
+const DefaultLocale = "en"
+
+// Formatter formats numbers for a specific locale
+type Formatter struct {
+	locale string
+	data   *localeData
+}
+
+var formatters = struct {
+	sync.Mutex
+	cache map[string]*Formatter
+}{cache: make(map[string]*Formatter)}
+
+// For returns the Formatter for `locale` (e.g. "de", "fr-CA", "en_IN").
+// If there's no data for the locale, the data for its language is used,
+// and then the data for DefaultLocale
+func For(locale string) *Formatter {
+	formatters.Lock()
+	defer formatters.Unlock()
+
+	if f, ok := formatters.cache[locale]; ok {
+		return f
+	}
+
+	name := strings.Replace(locale, "-", "_", -1)
+	if i := strings.IndexByte(name, '.'); i > -1 {
+		name = name[:i]
+	}
+	data, ok := locales[name]
+	if !ok {
+		if i := strings.IndexByte(name, '_'); i > -1 {
+			name = name[:i]
+			data, ok = locales[name]
+		}
+	}
+	if !ok {
+		name = DefaultLocale
+		data = locales[name]
+	}
+
+	f := &Formatter{locale: name, data: data}
+	formatters.cache[locale] = f
+	return f
+}
+
+// Locale returns the name of the locale whose data is used by `f`
+func (f *Formatter) Locale() string {
+	return f.locale
+}
+
+// Commify inserts grouping separators in the integer part of `v`, as in
+// "1,234,567.891". The fractional part is kept as is
+func (f *Formatter) Commify(v interface{}) string {
+	s := functions.ToString(v)
+	if _, ok := functions.ToFloat(v); !ok {
+		// Not a number. Leave it alone
+		return s
+	}
+	return f.format(strings.TrimSpace(s))
+}
+
+// Number formats `v` with grouping separators, rounded to `precision`
+// fraction digits. If precision is not given, up to 3 fraction digits
+// are displayed
+func (f *Formatter) Number(v interface{}, precision interface{}) string {
+	n, _ := functions.ToFloat(v)
+	if precision == nil {
+		return f.format(trimZeros(strconv.FormatFloat(n, 'f', 3, 64)))
+	}
+	p := functions.ToInt(precision)
+	return f.format(strconv.FormatFloat(round(n, p), 'f', p, 64))
+}
+
+// Currency formats `v` as an amount of the currency specified by its
+// ISO 4217 code (e.g. "USD", "JPY"). If the code is not given, the
+// currency of the locale is used. Amounts are rounded half away from
+// zero, so ¥0.5 is ¥1
+func (f *Formatter) Currency(v interface{}, code string) string {
+	if code == "" {
+		code = f.data.currency
+	}
+	code = strings.ToUpper(code)
+
+	symbol, digits := code, 2
+	if c, ok := currencies[code]; ok {
+		symbol, digits = c.symbol, c.digits
+	}
+
+	n, _ := functions.ToFloat(v)
+	n = round(n, digits)
+	s := f.format(strconv.FormatFloat(math.Abs(n), 'f', digits, 64))
+	if f.data.currencyAfter {
+		s = s + f.data.currencySpace + symbol
+	} else {
+		s = symbol + f.data.currencySpace + s
+	}
+	if n < 0 && s != "" {
+		s = "-" + s
+	}
+	return s
+}
+
+// Percent formats `v` (where 1 is 100%) as a percentage, rounded to
+// `precision` fraction digits. Halves are rounded away from zero, so
+// 0.125 is 13%
+func (f *Formatter) Percent(v interface{}, precision int) string {
+	n, _ := functions.ToFloat(v)
+	return f.format(strconv.FormatFloat(round(n*100, precision), 'f', precision, 64)) + f.data.percentSpace + "%"
+}
+
+var byteUnits = []string{"KB", "MB", "GB", "TB", "PB", "EB"}
+
+// Bytes formats `v` as a human readable size, such as "1.5 KB" or
+// "120 bytes". Sizes are in units of 1024 bytes, and rounded to
+// `precision` fraction digits (1 if not given)
+func (f *Formatter) Bytes(v interface{}, precision interface{}) string {
+	n, _ := functions.ToFloat(v)
+	p := 1
+	if precision != nil {
+		p = functions.ToInt(precision)
+	}
+
+	if math.Abs(n) < 1024 {
+		s := f.format(strconv.FormatFloat(n, 'f', 0, 64))
+		if n == 1 {
+			return s + " byte"
+		}
+		return s + " bytes"
+	}
+
+	unit := ""
+	for _, u := range byteUnits {
+		n /= 1024
+		unit = u
+		if math.Abs(n) < 1024 {
+			break
+		}
+	}
+	return f.format(strconv.FormatFloat(n, 'f', p, 64)) + " " + unit
+}
+
+// format localizes a number formatted by strconv: It adds grouping
+// separators, and replaces the decimal point
+func (f *Formatter) format(s string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i > -1 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+
+	// Don't group things like "1e+21" or "NaN"
+	for _, r := range intPart {
+		if r < '0' || r > '9' {
+			return sign + s
+		}
+	}
+
+	var groups []string
+	size := 3
+	for len(intPart) > size {
+		groups = append(groups, intPart[len(intPart)-size:])
+		intPart = intPart[:len(intPart)-size]
+		if f.data.secondaryGroup > 0 {
+			size = f.data.secondaryGroup
+		}
+	}
+	groups = append(groups, intPart)
+
+	var buf bytes.Buffer
+	buf.WriteString(sign)
+	for i := len(groups) - 1; i >= 0; i-- {
+		buf.WriteString(groups[i])
+		if i > 0 {
+			buf.WriteString(f.data.group)
+		}
+	}
+	if fracPart != "" {
+		buf.WriteString(f.data.decimal)
+		buf.WriteString(fracPart)
+	}
+	return buf.String()
+}
+
+// round rounds n to the given number of fraction digits. Unlike
+// strconv, which rounds halves to even, halves are rounded away from
+// zero, as is expected of amounts of money
+func round(n float64, digits int) float64 {
+	p := math.Pow10(digits)
+	r := math.Round(n*p) / p
+	if math.IsInf(r, 0) || math.IsNaN(r) {
+		// Too large to be scaled. strconv will do
+		return n
+	}
+	return r
+}
+
+func trimZeros(s string) string {
+	if strings.IndexByte(s, '.') < 0 {
+		return s
+	}
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
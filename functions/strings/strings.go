@@ -0,0 +1,171 @@
+package strings
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lestrrat/go-xslate/functions"
+)
+
+var depot = functions.NewFuncDepot("strings")
+
+func init() {
+	depot.Set("EndsWith", EndsWith)
+	depot.Set("Index", Index)
+	depot.Set("Length", Length)
+	depot.Set("Lower", Lower)
+	depot.Set("Match", Match)
+	depot.Set("Repeat", Repeat)
+	depot.Set("Replace", Replace)
+	depot.Set("Split", Split)
+	depot.Set("Sprintf", Sprintf)
+	depot.Set("StartsWith", StartsWith)
+	depot.Set("Substr", Substr)
+	depot.Set("Trim", Trim)
+	depot.Set("Ucfirst", Ucfirst)
+	depot.Set("Upper", Upper)
+}
+
+// Length returns the number of characters (not bytes) in `s`
+func Length(s string) int {
+	return utf8.RuneCountInString(s)
+}
+
+// Upper returns `s` with all characters converted to upper case
+func Upper(s string) string {
+	return strings.ToUpper(s)
+}
+
+// Lower returns `s` with all characters converted to lower case
+func Lower(s string) string {
+	return strings.ToLower(s)
+}
+
+// Ucfirst returns `s` with the first character converted to upper case
+func Ucfirst(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 {
+		return s
+	}
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// Trim returns `s` with leading and trailing whitespace removed
+func Trim(s string) string {
+	return strings.TrimSpace(s)
+}
+
+// Substr returns the substring of `s` starting at character `offset`,
+// which is `length` characters long. As in Perl, a negative offset counts
+// from the end of the string, a nil length means "until the end of the
+// string", and a negative length leaves that many characters off the end
+func Substr(s string, offset, length interface{}) string {
+	r := []rune(s)
+	start := functions.ToInt(offset)
+	if start < 0 {
+		start += len(r)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > len(r) {
+		return ""
+	}
+
+	end := len(r)
+	if length != nil {
+		if l := functions.ToInt(length); l < 0 {
+			end += l
+		} else if start+l < end {
+			end = start + l
+		}
+	}
+	if end <= start {
+		return ""
+	}
+	return string(r[start:end])
+}
+
+// Index returns the position (in characters) of the first occurrence of
+// `substr` in `s` at or after character `pos`, or -1 if it isn't found
+func Index(s, substr string, pos interface{}) int {
+	r := []rune(s)
+	start := functions.ToInt(pos)
+	if start < 0 {
+		start = 0
+	}
+	if start > len(r) {
+		return -1
+	}
+
+	i := strings.Index(string(r[start:]), substr)
+	if i < 0 {
+		return -1
+	}
+	return start + utf8.RuneCountInString(string(r[start:])[:i])
+}
+
+// Replace returns `s` with all occurrences of `old` replaced by `new`
+func Replace(s, old, new string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+// Split splits `s` by `sep`. If `limit` is a positive number, at most
+// `limit` elements are returned
+func Split(s, sep string, limit interface{}) []interface{} {
+	n := -1
+	if limit != nil {
+		if l := functions.ToInt(limit); l > 0 {
+			n = l
+		}
+	}
+
+	parts := strings.SplitN(s, sep, n)
+	l := make([]interface{}, len(parts))
+	for i, p := range parts {
+		l[i] = p
+	}
+	return l
+}
+
+// Match returns true if `s` matches the regular expression `pattern`.
+// An invalid pattern never matches
+func Match(s, pattern string) bool {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(s)
+}
+
+// Repeat returns `s` repeated `n` times
+func Repeat(s string, n interface{}) string {
+	count := functions.ToInt(n)
+	if count <= 0 {
+		return ""
+	}
+	return strings.Repeat(s, count)
+}
+
+// StartsWith returns true if `s` begins with `prefix`
+func StartsWith(s, prefix string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// EndsWith returns true if `s` ends with `suffix`
+func EndsWith(s, suffix string) bool {
+	return strings.HasSuffix(s, suffix)
+}
+
+// Sprintf uses `format` to format the given arguments, as in fmt.Sprintf
+func Sprintf(format string, args ...interface{}) string {
+	return fmt.Sprintf(format, args...)
+}
+
+// Depot returns the FuncDepot for "strings"
+func Depot() *functions.FuncDepot {
+	return depot
+}
@@ -0,0 +1,172 @@
+package time
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// strftimeLayouts maps strftime(3) conversion characters to the equivalent
+// Go layout. Conversions that have no Go layout equivalent are handled
+// directly in Strftime, and are not available for parsing
+var strftimeLayouts = map[byte]string{
+	'a': "Mon",
+	'A': "Monday",
+	'b': "Jan",
+	'B': "January",
+	'c': "Mon Jan _2 15:04:05 2006",
+	'd': "02",
+	'D': "01/02/06",
+	'e': "_2",
+	'F': "2006-01-02",
+	'h': "Jan",
+	'H': "15",
+	'I': "03",
+	'j': "002",
+	'm': "01",
+	'M': "04",
+	'n': "\n",
+	'p': "PM",
+	'r': "03:04:05 PM",
+	'R': "15:04",
+	'S': "05",
+	't': "\t",
+	'T': "15:04:05",
+	'x': "01/02/06",
+	'X': "15:04:05",
+	'y': "06",
+	'Y': "2006",
+	'z': "-0700",
+	'Z': "MST",
+	'%': "%",
+}
+
+// unpaddedLayouts are used for the GNU style `%-d` (no padding) conversions
+var unpaddedLayouts = map[byte]string{
+	'd': "2",
+	'I': "3",
+	'm': "1",
+	'M': "4",
+	'S': "5",
+}
+
+// Strftime formats `t` using strftime(3) style conversions such as
+// "%Y-%m-%d %H:%M:%S". A "-" flag (e.g. "%-d") removes zero padding.
+// In addition to the standard conversions, "%L" gives milliseconds
+// and "%s" the number of seconds since the Unix epoch
+func Strftime(t interface{}, format string) string {
+	tm, ok := ToTime(t)
+	if !ok {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 >= len(format) {
+			buf.WriteByte(c)
+			continue
+		}
+
+		i++
+		c = format[i]
+		if c == '-' && i+1 < len(format) {
+			i++
+			c = format[i]
+			if c == 'H' {
+				buf.WriteString(strconv.Itoa(tm.Hour()))
+				continue
+			}
+			if layout, ok := unpaddedLayouts[c]; ok {
+				buf.WriteString(tm.Format(layout))
+				continue
+			}
+		}
+
+		switch c {
+		case 'C':
+			buf.WriteString(pad2(tm.Year() / 100))
+		case 'k':
+			buf.WriteString(spacePad2(tm.Hour()))
+		case 'l':
+			buf.WriteString(spacePad2(hour12(tm)))
+		case 'L':
+			buf.WriteString(tm.Format(".000")[1:])
+		case 's':
+			buf.WriteString(strconv.FormatInt(tm.Unix(), 10))
+		case 'u':
+			wd := int(tm.Weekday())
+			if wd == 0 {
+				wd = 7
+			}
+			buf.WriteString(strconv.Itoa(wd))
+		case 'w':
+			buf.WriteString(strconv.Itoa(int(tm.Weekday())))
+		default:
+			if layout, ok := strftimeLayouts[c]; ok {
+				if c == '%' || c == 'n' || c == 't' {
+					buf.WriteString(layout)
+				} else {
+					buf.WriteString(tm.Format(layout))
+				}
+				continue
+			}
+			// Unknown conversions are left as is
+			buf.WriteByte('%')
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// strftimeToLayout converts a strftime(3) style format to a Go layout,
+// so that it can be used with time.Parse
+func strftimeToLayout(format string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 >= len(format) {
+			buf.WriteByte(c)
+			continue
+		}
+
+		i++
+		c = format[i]
+		if c == '-' && i+1 < len(format) {
+			if layout, ok := unpaddedLayouts[format[i+1]]; ok {
+				i++
+				buf.WriteString(layout)
+				continue
+			}
+		}
+		if layout, ok := strftimeLayouts[c]; ok {
+			buf.WriteString(layout)
+			continue
+		}
+		buf.WriteByte('%')
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+func pad2(n int) string {
+	if n < 10 {
+		return "0" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
+
+func spacePad2(n int) string {
+	if n < 10 {
+		return " " + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
+
+func hour12(t time.Time) int {
+	h := t.Hour() % 12
+	if h == 0 {
+		return 12
+	}
+	return h
+}
@@ -1,22 +1,316 @@
 package time
 
 import (
-	"github.com/lestrrat/go-xslate/functions"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/lestrrat/go-xslate/functions"
 )
 
 var depot = functions.NewFuncDepot("time")
 
 func init() {
-	depot.Set("After", time.After)
-	depot.Set("Sleep", time.Sleep)
-	depot.Set("Since", time.Since)
+	depot.Set("Add", Add)
+	depot.Set("AddDate", AddDate)
+	depot.Set("After", After)
+	depot.Set("Ago", Ago)
+	depot.Set("Before", Before)
+	depot.Set("Compare", Compare)
+	depot.Set("Equal", Equal)
+	depot.Set("Format", Format)
+	depot.Set("In", In)
 	depot.Set("Now", time.Now)
+	depot.Set("Parse", Parse)
 	depot.Set("ParseDuration", time.ParseDuration)
-	depot.Set("Since", time.Since)
+	depot.Set("Since", Since)
+	depot.Set("Strftime", Strftime)
+	depot.Set("Sub", Sub)
+	depot.Set("UTC", UTC)
 }
 
 // Depot returns the FuncDepot in the "time" namespace
 func Depot() *functions.FuncDepot {
 	return depot
 }
+
+// namedLayouts are layout names that can be used in place of an actual
+// layout in Format and Parse, e.g. `[% t | date("RFC3339") %]`
+var namedLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RubyDate":    time.RubyDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+	"DateTime":    "2006-01-02 15:04:05",
+	"DateOnly":    "2006-01-02",
+	"TimeOnly":    "15:04:05",
+}
+
+// parseLayouts are the layouts tried (in order) when parsing a string
+// without an explicit layout
+var parseLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.UnixDate,
+	time.ANSIC,
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// ToTime converts `v` to a time.Time. Besides time.Time values (and
+// pointers to them), strings in a handful of common formats (such as
+// RFC3339 and "2006-01-02 15:04:05") and numbers, taken as seconds since
+// the Unix epoch, are accepted
+func ToTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, true
+	case *time.Time:
+		if t == nil {
+			return time.Time{}, false
+		}
+		return *t, true
+	case string:
+		tm, err := Parse(t, "")
+		return tm, err == nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return time.Unix(int64(functions.ToInt(v)), 0), true
+	case reflect.Struct:
+		if rv.Type().ConvertibleTo(timeType) {
+			return rv.Convert(timeType).Interface().(time.Time), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// toDuration converts `v` to a time.Duration. Strings are parsed with
+// time.ParseDuration (e.g. "1h30m"), and plain numbers are taken as seconds
+func toDuration(v interface{}) time.Duration {
+	switch d := v.(type) {
+	case time.Duration:
+		return d
+	case string:
+		ret, _ := time.ParseDuration(d)
+		return ret
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return time.Duration(rv.Float() * float64(time.Second))
+	}
+	return time.Duration(functions.ToInt(v)) * time.Second
+}
+
+func toLayout(layout string) string {
+	if named, ok := namedLayouts[layout]; ok {
+		return named
+	}
+	if strings.IndexByte(layout, '%') > -1 {
+		return strftimeToLayout(layout)
+	}
+	return layout
+}
+
+// Format formats `t` according to `layout`, which may be a strftime(3)
+// style format ("%Y-%m-%d"), a Go layout ("2006-01-02"), or the name of
+// one of the standard layouts ("RFC3339"). If no layout is given,
+// "2006-01-02 15:04:05" is used
+func Format(t interface{}, layout string) string {
+	if layout == "" {
+		layout = "DateTime"
+	}
+	if named, ok := namedLayouts[layout]; ok {
+		layout = named
+	}
+	if strings.IndexByte(layout, '%') > -1 {
+		return Strftime(t, layout)
+	}
+
+	tm, ok := ToTime(t)
+	if !ok {
+		return ""
+	}
+	return tm.Format(layout)
+}
+
+// Parse parses `s` using `layout`, which may be any of the layouts accepted
+// by Format. If no layout is given, a handful of common layouts are tried.
+// Times without zone information are in UTC
+func Parse(s string, layout string) (time.Time, error) {
+	if layout != "" {
+		return time.Parse(toLayout(layout), s)
+	}
+
+	for _, l := range parseLayouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("time: could not parse %q", s)
+}
+
+var locations = struct {
+	sync.Mutex
+	cache map[string]*time.Location
+}{cache: make(map[string]*time.Location)}
+
+func loadLocation(name string) (*time.Location, error) {
+	locations.Lock()
+	defer locations.Unlock()
+
+	if loc, ok := locations.cache[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.cache[name] = loc
+	return loc, nil
+}
+
+// In converts `t` to the time zone specified by its IANA name, such as
+// "Asia/Tokyo" or "UTC"
+func In(t interface{}, name string) (time.Time, error) {
+	tm, ok := ToTime(t)
+	if !ok {
+		return time.Time{}, fmt.Errorf("time: %v is not a time", t)
+	}
+
+	loc, err := loadLocation(name)
+	if err != nil {
+		return tm, err
+	}
+	return tm.In(loc), nil
+}
+
+// UTC converts `t` to UTC
+func UTC(t interface{}) time.Time {
+	tm, _ := ToTime(t)
+	return tm.UTC()
+}
+
+// Add returns `t` plus duration `d`. `d` may be a time.Duration, a string
+// such as "1h30m" or "-15m", or a number of seconds
+func Add(t interface{}, d interface{}) time.Time {
+	tm, _ := ToTime(t)
+	return tm.Add(toDuration(d))
+}
+
+// AddDate returns `t` plus the given number of years, months and days
+func AddDate(t interface{}, years, months, days int) time.Time {
+	tm, _ := ToTime(t)
+	return tm.AddDate(years, months, days)
+}
+
+// Sub returns the duration between `a` and `b` (a - b)
+func Sub(a, b interface{}) time.Duration {
+	ta, _ := ToTime(a)
+	tb, _ := ToTime(b)
+	return ta.Sub(tb)
+}
+
+// Since returns the time elapsed since `t`
+func Since(t interface{}) time.Duration {
+	tm, _ := ToTime(t)
+	return time.Since(tm)
+}
+
+// Before returns true if `a` is before `b`
+func Before(a, b interface{}) bool {
+	return Compare(a, b) < 0
+}
+
+// After returns true if `a` is after `b`
+func After(a, b interface{}) bool {
+	return Compare(a, b) > 0
+}
+
+// Equal returns true if `a` and `b` represent the same instant
+func Equal(a, b interface{}) bool {
+	return Compare(a, b) == 0
+}
+
+// Compare returns -1, 0, or 1 depending on whether `a` is before, the same
+// as, or after `b`
+func Compare(a, b interface{}) int {
+	ta, _ := ToTime(a)
+	tb, _ := ToTime(b)
+	switch {
+	case ta.Before(tb):
+		return -1
+	case ta.After(tb):
+		return 1
+	}
+	return 0
+}
+
+var relativeUnits = []struct {
+	name string
+	size time.Duration
+}{
+	{"year", 365 * 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+	{"day", 24 * time.Hour},
+	{"hour", time.Hour},
+	{"minute", time.Minute},
+	{"second", time.Second},
+}
+
+// Ago returns the time relative to `base` (or the current time, if not
+// given) in a human readable form, such as "3 hours ago" or "in 2 days"
+func Ago(t interface{}, base interface{}) string {
+	tm, ok := ToTime(t)
+	if !ok {
+		return ""
+	}
+
+	now := time.Now()
+	if base != nil {
+		now, _ = ToTime(base)
+	}
+
+	d := now.Sub(tm)
+	future := d < 0
+	if future {
+		d = -d
+	}
+
+	for _, unit := range relativeUnits {
+		if d < unit.size {
+			continue
+		}
+
+		n := int64(d / unit.size)
+		s := fmt.Sprintf("%d %s", n, unit.name)
+		if n > 1 {
+			s += "s"
+		}
+		if future {
+			return "in " + s
+		}
+		return s + " ago"
+	}
+	return "just now"
+}
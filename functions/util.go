@@ -0,0 +1,263 @@
+package functions
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ToInt converts numeric values (and strings that look like numbers) to
+// an int, truncating any fraction. This is required because numbers in
+// templates are int64 or float64, while Go functions usually want plain
+// ints. Anything else is 0
+func ToInt(v interface{}) int {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return int(rv.Float())
+	case reflect.String:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(rv.String()), 64); err == nil {
+			return int(f)
+		}
+	case reflect.Bool:
+		if rv.Bool() {
+			return 1
+		}
+	}
+	return 0
+}
+
+// ToFloat converts numeric values and strings that look like numbers to
+// a float64. The bool return value is false if v is not a number
+func ToFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.String {
+		f, err := strconv.ParseFloat(strings.TrimSpace(rv.String()), 64)
+		return f, err == nil
+	}
+	if !isNumeric(rv) {
+		return 0, false
+	}
+	f, _ := toFloat64(rv)
+	return f, true
+}
+
+// ToString converts the given value to a string, in the same way the
+// template engine does when it prints a value
+func ToString(v interface{}) string {
+	// The common cases, without going through reflection
+	switch x := v.(type) {
+	case string:
+		return x
+	case int:
+		return strconv.Itoa(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return ""
+	case reflect.String:
+		return rv.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(rv.Float(), 'f', -1, 64)
+	case reflect.Bool:
+		return strconv.FormatBool(rv.Bool())
+	}
+	return fmt.Sprintf("%s", v)
+}
+
+// Compare compares two arbitrary values, and returns -1, 0, or 1 if `a` is
+// less than, equal to, or greater than `b`. Numbers are compared
+// numerically, everything else is compared by their string representation.
+// nil sorts before anything else
+func Compare(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+
+	if av, bv := reflect.ValueOf(a), reflect.ValueOf(b); isNumeric(av) && isNumeric(bv) {
+		x, _ := toFloat64(av)
+		y, _ := toFloat64(bv)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+
+	x, y := ToString(a), ToString(b)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// Call calls `fn` (which must be a function) with the given arguments, and
+// returns its first return value. Arguments are converted to the types
+// that `fn` expects as described in Convert, so that callbacks that take
+// concrete types can be passed to generic functions such as `map` and
+// `grep`. Arguments that cannot be converted are passed as zero values
+func Call(fn interface{}, args ...interface{}) interface{} {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		return nil
+	}
+
+	ft := fv.Type()
+	in := make([]reflect.Value, 0, len(args))
+	for i, arg := range args {
+		var t reflect.Type
+		switch {
+		case ft.IsVariadic() && i >= ft.NumIn()-1:
+			t = ft.In(ft.NumIn() - 1).Elem()
+		case i < ft.NumIn():
+			t = ft.In(i)
+		default:
+			// Too many arguments. Just drop them
+			continue
+		}
+		v, err := Convert(reflect.ValueOf(arg), t)
+		if err != nil {
+			v = reflect.Zero(t)
+		}
+		in = append(in, v)
+	}
+	for len(in) < ft.NumIn() && !(ft.IsVariadic() && len(in) == ft.NumIn()-1) {
+		in = append(in, reflect.Zero(ft.In(len(in))))
+	}
+
+	out := fv.Call(in)
+	if len(out) == 0 {
+		return nil
+	}
+	return out[0].Interface()
+}
+
+// ToList converts any slice or array into a []interface{}. Values that
+// are not lists are returned as a list with one element, and nil is
+// returned as an empty list
+func ToList(v interface{}) []interface{} {
+	if l, ok := v.([]interface{}); ok {
+		return l
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return []interface{}{}
+	case reflect.Slice, reflect.Array:
+		l := make([]interface{}, rv.Len())
+		for i := range l {
+			l[i] = rv.Index(i).Interface()
+		}
+		return l
+	}
+	return []interface{}{v}
+}
+
+// ToMap converts any map into a map[interface{}]interface{}. Values that
+// are not maps are returned as an empty map
+func ToMap(v interface{}) map[interface{}]interface{} {
+	if m, ok := v.(map[interface{}]interface{}); ok {
+		return m
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return map[interface{}]interface{}{}
+	}
+	m := make(map[interface{}]interface{}, rv.Len())
+	for _, k := range rv.MapKeys() {
+		m[k.Interface()] = rv.MapIndex(k).Interface()
+	}
+	return m
+}
+
+// Camelize converts snake_case names to CamelCase ("sort_by" -> "SortBy")
+func Camelize(name string) string {
+	var buf bytes.Buffer
+	upper := true
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// MapKey converts v to a value that can be used as a key of type t.
+// Numbers and strings are converted to each other as necessary, so that
+// hash[1] and hash["1"] both work
+func MapKey(v interface{}, t reflect.Type) (reflect.Value, bool) {
+	if v == nil {
+		return reflect.Value{}, false
+	}
+
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Type().AssignableTo(t):
+		return rv, true
+	case t.Kind() == reflect.Interface:
+		return reflect.Value{}, false
+	case t.Kind() == reflect.String:
+		return reflect.ValueOf(ToString(v)).Convert(t), true
+	case rv.Kind() == reflect.String:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i, err := strconv.ParseInt(rv.String(), 10, t.Bits())
+			if err != nil {
+				return reflect.Value{}, false
+			}
+			return reflect.ValueOf(i).Convert(t), true
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			u, err := strconv.ParseUint(rv.String(), 10, t.Bits())
+			if err != nil {
+				return reflect.Value{}, false
+			}
+			return reflect.ValueOf(u).Convert(t), true
+		case reflect.Float32, reflect.Float64:
+			f, err := strconv.ParseFloat(rv.String(), t.Bits())
+			if err != nil {
+				return reflect.Value{}, false
+			}
+			return reflect.ValueOf(f).Convert(t), true
+		}
+	case rv.Type().ConvertibleTo(t):
+		return rv.Convert(t), true
+	}
+	return reflect.Value{}, false
+}
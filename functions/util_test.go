@@ -0,0 +1,146 @@
+package functions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnakeCase(t *testing.T) {
+	for in, expected := range map[string]string{
+		"Name":       "name",
+		"CreatedAt":  "created_at",
+		"UserID":     "user_id",
+		"HTTPServer": "http_server",
+		"ID":         "id",
+		"Address2":   "address2",
+	} {
+		if got := snakeCase(in); got != expected {
+			t.Errorf("snakeCase(%q): expected %q, got %q", in, expected, got)
+		}
+	}
+}
+
+func TestStructFields(t *testing.T) {
+	type Base struct {
+		ID   int
+		Name string
+	}
+	type User struct {
+		Base
+		Name      string `xslate:"name"`
+		Email     string `json:"mail,omitempty"`
+		CreatedAt int
+		Password  string `xslate:"-" json:"password"`
+		Internal  string `json:"-"`
+	}
+
+	fields := cachedStructFields(reflect.TypeOf(User{}))
+	for name, expected := range map[string][]int{
+		"name":       {1},
+		"Name":       {1},
+		"id":         {0, 0},
+		"mail":       {2},
+		"email":      {2},
+		"created_at": {3},
+		"createdAt":  {3},
+		"internal":   {5},
+	} {
+		index, ok := fields.lookup(name)
+		if !ok || !reflect.DeepEqual(index, expected) {
+			t.Errorf("lookup(%q): expected %v, got %v (%t)", name, expected, index, ok)
+		}
+	}
+
+	for _, name := range []string{"password", "Password", "nosuch"} {
+		if index, ok := fields.lookup(name); ok {
+			t.Errorf("lookup(%q): expected no field, got %v", name, index)
+		}
+	}
+
+	if other := cachedStructFields(reflect.TypeOf(User{})); reflect.ValueOf(other).Pointer() != reflect.ValueOf(fields).Pointer() {
+		t.Errorf("expected fields to be cached")
+	}
+}
+
+func TestConvert(t *testing.T) {
+	type color string
+	valid := []struct {
+		in       interface{}
+		expected interface{}
+	}{
+		{int64(1), int(1)},
+		{int64(255), uint8(255)},
+		{2.0, int32(2)},
+		{int64(3), 3.0},
+		{"42", int(42)},
+		{"1.5", float32(1.5)},
+		{int64(7), "7"},
+		{true, "true"},
+		{"abc", []byte("abc")},
+		{[]byte("abc"), "abc"},
+		{"red", color("red")},
+		{nil, 0},
+		{nil, []string(nil)},
+		{[]interface{}{int64(1), "2"}, []int{1, 2}},
+		{map[interface{}]interface{}{"a": int64(1)}, map[string]int{"a": 1}},
+	}
+	for _, c := range valid {
+		v, err := Convert(reflect.ValueOf(c.in), reflect.TypeOf(c.expected))
+		if err != nil {
+			t.Errorf("Failed to convert %#v to %T: %s", c.in, c.expected, err)
+			continue
+		}
+		if !reflect.DeepEqual(v.Interface(), c.expected) {
+			t.Errorf("Expected %#v to be converted to %#v, got %#v", c.in, c.expected, v.Interface())
+		}
+	}
+
+	invalid := []struct {
+		in interface{}
+		t  reflect.Type
+	}{
+		{int64(256), reflect.TypeOf(uint8(0))},
+		{int64(-1), reflect.TypeOf(uint(0))},
+		{1.5, reflect.TypeOf(0)},
+		{"abc", reflect.TypeOf(0)},
+		{true, reflect.TypeOf(0)},
+		{[]interface{}{"x"}, reflect.TypeOf([]int{})},
+		{struct{}{}, reflect.TypeOf("")},
+	}
+	for _, c := range invalid {
+		if v, err := Convert(reflect.ValueOf(c.in), c.t); err == nil {
+			t.Errorf("Expected converting %#v to %s to fail, got %#v", c.in, c.t, v.Interface())
+		}
+	}
+}
+
+type fieldUser struct {
+	FirstName string `json:"first"`
+	LastName  string
+}
+
+func (u fieldUser) FullName() string {
+	return u.FirstName + " " + u.LastName
+}
+
+func TestField(t *testing.T) {
+	u := &fieldUser{FirstName: "Alice", LastName: "Smith"}
+	for name, expected := range map[string]interface{}{
+		"first":     "Alice",
+		"last_name": "Smith",
+		"full_name": "Alice Smith",
+		"nosuch":    nil,
+	} {
+		if got := Field(u, name); got != expected {
+			t.Errorf("Field(%q): expected %#v, got %#v", name, expected, got)
+		}
+	}
+
+	m := map[int]string{1: "one"}
+	if got := Field(m, "1"); got != "one" {
+		t.Errorf("Field(map, \"1\"): expected \"one\", got %#v", got)
+	}
+	if got := Field((*fieldUser)(nil), "first"); got != nil {
+		t.Errorf("Field(nil, \"first\"): expected nil, got %#v", got)
+	}
+}
@@ -0,0 +1,511 @@
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat/go-xslate/vm"
+	"github.com/pkg/errors"
+)
+
+// function is a Go function generated for a template, or for a MACRO or
+// a lambda in it. The ops become Go statements that work on the same
+// registers, stack and local variables as the VM:
+//
+//	sa, sb  the registers
+//	s       the stack (vm.Stack)
+//	lv      the local variables
+//
+// and jumps become gotos. The body of each TRY block is a closure that
+// is run by vm.Runtime.Try
+type function struct {
+	c      *compilation
+	name   string
+	entry  int
+	lambda bool
+
+	reached []bool
+	next    []int          // next reached op after each op, or -1
+	scopes  map[int]*scope // TRY blocks by the position of their try op
+	scopeOf []*scope       // innermost scope of each op
+	line    int            // line that rt.Line is known to be set to
+	body    bytes.Buffer
+
+	// local variables that the body reads, and that it assigns to
+	read    map[string]bool
+	written map[string]bool
+}
+
+// scope is the body of a function, or of a TRY block in it, which spans
+// the ops from lo to hi
+type scope struct {
+	lo, hi  int
+	parent  *scope
+	labels  map[int]bool // destinations of jumps within the scope
+	escapes map[int]bool // destinations of jumps out of the TRY block
+}
+
+func newScope(lo, hi int, parent *scope) *scope {
+	return &scope{
+		lo:      lo,
+		hi:      hi,
+		parent:  parent,
+		labels:  make(map[int]bool),
+		escapes: make(map[int]bool),
+	}
+}
+
+func (s *scope) contains(i int) bool {
+	return s.lo <= i && i <= s.hi
+}
+
+// locals are the variables that functions declare as needed
+var locals = map[string]bool{"sa": true, "sb": true, "s": true, "lv": true}
+
+func (f *function) write() error {
+	f.reached = f.reachable()
+	f.next = make([]int, len(f.reached))
+	next := -1
+	for i := len(f.reached) - 1; i >= 0; i-- {
+		f.next[i] = next
+		if f.reached[i] {
+			next = i
+		}
+	}
+	f.read = make(map[string]bool)
+	f.written = make(map[string]bool)
+	if err := f.makeScopes(); err != nil {
+		return err
+	}
+	if err := f.writeScope(f.scopes[-1]); err != nil {
+		return err
+	}
+
+	src := &f.c.src
+	if f.lambda {
+		fmt.Fprintf(src, "func %s(rt *vm.Runtime, vars vm.Vars, lv []interface{}) interface{} {\n", f.name)
+	} else {
+		fmt.Fprintf(src, "func %s(rt *vm.Runtime, vars vm.Vars) {\n", f.name)
+	}
+
+	var registers []string
+	for _, name := range []string{"sa", "sb"} {
+		if f.read[name] || f.written[name] {
+			registers = append(registers, name)
+		}
+	}
+	if len(registers) > 0 {
+		fmt.Fprintf(src, "var %s interface{}\n", strings.Join(registers, ", "))
+	}
+	if f.read["s"] {
+		fmt.Fprintf(src, "var s vm.Stack\n")
+	}
+	if f.read["lv"] && !f.lambda {
+		fmt.Fprintf(src, "lv := make([]interface{}, %d)\n", f.c.nlvars)
+	}
+	for _, name := range registers {
+		if !f.read[name] {
+			// Go does not allow variables that are only assigned to
+			fmt.Fprintf(src, "_ = %s\n", name)
+		}
+	}
+	src.Write(f.body.Bytes())
+	fmt.Fprintf(src, "}\n\n")
+	return nil
+}
+
+// reachable returns which ops can be reached from the entry of the
+// function. Go does not allow labels that are not used, and go vet
+// complains about unreachable code. The bodies of MACROs and lambdas
+// are functions of their own
+func (f *function) reachable() []bool {
+	ops, dests := f.c.ops, f.c.dests
+	reached := make([]bool, len(ops))
+	todo := []int{f.entry}
+	for len(todo) > 0 {
+		i := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for i < len(ops) && !reached[i] {
+			reached[i] = true
+			t := ops[i].Type()
+			if dests[i] >= 0 && t != vm.TXOPMakeMacro && t != vm.TXOPMakeClosure {
+				todo = append(todo, dests[i])
+			}
+			if t == vm.TXOPGoto || t == vm.TXOPEnd {
+				break
+			}
+			i++
+		}
+	}
+	return reached
+}
+
+// makeScopes finds the TRY blocks of the function, and which labels each
+// scope needs. Jumps out of a TRY block, as with LAST and NEXT, return
+// their destination from the closure, and the enclosing scope jumps there
+func (f *function) makeScopes() error {
+	ops, dests := f.c.ops, f.c.dests
+	top := newScope(0, len(ops)-1, nil)
+	f.scopes = map[int]*scope{-1: top}
+	f.scopeOf = make([]*scope, len(ops))
+
+	cur := top
+	for i, o := range ops {
+		for !cur.contains(i) {
+			cur = cur.parent
+		}
+		f.scopeOf[i] = cur
+		if !f.reached[i] || o.Type() != vm.TXOPTry {
+			continue
+		}
+
+		// The block ends with end_try, which is followed by a goto over
+		// the CATCH block, unless the CATCH block is empty
+		hi := dests[i] - 1
+		if hi-1 > i && ops[hi].Type() == vm.TXOPGoto && ops[hi-1].Type() == vm.TXOPEndTry {
+			hi--
+		}
+		if hi < i || hi > cur.hi {
+			return errors.Errorf("TRY block at %d does not nest", i)
+		}
+		cur = newScope(i+1, hi, cur)
+		f.scopes[i] = cur
+	}
+
+	for i, o := range ops {
+		if !f.reached[i] {
+			continue
+		}
+		switch o.Type() {
+		case vm.TXOPGoto, vm.TXOPAnd, vm.TXOPDefinedOr, vm.TXOPDefault, vm.TXOPForIter, vm.TXOPTry:
+			if f.fallsThrough(i) {
+				continue
+			}
+			s := f.scopeOf[i]
+			for !s.contains(dests[i]) {
+				s.escapes[dests[i]] = true
+				s = s.parent
+			}
+			if f.scopeOf[dests[i]] != s {
+				return errors.Errorf("op %d (%s) jumps into a TRY block", i, o.Type())
+			}
+			s.labels[dests[i]] = true
+		}
+	}
+	return nil
+}
+
+// fallsThrough returns true if op i is a goto to the op that follows it
+// in the generated code, as with the gotos over the bodies of MACROs
+func (f *function) fallsThrough(i int) bool {
+	j := f.next[i]
+	return j >= 0 && f.c.ops[i].Type() == vm.TXOPGoto && f.c.dests[i] == j && f.scopeOf[j] == f.scopeOf[i]
+}
+
+// jump returns the statement that jumps to the op at dest from scope s
+func (f *function) jump(s *scope, dest int) string {
+	if s.contains(dest) {
+		return fmt.Sprintf("goto L%d", dest)
+	}
+	return fmt.Sprintf("return %d", dest)
+}
+
+// stmt writes the statement given by format and args, and records the
+// local variables that it uses
+func (f *function) stmt(format string, args ...interface{}) {
+	code := fmt.Sprintf(format, args...)
+	f.body.WriteString(code)
+	f.body.WriteByte('\n')
+
+	var sc scanner.Scanner
+	fset := token.NewFileSet()
+	sc.Init(fset.AddFile("", fset.Base(), len(code)), []byte(code), nil, 0)
+
+	var toks []token.Token
+	var lits []string
+	for {
+		_, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		toks = append(toks, tok)
+		lits = append(lits, lit)
+	}
+	for i, tok := range toks {
+		if tok != token.IDENT || !locals[lits[i]] {
+			continue
+		}
+		if i == 0 && len(toks) > 1 && toks[1] == token.ASSIGN {
+			f.written[lits[i]] = true
+		} else {
+			f.read[lits[i]] = true
+		}
+	}
+}
+
+func (f *function) writeScope(s *scope) error {
+	f.line = -1
+	terminated := false
+	for i := s.lo; i <= s.hi; i++ {
+		if !f.reached[i] {
+			continue
+		}
+		if s.labels[i] {
+			f.stmt("L%d:", i)
+			// We may come from anywhere
+			f.line = -1
+		}
+
+		if f.c.ops[i].Type() == vm.TXOPTry {
+			block := f.scopes[i]
+			if err := f.writeTry(s, i, block); err != nil {
+				return err
+			}
+			i = block.hi
+			terminated = false
+			continue
+		}
+
+		n := f.body.Len()
+		var err error
+		if terminated, err = f.writeOp(s, i); err != nil {
+			return errors.Wrapf(err, "failed to generate code for op %d (%s)", i, f.c.ops[i].Type())
+		}
+		if s.labels[i] && f.body.Len() == n {
+			// A label needs a statement to go with
+			f.stmt(";")
+		}
+	}
+
+	if !terminated {
+		switch {
+		case s.parent != nil:
+			f.stmt("return -1")
+		case f.lambda:
+			f.stmt("return sa")
+		}
+	}
+	return nil
+}
+
+// writeTry writes the TRY block at op i of scope s, whose body is block.
+// When an error is raised, the CATCH block is run with the error in sa,
+// and sb cleared, as in the VM
+func (f *function) writeTry(s *scope, i int, block *scope) error {
+	next := "_"
+	if len(block.escapes) > 0 {
+		next = "next"
+	}
+	f.stmt("if %s, err := rt.Try(&s, func() int {", next)
+	if err := f.writeScope(block); err != nil {
+		return err
+	}
+	f.line = -1
+	f.stmt("}); err != nil {")
+	f.stmt("sa = err")
+	f.stmt("sb = nil")
+	f.stmt(f.jump(s, f.c.dests[i]))
+
+	if len(block.escapes) > 0 {
+		dests := make([]int, 0, len(block.escapes))
+		for dest := range block.escapes {
+			dests = append(dests, dest)
+		}
+		sort.Ints(dests)
+
+		f.stmt("} else {")
+		f.stmt("switch next {")
+		for _, dest := range dests {
+			f.stmt("case %d:", dest)
+			f.stmt(f.jump(s, dest))
+		}
+		f.stmt("}")
+	}
+	f.stmt("}")
+	return nil
+}
+
+// quiet returns true if ops of type t can't raise errors, and so they
+// don't need rt.Line to be up to date
+func quiet(t vm.OpType) bool {
+	switch t {
+	case vm.TXOPNoop, vm.TXOPEnd, vm.TXOPNil, vm.TXOPMoveToSb, vm.TXOPMoveFromSb, vm.TXOPLiteral, vm.TXOPFetchSymbol,
+		vm.TXOPSaveToLvar, vm.TXOPLoadLvar, vm.TXOPGoto, vm.TXOPAnd, vm.TXOPDefinedOr, vm.TXOPDefault,
+		vm.TXOPPush, vm.TXOPPop, vm.TXOPPushmark, vm.TXOPPopmark, vm.TXOPPushFrame, vm.TXOPPopFrame,
+		vm.TXOPPrintRawConst, vm.TXOPSaveWriter, vm.TXOPRestoreWriter, vm.TXOPMakeArray, vm.TXOPMakeMacro, vm.TXOPMakeClosure, vm.TXOPTry, vm.TXOPEndTry:
+		return true
+	}
+	return false
+}
+
+// writeOp writes the statements for op i of scope s. It returns true if
+// they always jump or return
+func (f *function) writeOp(s *scope, i int) (bool, error) {
+	o := f.c.ops[i]
+	if !quiet(o.Type()) && o.Line() != f.line {
+		f.stmt("rt.Line = %d", o.Line())
+		f.line = o.Line()
+	}
+
+	switch o.Type() {
+	case vm.TXOPNoop, vm.TXOPEndTry:
+		// TRY blocks are left by returning from their closure
+	case vm.TXOPEnd:
+		switch {
+		case f.lambda:
+			f.stmt("return sa")
+		case f.next[i] >= 0 && s.contains(f.next[i]):
+			f.stmt("return")
+		default:
+			// The end of the function
+		}
+		return true, nil
+	case vm.TXOPGoto:
+		if f.fallsThrough(i) {
+			return false, nil
+		}
+		f.stmt(f.jump(s, f.c.dests[i]))
+		return true, nil
+	case vm.TXOPAnd:
+		f.stmt("if !rt.Truthy(sa) {\n%s\n}", f.jump(s, f.c.dests[i]))
+	case vm.TXOPDefinedOr:
+		f.stmt("if sa != nil {\n%s\n}", f.jump(s, f.c.dests[i]))
+	case vm.TXOPDefault:
+		f.stmt("if !rt.IsEmpty(sa) {\n%s\n}", f.jump(s, f.c.dests[i]))
+	case vm.TXOPForStart:
+		f.stmt("rt.ForStart(lv, %d, sa)", o.ArgInt())
+	case vm.TXOPForLimit:
+		f.stmt("rt.ForLimit(lv, sa, %d)", o.ArgInt())
+	case vm.TXOPForIter:
+		f.stmt("if !rt.ForIter(lv, sa) {\n%s\n}", f.jump(s, f.c.dests[i]))
+	case vm.TXOPNil:
+		f.stmt("sa = nil")
+	case vm.TXOPMoveToSb:
+		f.stmt("sb = sa")
+	case vm.TXOPMoveFromSb:
+		f.stmt("sa = sb")
+	case vm.TXOPLiteral:
+		lit, err := goLiteral(o.Arg())
+		if err != nil {
+			return false, err
+		}
+		f.stmt("sa = %s", lit)
+	case vm.TXOPFetchSymbol:
+		f.stmt("sa = vars[%q]", o.ArgString())
+	case vm.TXOPFetchFieldSymbol:
+		f.stmt("sa = rt.Field(sa, %q)", o.ArgString())
+	case vm.TXOPFetchArrayElement:
+		f.stmt("sa = rt.Element(s.Pop(), s.Pop())")
+	case vm.TXOPFetchSlice:
+		f.stmt("sa = rt.Slice(s.Pop(), s.Pop(), s.Pop())")
+	case vm.TXOPSaveToLvar:
+		f.stmt("lv[%d] = sa", o.ArgInt())
+	case vm.TXOPLoadLvar:
+		f.stmt("sa = lv[%d]", o.ArgInt())
+	case vm.TXOPMarkRaw:
+		f.stmt("sa = rt.MarkRaw(sa)")
+	case vm.TXOPUnmarkRaw:
+		f.stmt("sa = rt.UnmarkRaw(sa)")
+	case vm.TXOPHTMLEscape:
+		f.stmt("sa = rt.HTMLEscape(sa)")
+	case vm.TXOPUriEscape:
+		f.stmt("sa = rt.URIEscape(sa)")
+	case vm.TXOPPrint:
+		f.stmt("rt.Print(sa)")
+	case vm.TXOPPrintRaw:
+		f.stmt("rt.PrintRaw(sa)")
+	case vm.TXOPPrintRawConst:
+		if s := o.ArgString(); s != "" {
+			f.stmt("rt.WriteString(%q)", s)
+		}
+	case vm.TXOPAdd:
+		f.stmt("sa = rt.Add(sb, sa)")
+	case vm.TXOPSub:
+		f.stmt("sa = rt.Sub(sb, sa)")
+	case vm.TXOPMul:
+		f.stmt("sa = rt.Mul(sb, sa)")
+	case vm.TXOPDiv:
+		f.stmt("sa = rt.Div(sb, sa)")
+	case vm.TXOPEquals:
+		f.stmt("sa = rt.Equals(sb, sa)")
+	case vm.TXOPNotEquals:
+		f.stmt("sa = !rt.Equals(sb, sa)")
+	case vm.TXOPLessThan:
+		f.stmt("sa = rt.LessThan(sb, sa)")
+	case vm.TXOPGreaterThan:
+		f.stmt("sa = rt.GreaterThan(sb, sa)")
+	case vm.TXOPConcat:
+		f.stmt("sa = rt.Concat(sb, sa)")
+	case vm.TXOPRepeat:
+		f.stmt("sa = rt.Repeat(sb, sa)")
+	case vm.TXOPStringLessThan:
+		f.stmt(`sa = rt.StringCompare("lt", sb, sa) < 0`)
+	case vm.TXOPStringGreaterThan:
+		f.stmt(`sa = rt.StringCompare("gt", sb, sa) > 0`)
+	case vm.TXOPStringLessThanEquals:
+		f.stmt(`sa = rt.StringCompare("le", sb, sa) <= 0`)
+	case vm.TXOPStringGreaterThanEquals:
+		f.stmt(`sa = rt.StringCompare("ge", sb, sa) >= 0`)
+	case vm.TXOPStringCompare:
+		f.stmt(`sa = int64(rt.StringCompare("cmp", sb, sa))`)
+	case vm.TXOPPush:
+		f.stmt("s.Push(sa)")
+	case vm.TXOPPop:
+		f.stmt("sa = s.Pop()")
+	case vm.TXOPPushmark:
+		f.stmt("s.Pushmark()")
+	case vm.TXOPPopmark:
+		f.stmt("s.Popmark()")
+	case vm.TXOPPushFrame:
+		f.stmt("rt.PushFrame()")
+	case vm.TXOPPopFrame:
+		f.stmt("rt.PopFrame()")
+	case vm.TXOPFunCall, vm.TXOPFunCallOmni:
+		// The name of the variable holding the function, if known
+		var name string
+		if o.Arg() != nil {
+			name = o.ArgString()
+		}
+		f.stmt("sa = rt.Call(sa, %q, s.Args())", name)
+	case vm.TXOPFunCallSymbol:
+		f.stmt("sa = rt.CallSymbol(%q, s.Args())", o.ArgString())
+	case vm.TXOPMethodCall:
+		f.stmt("sa = rt.CallMethod(%q, s.Args())", o.ArgString())
+	case vm.TXOPFilter:
+		f.stmt("sa = rt.Filter(%q, s.Args())", o.ArgString())
+	case vm.TXOPRange:
+		f.stmt("s.PushRange(sb, sa)")
+	case vm.TXOPMakeArray:
+		f.stmt("sa = s.Args()")
+	case vm.TXOPMakeHash:
+		f.stmt("sa = rt.Hash(s.Args())")
+	case vm.TXOPInclude:
+		f.c.includes = true
+		f.stmt("rt.Include(lookup, sa, sb)")
+	case vm.TXOPWrapper:
+		t := f.c.g.lookup(o.ArgString())
+		if t == nil {
+			return false, errors.Errorf("WRAPPER template '%s' is not one of the templates generated", o.ArgString())
+		}
+		f.stmt("rt.Wrapper(%q, render%s, sa, sb)", t.name, t.funcName)
+	case vm.TXOPSaveWriter:
+		f.stmt("rt.SaveWriter(&s)")
+	case vm.TXOPRestoreWriter:
+		f.stmt("rt.RestoreWriter(&s)")
+	case vm.TXOPMakeMacro:
+		dest := f.c.dests[i]
+		m := f.c.function(dest, fmt.Sprintf("render%sMacro%d", f.c.t.funcName, dest), false)
+		f.stmt("sa = rt.Macro(%s, s.Args())", m.name)
+	case vm.TXOPMakeClosure:
+		dest := f.c.dests[i]
+		l := f.c.function(dest, fmt.Sprintf("render%sLambda%d", f.c.t.funcName, dest), true)
+		f.stmt("sa = rt.Lambda(%s, s.Args(), lv)", l.name)
+	default:
+		return false, errors.Errorf("unsupported op")
+	}
+	return false, nil
+}
@@ -0,0 +1,255 @@
+/*
+Package gen compiles Xslate templates to Go source code.
+
+The templates are parsed and compiled to ByteCode as usual, and the
+ByteCode is then turned into one Go function per template:
+
+	func RenderWelcome(w io.Writer, vars xslate.Vars) error
+	func RenderWelcomeContext(ctx context.Context, w io.Writer, vars xslate.Vars, opts *vm.RenderOptions) error
+
+The latter gives ctx to the functions called from the template, and sets
+the limit of loop iterations and where warnings go with vm.RenderOptions.
+
+Each op becomes a Go statement. Control flow is compiled to Go, and values
+are printed, escaped and fetched with the helpers of vm.Runtime, which run
+the same code as the VM, so the generated code renders exactly like
+templates rendered with Xslate. INCLUDE and WRAPPER can refer to any of
+the templates generated along with the template. Functions are given to
+the templates as variables.
+
+This is what `xslate gen` uses:
+
+	xslate gen -package emails -o templates.go welcome.tx header.tx
+*/
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/lestrrat/go-xslate/vm"
+	"github.com/pkg/errors"
+)
+
+// Generator collects compiled templates, and writes them out as Go source
+type Generator struct {
+	// Package is the name of the package of the generated source
+	Package   string
+	templates []*template
+	names     map[string]bool
+}
+
+type template struct {
+	name     string // name of the template, used by INCLUDE and WRAPPER
+	funcName string // name of the generated function, without "Render"
+	bc       *vm.ByteCode
+}
+
+// New creates a Generator for a package named pkg
+func New(pkg string) *Generator {
+	return &Generator{
+		Package: pkg,
+		names:   make(map[string]bool),
+	}
+}
+
+// Add adds the template compiled to bc. Its name is the name of the
+// template, such as "emails/welcome.tx", which becomes RenderEmailsWelcome
+func (g *Generator) Add(name string, bc *vm.ByteCode) error {
+	funcName := FuncName(name)
+	if funcName == "" {
+		return errors.Errorf("cannot make a function name from template '%s'", name)
+	}
+	if g.names[funcName] {
+		return errors.Errorf("template '%s' conflicts with another template named %s", name, funcName)
+	}
+	g.names[funcName] = true
+	g.templates = append(g.templates, &template{name: name, funcName: funcName, bc: bc})
+	return nil
+}
+
+// FuncName returns the name of the function generated for the template
+// name, without the "Render" prefix. The extension is dropped, and the
+// rest is converted to CamelCase
+func FuncName(name string) string {
+	if i := strings.LastIndexByte(name, '.'); i > strings.LastIndexByte(name, '/') {
+		name = name[:i]
+	}
+
+	buf := bytes.Buffer{}
+	upper := true
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// WriteTo writes the generated source to w
+func (g *Generator) WriteTo(w io.Writer) (int64, error) {
+	src, err := g.Generate()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(src)
+	return int64(n), err
+}
+
+// Generate returns the generated source, formatted with gofmt
+func (g *Generator) Generate() ([]byte, error) {
+	if len(g.templates) == 0 {
+		return nil, errors.New("no templates to generate")
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "// Code generated by xslate gen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(buf, "package %s\n\n", g.Package)
+	fmt.Fprintf(buf, "import (\n\t\"context\"\n\t\"io\"\n\n\t\"github.com/lestrrat/go-xslate\"\n\t\"github.com/lestrrat/go-xslate/vm\"\n)\n\n")
+
+	includes := false
+	for _, t := range g.templates {
+		c, err := g.compile(t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to generate code for template '%s'", t.name)
+		}
+		buf.Write(c.src.Bytes())
+		includes = includes || c.includes
+	}
+
+	if includes {
+		fmt.Fprintf(buf, "// lookup returns the function that renders the template name, for INCLUDE\n")
+		fmt.Fprintf(buf, "func lookup(name string) vm.CompiledFunc {\nswitch name {\n")
+		for _, t := range g.templates {
+			fmt.Fprintf(buf, "case %q:\nreturn render%s\n", t.name, t.funcName)
+		}
+		fmt.Fprintf(buf, "}\nreturn nil\n}\n")
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to format generated code")
+	}
+	return src, nil
+}
+
+// lookup returns the template named name, or nil
+func (g *Generator) lookup(name string) *template {
+	for _, t := range g.templates {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// compilation is the code generated for a template. Besides the
+// template itself, each MACRO and lambda in it becomes a function
+type compilation struct {
+	g        *Generator
+	t        *template
+	ops      []vm.Op
+	dests    []int // destination of ops[i] if it's a jump, -1 otherwise
+	nlvars   int   // number of local variables
+	funcs    []*function
+	entries  map[int]*function
+	includes bool // true if the template INCLUDEs other templates
+	src      bytes.Buffer
+}
+
+func (g *Generator) compile(t *template) (*compilation, error) {
+	c := &compilation{
+		g:       g,
+		t:       t,
+		ops:     t.bc.OpList,
+		dests:   make([]int, len(t.bc.OpList)),
+		entries: make(map[int]*function),
+	}
+	for i, o := range c.ops {
+		c.dests[i] = -1
+		if o.Type().IsJump() {
+			c.dests[i] = i + o.ArgInt()
+			if c.dests[i] < 0 || c.dests[i] >= len(c.ops) {
+				return nil, errors.Errorf("op %d (%s) jumps out of the ByteCode", i, o.Type())
+			}
+		}
+
+		n := 0
+		switch o.Type() {
+		case vm.TXOPSaveToLvar, vm.TXOPLoadLvar:
+			n = o.ArgInt() + 1
+		case vm.TXOPForStart:
+			// The loop variable goes next to the item
+			n = o.ArgInt() + 2
+		}
+		if n > c.nlvars {
+			c.nlvars = n
+		}
+	}
+
+	fmt.Fprintf(&c.src, "// Render%s renders the template %q\n", t.funcName, t.name)
+	fmt.Fprintf(&c.src, "func Render%s(w io.Writer, vars xslate.Vars) error {\n", t.funcName)
+	fmt.Fprintf(&c.src, "return Render%sContext(context.Background(), w, vars, nil)\n}\n\n", t.funcName)
+	fmt.Fprintf(&c.src, "// Render%sContext is like Render%s, but functions called from the\n", t.funcName, t.funcName)
+	fmt.Fprintf(&c.src, "// template that take a context.Context are given ctx. If opts is nil,\n")
+	fmt.Fprintf(&c.src, "// vm.NewRenderOptions() is used\n")
+	fmt.Fprintf(&c.src, "func Render%sContext(ctx context.Context, w io.Writer, vars xslate.Vars, opts *vm.RenderOptions) error {\n", t.funcName)
+	fmt.Fprintf(&c.src, "return vm.RenderCompiled(ctx, w, %q, render%s, vm.Vars(vars), opts)\n}\n\n", t.name, t.funcName)
+
+	c.function(0, "render"+t.funcName, false)
+	// Functions are added as MACROs and lambdas are found
+	for i := 0; i < len(c.funcs); i++ {
+		if err := c.funcs[i].write(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// function returns the function whose body starts at entry, creating it
+// if it's not there yet
+func (c *compilation) function(entry int, name string, lambda bool) *function {
+	if f, ok := c.entries[entry]; ok {
+		return f
+	}
+	f := &function{c: c, name: name, entry: entry, lambda: lambda}
+	c.entries[entry] = f
+	c.funcs = append(c.funcs, f)
+	return f
+}
+
+// goLiteral returns the Go expression for an op argument
+func goLiteral(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "nil", nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return "int64(" + strconv.FormatInt(v, 10) + ")", nil
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return "", errors.Errorf("unsupported number %g", v)
+		}
+		return "float64(" + strconv.FormatFloat(v, 'g', -1, 64) + ")", nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		return strconv.Quote(v), nil
+	case []byte:
+		return "[]byte(" + strconv.Quote(string(v)) + ")", nil
+	}
+	return "", errors.Errorf("unsupported type %T", v)
+}
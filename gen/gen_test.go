@@ -0,0 +1,75 @@
+package gen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat/go-xslate/compiler"
+	"github.com/lestrrat/go-xslate/parser/tterse"
+	"github.com/lestrrat/go-xslate/vm"
+)
+
+func TestFuncName(t *testing.T) {
+	names := map[string]string{
+		"index.tx":          "Index",
+		"emails/welcome.tx": "EmailsWelcome",
+		"user-profile.html": "UserProfile",
+		"a/b_c/d.tx":        "ABCD",
+		"404.tx":            "404",
+		"emails/welcome":    "EmailsWelcome",
+	}
+	for name, expected := range names {
+		if got := FuncName(name); got != expected {
+			t.Errorf("FuncName(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
+
+func TestGenerator_Add(t *testing.T) {
+	g := New("templates")
+	bc := vm.NewByteCode()
+	if err := g.Add("emails/welcome.tx", bc); err != nil {
+		t.Fatalf("failed to add template: %s", err)
+	}
+	if err := g.Add("emails_welcome.tx", bc); err == nil {
+		t.Errorf("expected templates with the same function name to be an error")
+	}
+}
+
+// TestGenerator_Golden checks that gen/internal/gentest is up to date. Run
+// go generate in that directory after changing the generator
+func TestGenerator_Golden(t *testing.T) {
+	root := filepath.Join("internal", "gentest", "testdata")
+	g := New("gentest")
+	for _, name := range []string{"header.tx", "layout.tx", "count.tx", "emails/welcome.tx"} {
+		template, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %s", name, err)
+		}
+		ast, err := tterse.New().Parse(name, template)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", name, err)
+		}
+		bc, err := compiler.New().Compile(ast)
+		if err != nil {
+			t.Fatalf("failed to compile %s: %s", name, err)
+		}
+		if err := g.Add(name, bc); err != nil {
+			t.Fatalf("failed to add %s: %s", name, err)
+		}
+	}
+
+	src, err := g.Generate()
+	if err != nil {
+		t.Fatalf("failed to generate: %s", err)
+	}
+	expected, err := ioutil.ReadFile(filepath.Join("internal", "gentest", "templates.go"))
+	if err != nil {
+		t.Fatalf("failed to read generated source: %s", err)
+	}
+	if !bytes.Equal(src, expected) {
+		t.Errorf("generated source differs from internal/gentest/templates.go")
+	}
+}
@@ -0,0 +1,5 @@
+// Package gentest holds templates compiled by xslate gen, to test that
+// the generated code renders the same output as the VM
+package gentest
+
+//go:generate go run ../../../cli/xslate gen -package gentest -root testdata -o templates.go header.tx layout.tx count.tx emails/welcome.tx
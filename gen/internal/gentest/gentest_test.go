@@ -0,0 +1,91 @@
+package gentest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/go-xslate"
+	"github.com/lestrrat/go-xslate/vm"
+)
+
+func TestRenderEmailsWelcome(t *testing.T) {
+	shout := func(s string) (string, error) { return "", fmt.Errorf("cannot shout at %s", s) }
+	vars := xslate.Vars{
+		"shout": shout,
+		"name":  "<Bob>",
+		"items": []map[string]interface{}{
+			{"name": "apple", "quantity": 3, "price": 2},
+			{"name": "pear", "quantity": 1, "price": 5},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := RenderEmailsWelcome(buf, vars); err != nil {
+		t.Fatalf("failed to render: %s", err)
+	}
+	if !strings.Contains(buf.String(), "\nitems: 2\n") {
+		t.Errorf("expected the output of the MACRO with arguments, got:\n%s", buf.String())
+	}
+
+	for _, backend := range []string{"interpreter", "closure"} {
+		tx, err := xslate.New(xslate.Args{
+			"Loader": xslate.Args{"LoadPaths": []string{"testdata"}},
+			"VM":     xslate.Args{"Backend": backend},
+		})
+		if err != nil {
+			t.Fatalf("failed to create Xslate: %s", err)
+		}
+		expected, err := tx.Render("emails/welcome.tx", vars)
+		if err != nil {
+			t.Fatalf("failed to render with Xslate: %s", err)
+		}
+		if buf.String() != expected {
+			t.Errorf("output differs from the %s backend.\ngot:\n%s\nexpected:\n%s", backend, buf.String(), expected)
+		}
+	}
+}
+
+func TestRenderHeader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := RenderHeader(buf, xslate.Vars{"title": "a & b"}); err != nil {
+		t.Fatalf("failed to render: %s", err)
+	}
+	if expected := "<h1>a &amp; b</h1>\n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+type userKey struct{}
+
+func TestRenderCountContext(t *testing.T) {
+	items := make([]int, 1500)
+	vars := xslate.Vars{
+		"items": items,
+		"user":  func(ctx context.Context) interface{} { return ctx.Value(userKey{}) },
+	}
+
+	// The default limit of loop iterations is 1000
+	buf := &bytes.Buffer{}
+	if err := RenderCount(buf, vars); err == nil {
+		t.Errorf("expected the loop to exceed the default MaxLoopCount")
+	}
+
+	buf.Reset()
+	warnings := &bytes.Buffer{}
+	opts := vm.NewRenderOptions()
+	opts.MaxLoopCount = 2000
+	opts.Warnings = warnings
+	ctx := context.WithValue(context.Background(), userKey{}, "Bob")
+	if err := RenderCountContext(ctx, buf, vars, opts); err != nil {
+		t.Fatalf("failed to render: %s", err)
+	}
+	if expected := "1500 Bob \n"; buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+	if !strings.Contains(warnings.String(), "nil") {
+		t.Errorf("expected a warning about printing nil, got %q", warnings.String())
+	}
+}
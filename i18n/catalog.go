@@ -0,0 +1,101 @@
+package i18n
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MapCatalog is an in-memory catalog. Catalogs read from .po and .mo
+// files are also MapCatalogs
+type MapCatalog struct {
+	messages map[string][]string
+	nplurals int
+	plural   PluralFunc
+}
+
+// NewMapCatalog creates a new MapCatalog containing `messages`, which
+// maps message ids to their translations. Plural forms are selected
+// using the English rules ("n != 1") unless SetPluralForms is called
+func NewMapCatalog(messages map[string]string) *MapCatalog {
+	c := &MapCatalog{
+		messages: make(map[string][]string, len(messages)),
+		nplurals: 2,
+		plural:   defaultPluralFunc,
+	}
+	for id, s := range messages {
+		c.Set(id, s)
+	}
+	return c
+}
+
+// Set sets the translation of `msgid`. For messages with plural forms,
+// give the translation for each form in the order of the catalog's
+// plural forms
+func (c *MapCatalog) Set(msgid string, translations ...string) {
+	c.messages[msgid] = translations
+}
+
+// SetPluralForms sets the rules to select plural forms, using the same
+// syntax as the Plural-Forms header in .po files:
+//
+//   nplurals=2; plural=(n != 1);
+func (c *MapCatalog) SetPluralForms(s string) error {
+	var nplurals, plural string
+	for _, field := range strings.Split(s, ";") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "nplurals":
+			nplurals = strings.TrimSpace(kv[1])
+		case "plural":
+			plural = strings.TrimSpace(kv[1])
+		}
+	}
+
+	if nplurals == "" || plural == "" {
+		return errors.Errorf("invalid plural forms '%s'", s)
+	}
+
+	n, err := parsePluralCount(nplurals)
+	if err != nil {
+		return errors.Wrapf(err, "invalid plural forms '%s'", s)
+	}
+	fn, err := ParsePluralExpr(plural)
+	if err != nil {
+		return errors.Wrapf(err, "invalid plural forms '%s'", s)
+	}
+	c.nplurals = n
+	c.plural = fn
+	return nil
+}
+
+// Len returns the number of messages in this catalog
+func (c *MapCatalog) Len() int {
+	return len(c.messages)
+}
+
+// Get returns the translation of `msgid`
+func (c *MapCatalog) Get(msgid string) (string, bool) {
+	t, ok := c.messages[msgid]
+	if !ok || len(t) == 0 || t[0] == "" {
+		return "", false
+	}
+	return t[0], true
+}
+
+// GetPlural returns the translation of `msgid` appropriate for `n`
+func (c *MapCatalog) GetPlural(msgid, plural string, n int) (string, bool) {
+	t, ok := c.messages[msgid]
+	if !ok {
+		return "", false
+	}
+
+	i := c.plural(n)
+	if i < 0 || i >= len(t) || i >= c.nplurals || t[i] == "" {
+		return "", false
+	}
+	return t[i], true
+}
@@ -0,0 +1,191 @@
+package i18n
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat/go-xslate/node"
+	"github.com/lestrrat/go-xslate/parser"
+	"github.com/pkg/errors"
+)
+
+// Message is a message extracted from templates
+type Message struct {
+	ID         string
+	Plural     string
+	References []string // "file:line" where the message is used
+}
+
+// Extractor collects the messages used in templates via `loc`, `l`,
+// `nloc`, and the `loc`/`l` filters, so that they can be written out
+// as a .pot file for translators
+type Extractor struct {
+	parser   parser.Parser
+	messages map[string]*Message
+	order    []string
+}
+
+// NewExtractor creates a new Extractor, which parses templates with `p`
+func NewExtractor(p parser.Parser) *Extractor {
+	return &Extractor{
+		parser:   p,
+		messages: make(map[string]*Message),
+	}
+}
+
+// ExtractFile extracts messages from the template file at `path`
+func (e *Extractor) ExtractFile(path string) error {
+	template, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", path)
+	}
+	return e.Extract(path, template)
+}
+
+// Extract extracts messages from `template`. `name` is used in the
+// references to the messages
+func (e *Extractor) Extract(name string, template []byte) error {
+	ast, err := e.parser.Parse(name, template)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %s", name)
+	}
+
+	for n := range ast.Visit() {
+		var id, plural string
+		var pos int
+		switch n.Type() {
+		case node.FunCall:
+			call := n.(*node.FunCallNode)
+			if call.Invocant.Type() != node.FetchSymbol {
+				continue
+			}
+			fname := string(call.Invocant.(*node.TextNode).Text)
+			args := call.Args.Nodes
+			switch {
+			case (fname == "loc" || fname == "l") && len(args) > 0:
+				id = literalString(args[0])
+			case fname == "nloc" && len(args) > 1:
+				id = literalString(args[0])
+				plural = literalString(args[1])
+				if plural == "" {
+					continue
+				}
+			}
+			pos = call.Pos()
+		case node.Filter:
+			filter := n.(*node.FilterNode)
+			if filter.Name != "loc" && filter.Name != "l" {
+				continue
+			}
+			id = literalString(filter.Child)
+			pos = filter.Child.Pos()
+		}
+
+		if id == "" {
+			continue
+		}
+		e.add(id, plural, fmt.Sprintf("%s:%d", name, lineNumber(template, pos)))
+	}
+	return nil
+}
+
+func (e *Extractor) add(id, plural, ref string) {
+	m, ok := e.messages[id]
+	if !ok {
+		m = &Message{ID: id}
+		e.messages[id] = m
+		e.order = append(e.order, id)
+	}
+	if m.Plural == "" {
+		m.Plural = plural
+	}
+	for _, r := range m.References {
+		if r == ref {
+			return
+		}
+	}
+	m.References = append(m.References, ref)
+}
+
+// Messages returns the extracted messages, in the order they were found
+func (e *Extractor) Messages() []*Message {
+	ret := make([]*Message, len(e.order))
+	for i, id := range e.order {
+		ret[i] = e.messages[id]
+	}
+	return ret
+}
+
+// WritePOT writes the extracted messages as a .pot file
+func (e *Extractor) WritePOT(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString(`#, fuzzy
+msgid ""
+msgstr ""
+"Content-Type: text/plain; charset=UTF-8\n"
+"Content-Transfer-Encoding: 8bit\n"
+"Plural-Forms: nplurals=INTEGER; plural=EXPRESSION;\n"
+`)
+
+	for _, m := range e.Messages() {
+		refs := append([]string(nil), m.References...)
+		sort.Strings(refs)
+
+		buf.WriteString("\n#: ")
+		buf.WriteString(strings.Join(refs, " "))
+		buf.WriteString("\n")
+		writePOString(&buf, "msgid", m.ID)
+		if m.Plural == "" {
+			buf.WriteString("msgstr \"\"\n")
+			continue
+		}
+		writePOString(&buf, "msgid_plural", m.Plural)
+		buf.WriteString("msgstr[0] \"\"\nmsgstr[1] \"\"\n")
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// writePOString writes `keyword "s"`, splitting multi-line strings
+// into one line per line of `s`, as xgettext does
+func writePOString(buf *bytes.Buffer, keyword, s string) {
+	buf.WriteString(keyword)
+	lines := strings.SplitAfter(s, "\n")
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > 1 {
+		buf.WriteString(" \"\"\n")
+		for _, line := range lines {
+			buf.WriteString("\"" + escapePO(line) + "\"\n")
+		}
+		return
+	}
+	buf.WriteString(" \"" + escapePO(s) + "\"\n")
+}
+
+var poEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\r", `\r`)
+
+func escapePO(s string) string {
+	return poEscaper.Replace(s)
+}
+
+// literalString returns the value of `n` if it's a string literal
+func literalString(n node.Node) string {
+	if n == nil || n.Type() != node.Text {
+		return ""
+	}
+	return string(n.(*node.TextNode).Text)
+}
+
+func lineNumber(template []byte, pos int) int {
+	if pos > len(template) {
+		pos = len(template)
+	}
+	return bytes.Count(template[:pos], []byte{'\n'}) + 1
+}
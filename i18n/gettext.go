@@ -0,0 +1,289 @@
+package i18n
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// contextSeparator separates msgctxt and msgid in catalog keys, as in .mo files
+const contextSeparator = "\x04"
+
+// LoadFile reads a gettext catalog from the given file. Files with a
+// ".mo" extension are read as compiled catalogs, and everything else
+// as .po files
+func LoadFile(path string) (*MapCatalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open catalog %s", path)
+	}
+	defer f.Close()
+
+	var c *MapCatalog
+	if filepath.Ext(path) == ".mo" {
+		c, err = ParseMO(f)
+	} else {
+		c, err = ParsePO(f)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load catalog %s", path)
+	}
+	return c, nil
+}
+
+// poEntry is a single entry in a .po file while it's being parsed
+type poEntry struct {
+	context      string
+	id           string
+	plural       string
+	translations []string
+	fuzzy        bool
+	hasID        bool
+}
+
+// ParsePO reads a catalog in GNU gettext .po format. Fuzzy entries
+// are ignored, as msgfmt does by default
+func ParsePO(r io.Reader) (*MapCatalog, error) {
+	c := NewMapCatalog(nil)
+
+	var e poEntry
+	var target *string // the string continuation lines are appended to
+	flush := func() error {
+		if e.hasID {
+			if err := c.addEntry(&e); err != nil {
+				return err
+			}
+		}
+		e = poEntry{}
+		target = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#,"):
+			if e.hasID {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			e.fuzzy = e.fuzzy || strings.Contains(line, "fuzzy")
+			continue
+		case line[0] == '#':
+			continue
+		case line[0] == '"':
+			if target == nil {
+				return nil, errors.Errorf("line %d: unexpected string", lineno)
+			}
+			s, err := unquotePO(line)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", lineno)
+			}
+			*target += s
+			continue
+		}
+
+		keyword := line
+		value := ""
+		if i := strings.IndexAny(line, " \t"); i > -1 {
+			keyword = line[:i]
+			value = strings.TrimSpace(line[i:])
+		}
+		s, err := unquotePO(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineno)
+		}
+
+		switch {
+		case keyword == "msgctxt":
+			if e.hasID {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			e.context = s
+			target = &e.context
+		case keyword == "msgid":
+			if e.hasID {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			e.id = s
+			e.hasID = true
+			target = &e.id
+		case keyword == "msgid_plural":
+			e.plural = s
+			target = &e.plural
+		case keyword == "msgstr":
+			e.translations = append(e.translations, s)
+			target = &e.translations[len(e.translations)-1]
+		case strings.HasPrefix(keyword, "msgstr["):
+			i, err := strconv.Atoi(strings.TrimSuffix(keyword[len("msgstr["):], "]"))
+			if err != nil || i < 0 {
+				return nil, errors.Errorf("line %d: invalid keyword '%s'", lineno, keyword)
+			}
+			for len(e.translations) <= i {
+				e.translations = append(e.translations, "")
+			}
+			e.translations[i] = s
+			target = &e.translations[i]
+		default:
+			return nil, errors.Errorf("line %d: unknown keyword '%s'", lineno, keyword)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read .po file")
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func unquotePO(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", errors.Errorf("expected quoted string, got '%s'", s)
+	}
+	s = s[1 : len(s)-1]
+
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			buf.WriteByte('\n')
+		case 't':
+			buf.WriteByte('\t')
+		case 'r':
+			buf.WriteByte('\r')
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String(), nil
+}
+
+func (c *MapCatalog) addEntry(e *poEntry) error {
+	if e.fuzzy {
+		// This includes the header of templates (.pot), whose Plural-Forms
+		// are placeholders
+		return nil
+	}
+
+	if e.id == "" && e.context == "" {
+		// This is the header
+		if len(e.translations) > 0 {
+			return c.parseHeader(e.translations[0])
+		}
+		return nil
+	}
+
+	key := e.id
+	if e.context != "" {
+		key = e.context + contextSeparator + e.id
+	}
+	c.Set(key, e.translations...)
+	return nil
+}
+
+func (c *MapCatalog) parseHeader(header string) error {
+	for _, line := range strings.Split(header, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "Plural-Forms" {
+			continue
+		}
+		return c.SetPluralForms(strings.TrimSpace(kv[1]))
+	}
+	return nil
+}
+
+const (
+	moMagic         = 0x950412de
+	moMagicReversed = 0xde120495
+)
+
+// ParseMO reads a compiled catalog in GNU gettext .mo format
+func ParseMO(r io.Reader) (*MapCatalog, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read .mo file")
+	}
+	if len(data) < 20 {
+		return nil, errors.New("invalid .mo file: too short")
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	switch binary.LittleEndian.Uint32(data) {
+	case moMagic:
+	case moMagicReversed:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid .mo file: bad magic number")
+	}
+
+	count := int(order.Uint32(data[8:]))
+	origTable := int(order.Uint32(data[12:]))
+	transTable := int(order.Uint32(data[16:]))
+
+	// readString reads the i-th string from the table at `table`
+	readString := func(table, i int) (string, error) {
+		pos := table + i*8
+		if pos < 0 || pos+8 > len(data) {
+			return "", errors.New("invalid .mo file: string table out of range")
+		}
+		length := int(order.Uint32(data[pos:]))
+		offset := int(order.Uint32(data[pos+4:]))
+		if offset < 0 || length < 0 || offset+length > len(data) {
+			return "", errors.New("invalid .mo file: string out of range")
+		}
+		return string(data[offset : offset+length]), nil
+	}
+
+	c := NewMapCatalog(nil)
+	for i := 0; i < count; i++ {
+		orig, err := readString(origTable, i)
+		if err != nil {
+			return nil, err
+		}
+		trans, err := readString(transTable, i)
+		if err != nil {
+			return nil, err
+		}
+
+		var e poEntry
+		if j := strings.Index(orig, contextSeparator); j > -1 {
+			e.context = orig[:j]
+			orig = orig[j+1:]
+		}
+		ids := strings.SplitN(orig, "\x00", 2)
+		e.id = ids[0]
+		if len(ids) > 1 {
+			e.plural = ids[1]
+		}
+		e.translations = strings.Split(trans, "\x00")
+		if err := c.addEntry(&e); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,172 @@
+/*
+Package i18n implements message localization for Xslate templates.
+
+Translations are provided by Catalogs, one per locale. Catalogs can be
+read from GNU gettext .po and .mo files, or built in memory:
+
+  l := i18n.NewLocalizer("en")
+  fr, _ := i18n.LoadFile("locale/fr.po")
+  l.AddCatalog("fr", fr)
+  l.AddCatalog("ja", i18n.NewMapCatalog(map[string]string{
+    "Hello, [_1]!": "こんにちは、[_1]さん!",
+  }))
+
+  tx, _ := xslate.New(xslate.Args{"Localizer": l})
+  tx.RenderString(`[% loc("Hello, [_1]!", name) %]`, xslate.Vars{
+    "locale": "ja",
+    "name":   "Bob",
+  })
+
+Placeholders are written as [_1], [_2], ..., and refer to the arguments
+following the message. For plural forms (nloc), [_1] is the count.
+*/
+package i18n
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/go-xslate/functions"
+)
+
+// Catalog provides translated messages for a single locale
+type Catalog interface {
+	// Get returns the translation of `msgid`
+	Get(msgid string) (string, bool)
+	// GetPlural returns the translation of `msgid` (whose plural form in
+	// the source language is `plural`) appropriate for the count `n`
+	GetPlural(msgid, plural string, n int) (string, bool)
+}
+
+// Localizer holds the catalogs for each locale, and translates messages
+type Localizer struct {
+	// DefaultLocale is used when the requested locale is not available
+	DefaultLocale string
+	catalogs      map[string]Catalog
+}
+
+// NewLocalizer creates a new Localizer. Messages requested in locales
+// without a catalog are translated using the catalog for `defaultLocale`
+func NewLocalizer(defaultLocale string) *Localizer {
+	return &Localizer{
+		DefaultLocale: defaultLocale,
+		catalogs:      make(map[string]Catalog),
+	}
+}
+
+// AddCatalog registers the catalog to be used for `locale`
+func (l *Localizer) AddCatalog(locale string, c Catalog) {
+	l.catalogs[normalizeLocale(locale)] = c
+}
+
+// Catalog returns the catalog to be used for `locale`. If there's no
+// catalog for the given locale (e.g. "fr_CA"), the catalog for its
+// language ("fr") is used, and then the catalog for the default locale
+func (l *Localizer) Catalog(locale string) (Catalog, bool) {
+	locale = normalizeLocale(locale)
+	if c, ok := l.catalogs[locale]; ok {
+		return c, true
+	}
+	if i := strings.IndexByte(locale, '_'); i > -1 {
+		if c, ok := l.catalogs[locale[:i]]; ok {
+			return c, true
+		}
+	}
+	if def := normalizeLocale(l.DefaultLocale); def != "" && def != locale {
+		return l.Catalog(def)
+	}
+	return nil, false
+}
+
+// Loc returns the translation of `msgid` in `locale`, with the
+// placeholders replaced by `args`. If no translation is available,
+// `msgid` itself is used
+func (l *Localizer) Loc(locale, msgid string, args ...interface{}) string {
+	s := msgid
+	if c, ok := l.Catalog(locale); ok {
+		if t, ok := c.Get(msgid); ok {
+			s = t
+		}
+	}
+	return Expand(s, args...)
+}
+
+// NLoc returns the translation of `msgid` appropriate for the count `n`.
+// If no translation is available, `msgid` is used when n == 1, and
+// `plural` otherwise. The placeholder [_1] is `n`, and [_2] and onwards
+// are replaced by `args`
+func (l *Localizer) NLoc(locale, msgid, plural string, n int, args ...interface{}) string {
+	s := plural
+	if n == 1 {
+		s = msgid
+	}
+	if c, ok := l.Catalog(locale); ok {
+		if t, ok := c.GetPlural(msgid, plural, n); ok {
+			s = t
+		}
+	}
+	return Expand(s, append([]interface{}{n}, args...)...)
+}
+
+// Functions returns the template functions for `locale`: `loc` (and its
+// alias `l`) for ordinary messages, and `nloc` for plural forms. `loc`
+// and `l` can also be used as filters, as in `[% "Hello" | loc %]`
+func (l *Localizer) Functions(locale string) map[string]interface{} {
+	loc := func(msgid string, args ...interface{}) string {
+		return l.Loc(locale, msgid, args...)
+	}
+	nloc := func(msgid, plural string, n interface{}, args ...interface{}) string {
+		return l.NLoc(locale, msgid, plural, functions.ToInt(n), args...)
+	}
+	return map[string]interface{}{
+		"loc":  loc,
+		"l":    loc,
+		"nloc": nloc,
+	}
+}
+
+// Expand replaces the placeholders [_1], [_2], ... in `s` with the
+// corresponding `args`. Placeholders without a corresponding argument
+// are replaced with an empty string
+func Expand(s string, args ...interface{}) string {
+	if strings.Index(s, "[_") < 0 {
+		return s
+	}
+
+	var buf bytes.Buffer
+	for {
+		i := strings.Index(s, "[_")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], ']')
+		if j < 0 {
+			break
+		}
+
+		n, err := strconv.Atoi(s[i+2 : i+j])
+		if err != nil || n < 1 {
+			buf.WriteString(s[:i+2])
+			s = s[i+2:]
+			continue
+		}
+
+		buf.WriteString(s[:i])
+		if n <= len(args) {
+			buf.WriteString(functions.ToString(args[n-1]))
+		}
+		s = s[i+j+1:]
+	}
+	buf.WriteString(s)
+	return buf.String()
+}
+
+// normalizeLocale converts locale names such as "fr-CA" to "fr_CA", and
+// strips the encoding (e.g. "ja_JP.UTF-8")
+func normalizeLocale(locale string) string {
+	if i := strings.IndexByte(locale, '.'); i > -1 {
+		locale = locale[:i]
+	}
+	return strings.Replace(locale, "-", "_", -1)
+}
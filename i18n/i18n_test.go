@@ -0,0 +1,189 @@
+package i18n
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/go-xslate/parser/tterse"
+)
+
+const testPO = `# French translations
+msgid ""
+msgstr ""
+"Content-Type: text/plain; charset=UTF-8\n"
+"Plural-Forms: nplurals=2; plural=(n > 1);\n"
+
+#: index.tx:1
+msgid "Hello, [_1]!"
+msgstr "Bonjour, [_1] !"
+
+msgid "[_1] file"
+msgid_plural "[_1] files"
+msgstr[0] "[_1] fichier"
+msgstr[1] "[_1] fichiers"
+
+msgid ""
+"multi\n"
+"line"
+msgstr "sur\n"
+"plusieurs lignes"
+
+#, fuzzy
+msgid "Goodbye"
+msgstr "Au revoir"
+`
+
+func TestParsePO(t *testing.T) {
+	c, err := ParsePO(strings.NewReader(testPO))
+	if err != nil {
+		t.Fatalf("failed to parse .po: %s", err)
+	}
+
+	if s, ok := c.Get("Hello, [_1]!"); !ok || s != "Bonjour, [_1] !" {
+		t.Errorf("expected 'Bonjour, [_1] !', got '%s'", s)
+	}
+	if s, ok := c.Get("multi\nline"); !ok || s != "sur\nplusieurs lignes" {
+		t.Errorf("expected multi line translation, got '%s'", s)
+	}
+	if _, ok := c.Get("Goodbye"); ok {
+		t.Errorf("fuzzy entries should be ignored")
+	}
+
+	// French uses the singular form for 0 as well
+	for n, expected := range map[int]string{0: "[_1] fichier", 1: "[_1] fichier", 2: "[_1] fichiers"} {
+		if s, ok := c.GetPlural("[_1] file", "[_1] files", n); !ok || s != expected {
+			t.Errorf("expected '%s' for %d, got '%s'", expected, n, s)
+		}
+	}
+}
+
+// buildMO creates a .mo file from the given original/translation pairs
+func buildMO(pairs [][2]string) []byte {
+	n := len(pairs)
+	origTable := 28
+	transTable := origTable + n*8
+	offset := transTable + n*8
+
+	var header, strs bytes.Buffer
+	for _, v := range []int{0x950412de, 0, n, origTable, transTable, 0, 0} {
+		binary.Write(&header, binary.LittleEndian, uint32(v))
+	}
+	var origs, trans bytes.Buffer
+	for i, table := range []*bytes.Buffer{&origs, &trans} {
+		for _, p := range pairs {
+			binary.Write(table, binary.LittleEndian, uint32(len(p[i])))
+			binary.Write(table, binary.LittleEndian, uint32(offset+strs.Len()))
+			strs.WriteString(p[i])
+			strs.WriteByte(0)
+		}
+	}
+	header.Write(origs.Bytes())
+	header.Write(trans.Bytes())
+	header.Write(strs.Bytes())
+	return header.Bytes()
+}
+
+func TestParseMO(t *testing.T) {
+	data := buildMO([][2]string{
+		{"", "Plural-Forms: nplurals=3; plural=n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2;\n"},
+		{"Hello", "Привет"},
+		{"[_1] file\x00[_1] files", "[_1] файл\x00[_1] файла\x00[_1] файлов"},
+	})
+
+	c, err := ParseMO(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse .mo: %s", err)
+	}
+
+	if s, ok := c.Get("Hello"); !ok || s != "Привет" {
+		t.Errorf("expected 'Привет', got '%s'", s)
+	}
+	for n, expected := range map[int]string{1: "[_1] файл", 3: "[_1] файла", 5: "[_1] файлов", 11: "[_1] файлов", 21: "[_1] файл"} {
+		if s, _ := c.GetPlural("[_1] file", "[_1] files", n); s != expected {
+			t.Errorf("expected '%s' for %d, got '%s'", expected, n, s)
+		}
+	}
+}
+
+func TestParsePluralExpr(t *testing.T) {
+	for _, bad := range []string{"n +", "(n", "x == 1", "n ? 1"} {
+		if _, err := ParsePluralExpr(bad); err == nil {
+			t.Errorf("expected '%s' to fail", bad)
+		}
+	}
+
+	fn, err := ParsePluralExpr("n==0 ? 0 : n==1 ? 1 : !(n%2) ? 2 : 3")
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	for n, expected := range map[int]int{0: 0, 1: 1, 4: 2, 7: 3} {
+		if i := fn(n); i != expected {
+			t.Errorf("expected %d for %d, got %d", expected, n, i)
+		}
+	}
+}
+
+func TestLocalizer(t *testing.T) {
+	fr, err := ParsePO(strings.NewReader(testPO))
+	if err != nil {
+		t.Fatalf("failed to parse .po: %s", err)
+	}
+
+	l := NewLocalizer("en")
+	l.AddCatalog("fr", fr)
+	l.AddCatalog("en", NewMapCatalog(map[string]string{"Hello, [_1]!": "Hi, [_1]!"}))
+
+	if s := l.Loc("fr-CA", "Hello, [_1]!", "Bob"); s != "Bonjour, Bob !" {
+		t.Errorf("expected fallback to 'fr', got '%s'", s)
+	}
+	if s := l.Loc("de", "Hello, [_1]!", "Bob"); s != "Hi, Bob!" {
+		t.Errorf("expected fallback to default locale, got '%s'", s)
+	}
+	if s := l.Loc("fr", "Not translated [_2][_1]", 1, 2); s != "Not translated 21" {
+		t.Errorf("expected untranslated message, got '%s'", s)
+	}
+	if s := l.NLoc("de", "[_1] file", "[_1] files", 3); s != "3 files" {
+		t.Errorf("expected '3 files', got '%s'", s)
+	}
+}
+
+func TestExtractor(t *testing.T) {
+	e := NewExtractor(tterse.New())
+	err := e.Extract("index.tx", []byte(`[% loc("Hello, [_1]!", name) %]
+[% "Welcome" | loc %] [% other("ignored") %]
+[% nloc("[_1] file", "[_1] files", count) %][% l("Hello, [_1]!", name) %]`))
+	if err != nil {
+		t.Fatalf("failed to extract: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := e.WritePOT(&buf); err != nil {
+		t.Fatalf("failed to write .pot: %s", err)
+	}
+
+	expected := `
+#: index.tx:1 index.tx:3
+msgid "Hello, [_1]!"
+msgstr ""
+
+#: index.tx:2
+msgid "Welcome"
+msgstr ""
+
+#: index.tx:3
+msgid "[_1] file"
+msgid_plural "[_1] files"
+msgstr[0] ""
+msgstr[1] ""
+`
+	if !strings.HasSuffix(buf.String(), expected) {
+		t.Errorf("unexpected .pot output:\n%s", buf.String())
+	}
+
+	// The generated .pot must be readable by ParsePO
+	if _, err := ParsePO(&buf); err != nil {
+		t.Errorf("failed to parse generated .pot: %s", err)
+	}
+}
@@ -0,0 +1,259 @@
+package i18n
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PluralFunc returns the index of the plural form to be used for `n`
+type PluralFunc func(n int) int
+
+func defaultPluralFunc(n int) int {
+	if n == 1 {
+		return 0
+	}
+	return 1
+}
+
+func parsePluralCount(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, errors.Errorf("nplurals must be positive, got %d", n)
+	}
+	return n, nil
+}
+
+// ParsePluralExpr parses the C expression used in the Plural-Forms header
+// of gettext catalogs, such as "(n != 1)" or
+// "n%10==1 && n%100!=11 ? 0 : n%10>=2 && n%10<=4 && (n%100<10 || n%100>=20) ? 1 : 2"
+func ParsePluralExpr(s string) (PluralFunc, error) {
+	p := &pluralParser{input: s}
+	p.next()
+	fn, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, errors.Errorf("unexpected '%s' in plural expression", p.tok)
+	}
+	return PluralFunc(fn), nil
+}
+
+// pluralParser is a recursive descent parser for plural expressions.
+// Each parse method returns a closure that evaluates the sub expression
+type pluralParser struct {
+	input string
+	pos   int
+	tok   string
+}
+
+// pluralOps are the multi character operators, which need to be matched
+// before their single character prefixes
+var pluralOps = []string{"==", "!=", "<=", ">=", "&&", "||"}
+
+func (p *pluralParser) next() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+	if p.pos >= len(p.input) {
+		p.tok = ""
+		return
+	}
+
+	rest := p.input[p.pos:]
+	for _, op := range pluralOps {
+		if strings.HasPrefix(rest, op) {
+			p.tok = op
+			p.pos += len(op)
+			return
+		}
+	}
+
+	if c := rest[0]; c >= '0' && c <= '9' {
+		i := 1
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		p.tok = rest[:i]
+		p.pos += i
+		return
+	}
+
+	p.tok = rest[:1]
+	p.pos++
+}
+
+func (p *pluralParser) expect(tok string) error {
+	if p.tok != tok {
+		return errors.Errorf("expected '%s' in plural expression, got '%s'", tok, p.tok)
+	}
+	p.next()
+	return nil
+}
+
+func (p *pluralParser) parseTernary() (func(int) int, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "?" {
+		return cond, nil
+	}
+	p.next()
+
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	return func(n int) int {
+		if cond(n) != 0 {
+			return then(n)
+		}
+		return otherwise(n)
+	}, nil
+}
+
+// pluralPrecedence lists binary operators from the lowest precedence
+var pluralPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", ">", "<=", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *pluralParser) parseBinary(level int) (func(int) int, error) {
+	if level >= len(pluralPrecedence) {
+		return p.parseUnary()
+	}
+
+	lhs, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := ""
+		for _, candidate := range pluralPrecedence[level] {
+			if p.tok == candidate {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return lhs, nil
+		}
+		p.next()
+
+		rhs, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = pluralBinaryOp(op, lhs, rhs)
+	}
+}
+
+func pluralBinaryOp(op string, lhs, rhs func(int) int) func(int) int {
+	b2i := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	return func(n int) int {
+		l, r := lhs(n), rhs(n)
+		switch op {
+		case "||":
+			return b2i(l != 0 || r != 0)
+		case "&&":
+			return b2i(l != 0 && r != 0)
+		case "==":
+			return b2i(l == r)
+		case "!=":
+			return b2i(l != r)
+		case "<":
+			return b2i(l < r)
+		case ">":
+			return b2i(l > r)
+		case "<=":
+			return b2i(l <= r)
+		case ">=":
+			return b2i(l >= r)
+		case "+":
+			return l + r
+		case "-":
+			return l - r
+		case "*":
+			return l * r
+		case "/":
+			if r == 0 {
+				return 0
+			}
+			return l / r
+		case "%":
+			if r == 0 {
+				return 0
+			}
+			return l % r
+		}
+		return 0
+	}
+}
+
+func (p *pluralParser) parseUnary() (func(int) int, error) {
+	switch p.tok {
+	case "!":
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(n int) int {
+			if x(n) == 0 {
+				return 1
+			}
+			return 0
+		}, nil
+	case "-":
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(n int) int { return -x(n) }, nil
+	case "(":
+		p.next()
+		x, err := p.parseTernary()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	case "n":
+		p.next()
+		return func(n int) int { return n }, nil
+	}
+
+	v, err := strconv.Atoi(p.tok)
+	if err != nil {
+		return nil, errors.Errorf("unexpected '%s' in plural expression", p.tok)
+	}
+	p.next()
+	return func(int) int { return v }, nil
+}
@@ -0,0 +1,29 @@
+package bwpool
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// buffered writer pool
+var pool = sync.Pool{
+	New: allocWriter,
+}
+
+func allocWriter() interface{} {
+	return bufio.NewWriter(nil)
+}
+
+// Get returns a buffered writer that writes to w
+func Get(w io.Writer) *bufio.Writer {
+	bw := pool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+// Release returns bw to the pool. It must have been flushed
+func Release(bw *bufio.Writer) {
+	bw.Reset(nil)
+	pool.Put(bw)
+}
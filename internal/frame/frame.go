@@ -11,19 +11,21 @@ import (
 // stack where the actual data resides. Frame is just a convenient
 // wrapper to remember when the Frame started
 type Frame struct {
-	stack stack.Stack
+	stack *stack.Stack
 	mark  int
 }
 
-// New creates a new Frame instance.
-func New(s stack.Stack) *Frame {
+// New creates a new Frame instance. Frames created from the same stack
+// share their storage, so variables are addressed by their absolute
+// position in the stack
+func New(s *stack.Stack) *Frame {
 	return &Frame{
 		mark:  0,
 		stack: s,
 	}
 }
 
-func (f Frame) Stack() stack.Stack {
+func (f Frame) Stack() *stack.Stack {
 	return f.stack
 }
 
@@ -48,7 +50,7 @@ func (f *Frame) DeclareVar(v interface{}) int {
 func (f *Frame) GetLvar(i int) (interface{}, error) {
 	v, err := f.stack.Get(i)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get local variable at "+strconv.Itoa(i+f.mark))
+		return nil, errors.Wrap(err, "failed to get local variable at "+strconv.Itoa(i))
 	}
 	return v, nil
 }
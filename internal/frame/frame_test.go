@@ -8,7 +8,8 @@ import (
 )
 
 func TestFrame_Lvar(t *testing.T) {
-	f := New(stack.New(5))
+	s := stack.New(5)
+	f := New(&s)
 	f.SetLvar(0, 1)
 	x, err := f.GetLvar(0)
 	if !assert.NoError(t, err, "f.GetLvar(0) should succeed") {
@@ -119,6 +119,14 @@ func (s *Stack) Pop() interface{} {
 	return v
 }
 
+// Truncate removes the items at the end of the stack, so that only the
+// first `size` items remain
+func (s *Stack) Truncate(size int) {
+	if size < len(*s) {
+		*s = (*s)[:size]
+	}
+}
+
 // String returns the textual representation of the stack
 func (s *Stack) String() string {
 	buf := bytes.Buffer{}
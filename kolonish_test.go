@@ -31,3 +31,81 @@ func TestKolonish_Comments(t *testing.T) {
 	c.renderStringAndCompare(`    <:- "Hello, World!" :>`, nil, `Hello, World!`)
 	c.renderStringAndCompare(`<: "Hello, World!" -:>    `, nil, `Hello, World!`)
 }
+
+func TestKolonish_CustomDelimiters(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	pargs := c.XslateArgs["Parser"].(Args)
+	pargs["TagStart"] = "<%"
+	pargs["TagEnd"] = "%>"
+	pargs["LineStart"] = ":"
+	template := `<: "Hello" :> <% "Hello" %>
+: "World"
+`
+	c.renderStringAndCompare(template, nil, "<: \"Hello\" :> Hello\nWorld")
+}
+
+func TestKolonish_Lambda(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`<: [1, 2, 3].map(-> $x { $x * 2 }).join(",") :>`, nil, `2,4,6`)
+	c.renderStringAndCompare(`<: $list.grep(-> $x { $x > 1 }).join(",") :>`, Vars{"list": []int{1, 2, 3}}, `2,3`)
+}
+
+func TestKolonish_Loops(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`<: for $list -> $x { :><: $x :>,<: } :>`, Vars{"list": []int{1, 2, 3}}, `1,2,3,`)
+	c.renderStringAndCompare(`<: for [1, 2, 3, 4] -> $x { :><: if $x == 2 { :><: next :><: } :><: if $x > 3 { :><: last :><: } :><: $x :>,<: } :>`, nil, `1,3,`)
+	c.renderStringAndCompare(`<: $i = 0 :><: while $i < 5 { :><: $i += 1 :><: if $i == 3 { :><: last :><: } :><: $i :>,<: } :>`, nil, `1,2,`)
+
+	template := `<: for $rows -> $row { :><: for $row -> $col { :><: if $col == 0 { :><: next $row :><: } :><: $col :><: } :>;<: } :>`
+	c.renderStringAndCompare(template, Vars{"rows": [][]int{{1, 0, 2}, {3}}}, `13;`)
+}
+
+func TestKolonish_KeywordsAsNames(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"next": "n", "item": map[string]string{"last": "l", "for": "f"}}
+	c.renderStringAndCompare(`<: $next :><: $item.last :><: $item.for :>`, vars, `nlf`)
+	c.renderStringAndCompare(`<: for [1, 2, 3] -> $x limit 3 { :><: $x :><: } :>`, nil, `123`)
+}
+
+func TestKolonish_HashLiteral(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`<: { name => "Bob", age: 42 }.values().join(",") :>`, nil, `42,Bob`)
+	c.renderStringAndCompare(`<: for { b => [1, 2], a => [3] } -> $p { :><: $p.key :><: $p.value.size() :><: } :>`, nil, `a1b2`)
+}
+
+func TestKolonish_Conditional(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"yes": true, "name": "Bob"}
+	c.renderStringAndCompare(`<: $yes ? "a" : "b" :>,<: $no ? "a" : "b" :>`, vars, `a,b`)
+	c.renderStringAndCompare(`<: $missing // $name :>,<: $name // "x" :>`, vars, `Bob,Bob`)
+	c.renderStringAndCompare(`<: for [1, 2, 3] -> $i { :><: $i == 2 ? "two" : $i :><: } :>`, nil, `1two3`)
+}
+
+func TestKolonish_StringOperators(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"name": "Bob", "x": 2}
+	c.renderStringAndCompare(`<: "Hello, " ~ $name :>,<: "ab" x $x :>,<: $x x $x :>`, vars, `Hello, Bob,abab,22`)
+	c.renderStringAndCompare(`<: if $name lt "Carol" { :>yes<: } :>,<: $name cmp "Alice" :>`, vars, `yes,1`)
+}
+
+func TestKolonish_IndexAndSlice(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"list": []string{"a", "b", "c"}, "hash": map[string]int{"x": 1}, "key": "x"}
+	c.renderStringAndCompare(`<: $list[-1] :>,<: $list[0..1].join("") :>,<: $hash[$key] :>,<: $list[5] // "none" :>`, vars, `c,ab,1,none`)
+}
@@ -2,6 +2,8 @@ package node
 
 import "reflect"
 
+// DefaultMaxIterations is the default maximum number of iterations of a
+// loop, which is enforced by the VM
 const DefaultMaxIterations = 1000
 
 // NodeType is used to distinguish each AST node
@@ -53,9 +55,25 @@ const (
 	LT
 	GT
 	MakeArray
+	MakeHash
 	Group
 	Filter
 	Macro
+	Lambda
+	Last
+	Next
+	Ternary
+	DefinedOr
+	Concat
+	Repeat
+	StringLT
+	StringGT
+	StringLE
+	StringGE
+	StringCmp
+	FetchSlice
+	Try
+	Catch
 	Max
 )
 
@@ -103,7 +121,7 @@ type LocalVarNode struct {
 type LoopNode struct {
 	*ListNode         // Body of the loop
 	Condition    Node //
-	MaxIteration int  // Max number of iterations
+	MaxIteration int  // Max number of iterations. 0 to use the VM's limit
 }
 
 type ForeachNode struct {
@@ -115,6 +133,38 @@ type ForeachNode struct {
 
 type WhileNode struct {
 	*LoopNode
+	LoopVarIdx int
+}
+
+// CatchNode is the CATCH block of a TRY. ErrorVarIdx is the location of
+// the local variable `error`, which holds the error that was caught
+type CatchNode struct {
+	*ListNode
+	ErrorVarIdx int
+}
+
+// FetchSliceNode is `Container[Start..End]`
+type FetchSliceNode struct {
+	BaseNode
+	Container Node
+	Start     Node
+	End       Node
+}
+
+// TernaryNode is the conditional operator `Condition ? Then : Else`
+type TernaryNode struct {
+	BaseNode
+	Condition Node
+	Then      Node
+	Else      Node
+}
+
+// LoopControlNode is a LAST or NEXT statement. Label is the name of the
+// loop variable of the FOREACH it applies to, or empty for the innermost
+// loop
+type LoopControlNode struct {
+	BaseNode
+	Label string
 }
 
 type MethodCallNode struct {
@@ -160,11 +210,22 @@ type BinaryNode struct {
 type FilterNode struct {
 	*UnaryNode
 	Name string
+	Args *ListNode // Arguments as in `| date("%Y")`. nil if none given
 }
 
 type MacroNode struct {
 	*ListNode
 	Name      string
 	LocalVar  *LocalVarNode
+	Arguments []string // Names of the parameters
+}
+
+// LambdaNode is an anonymous function, such as `-> $x { $x * 2 }`.
+// Its body is a single expression
+type LambdaNode struct {
+	*UnaryNode
 	Arguments []*LocalVarNode
+	// Captures are the local variables of enclosing scopes that the
+	// body uses. Their values are captured when the lambda is created
+	Captures []*LocalVarNode
 }
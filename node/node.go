@@ -131,8 +131,8 @@ func (n *AssignmentNode) Copy() Node {
 
 func (n *AssignmentNode) Visit(c chan Node) {
 	c <- n
-	c <- n.Assignee
-	c <- n.Expression
+	n.Assignee.Visit(c)
+	n.Expression.Visit(c)
 }
 
 func NewLocalVarNode(pos int, symbol string, idx int) *LocalVarNode {
@@ -157,10 +157,8 @@ func (n *LocalVarNode) String() string {
 }
 
 func NewLoopNode(pos int) *LoopNode {
-	maxiter := DefaultMaxIterations
 	return &LoopNode{
-		ListNode:     NewListNode(pos),
-		MaxIteration: maxiter,
+		ListNode: NewListNode(pos),
 	}
 }
 
@@ -209,7 +207,8 @@ func NewWhileNode(pos int, n Node) *WhileNode {
 
 func (n *WhileNode) Copy() Node {
 	return &WhileNode{
-		LoopNode: n.LoopNode.Copy().(*LoopNode),
+		LoopNode:   n.LoopNode.Copy().(*LoopNode),
+		LoopVarIdx: n.LoopVarIdx,
 	}
 }
 
@@ -219,6 +218,140 @@ func (n *WhileNode) Visit(c chan Node) {
 	n.ListNode.Visit(c)
 }
 
+func NewFetchSliceNode(pos int, container, start, end Node) *FetchSliceNode {
+	return &FetchSliceNode{
+		BaseNode:  BaseNode{FetchSlice, pos},
+		Container: container,
+		Start:     start,
+		End:       end,
+	}
+}
+
+func (n *FetchSliceNode) Copy() Node {
+	return &FetchSliceNode{
+		BaseNode:  n.BaseNode,
+		Container: n.Container.Copy(),
+		Start:     n.Start.Copy(),
+		End:       n.End.Copy(),
+	}
+}
+
+func (n *FetchSliceNode) Visit(c chan Node) {
+	c <- n
+	n.Container.Visit(c)
+	n.Start.Visit(c)
+	n.End.Visit(c)
+}
+
+func NewTernaryNode(pos int, condition Node) *TernaryNode {
+	return &TernaryNode{
+		BaseNode:  BaseNode{Ternary, pos},
+		Condition: condition,
+	}
+}
+
+func (n *TernaryNode) Copy() Node {
+	return &TernaryNode{
+		BaseNode:  n.BaseNode,
+		Condition: n.Condition.Copy(),
+		Then:      n.Then.Copy(),
+		Else:      n.Else.Copy(),
+	}
+}
+
+func (n *TernaryNode) Visit(c chan Node) {
+	c <- n
+	n.Condition.Visit(c)
+	n.Then.Visit(c)
+	n.Else.Visit(c)
+}
+
+func NewDefinedOrNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{DefinedOr, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewConcatNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{Concat, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewRepeatNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{Repeat, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStringLTNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StringLT, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStringGTNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StringGT, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStringLENode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StringLE, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStringGENode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StringGE, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStringCmpNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StringCmp, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewLoopControlNode(pos int, t NodeType, label string) *LoopControlNode {
+	return &LoopControlNode{
+		BaseNode{t, pos},
+		label,
+	}
+}
+
+func (n *LoopControlNode) Copy() Node {
+	return NewLoopControlNode(n.pos, n.NodeType, n.Label)
+}
+
+func (n *LoopControlNode) Visit(c chan Node) {
+	c <- n
+}
+
+func (n *LoopControlNode) String() string {
+	if n.Label == "" {
+		return n.NodeType.String()
+	}
+	return fmt.Sprintf("%s %s", n.NodeType, n.Label)
+}
+
 func NewMethodCallNode(pos int, invocant Node, method string, args *ListNode) *MethodCallNode {
 	return &MethodCallNode{
 		BaseNode{MethodCall, pos},
@@ -357,9 +490,9 @@ func (n *IfNode) Copy() Node {
 
 func (n *IfNode) Visit(c chan Node) {
 	c <- n
-	c <- n.BooleanExpression
+	n.BooleanExpression.Visit(c)
 	for _, child := range n.ListNode.Nodes {
-		c <- child
+		child.Visit(c)
 	}
 }
 
@@ -372,6 +505,29 @@ func NewElseNode(pos int) *ElseNode {
 	return n
 }
 
+// NewTryNode creates a TRY block. Its CATCH block, if any, is one of
+// its children
+func NewTryNode(pos int) *ListNode {
+	n := NewListNode(pos)
+	n.NodeType = Try
+	return n
+}
+
+func NewCatchNode(pos int) *CatchNode {
+	n := &CatchNode{ListNode: NewListNode(pos)}
+	n.NodeType = Catch
+	return n
+}
+
+func (n *CatchNode) Copy() Node {
+	x := &CatchNode{
+		ListNode:    n.ListNode.Copy().(*ListNode),
+		ErrorVarIdx: n.ErrorVarIdx,
+	}
+	x.NodeType = Catch
+	return x
+}
+
 func NewRangeNode(pos int, start, end Node) *BinaryNode {
 	return &BinaryNode{
 		BaseNode{Range, pos},
@@ -392,6 +548,15 @@ func (n *UnaryNode) Copy() Node {
 	}
 }
 
+// NewMakeHashNode creates a node for a hash literal. child is a list of
+// keys and values, alternating
+func NewMakeHashNode(pos int, child Node) *UnaryNode {
+	return &UnaryNode{
+		BaseNode{MakeHash, pos},
+		child,
+	}
+}
+
 func NewMakeArrayNode(pos int, child Node) *UnaryNode {
 	return &UnaryNode{
 		BaseNode{MakeArray, pos},
@@ -403,6 +568,7 @@ type IncludeNode struct {
 	BaseNode
 	IncludeTarget   Node
 	AssignmentNodes []Node
+	Vars            Node // hash of variables, as in `WITH { foo => 1 }`
 }
 
 func NewIncludeNode(pos int, include Node) *IncludeNode {
@@ -410,6 +576,7 @@ func NewIncludeNode(pos int, include Node) *IncludeNode {
 		BaseNode{Include, pos},
 		include,
 		[]Node{},
+		nil,
 	}
 }
 
@@ -518,22 +685,31 @@ func NewFilterNode(pos int, name string, child Node) *FilterNode {
 			child,
 		},
 		name,
+		nil,
 	}
 }
 
 func (n *FilterNode) Copy() Node {
+	var args *ListNode
+	if n.Args != nil {
+		args = n.Args.Copy().(*ListNode)
+	}
 	return &FilterNode{
 		&UnaryNode{
 			BaseNode{Filter, n.pos},
 			n.Child.Copy(),
 		},
 		n.Name,
+		args,
 	}
 }
 
 func (n *FilterNode) Visit(c chan Node) {
 	c <- n
-	n.UnaryNode.Visit(c)
+	n.Child.Visit(c)
+	if n.Args != nil {
+		n.Args.Visit(c)
+	}
 }
 
 func NewFetchArrayElementNode(pos int) *BinaryNode {
@@ -549,12 +725,51 @@ func NewMacroNode(pos int, name string) *MacroNode {
 		NewListNode(pos),
 		name,
 		nil,
-		[]*LocalVarNode{},
+		[]string{},
 	}
 	n.NodeType = Macro
 	return n
 }
 
-func (n *MacroNode) AppendArg(arg *LocalVarNode) {
+func (n *MacroNode) AppendArg(arg string) {
+	n.Arguments = append(n.Arguments, arg)
+}
+
+func NewLambdaNode(pos int, body Node) *LambdaNode {
+	return &LambdaNode{
+		&UnaryNode{
+			BaseNode{Lambda, pos},
+			body,
+		},
+		[]*LocalVarNode{},
+		[]*LocalVarNode{},
+	}
+}
+
+func (n *LambdaNode) AppendArg(arg *LocalVarNode) {
 	n.Arguments = append(n.Arguments, arg)
 }
+
+// AppendCapture records that the body uses the local variable v of an
+// enclosing scope. Variables that are used more than once are recorded
+// once
+func (n *LambdaNode) AppendCapture(v *LocalVarNode) {
+	for _, c := range n.Captures {
+		if c.Offset == v.Offset {
+			return
+		}
+	}
+	n.Captures = append(n.Captures, v)
+}
+
+func (n *LambdaNode) Copy() Node {
+	x := NewLambdaNode(n.pos, n.Child.Copy())
+	x.Arguments = append(x.Arguments, n.Arguments...)
+	x.Captures = append(x.Captures, n.Captures...)
+	return x
+}
+
+func (n *LambdaNode) Visit(c chan Node) {
+	c <- n
+	n.Child.Visit(c)
+}
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/lestrrat/go-xslate/internal/rbpool"
 	"github.com/lestrrat/go-xslate/node"
@@ -31,3 +32,16 @@ func (ast *AST) String() string {
 	}
 	return buf.String()
 }
+
+// LineOf returns the line number of the given position in the template,
+// such as the one returned by node.Node's Pos(). It returns 0 if it is
+// not known
+func (ast *AST) LineOf(pos int) int {
+	i := sort.Search(len(ast.lines), func(i int) bool {
+		return ast.lines[i].Pos > pos
+	})
+	if i == 0 {
+		return 0
+	}
+	return ast.lines[i-1].Line
+}
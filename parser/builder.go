@@ -12,7 +12,7 @@ import (
 	"github.com/pkg/errors"
 )
 
-func NewFrame(s stack.Stack) *Frame {
+func NewFrame(s *stack.Stack) *Frame {
 	f := &Frame{
 		frame.New(s),
 		nil,
@@ -30,10 +30,22 @@ type builderCtx struct {
 	PeekCount       int
 	Tokens          [3]lex.LexItem
 	CurrentStackTop int
-	PostChomp       bool
+	PostChomp       ChompMode
 	FrameStack      stack.Stack
 	Frames          stack.Stack
 	Error           error
+	// Lines records where each line starts, as seen in the tokens read
+	// from the lexer
+	Lines []linePos
+	// Lambdas are the lambdas being parsed, innermost last
+	Lambdas []lambdaScope
+}
+
+// lambdaScope is a lambda being parsed. Local variables below mark in the
+// framestack belong to enclosing scopes, and are captured by the lambda
+type lambdaScope struct {
+	node *node.LambdaNode
+	mark int
 }
 
 func NewBuilder() *Builder {
@@ -62,8 +74,9 @@ func (b *Builder) Parse(name string, l lex.Lexer) (ast *AST, err error) {
 	b.Start(ctx)
 	b.ParseStatements(ctx)
 	return &AST{
-		Name: name,
-		Root: ctx.Root,
+		Name:  name,
+		Root:  ctx.Root,
+		lines: ctx.Lines,
 	}, nil
 }
 
@@ -80,7 +93,7 @@ func (b *Builder) Peek(ctx *builderCtx) lex.LexItem {
 		return ctx.Tokens[ctx.PeekCount-1]
 	}
 	ctx.PeekCount = 1
-	ctx.Tokens[0] = ctx.Lexer.NextItem()
+	ctx.Tokens[0] = ctx.NextItem()
 	return ctx.Tokens[0]
 }
 
@@ -100,7 +113,7 @@ func (b *Builder) Next(ctx *builderCtx) lex.LexItem {
 	if ctx.PeekCount > 0 {
 		ctx.PeekCount--
 	} else {
-		ctx.Tokens[0] = ctx.Lexer.NextItem()
+		ctx.Tokens[0] = ctx.NextItem()
 	}
 	return ctx.Tokens[ctx.PeekCount]
 }
@@ -122,11 +135,34 @@ func (b *Builder) Backup2(ctx *builderCtx, t1 lex.LexItem) {
 	ctx.PeekCount = 2
 }
 
+// NextItem reads the next token from the lexer, and records the line
+// that it's on
+func (ctx *builderCtx) NextItem() lex.LexItem {
+	t := ctx.Lexer.NextItem()
+	if n := len(ctx.Lines); n == 0 || ctx.Lines[n-1].Line != t.Line() {
+		ctx.Lines = append(ctx.Lines, linePos{Pos: t.Pos(), Line: t.Line()})
+	}
+	return t
+}
+
+// templateVar marks names in LvarNames that refer to template variables,
+// such as the parameters of a MACRO, even if an enclosing scope has a
+// local variable of the same name
+const templateVar = -1
+
 func (ctx *builderCtx) HasLocalVar(symbol string) (pos int, ok bool) {
 	for i := ctx.Frames.Size() - 1; i >= 0; i-- {
 		f, _ := ctx.Frames.Get(i)
 		pos, ok = f.(*Frame).LvarNames[symbol]
 		if ok {
+			if pos == templateVar {
+				return 0, false
+			}
+			for _, l := range ctx.Lambdas {
+				if pos < l.mark {
+					l.node.AppendCapture(node.NewLocalVarNode(0, symbol, pos))
+				}
+			}
 			return
 		}
 	}
@@ -140,10 +176,13 @@ func (ctx *builderCtx) DeclareLocalVar(symbol string) int {
 	return i
 }
 
+// PushFrame creates a new scope for local variables. Local variables are
+// assigned unique slots in ctx.FrameStack, and the VM uses the same
+// slots at runtime
 func (ctx *builderCtx) PushFrame() *Frame {
-	f := NewFrame(ctx.FrameStack)
+	f := NewFrame(&ctx.FrameStack)
 	ctx.Frames.Push(f)
-	f.SetMark(ctx.Frames.Size())
+	f.SetMark(ctx.FrameStack.Size())
 	return f
 }
 
@@ -154,7 +193,7 @@ func (ctx *builderCtx) PopFrame() *Frame {
 	}
 
 	f := x.(*Frame)
-	for i := ctx.FrameStack.Size() - 1; i > f.Mark(); i-- {
+	for i := ctx.FrameStack.Size(); i > f.Mark(); i-- {
 		ctx.FrameStack.Pop()
 	}
 	return f
@@ -205,7 +244,7 @@ func (b *Builder) ParseTemplateOrText(ctx *builderCtx) node.Node {
 	switch token.Type() {
 	case ItemRawString:
 		return b.ParseRawString(ctx)
-	case ItemTagStart:
+	case ItemTagStart, ItemLineStart:
 		return b.ParseTemplate(ctx)
 	default:
 		panic(fmt.Sprintf("Unexpected token: %s", token))
@@ -213,7 +252,6 @@ func (b *Builder) ParseTemplateOrText(ctx *builderCtx) node.Node {
 }
 
 func (b *Builder) ParseRawString(ctx *builderCtx) node.Node {
-	const whiteSpace = " \t\r\n"
 	token := b.NextNonSpace(ctx)
 	if token.Type() != ItemRawString {
 		b.Unexpected(ctx, "Expected raw string, got %s", token)
@@ -221,18 +259,32 @@ func (b *Builder) ParseRawString(ctx *builderCtx) node.Node {
 
 	value := token.Value()
 
-	if ctx.PostChomp {
+	// Trim applies to the very beginning of the template...
+	if b.Trim && token.Pos() == 0 {
 		value = strings.TrimLeft(value, whiteSpace)
-		ctx.PostChomp = false
 	}
 
+	value = chompLeft(value, ctx.PostChomp)
+	ctx.PostChomp = ChompNone
+
 	// Look for signs of pre-chomp
-	if b.PeekNonSpace(ctx).Type() == ItemTagStart {
+	switch b.PeekNonSpace(ctx).Type() {
+	case ItemLineStart:
+		// Indentation before a line statement is never part of the output
+		value = strings.TrimRight(value, " \t")
+		fallthrough
+	case ItemTagStart:
 		start := b.NextNonSpace(ctx)
 		next := b.PeekNonSpace(ctx)
 		b.Backup2(ctx, start)
-		if next.Type() == ItemMinus {
-			// prechomp!
+		mode, ok := chompModifier(next.Type())
+		if !ok || !adjacent(start, next) {
+			mode = b.PreChomp
+		}
+		value = chompRight(value, mode)
+	case ItemEOF:
+		// ...and to the very end of it
+		if b.Trim {
 			value = strings.TrimRight(value, whiteSpace)
 		}
 	}
@@ -243,6 +295,12 @@ func (b *Builder) ParseRawString(ctx *builderCtx) node.Node {
 	return n
 }
 
+// adjacent returns true if there is nothing between the tokens a and b,
+// not even whitespace
+func adjacent(a, b lex.LexItem) bool {
+	return a.Pos()+len(a.Value()) == b.Pos()
+}
+
 func (b *Builder) Unexpected(ctx *builderCtx, format string, args ...interface{}) {
 	msg := fmt.Sprintf(
 		"Unexpected token found: %s in %s at line %d",
@@ -257,25 +315,29 @@ func (b *Builder) Unexpected(ctx *builderCtx, format string, args ...interface{}
 func (b *Builder) ParseTemplate(ctx *builderCtx) node.Node {
 	// consume tagstart
 	start := b.NextNonSpace(ctx)
-	if start.Type() != ItemTagStart {
+	if t := start.Type(); t != ItemTagStart && t != ItemLineStart {
 		b.Unexpected(ctx, "Expected TagStart, got %s", start)
 	}
-	ctx.PostChomp = false
+	ctx.PostChomp = ChompNone
 
-	if b.PeekNonSpace(ctx).Type() == ItemMinus {
-		b.NextNonSpace(ctx)
+	// A modifier is only a chomp when it's attached to the tag start, so
+	// that "[% -1 %]" is a negative number
+	if next := b.PeekNonSpace(ctx); adjacent(start, next) {
+		if _, ok := chompModifier(next.Type()); ok {
+			b.NextNonSpace(ctx)
+		}
 	}
 
 	var tmpl node.Node
 	switch b.PeekNonSpace(ctx).Type() {
-	case ItemEnd:
+	case ItemEnd, ItemCloseCurlyBracket: // `}` closes Kolon style blocks
 		b.NextNonSpace(ctx)
 		for keepPopping := true; keepPopping; {
 			parent := ctx.PopParentNode()
 			switch parent.Type() {
 			case node.Root:
 				b.Unexpected(ctx, "Unexpected END")
-			case node.Else:
+			case node.Else, node.Catch:
 				// no op
 			default:
 				keepPopping = false
@@ -290,6 +352,8 @@ func (b *Builder) ParseTemplate(ctx *builderCtx) node.Node {
 	case ItemSet:
 		b.NextNonSpace(ctx) // Consume SET
 		tmpl = b.ParseAssignment(ctx)
+	case ItemDefault:
+		tmpl = b.ParseDefault(ctx)
 	case ItemMacro:
 		tmpl = b.ParseMacro(ctx)
 	case ItemWrapper:
@@ -298,17 +362,23 @@ func (b *Builder) ParseTemplate(ctx *builderCtx) node.Node {
 		tmpl = b.ParseForeach(ctx)
 	case ItemWhile:
 		tmpl = b.ParseWhile(ctx)
+	case ItemLast, ItemNext:
+		tmpl = b.ParseLoopControl(ctx)
 	case ItemInclude:
 		tmpl = b.ParseInclude(ctx)
 	case ItemTagEnd: // Silly, but possible
 		b.NextNonSpace(ctx)
 		tmpl = node.NewNoopNode()
-	case ItemIdentifier, ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString, ItemOpenParen:
+	case ItemIdentifier, ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString, ItemOpenParen, ItemOpenSquareBracket, ItemOpenCurlyBracket, ItemMinus:
 		tmpl = b.ParseExpressionOrAssignment(ctx, true)
 	case ItemIf:
 		tmpl = b.ParseIf(ctx)
 	case ItemElse:
 		tmpl = b.ParseElse(ctx)
+	case ItemTry:
+		tmpl = b.ParseTry(ctx)
+	case ItemCatch:
+		tmpl = b.ParseCatch(ctx)
 	default:
 		b.Unexpected(ctx, "%s", b.PeekNonSpace(ctx))
 	}
@@ -317,9 +387,15 @@ func (b *Builder) ParseTemplate(ctx *builderCtx) node.Node {
 		b.NextNonSpace(ctx)
 	}
 
-	if b.PeekNonSpace(ctx).Type() == ItemMinus {
-		b.NextNonSpace(ctx)
-		ctx.PostChomp = true
+	if mode, ok := chompModifier(b.PeekNonSpace(ctx).Type()); ok {
+		modifier := b.NextNonSpace(ctx)
+		if end := b.PeekNonSpace(ctx); !adjacent(modifier, end) {
+			b.Unexpected(ctx, "Expected %s to be attached to the tag end", modifier)
+		}
+		ctx.PostChomp = mode
+	} else if start.Type() == ItemTagStart {
+		// Line statements already swallow their trailing newline
+		ctx.PostChomp = b.PostChomp
 	}
 
 	// Consume tag end
@@ -393,7 +469,7 @@ LOOP:
 			cur := b.NextNonSpace(ctx)
 			next := b.PeekNonSpace(ctx)
 			b.Backup2(ctx, cur)
-			if next.Type() == ItemTagEnd {
+			if next.Type() == ItemTagEnd && adjacent(cur, next) {
 				break LOOP
 			}
 		}
@@ -410,8 +486,8 @@ func (b *Builder) ParseAssignment(ctx *builderCtx) node.Node {
 		b.Unexpected(ctx, "Expected identifier, got %s", symbol)
 	}
 
-	b.DeclareLocalVarIfNew(ctx, symbol)
 	n := node.NewAssignmentNode(symbol.Pos(), symbol.Value())
+	n.Assignee.Offset = b.DeclareLocalVarIfNew(ctx, symbol)
 
 	eq := b.NextNonSpace(ctx)
 	switch eq.Type() {
@@ -444,11 +520,36 @@ func (b *Builder) ParseAssignment(ctx *builderCtx) node.Node {
 	return n
 }
 
-func (b *Builder) DeclareLocalVarIfNew(ctx *builderCtx, symbol lex.LexItem) {
-	_, ok := ctx.HasLocalVar(symbol.Value())
-	if !ok {
-		ctx.DeclareLocalVar(symbol.Value())
+// ParseDefault parses `DEFAULT var = value`, which assigns value to var
+// only when var is undefined or false
+func (b *Builder) ParseDefault(ctx *builderCtx) node.Node {
+	b.NextNonSpace(ctx) // Consume DEFAULT
+	symbol := b.NextNonSpace(ctx)
+	if symbol.Type() != ItemIdentifier {
+		b.Unexpected(ctx, "Expected identifier, got %s", symbol)
 	}
+
+	// The condition must be resolved before var is declared, so that it
+	// refers to any outer variable of the same name
+	cond := node.NewTernaryNode(symbol.Pos(), b.LocalVarOrFetchSymbol(ctx, symbol))
+	cond.Then = b.LocalVarOrFetchSymbol(ctx, symbol)
+
+	if eq := b.NextNonSpace(ctx); eq.Type() != ItemAssign {
+		b.Unexpected(ctx, "Expected assign, got %s", eq)
+	}
+	cond.Else = b.ParseExpression(ctx, false)
+
+	n := node.NewAssignmentNode(symbol.Pos(), symbol.Value())
+	n.Assignee.Offset = b.DeclareLocalVarIfNew(ctx, symbol)
+	n.Expression = cond
+	return n
+}
+
+func (b *Builder) DeclareLocalVarIfNew(ctx *builderCtx, symbol lex.LexItem) int {
+	if idx, ok := ctx.HasLocalVar(symbol.Value()); ok {
+		return idx
+	}
+	return ctx.DeclareLocalVar(symbol.Value())
 }
 
 func (b *Builder) LocalVarOrFetchSymbol(ctx *builderCtx, token lex.LexItem) node.Node {
@@ -466,12 +567,71 @@ func (b *Builder) ParseTerm(ctx *builderCtx) node.Node {
 	case ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString:
 		b.Backup(ctx)
 		return b.ParseLiteral(ctx)
+	case ItemArrow:
+		b.Backup(ctx)
+		return b.ParseLambda(ctx)
 	default:
 		b.Backup(ctx)
 		return nil
 	}
 }
 
+// ParseLambda parses an anonymous function: `-> x, y { x + y }`, where
+// the argument list may optionally be enclosed in parenthesis. Arguments
+// are local variables in a new scope, while variables from enclosing
+// scopes are captured when the lambda is created
+func (b *Builder) ParseLambda(ctx *builderCtx) node.Node {
+	arrow := b.NextNonSpace(ctx)
+	if arrow.Type() != ItemArrow {
+		b.Unexpected(ctx, "Expected '->', got %s", arrow)
+	}
+
+	n := node.NewLambdaNode(arrow.Pos(), nil)
+	f := ctx.PushFrame()
+	ctx.Lambdas = append(ctx.Lambdas, lambdaScope{node: n, mark: f.Mark()})
+
+	expectCloseParen := false
+	if b.PeekNonSpace(ctx).Type() == ItemOpenParen {
+		b.NextNonSpace(ctx)
+		expectCloseParen = true
+	}
+
+	for {
+		next := b.NextNonSpace(ctx)
+		if next.Type() != ItemIdentifier {
+			b.Backup(ctx)
+			break
+		}
+		idx := ctx.DeclareLocalVar(next.Value())
+		n.AppendArg(node.NewLocalVarNode(next.Pos(), next.Value(), idx))
+
+		if b.PeekNonSpace(ctx).Type() != ItemComma {
+			break
+		}
+		b.NextNonSpace(ctx)
+	}
+
+	if expectCloseParen {
+		if closeParen := b.NextNonSpace(ctx); closeParen.Type() != ItemCloseParen {
+			b.Unexpected(ctx, "Expected ')', got %s", closeParen)
+		}
+	}
+
+	if openBrace := b.NextNonSpace(ctx); openBrace.Type() != ItemOpenCurlyBracket {
+		b.Unexpected(ctx, "Expected '{', got %s", openBrace)
+	}
+
+	n.Child = b.ParseExpression(ctx, false)
+
+	if closeBrace := b.NextNonSpace(ctx); closeBrace.Type() != ItemCloseCurlyBracket {
+		b.Unexpected(ctx, "Expected '}', got %s", closeBrace)
+	}
+
+	ctx.Lambdas = ctx.Lambdas[:len(ctx.Lambdas)-1]
+	ctx.PopFrame()
+	return n
+}
+
 func (b *Builder) ParseFunCall(ctx *builderCtx, invocant node.Node) node.Node {
 	next := b.NextNonSpace(ctx)
 	if next.Type() != ItemOpenParen {
@@ -512,9 +672,12 @@ func (b *Builder) ParseMethodCallOrMapLookup(ctx *builderCtx, invocant node.Node
 
 	// If we are followed by another period, we are going to have to
 	// check for another level of methodcall / lookup
-	if b.PeekNonSpace(ctx).Type() == ItemPeriod {
+	switch b.PeekNonSpace(ctx).Type() {
+	case ItemPeriod:
 		b.NextNonSpace(ctx) // consume period
 		return b.ParseMethodCallOrMapLookup(ctx, n)
+	case ItemOpenSquareBracket:
+		return b.ParseArrayElementFetch(ctx, n)
 	}
 	return n
 }
@@ -527,15 +690,62 @@ func (b *Builder) ParseArrayElementFetch(ctx *builderCtx, invocant node.Node) no
 
 	index := b.ParseExpression(ctx, false)
 
-	n := node.NewFetchArrayElementNode(openBracket.Pos())
-	n.Left = invocant
-	n.Right = index
+	var n node.Node
+	if b.PeekNonSpace(ctx).Type() == ItemRange {
+		// It's a slice: list[start..end]
+		b.NextNonSpace(ctx)
+		n = node.NewFetchSliceNode(openBracket.Pos(), invocant, index, b.ParseExpression(ctx, false))
+	} else {
+		fetch := node.NewFetchArrayElementNode(openBracket.Pos())
+		fetch.Left = invocant
+		fetch.Right = index
+		n = fetch
+	}
 
 	closeBracket := b.NextNonSpace(ctx)
 	if closeBracket.Type() != ItemCloseSquareBracket {
 		b.Unexpected(ctx, "Expected ']', got %s", closeBracket)
 	}
 
+	// Element fetches may be chained: list[0][1], list[0].name
+	switch b.PeekNonSpace(ctx).Type() {
+	case ItemOpenSquareBracket:
+		return b.ParseArrayElementFetch(ctx, n)
+	case ItemPeriod:
+		b.NextNonSpace(ctx) // consume period
+		return b.ParseMethodCallOrMapLookup(ctx, n)
+	}
+	return n
+}
+
+// ParseNegation parses the unary minus. Negative numbers become literals,
+// anything else is subtracted from 0
+func (b *Builder) ParseNegation(ctx *builderCtx) node.Node {
+	minus := b.NextNonSpace(ctx)
+	if minus.Type() != ItemMinus {
+		b.Unexpected(ctx, "Expected '-', got %s", minus)
+	}
+
+	var operand node.Node
+	switch b.PeekNonSpace(ctx).Type() {
+	case ItemOpenParen:
+		operand = b.ParseGroup(ctx)
+	case ItemMinus:
+		operand = b.ParseNegation(ctx)
+	default:
+		operand = b.ParseTerm(ctx)
+		if operand == nil {
+			b.Unexpected(ctx, "Expected term after '-', got %s", b.PeekNonSpace(ctx))
+		}
+	}
+
+	if operand.Type() == node.Int {
+		return node.NewIntNode(minus.Pos(), -operand.(*node.NumberNode).Value.Int())
+	}
+
+	n := node.NewMinusNode(minus.Pos())
+	n.Left = node.NewIntNode(minus.Pos(), 0)
+	n.Right = operand
 	return n
 }
 
@@ -546,6 +756,130 @@ func (b *Builder) ParseExpression(ctx *builderCtx, canPrint bool) (n node.Node)
 		}
 	}()
 
+	n = b.parseBinaryExpression(ctx)
+
+	// The conditional operators have the lowest precedence. // binds
+	// tighter than ?:, which is right associative:
+	// a // b ? c : d ? e : f is (a // b) ? c : (d ? e : f)
+	for b.PeekNonSpace(ctx).Type() == ItemDefinedOr {
+		next := b.NextNonSpace(ctx)
+		tmp := node.NewDefinedOrNode(next.Pos())
+		tmp.Left = n
+		tmp.Right = b.parseBinaryExpression(ctx)
+		n = tmp
+	}
+
+	if next := b.PeekNonSpace(ctx); next.Type() == ItemQuestion {
+		b.NextNonSpace(ctx)
+		tmp := node.NewTernaryNode(next.Pos(), n)
+		tmp.Then = b.ParseExpression(ctx, false)
+		if colon := b.NextNonSpace(ctx); colon.Type() != ItemColon {
+			b.Unexpected(ctx, "Expected ':', got %s", colon)
+		}
+		tmp.Else = b.ParseExpression(ctx, false)
+		n = tmp
+	}
+	return
+}
+
+// parseBinaryExpression parses an expression without the conditional
+// operators
+func (b *Builder) parseBinaryExpression(ctx *builderCtx) node.Node {
+	return b.parseBinaryOperation(ctx, 1)
+}
+
+// parseBinaryOperation parses operands joined by binary operators whose
+// precedence is at least minPrec. Operators of the same precedence are
+// left associative, so 5 - 1 - 1 is (5 - 1) - 1, and 1 + 2 == 3 is
+// (1 + 2) == 3
+func (b *Builder) parseBinaryOperation(ctx *builderCtx, minPrec int) node.Node {
+	n := b.parseOperand(ctx)
+	for {
+		next := b.NextNonSpace(ctx)
+		prec := binaryPrecedence(next)
+		if prec == 0 || prec < minPrec {
+			b.Backup(ctx)
+			return n
+		}
+
+		switch next.Type() {
+		case ItemPlus, ItemMinus, ItemTilde:
+			if end := b.PeekNonSpace(ctx); end.Type() == ItemTagEnd && adjacent(next, end) {
+				b.Backup2(ctx, next)
+				// Postchomp! not an operator!
+				return n
+			}
+		}
+
+		tmp := newBinaryNode(next)
+		tmp.Left = n
+		tmp.Right = b.parseBinaryOperation(ctx, prec+1)
+		n = tmp
+	}
+}
+
+// binaryPrecedence returns the precedence of the binary operator t, or 0
+// if t is not one. From the loosest to the tightest, the operators are
+// comparisons, concatenation (so "a" ~ 1 + 2 is "a3"), addition and
+// subtraction, and then multiplication, division and repetition
+func binaryPrecedence(t lex.LexItem) int {
+	switch t.Type() {
+	case ItemEquals, ItemNotEquals, ItemLT, ItemGT, ItemStringLT, ItemStringGT, ItemStringLE, ItemStringGE, ItemStringCmp:
+		return 1
+	case ItemTilde:
+		return 2
+	case ItemPlus, ItemMinus:
+		return 3
+	case ItemAsterisk, ItemSlash:
+		return 4
+	case ItemIdentifier:
+		// "x" is only an operator where an operator is expected, so
+		// that it can still be used as a variable name
+		if t.Value() == "x" {
+			return 4
+		}
+	}
+	return 0
+}
+
+func newBinaryNode(t lex.LexItem) *node.BinaryNode {
+	switch t.Type() {
+	case ItemPlus:
+		return node.NewPlusNode(t.Pos())
+	case ItemMinus:
+		return node.NewMinusNode(t.Pos())
+	case ItemAsterisk:
+		return node.NewMulNode(t.Pos())
+	case ItemSlash:
+		return node.NewDivNode(t.Pos())
+	case ItemEquals:
+		return node.NewEqualsNode(t.Pos())
+	case ItemNotEquals:
+		return node.NewNotEqualsNode(t.Pos())
+	case ItemLT:
+		return node.NewLTNode(t.Pos())
+	case ItemGT:
+		return node.NewGTNode(t.Pos())
+	case ItemStringLT:
+		return node.NewStringLTNode(t.Pos())
+	case ItemStringGT:
+		return node.NewStringGTNode(t.Pos())
+	case ItemStringLE:
+		return node.NewStringLENode(t.Pos())
+	case ItemStringGE:
+		return node.NewStringGENode(t.Pos())
+	case ItemStringCmp:
+		return node.NewStringCmpNode(t.Pos())
+	case ItemTilde:
+		return node.NewConcatNode(t.Pos())
+	}
+	return node.NewRepeatNode(t.Pos())
+}
+
+// parseOperand parses an operand of a binary operator: a term, a group,
+// or a list or hash literal, along with the method calls, element
+// fetches and filters applied to it
+func (b *Builder) parseOperand(ctx *builderCtx) (n node.Node) {
 	switch b.PeekNonSpace(ctx).Type() {
 	case ItemOpenParen:
 		// Looks like a group of something
@@ -553,11 +887,16 @@ func (b *Builder) ParseExpression(ctx *builderCtx, canPrint bool) (n node.Node)
 	case ItemOpenSquareBracket:
 		// Looks like an inline list def
 		n = b.ParseMakeArray(ctx)
+	case ItemOpenCurlyBracket:
+		// Looks like an inline hash def
+		n = b.ParseMakeHash(ctx)
+	case ItemMinus:
+		n = b.ParseNegation(ctx)
 	default:
 		// Otherwise it's a straight forward ... something
 		n = b.ParseTerm(ctx)
 		if n == nil {
-			panic(fmt.Sprintf("Expected term but could not parse. Next is %s\n", b.PeekNonSpace(ctx)))
+			b.Unexpected(ctx, "Expected term, got %s", b.PeekNonSpace(ctx))
 		}
 	}
 
@@ -576,69 +915,20 @@ func (b *Builder) ParseExpression(ctx *builderCtx, canPrint bool) (n node.Node)
 			// A variable followed by an open paren is a function call
 			n = b.ParseFunCall(ctx, n)
 		}
+	case node.Text, node.Group, node.MakeArray, node.MakeHash:
+		// Literals may have (virtual) methods, too: "foo".upper()
+		switch next.Type() {
+		case ItemPeriod:
+			b.NextNonSpace(ctx)
+			n = b.ParseMethodCallOrMapLookup(ctx, n)
+		case ItemOpenSquareBracket:
+			n = b.ParseArrayElementFetch(ctx, n)
+		}
 	}
 
-	next = b.NextNonSpace(ctx)
-	switch next.Type() {
-	case ItemPlus:
-		tmp := node.NewPlusNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemMinus:
-		// This is special...
-		following := b.PeekNonSpace(ctx)
-		if following.Type() == ItemTagEnd {
-			b.Backup2(ctx, next)
-			// Postchomp! not arithmetic!
-			return
-		}
-		tmp := node.NewMinusNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemAsterisk:
-		tmp := node.NewMulNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemSlash:
-		tmp := node.NewDivNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemEquals:
-		tmp := node.NewEqualsNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-	case ItemNotEquals:
-		tmp := node.NewNotEqualsNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-	case ItemLT:
-		tmp := node.NewLTNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemGT:
-		tmp := node.NewGTNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-	case ItemVerticalSlash:
-		b.Backup(ctx)
+	if b.PeekNonSpace(ctx).Type() == ItemVerticalSlash {
 		n = b.ParseFilter(ctx, n)
-	default:
-		b.Backup(ctx)
 	}
-
 	return
 }
 
@@ -655,6 +945,16 @@ func (b *Builder) ParseFilter(ctx *builderCtx, n node.Node) node.Node {
 
 	filter := node.NewFilterNode(id.Pos(), id.Value(), n)
 
+	// Filters may take arguments, as in `| date("%Y-%m-%d")`
+	if b.PeekNonSpace(ctx).Type() == ItemOpenParen {
+		b.NextNonSpace(ctx)
+		filter.Args = b.ParseList(ctx).(*node.ListNode)
+		closeParen := b.NextNonSpace(ctx)
+		if closeParen.Type() != ItemCloseParen {
+			b.Unexpected(ctx, "Expected ')', got %s", closeParen.Type())
+		}
+	}
+
 	if b.PeekNonSpace(ctx).Type() == ItemVerticalSlash {
 		filter = b.ParseFilter(ctx, filter).(*node.FilterNode)
 	}
@@ -695,25 +995,44 @@ func (b *Builder) ParseForeach(ctx *builderCtx) node.Node {
 		b.Unexpected(ctx, "Expected FOREACH, got %s", foreach)
 	}
 
-	localsym := b.NextNonSpace(ctx)
-	if localsym.Type() != ItemIdentifier {
-		b.Unexpected(ctx, "Expected identifier, got %s", localsym)
+	// FOREACH x IN list [LIMIT n] (TTerse), or
+	// for $list -> $x [limit n] { (Kolon)
+	var localsym lex.LexItem
+	var list node.Node
+	var limit int
+	if t := b.NextNonSpace(ctx); t.Type() == ItemIdentifier && b.PeekNonSpace(ctx).Type() == ItemIn {
+		localsym = t
+		b.NextNonSpace(ctx)
+		list = b.ParseListVariableOrMakeArray(ctx)
+		limit = b.ParseLoopLimit(ctx)
+	} else {
+		if t.Type() == ItemIdentifier {
+			b.Backup2(ctx, t)
+		} else {
+			b.Backup(ctx)
+		}
+		list = b.ParseExpression(ctx, false)
+		if arrow := b.NextNonSpace(ctx); arrow.Type() != ItemArrow {
+			b.Unexpected(ctx, "Expected IN or '->', got %s", arrow)
+		}
+		localsym = b.NextNonSpace(ctx)
+		if localsym.Type() != ItemIdentifier {
+			b.Unexpected(ctx, "Expected identifier, got %s", localsym)
+		}
+		limit = b.ParseLoopLimit(ctx)
+		if open := b.NextNonSpace(ctx); open.Type() != ItemOpenCurlyBracket {
+			b.Unexpected(ctx, "Expected '{', got %s", open)
+		}
 	}
 
 	forNode := node.NewForeachNode(foreach.Pos(), localsym.Value())
-	// use current frame mark
-	forNode.IndexVarIdx = ctx.CurrentFrame().Mark()
-
-	in := b.NextNonSpace(ctx)
-	if in.Type() != ItemIn {
-		b.Unexpected(ctx, "Expected IN, got %s", in)
-	}
-
-	forNode.List = b.ParseListVariableOrMakeArray(ctx)
+	forNode.List = list
+	forNode.MaxIteration = limit
 
 	ctx.CurrentParentNode().Append(forNode)
 	ctx.PushParentNode(forNode)
-	ctx.DeclareLocalVar(localsym.Value())
+	// The loop variable always lives in the slot right after the item
+	forNode.IndexVarIdx = ctx.DeclareLocalVar(localsym.Value())
 	ctx.DeclareLocalVar("loop")
 
 	return nil
@@ -728,13 +1047,95 @@ func (b *Builder) ParseWhile(ctx *builderCtx) node.Node {
 	condition := b.ParseExpression(ctx, false)
 	whileNode := node.NewWhileNode(while.Pos(), condition)
 
+	// Kolon style blocks start with a `{`
+	if b.PeekNonSpace(ctx).Type() == ItemOpenCurlyBracket {
+		b.NextNonSpace(ctx)
+	}
+
 	ctx.CurrentParentNode().Append(whileNode)
 	ctx.PushParentNode(whileNode)
-	ctx.DeclareLocalVar("loop")
+	whileNode.LoopVarIdx = ctx.DeclareLocalVar("loop")
 
 	return nil
 }
 
+// ParseLoopLimit parses the optional `LIMIT n` after FOREACH, which
+// overrides the maximum number of iterations for that loop. It returns
+// 0 if there is no LIMIT
+func (b *Builder) ParseLoopLimit(ctx *builderCtx) int {
+	if b.PeekNonSpace(ctx).Type() != ItemLimit {
+		return 0
+	}
+	b.NextNonSpace(ctx)
+
+	t := b.NextNonSpace(ctx)
+	if t.Type() != ItemNumber {
+		b.Unexpected(ctx, "Expected number after LIMIT, got %s", t)
+	}
+	n, err := strconv.Atoi(t.Value())
+	if err != nil || n <= 0 {
+		b.Unexpected(ctx, "Invalid LIMIT: %s", t.Value())
+	}
+	return n
+}
+
+// ParseLoopControl parses LAST and NEXT. They may be followed by the name
+// of the loop variable of an enclosing FOREACH, to leave or continue
+// that loop instead of the innermost one
+func (b *Builder) ParseLoopControl(ctx *builderCtx) node.Node {
+	t := b.NextNonSpace(ctx)
+	var nt node.NodeType
+	switch t.Type() {
+	case ItemLast:
+		nt = node.Last
+	case ItemNext:
+		nt = node.Next
+	default:
+		b.Unexpected(ctx, "Expected LAST or NEXT, got %s", t)
+	}
+
+	label := ""
+	if b.PeekNonSpace(ctx).Type() == ItemIdentifier {
+		label = b.NextNonSpace(ctx).Value()
+	}
+
+	if !ctx.HasEnclosingLoop(label) {
+		if label == "" {
+			b.Unexpected(ctx, "%s outside of a loop", t)
+		}
+		b.Unexpected(ctx, "%s: no enclosing loop over '%s'", t, label)
+	}
+
+	return node.NewLoopControlNode(t.Pos(), nt, label)
+}
+
+// HasEnclosingLoop returns true if we're inside a loop that LAST and NEXT
+// can jump out of. If label is not empty, the loop must be a FOREACH
+// whose loop variable is named label. Loops outside of the current
+// MACRO or WRAPPER do not count
+func (ctx *builderCtx) HasEnclosingLoop(label string) bool {
+	for i := ctx.Frames.Size() - 1; i >= 0; i-- {
+		f, _ := ctx.Frames.Get(i)
+		n := f.(*Frame).Node
+		if n == nil {
+			continue
+		}
+		switch n.Type() {
+		case node.Foreach:
+			if label == "" || n.(*node.ForeachNode).IndexVarName == label {
+				return true
+			}
+		case node.While:
+			if label == "" {
+				return true
+			}
+		case node.Root, node.Macro, node.Wrapper:
+			return false
+		}
+	}
+	return false
+}
+
 func (b *Builder) ParseRange(ctx *builderCtx) node.Node {
 	start := b.ParseTerm(ctx)
 	if start == nil {
@@ -766,12 +1167,17 @@ func (b *Builder) ParseListVariableOrMakeArray(ctx *builderCtx) node.Node {
 		} else {
 			n = node.NewFetchSymbolNode(list.Pos(), list.Value())
 		}
-		if b.PeekNonSpace(ctx).Type() == ItemPeriod {
+		switch b.PeekNonSpace(ctx).Type() {
+		case ItemPeriod:
 			b.NextNonSpace(ctx)
 			n = b.ParseMethodCallOrMapLookup(ctx, n)
+		case ItemOpenSquareBracket:
+			n = b.ParseArrayElementFetch(ctx, n)
 		}
 	case ItemOpenSquareBracket:
 		n = b.ParseMakeArray(ctx)
+	case ItemOpenCurlyBracket:
+		n = b.ParseMakeHash(ctx)
 	default:
 		panic("fuck")
 	}
@@ -794,6 +1200,54 @@ func (b *Builder) ParseMakeArray(ctx *builderCtx) node.Node {
 	return node.NewMakeArrayNode(openB.Pos(), child)
 }
 
+// ParseMakeHash parses a hash literal. Keys and values may be separated
+// by `=>`, `:` or `=`, and keys that are bare words are strings:
+//
+//   { name => "Bob", "age": 42, items = [1, 2] }
+func (b *Builder) ParseMakeHash(ctx *builderCtx) node.Node {
+	openB := b.NextNonSpace(ctx)
+	if openB.Type() != ItemOpenCurlyBracket {
+		b.Unexpected(ctx, "Expected '{', got %s", openB.Value())
+	}
+
+	child := node.NewListNode(openB.Pos())
+	for b.PeekNonSpace(ctx).Type() != ItemCloseCurlyBracket {
+		var key node.Node
+		if t := b.NextNonSpace(ctx); t.Type() != ItemIdentifier {
+			b.Backup(ctx)
+			key = b.ParseExpression(ctx, false)
+		} else if isHashSeparator(b.PeekNonSpace(ctx).Type()) {
+			key = node.NewTextNode(t.Pos(), t.Value())
+		} else {
+			b.Backup2(ctx, t)
+			key = b.ParseExpression(ctx, false)
+		}
+
+		if sep := b.NextNonSpace(ctx); !isHashSeparator(sep.Type()) {
+			b.Unexpected(ctx, "Expected '=>' or ':', got %s", sep)
+		}
+
+		child.Append(key)
+		child.Append(b.ParseExpression(ctx, false))
+
+		if b.PeekNonSpace(ctx).Type() != ItemComma {
+			break
+		}
+		b.NextNonSpace(ctx)
+	}
+
+	closeB := b.NextNonSpace(ctx)
+	if closeB.Type() != ItemCloseCurlyBracket {
+		b.Unexpected(ctx, "Expected '}', got %s", closeB.Value())
+	}
+
+	return node.NewMakeHashNode(openB.Pos(), child)
+}
+
+func isHashSeparator(t lex.ItemType) bool {
+	return t == ItemFatComma || t == ItemColon || t == ItemAssign
+}
+
 func (b *Builder) ParseList(ctx *builderCtx) node.Node {
 	n := node.NewListNode(b.PeekNonSpace(ctx).Pos())
 OUTER:
@@ -801,7 +1255,7 @@ OUTER:
 		// At the beginning of this loop, we must see an
 		// identifier or a literal
 		switch item := b.PeekNonSpace(ctx); item.Type() {
-		case ItemIdentifier, ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString:
+		case ItemIdentifier, ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString, ItemArrow, ItemOpenSquareBracket, ItemOpenCurlyBracket, ItemMinus:
 			// okay, proceed
 		default:
 			break OUTER
@@ -853,6 +1307,11 @@ func (b *Builder) ParseIf(ctx *builderCtx) node.Node {
 		}
 	}
 
+	// Kolon style blocks start with a `{`
+	if b.PeekNonSpace(ctx).Type() == ItemOpenCurlyBracket {
+		b.NextNonSpace(ctx)
+	}
+
 	ctx.CurrentParentNode().Append(ifNode)
 	ctx.PushParentNode(ifNode)
 
@@ -878,6 +1337,42 @@ func (b *Builder) ParseElse(ctx *builderCtx) node.Node {
 	return nil
 }
 
+// ParseTry parses the beginning of a TRY block. Errors raised while
+// running the block are caught, and run the CATCH block instead
+func (b *Builder) ParseTry(ctx *builderCtx) node.Node {
+	tryToken := b.NextNonSpace(ctx)
+	if tryToken.Type() != ItemTry {
+		b.Unexpected(ctx, "Expected try, got %s", tryToken)
+	}
+
+	tryNode := node.NewTryNode(tryToken.Pos())
+	ctx.CurrentParentNode().Append(tryNode)
+	ctx.PushParentNode(tryNode)
+
+	return nil
+}
+
+func (b *Builder) ParseCatch(ctx *builderCtx) node.Node {
+	catchToken := b.NextNonSpace(ctx)
+	if catchToken.Type() != ItemCatch {
+		b.Unexpected(ctx, "Expected catch, got %s", catchToken)
+	}
+
+	// CurrentParentNode must be "Try" in order for "catch" to work
+	if ctx.CurrentParentNode().Type() != node.Try {
+		b.Unexpected(ctx, "Found catch without try")
+	}
+
+	catchNode := node.NewCatchNode(catchToken.Pos())
+	ctx.CurrentParentNode().Append(catchNode)
+	ctx.PushParentNode(catchNode)
+	// The error is local to the CATCH block, so that it doesn't replace
+	// a template variable named "error"
+	catchNode.ErrorVarIdx = ctx.DeclareLocalVar("error")
+
+	return nil
+}
+
 func (b *Builder) ParseInclude(ctx *builderCtx) node.Node {
 	incToken := b.NextNonSpace(ctx)
 	if incToken.Type() != ItemInclude {
@@ -895,6 +1390,11 @@ func (b *Builder) ParseInclude(ctx *builderCtx) node.Node {
 	}
 
 	b.NextNonSpace(ctx)
+	if b.PeekNonSpace(ctx).Type() == ItemOpenCurlyBracket {
+		x.Vars = b.ParseMakeHash(ctx)
+		ctx.PopFrame()
+		return x
+	}
 	for {
 		a := b.ParseAssignment(ctx)
 		x.AppendAssignment(a)
@@ -958,8 +1458,10 @@ func (b *Builder) ParseMacro(ctx *builderCtx) node.Node {
 				break
 			}
 
-			//      idx := ctx.DeclareLocalVar(next.Value())
-			//      macro.AppendArg(node.NewLocalVarNode(next.Pos(), next.Value(), idx))
+			// The arguments are passed as template variables, which
+			// hide local variables of the same name
+			macro.AppendArg(next.Value())
+			ctx.CurrentFrame().LvarNames[next.Value()] = templateVar
 
 			next = b.NextNonSpace(ctx)
 			if next.Type() != ItemComma {
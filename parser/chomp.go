@@ -0,0 +1,106 @@
+package parser
+
+import (
+	"strings"
+
+	"github.com/lestrrat/go-lex"
+	"github.com/pkg/errors"
+)
+
+const whiteSpace = " \t\r\n"
+
+// ParseChompMode converts the textual representation of a ChompMode
+// ("none", "one", "collapse", "greedy", optionally prefixed with "chomp_"
+// as in Template-Toolkit) to a ChompMode
+func ParseChompMode(s string) (ChompMode, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), "chomp_") {
+	case "none":
+		return ChompNone, nil
+	case "one", "all":
+		return ChompOne, nil
+	case "collapse":
+		return ChompCollapse, nil
+	case "greedy":
+		return ChompGreedy, nil
+	}
+	return ChompNone, errors.New("unknown chomp mode '" + s + "'")
+}
+
+// String returns the textual representation of a ChompMode
+func (m ChompMode) String() string {
+	switch m {
+	case ChompNone:
+		return "none"
+	case ChompOne:
+		return "one"
+	case ChompCollapse:
+		return "collapse"
+	case ChompGreedy:
+		return "greedy"
+	}
+	return "unknown"
+}
+
+// chompModifier returns the ChompMode requested by a per-tag whitespace
+// modifier, such as the '-' in "[%- foo -%]".
+//
+// '-' and '~' remove all whitespace (in Text::Xslate, '-' has always been
+// greedy, unlike Template-Toolkit's CHOMP_ONE), '=' collapses whitespace
+// into a single space, and '+' disables chomping for that side of the tag
+func chompModifier(t lex.ItemType) (ChompMode, bool) {
+	switch t {
+	case ItemMinus, ItemTilde:
+		return ChompGreedy, true
+	case ItemAssign:
+		return ChompCollapse, true
+	case ItemPlus:
+		return ChompNone, true
+	}
+	return ChompNone, false
+}
+
+// chompRight applies ChompMode m to the end of s. This is what happens to
+// raw text that precedes a tag
+func chompRight(s string, m ChompMode) string {
+	switch m {
+	case ChompOne:
+		trimmed := strings.TrimRight(s, " \t")
+		switch {
+		case strings.HasSuffix(trimmed, "\r\n"):
+			return trimmed[:len(trimmed)-2]
+		case strings.HasSuffix(trimmed, "\n"):
+			return trimmed[:len(trimmed)-1]
+		case trimmed == "":
+			return trimmed
+		}
+	case ChompCollapse:
+		if trimmed := strings.TrimRight(s, whiteSpace); len(trimmed) < len(s) {
+			return trimmed + " "
+		}
+	case ChompGreedy:
+		return strings.TrimRight(s, whiteSpace)
+	}
+	return s
+}
+
+// chompLeft applies ChompMode m to the beginning of s. This is what happens
+// to raw text that follows a tag
+func chompLeft(s string, m ChompMode) string {
+	switch m {
+	case ChompOne:
+		trimmed := strings.TrimLeft(s, " \t")
+		switch {
+		case strings.HasPrefix(trimmed, "\r\n"):
+			return trimmed[2:]
+		case strings.HasPrefix(trimmed, "\n"):
+			return trimmed[1:]
+		}
+	case ChompCollapse:
+		if trimmed := strings.TrimLeft(s, whiteSpace); len(trimmed) < len(s) {
+			return " " + trimmed
+		}
+	case ChompGreedy:
+		return strings.TrimLeft(s, whiteSpace)
+	}
+	return s
+}
@@ -20,6 +20,7 @@ const (
 	ItemSpace
 	ItemTagStart
 	ItemTagEnd
+	ItemLineStart
 	ItemSymbol
 	ItemIdentifier
 	ItemDoubleQuotedString
@@ -31,6 +32,8 @@ const (
 	ItemCloseParen         // ')'
 	ItemOpenSquareBracket  // '['
 	ItemCloseSquareBracket // ']'
+	ItemOpenCurlyBracket   // '{'
+	ItemCloseCurlyBracket  // '}'
 	ItemPeriod             // '.'
 	ItemKeyword            // Delimiter
 	ItemCall               // CALL
@@ -40,6 +43,9 @@ const (
 	ItemBlock              // BLOCK
 	ItemForeach            // FOREACH
 	ItemWhile              // WHILE
+	ItemLast               // LAST
+	ItemNext               // NEXT
+	ItemLimit              // LIMIT
 	ItemIn                 // IN
 	ItemInclude            // INCLUDE
 	ItemWith               // WITH
@@ -71,6 +77,7 @@ const (
 	ItemAnd                // &&
 	ItemOr                 // ||
 	ItemFatComma           // =>
+	ItemArrow              // ->
 	ItemIncr               // ++
 	ItemDecr               // --
 	ItemPlus
@@ -79,7 +86,18 @@ const (
 	ItemSlash
 	ItemVerticalSlash
 	ItemMod
-	ItemAssign // =
+	ItemTilde     // ~
+	ItemAssign    // =
+	ItemColon     // :
+	ItemQuestion  // ?
+	ItemDefinedOr // //
+	ItemStringLT  // lt
+	ItemStringGT  // gt
+	ItemStringLE  // le
+	ItemStringGE  // ge
+	ItemStringCmp // cmp
+	ItemTry       // TRY
+	ItemCatch     // CATCH
 
 	DefaultItemTypeMax
 )
@@ -91,9 +109,35 @@ type AST struct {
 	Root      *node.ListNode // root of the tree
 	Timestamp time.Time      // last-modified date of this template
 	text      string
+	lines     []linePos
 }
 
+// linePos records that the token at Pos starts on Line
+type linePos struct {
+	Pos  int
+	Line int
+}
+
+// ChompMode specifies how whitespace surrounding a tag is removed
+type ChompMode int
+
+// These Chomp... constants are the available ChompModes. They mirror
+// Template-Toolkit's CHOMP_NONE, CHOMP_ONE, CHOMP_COLLAPSE and CHOMP_GREEDY
+const (
+	ChompNone     ChompMode = iota // leave whitespace alone
+	ChompOne                       // remove spaces and tabs up to (and including) one newline
+	ChompCollapse                  // collapse all whitespace into a single space
+	ChompGreedy                    // remove all whitespace, including newlines
+)
+
+// Builder takes the tokens generated by a Lexer and creates an AST
 type Builder struct {
+	// PreChomp is applied to the raw text right before each tag
+	PreChomp ChompMode
+	// PostChomp is applied to the raw text right after each tag
+	PostChomp ChompMode
+	// Trim removes leading and trailing whitespace from the template
+	Trim bool
 }
 
 // Frame is the frame struct used during parsing, which has a bit of
@@ -109,9 +153,16 @@ type Frame struct {
 
 type Lexer struct {
 	lex.Lexer
-	tagStart string
-	tagEnd   string
-	symbols  *LexSymbolSet
+	tagStart  string
+	tagEnd    string
+	lineStart string
+	symbols   *LexSymbolSet
+
+	// atLineStart is true when the next character to be read is at the
+	// beginning of a line, and inLine is true while we are lexing a
+	// line statement (i.e. a line starting with lineStart)
+	atLineStart bool
+	inLine      bool
 }
 
 // LexSymbol holds the pre-defined symbols to be lexed
@@ -14,10 +14,29 @@ var SymbolSet = parser.DefaultSymbolSet.Copy()
 
 func init() {
 	SymbolSet.Set("$", ItemDollar)
+	SymbolSet.Set("if", parser.ItemIf)
+	SymbolSet.Set("for", parser.ItemForeach)
+	SymbolSet.Set("while", parser.ItemWhile)
+	SymbolSet.Set("last", parser.ItemLast)
+	SymbolSet.Set("next", parser.ItemNext)
+	SymbolSet.Set("limit", parser.ItemLimit)
 }
 
 // Kolonish is the main parser for Kolonish
-type Kolonish struct{}
+type Kolonish struct {
+	// PreChomp, PostChomp and Trim control the whitespace surrounding
+	// tags. See parser.Builder for details
+	PreChomp  parser.ChompMode
+	PostChomp parser.ChompMode
+	Trim      bool
+
+	// TagStart and TagEnd override the default tag delimiters, and
+	// LineStart enables line statements (lines beginning with LineStart
+	// are treated as a directive). Empty strings mean "use the default"
+	TagStart  string
+	TagEnd    string
+	LineStart string
+}
 
 // NewStringLexer creates a new lexer
 func NewStringLexer(template string) *parser.Lexer {
@@ -50,6 +69,25 @@ func NewLexer(template string) *parser.Lexer {
 	return l
 }
 
+func (p *Kolonish) newBuilder() *parser.Builder {
+	b := parser.NewBuilder()
+	b.PreChomp = p.PreChomp
+	b.PostChomp = p.PostChomp
+	b.Trim = p.Trim
+	return b
+}
+
+func (p *Kolonish) configureLexer(l *parser.Lexer) *parser.Lexer {
+	if p.TagStart != "" {
+		l.SetTagStart(p.TagStart)
+	}
+	if p.TagEnd != "" {
+		l.SetTagEnd(p.TagEnd)
+	}
+	l.SetLineStart(p.LineStart)
+	return l
+}
+
 // Parse parses the given template and creates an AST
 func (p *Kolonish) Parse(name string, template []byte) (*parser.AST, error) {
 	return p.ParseString(name, string(template))
@@ -57,14 +95,14 @@ func (p *Kolonish) Parse(name string, template []byte) (*parser.AST, error) {
 
 // ParseString is the same as Parse, but receives a string instead of []byte
 func (p *Kolonish) ParseString(name, template string) (*parser.AST, error) {
-	b := parser.NewBuilder()
-	lex := NewStringLexer(template)
-	return b.Parse(name, lex)
+	b := p.newBuilder()
+	lex := p.configureLexer(NewStringLexer(template))
+	return b.Parse(name, newSigilLexer(lex))
 }
 
 // ParseReader gets the template content from an io.Reader type
 func (p *Kolonish) ParseReader(name string, rdr io.Reader) (*parser.AST, error) {
-	b := parser.NewBuilder()
-	lex := NewReaderLexer(rdr)
-	return b.Parse(name, lex)
+	b := p.newBuilder()
+	lex := p.configureLexer(NewReaderLexer(rdr))
+	return b.Parse(name, newSigilLexer(lex))
 }
@@ -0,0 +1,69 @@
+package kolonish
+
+import (
+	"unicode"
+
+	"github.com/lestrrat/go-lex"
+	"github.com/lestrrat/go-xslate/parser"
+)
+
+// sigilLexer wraps a parser.Lexer so that variables with the `$` sigil
+// (e.g. `$foo`) are handed to the builder as plain identifiers. Keywords
+// used as variable or field names, as in `$next` or `$item.last`, are
+// identifiers as well
+type sigilLexer struct {
+	*parser.Lexer
+	pending    lex.LexItem
+	hasPending bool
+	prev       lex.ItemType
+}
+
+func newSigilLexer(l *parser.Lexer) *sigilLexer {
+	return &sigilLexer{Lexer: l}
+}
+
+func (l *sigilLexer) NextItem() lex.LexItem {
+	i := l.nextItem()
+	l.prev = i.Type()
+	return i
+}
+
+func (l *sigilLexer) nextItem() lex.LexItem {
+	if l.hasPending {
+		l.hasPending = false
+		return l.pending
+	}
+
+	i := l.Lexer.NextItem()
+	if i.Type() != ItemDollar {
+		if l.prev == parser.ItemPeriod && isKeyword(i) {
+			return lex.NewItem(parser.ItemIdentifier, i.Pos(), i.Line(), i.Value())
+		}
+		return i
+	}
+
+	next := l.Lexer.NextItem()
+	if next.Type() != parser.ItemIdentifier && !isKeyword(next) {
+		l.pending = next
+		l.hasPending = true
+		return i
+	}
+	return lex.NewItem(parser.ItemIdentifier, i.Pos(), i.Line(), next.Value())
+}
+
+// isKeyword returns true if i is a word symbol, such as `for`
+func isKeyword(i lex.LexItem) bool {
+	if i.Type() == parser.ItemIdentifier {
+		return false
+	}
+	v := i.Value()
+	if v == "" {
+		return false
+	}
+	for j, r := range v {
+		if !(r == '_' || unicode.IsLetter(r) || (j > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return true
+}
@@ -32,6 +32,7 @@ func init() {
 	lex.TypeNames[ItemIdentifier] = "Identifier"
 	lex.TypeNames[ItemTagStart] = "TagStart"
 	lex.TypeNames[ItemTagEnd] = "TagEnd"
+	lex.TypeNames[ItemLineStart] = "LineStart"
 	lex.TypeNames[ItemBool] = "Bool"
 	lex.TypeNames[ItemField] = "Field"
 	lex.TypeNames[ItemSet] = "Set"
@@ -43,6 +44,9 @@ func init() {
 	lex.TypeNames[ItemAssign] = "Assign"
 	lex.TypeNames[ItemOpenSquareBracket] = "OpenSquareBracket"
 	lex.TypeNames[ItemCloseSquareBracket] = "CloseSquareBracket"
+	lex.TypeNames[ItemOpenCurlyBracket] = "OpenCurlyBracket"
+	lex.TypeNames[ItemCloseCurlyBracket] = "CloseCurlyBracket"
+	lex.TypeNames[ItemArrow] = "Arrow"
 	lex.TypeNames[ItemWrapper] = "Wrapper"
 	lex.TypeNames[ItemComma] = "Comma"
 	lex.TypeNames[ItemOpenParen] = "OpenParen"
@@ -57,6 +61,9 @@ func init() {
 	lex.TypeNames[ItemWith] = "With"
 	lex.TypeNames[ItemForeach] = "Foreach"
 	lex.TypeNames[ItemWhile] = "While"
+	lex.TypeNames[ItemLast] = "Last"
+	lex.TypeNames[ItemNext] = "Next"
+	lex.TypeNames[ItemLimit] = "Limit"
 	lex.TypeNames[ItemIn] = "In"
 	lex.TypeNames[ItemInclude] = "Include"
 	lex.TypeNames[ItemIf] = "If"
@@ -86,9 +93,20 @@ func init() {
 	lex.TypeNames[ItemAnd] = "And"
 	lex.TypeNames[ItemOr] = "Or"
 	lex.TypeNames[ItemFatComma] = "FatComma"
+	lex.TypeNames[ItemColon] = "Colon"
+	lex.TypeNames[ItemQuestion] = "Question"
+	lex.TypeNames[ItemDefinedOr] = "DefinedOr"
+	lex.TypeNames[ItemStringLT] = "StringLessThan"
+	lex.TypeNames[ItemStringGT] = "StringGreaterThan"
+	lex.TypeNames[ItemStringLE] = "StringLessThanEquals"
+	lex.TypeNames[ItemStringGE] = "StringGreaterThanEquals"
+	lex.TypeNames[ItemStringCmp] = "StringCompare"
+	lex.TypeNames[ItemTry] = "Try"
+	lex.TypeNames[ItemCatch] = "Catch"
 	lex.TypeNames[ItemIncr] = "Incr"
 	lex.TypeNames[ItemDecr] = "Decr"
 	lex.TypeNames[ItemMod] = "Mod"
+	lex.TypeNames[ItemTilde] = "Tilde"
 	lex.TypeNames[ItemEnd] = "End"
 }
 
@@ -100,6 +118,14 @@ func (l *Lexer) SetTagEnd(s string) {
 	l.tagEnd = s
 }
 
+// SetLineStart sets the prefix that marks a line statement. A line whose
+// first non-blank characters are this prefix is treated as a directive
+// that ends at the end of the line. An empty string disables line
+// statements
+func (l *Lexer) SetLineStart(s string) {
+	l.lineStart = s
+}
+
 func isSpace(r rune) bool {
 	return r == ' ' || r == '\t'
 }
@@ -122,10 +148,9 @@ func isNumeric(r rune) bool {
 
 func NewStringLexer(template string, ss *LexSymbolSet) *Lexer {
 	l := &Lexer{
-		nil,
-		"",
-		"",
-		ss,
+		Lexer:       nil,
+		symbols:     ss,
+		atLineStart: true,
 	}
 	l.Lexer = lex.NewStringLexer(template, l.lexRawString)
 	return l
@@ -133,10 +158,9 @@ func NewStringLexer(template string, ss *LexSymbolSet) *Lexer {
 
 func NewReaderLexer(rdr io.Reader, ss *LexSymbolSet) *Lexer {
 	l := &Lexer{
-		nil,
-		"",
-		"",
-		ss,
+		Lexer:       nil,
+		symbols:     ss,
+		atLineStart: true,
 	}
 	l.Lexer = lex.NewReaderLexer(rdr, l.lexRawString)
 	return l
@@ -144,15 +168,31 @@ func NewReaderLexer(rdr io.Reader, ss *LexSymbolSet) *Lexer {
 
 func (sl *Lexer) lexRawString(l lex.Lexer) lex.LexFn {
 	for {
+		if sl.atLineStart && sl.lineStart != "" {
+			// Indentation before the line statement prefix is allowed.
+			// It stays in the raw string, and is stripped by the parser
+			for isSpace(sl.Peek()) {
+				sl.Next()
+			}
+			if sl.PeekString(sl.lineStart) {
+				if len(l.BufferString()) > 0 {
+					sl.Emit(ItemRawString)
+				}
+				return sl.lexLineStart
+			}
+		}
+
 		if sl.PeekString(sl.tagStart) {
 			if len(l.BufferString()) > 0 {
 				sl.Emit(ItemRawString)
 			}
 			return sl.lexTagStart
 		}
-		if sl.Next() == lex.EOF {
+		r := sl.Next()
+		if r == lex.EOF {
 			break
 		}
+		sl.atLineStart = r == '\n'
 	}
 
 	if len(sl.BufferString()) > 0 {
@@ -195,9 +235,40 @@ func (sl *Lexer) lexTagEnd(l lex.Lexer) lex.LexFn {
 		sl.EmitErrorf("Expected tag end (%s)", sl.tagEnd)
 	}
 	sl.Emit(ItemTagEnd)
+	sl.atLineStart = false
+	return sl.lexRawString
+}
+
+func (sl *Lexer) lexLineStart(l lex.Lexer) lex.LexFn {
+	if !sl.AcceptString(sl.lineStart) {
+		sl.EmitErrorf("Expected line start (%s)", sl.lineStart)
+	}
+	sl.Emit(ItemLineStart)
+	sl.atLineStart = false
+	sl.inLine = true
+	return sl.lexInsideTag
+}
+
+// lexLineEnd ends a line statement. The newline is consumed as part of
+// the statement, so that it does not appear in the output
+func (sl *Lexer) lexLineEnd(l lex.Lexer) lex.LexFn {
+	if !sl.AcceptString("\r\n") {
+		sl.AcceptString("\n")
+	}
+	sl.Emit(ItemTagEnd)
+	sl.atLineStart = true
+	sl.inLine = false
 	return sl.lexRawString
 }
 
+func (sl *Lexer) atLineEnd() bool {
+	if !sl.inLine {
+		return false
+	}
+	r := sl.Peek()
+	return r == lex.EOF || isEndOfLine(r)
+}
+
 func (sl *Lexer) lexIdentifier(l lex.Lexer) lex.LexFn {
 Loop:
 	for {
@@ -210,7 +281,7 @@ Loop:
 				return sl.EmitErrorf("bad character %#U", r)
 			}
 
-			if sym := sl.symbols.Get(word); sym.Type > ItemKeyword {
+			if sym, ok := sl.symbols.Map[word]; ok {
 				sl.Emit(sym.Type)
 			} else {
 				switch {
@@ -228,6 +299,12 @@ Loop:
 	return sl.lexInsideTag
 }
 
+// isWordSymbol returns true if the symbol looks like an identifier
+func isWordSymbol(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return r == '_' || unicode.IsLetter(r)
+}
+
 func (l *Lexer) atTerminator() bool {
 	r := l.Peek()
 	if isSpace(r) || isEndOfLine(r) {
@@ -258,7 +335,7 @@ func (sl *Lexer) lexRange(l lex.Lexer) lex.LexFn {
 	if isNumeric(sl.Peek()) {
 		return sl.lexInteger
 	}
-	return sl.lexIdentifier
+	return sl.lexInsideTag
 }
 
 func (sl *Lexer) lexInteger(l lex.Lexer) lex.LexFn {
@@ -331,7 +408,11 @@ func (l *Lexer) scanNumber() bool {
 
 func (sl *Lexer) lexComment(l lex.Lexer) lex.LexFn {
 	for {
-		if sl.PeekString(sl.tagEnd) {
+		if sl.atLineEnd() {
+			sl.Emit(ItemComment)
+			return sl.lexLineEnd
+		}
+		if !sl.inLine && sl.PeekString(sl.tagEnd) {
 			sl.Emit(ItemComment)
 			return sl.lexTagEnd
 		}
@@ -342,9 +423,15 @@ func (sl *Lexer) lexComment(l lex.Lexer) lex.LexFn {
 	}
 }
 
+// lexQuotedString lexes a string up to the closing quote. Strings may not
+// span the end of the tag, or the end of the line in a line statement
 func (sl *Lexer) lexQuotedString(l lex.Lexer, quote rune, t lex.ItemType) lex.LexFn {
 	for {
-		if sl.PeekString(sl.tagEnd) {
+		if sl.inLine {
+			if sl.atLineEnd() {
+				return sl.EmitErrorf("unexpected end of quoted string")
+			}
+		} else if sl.PeekString(sl.tagEnd) {
 			return sl.EmitErrorf("unexpected end of quoted string")
 		}
 
@@ -375,12 +462,21 @@ func (sl *Lexer) lexInsideTag(l lex.Lexer) lex.LexFn {
 	guard := lex.Mark("lexInsideTag")
 	defer guard()
 
+	if sl.atLineEnd() {
+		return sl.lexLineEnd
+	}
+
 	if sl.PeekString(sl.tagEnd) {
 		return sl.lexTagEnd
 	}
 
-	// Find registered symbols
+	// Find registered symbols. Symbols that are words (e.g. "eq", "IN")
+	// are handled in lexIdentifier, so that identifiers such as "neg" or
+	// "INDEX" are not mistaken for symbols followed by an identifier
 	for _, sym := range sl.getSortedSymbols() {
+		if isWordSymbol(sym.Name) {
+			continue
+		}
 		if sl.AcceptString(sym.Name) {
 			sl.Emit(sym.Type)
 			return sl.lexInsideTag
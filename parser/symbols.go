@@ -14,6 +14,11 @@ func init() {
 	DefaultSymbolSet.Set("eq", ItemEquals, 0.0)
 	DefaultSymbolSet.Set("!=", ItemNotEquals, 1.0)
 	DefaultSymbolSet.Set("ne", ItemNotEquals, 0.0)
+	DefaultSymbolSet.Set("lt", ItemStringLT, 0.0)
+	DefaultSymbolSet.Set("gt", ItemStringGT, 0.0)
+	DefaultSymbolSet.Set("le", ItemStringLE, 0.0)
+	DefaultSymbolSet.Set("ge", ItemStringGE, 0.0)
+	DefaultSymbolSet.Set("cmp", ItemStringCmp, 0.0)
 	DefaultSymbolSet.Set("+=", ItemAssignAdd, 1.0)
 	DefaultSymbolSet.Set("-=", ItemAssignSub, 1.0)
 	DefaultSymbolSet.Set("*=", ItemAssignMul, 1.0)
@@ -33,6 +38,14 @@ func init() {
 	DefaultSymbolSet.Set("-", ItemMinus, 0.0)
 	DefaultSymbolSet.Set("*", ItemAsterisk, 0.0)
 	DefaultSymbolSet.Set("/", ItemSlash, 0.0)
+	DefaultSymbolSet.Set("~", ItemTilde, 0.0)
+	DefaultSymbolSet.Set("{", ItemOpenCurlyBracket, 0.0)
+	DefaultSymbolSet.Set("}", ItemCloseCurlyBracket, 0.0)
+	DefaultSymbolSet.Set("->", ItemArrow, 1.0)
+	DefaultSymbolSet.Set("=>", ItemFatComma, 1.0)
+	DefaultSymbolSet.Set(":", ItemColon, 0.0)
+	DefaultSymbolSet.Set("?", ItemQuestion, 0.0)
+	DefaultSymbolSet.Set("//", ItemDefinedOr, 1.0)
 }
 
 // Sort returns a sorted list of LexSymbols, sorted by Priority
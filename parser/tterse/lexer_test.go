@@ -274,3 +274,21 @@ func TestBareQuotedString(t *testing.T) {
 	}
 	compareLex(t, expected, l)
 }
+
+func TestLexIdentifierWithSymbolPrefix(t *testing.T) {
+	tmpl := `[% neg ne INDEX %]`
+	l := lexit(tmpl)
+
+	expected := []lex.LexItem{
+		tagStart,
+		space,
+		makeItem(parser.ItemIdentifier, 0, 1, "neg"),
+		space,
+		makeItem(parser.ItemNotEquals, 0, 1, "ne"),
+		space,
+		makeItem(parser.ItemIdentifier, 0, 1, "INDEX"),
+		space,
+		tagEnd,
+	}
+	compareLex(t, expected, l)
+}
@@ -24,13 +24,32 @@ func init() {
 	SymbolSet.Set("UNLESS", parser.ItemUnless)
 	SymbolSet.Set("FOREACH", parser.ItemForeach)
 	SymbolSet.Set("WHILE", parser.ItemWhile)
+	SymbolSet.Set("LAST", parser.ItemLast)
+	SymbolSet.Set("NEXT", parser.ItemNext)
+	SymbolSet.Set("LIMIT", parser.ItemLimit)
+	SymbolSet.Set("DEFAULT", parser.ItemDefault)
 	SymbolSet.Set("MACRO", parser.ItemMacro)
 	SymbolSet.Set("BLOCK", parser.ItemBlock)
+	SymbolSet.Set("TRY", parser.ItemTry)
+	SymbolSet.Set("CATCH", parser.ItemCatch)
 	SymbolSet.Set("END", parser.ItemEnd)
 }
 
 // TTerse is the main parser for TTerse
-type TTerse struct{}
+type TTerse struct {
+	// PreChomp, PostChomp and Trim control the whitespace surrounding
+	// tags. See parser.Builder for details
+	PreChomp  parser.ChompMode
+	PostChomp parser.ChompMode
+	Trim      bool
+
+	// TagStart and TagEnd override the default tag delimiters, and
+	// LineStart enables line statements (lines beginning with LineStart
+	// are treated as a directive). Empty strings mean "use the default"
+	TagStart  string
+	TagEnd    string
+	LineStart string
+}
 
 // NewStringLexer creates a new lexer
 func NewStringLexer(template string) *parser.Lexer {
@@ -55,6 +74,25 @@ func New() *TTerse {
 	return &TTerse{}
 }
 
+func (p *TTerse) newBuilder() *parser.Builder {
+	b := parser.NewBuilder()
+	b.PreChomp = p.PreChomp
+	b.PostChomp = p.PostChomp
+	b.Trim = p.Trim
+	return b
+}
+
+func (p *TTerse) configureLexer(l *parser.Lexer) *parser.Lexer {
+	if p.TagStart != "" {
+		l.SetTagStart(p.TagStart)
+	}
+	if p.TagEnd != "" {
+		l.SetTagEnd(p.TagEnd)
+	}
+	l.SetLineStart(p.LineStart)
+	return l
+}
+
 // Parse parses the given template and creates an AST
 func (p *TTerse) Parse(name string, template []byte) (*parser.AST, error) {
 	return p.ParseString(name, string(template))
@@ -62,14 +100,14 @@ func (p *TTerse) Parse(name string, template []byte) (*parser.AST, error) {
 
 // ParseString is the same as Parse, but receives a string instead of []byte
 func (p *TTerse) ParseString(name, template string) (*parser.AST, error) {
-	b := parser.NewBuilder()
-	lex := NewStringLexer(template)
+	b := p.newBuilder()
+	lex := p.configureLexer(NewStringLexer(template))
 	return b.Parse(name, lex)
 }
 
 // ParseReader gets the template content from an io.Reader type
 func (p *TTerse) ParseReader(name string, rdr io.Reader) (*parser.AST, error) {
-	b := parser.NewBuilder()
-	lex := NewReaderLexer(rdr)
+	b := p.newBuilder()
+	lex := p.configureLexer(NewReaderLexer(rdr))
 	return b.Parse(name, lex)
 }
@@ -2,11 +2,19 @@ package xslate
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/lestrrat/go-xslate/parser"
+	"github.com/lestrrat/go-xslate/vm"
 )
 
 func TestTTerse_SimpleString(t *testing.T) {
@@ -17,6 +25,115 @@ func TestTTerse_SimpleString(t *testing.T) {
 	c.renderStringAndCompare(`[% "Hello, World!" -%]    `, nil, `Hello, World!`)
 }
 
+func TestTTerse_ChompModifiers(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+	c.renderStringAndCompare("a \n  [%~ \"b\" ~%]  \n c", nil, `abc`)
+	c.renderStringAndCompare("a \n  [%= \"b\" =%]  \n c", nil, `a b c`)
+	c.renderStringAndCompare("a\n[%+ \"b\" +%]\nc", nil, "a\nb\nc")
+
+	// '~', '+' and '-' right before the tag end are modifiers, not operators
+	vars := Vars{"a": "A", "n": 1}
+	c.renderStringAndCompare("[% a ~%]\n  b", vars, `Ab`)
+	c.renderStringAndCompare("[% a ~ \"!\" ~%]\n  b", vars, `A!b`)
+	c.renderStringAndCompare("[% n + 1 +%]\n[% n - 1 -%]\n", vars, "2\n0")
+
+	// ...but they must be attached to it, and are operators otherwise
+	tx := c.CreateTx()
+	for _, template := range []string{`[% a ~ %]`, `[% a + %]`, `[% a - %]`, `[% IF n %][% END - %]`} {
+		if _, err := tx.RenderString(template, vars); err == nil {
+			t.Errorf("Expected '%s' to fail to parse", template)
+		}
+	}
+}
+
+func TestTTerse_GlobalChomp(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	template := "<ul>\n  [% FOREACH i IN list %]\n  <li>[% i %]</li>\n  [% END %]\n</ul>\n"
+	vars := Vars{"list": []int{1, 2}}
+
+	pargs := c.XslateArgs["Parser"].(Args)
+	pargs["PreChomp"] = parser.ChompOne
+	c.renderStringAndCompare(template, vars, "<ul>\n  <li>1</li>\n  <li>2</li>\n</ul>\n")
+
+	pargs["PreChomp"] = "collapse"
+	pargs["PostChomp"] = "collapse"
+	c.renderStringAndCompare(template, vars, "<ul>  <li>1</li>  <li>2</li>  </ul>\n")
+
+	pargs["PreChomp"] = "greedy"
+	pargs["PostChomp"] = int(parser.ChompGreedy)
+	c.renderStringAndCompare(template, vars, "<ul><li>1</li><li>2</li></ul>\n")
+
+	// '+' disables the global setting for that side of the tag
+	c.renderStringAndCompare("a\n[%+ \"b\" %]\nc", nil, "a\nbc")
+
+	pargs["PreChomp"] = "bogus"
+	if _, err := New(c.XslateArgs); err == nil {
+		t.Errorf("Expected an error for an invalid PreChomp value")
+	}
+}
+
+func TestTTerse_Trim(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.XslateArgs["Parser"].(Args)["Trim"] = true
+	c.renderStringAndCompare("\n\n  Hello, [% name %]!\n\n", Vars{"name": "Bob"}, `Hello, Bob!`)
+	c.renderStringAndCompare("  [% name %]  ", Vars{"name": "Bob"}, `Bob`)
+
+	c.XslateArgs["Parser"].(Args)["Trim"] = "yes"
+	if _, err := New(c.XslateArgs); err == nil {
+		t.Errorf("Expected an error for an invalid Trim value")
+	}
+}
+
+func TestTTerse_CustomDelimiters(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	pargs := c.XslateArgs["Parser"].(Args)
+	pargs["TagStart"] = "{{"
+	pargs["TagEnd"] = "}}"
+	c.renderStringAndCompare(`[% name %] is {{ name }}`, Vars{"name": "Bob"}, `[% name %] is Bob`)
+	c.renderStringAndCompare(`{{- FOREACH x IN list -}} {{ x }} {{- END }}`, Vars{"list": []int{1, 2, 3}}, `123`)
+}
+
+func TestTTerse_LineStatements(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.XslateArgs["Parser"].(Args)["LineStart"] = "%%"
+	template := `<ul>
+  %% FOREACH x IN list
+  <li>[% x %]</li>
+  %% END
+</ul>
+%% # comment
+%% name`
+	c.renderStringAndCompare(template, Vars{"list": []int{1, 2}, "name": "Bob"}, "<ul>\n  <li>1</li>\n  <li>2</li>\n</ul>\nBob")
+	c.renderStringAndCompare("100 %% name\n", Vars{"name": "Bob"}, "100 %% name\n")
+
+	// Line statements end at the end of the line, not at the tag end
+	c.renderStringAndCompare("%% x = \"a %] b\"\n%% # c %] d\n[% x %]", nil, "a %] b")
+	c.renderStringAndCompare("%% 'a %] b'\n", nil, "a %] b")
+	tx := c.CreateTx()
+	if _, err := tx.RenderString("%% x = \"a\n\"\n", nil); err == nil {
+		t.Errorf("expected a quoted string across lines to fail to parse")
+	}
+}
+
+func TestTTerse_InvalidDelimiters(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.XslateArgs["Parser"].(Args)["TagStart"] = 1
+	if _, err := New(c.XslateArgs); err == nil {
+		t.Errorf("expected non-string TagStart to be rejected")
+	}
+}
+
 func TestTTerse_SimpleHTMLString(t *testing.T) {
 	c := newTestCtx(t)
 	defer c.Cleanup()
@@ -56,6 +173,68 @@ func TestTTerse_ListVariableFunctions(t *testing.T) {
 	defer c.Cleanup()
 	c.renderStringAndCompare(`[% list.size() %]`, Vars{"list": []int{0, 1, 2}}, `3`)
 	c.renderStringAndCompare(`[% list.size() %]`, Vars{"list": []time.Time{}}, `0`)
+
+	vars := Vars{
+		"list":   []int{3, 1, 2, 3},
+		"words":  []string{"banana", "apple", "cherry"},
+		"double": func(i int) int { return i * 2 },
+		"odd":    func(i int) bool { return i%2 == 1 },
+		"desc":   func(a, b int) int { return b - a },
+		"people": []struct {
+			Name string
+			Age  int
+		}{{"Bob", 30}, {"Alice", 25}},
+	}
+	c.renderStringAndCompare(`[% list.join(",") %]`, vars, `3,1,2,3`)
+	c.renderStringAndCompare(`[% list.reverse().join(",") %]`, vars, `3,2,1,3`)
+	c.renderStringAndCompare(`[% list.sort().join(",") %]`, vars, `1,2,3,3`)
+	c.renderStringAndCompare(`[% list.sort(desc).join(",") %]`, vars, `3,3,2,1`)
+	c.renderStringAndCompare(`[% words.sort().join(",") %]`, vars, `apple,banana,cherry`)
+	c.renderStringAndCompare(`[% list.map(double).join(",") %]`, vars, `6,2,4,6`)
+	c.renderStringAndCompare(`[% list.grep(odd).join(",") %]`, vars, `3,1,3`)
+	c.renderStringAndCompare(`[% words.grep("an").join(",") %]`, vars, `banana`)
+	c.renderStringAndCompare(`[% list.first() %]-[% list.last() %]`, vars, `3-3`)
+	c.renderStringAndCompare(`[% list.slice(1, 2).join(",") %]`, vars, `1,2`)
+	c.renderStringAndCompare(`[% list.merge(words).join(",") %]`, vars, `3,1,2,3,banana,apple,cherry`)
+	c.renderStringAndCompare(`[% list.uniq().join(",") %]`, vars, `3,1,2`)
+	c.renderStringAndCompare(`[% FOREACH p IN people.sort_by("age") %][% p.name %],[% END %]`, vars, `Alice,Bob,`)
+	c.renderStringAndCompare(`[% empty.first() %]`, Vars{"empty": []int{}}, ``)
+}
+
+func TestTTerse_StringVariableFunctions(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"en": "hello, world", "ja": "こんにちは世界", "pad": "  x  ", "back": -2}
+	c.renderStringAndCompare(`[% en.length() %],[% ja.length() %]`, vars, `12,7`)
+	c.renderStringAndCompare(`[% en.upper() %],[% "ÀB".lower() %]`, vars, `HELLO, WORLD,àb`)
+	c.renderStringAndCompare(`[% en.ucfirst() %],[% "élan".ucfirst() %]`, vars, `Hello, world,Élan`)
+	c.renderStringAndCompare(`[[% pad.trim() %]]`, vars, `[x]`)
+	c.renderStringAndCompare(`[% ja.substr(5) %],[% ja.substr(0, 5) %],[% ja.substr(back, 1) %]`, vars, `世界,こんにちは,世`)
+	c.renderStringAndCompare(`[% ja.index("世界") %],[% en.index("o", 5) %],[% en.index("z") %]`, vars, `5,8,-1`)
+	c.renderStringAndCompare(`[% ja.replace("世界", "日本") %]`, vars, `こんにちは日本`)
+	c.renderStringAndCompare(`[% en.split(", ").join("|") %],[% "a-b-c".split("-", 2).join("|") %]`, vars, `hello|world,a|b-c`)
+	c.renderStringAndCompare(`[% en.match("^h.*d$") %],[% ja.match("^世") %]`, vars, `true,false`)
+	c.renderStringAndCompare(`[% "世".repeat(3) %]`, vars, `世世世`)
+	c.renderStringAndCompare(`[% ja.starts_with("こん") %],[% ja.ends_with("世") %]`, vars, `true,false`)
+	c.renderStringAndCompare(`[% "%s=%03d".sprintf(en, 7) %]`, vars, `hello, world=007`)
+}
+
+func TestTTerse_MapVariableFunctions(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{
+		"data":  map[string]int{"b": 2, "a": 1, "c": 3},
+		"other": map[string]int{"c": 30, "d": 40},
+	}
+	c.renderStringAndCompare(`[% data.keys().join(",") %]`, vars, `a,b,c`)
+	c.renderStringAndCompare(`[% data.values().join(",") %]`, vars, `1,2,3`)
+	c.renderStringAndCompare(`[% FOREACH pair IN data.kv() %][% pair.key %]=[% pair.value %];[% END %]`, vars, `a=1;b=2;c=3;`)
+	c.renderStringAndCompare(`[% data.size() %]`, vars, `3`)
+	c.renderStringAndCompare(`[% data.exists("a") %],[% data.exists("z") %]`, vars, `true,false`)
+	c.renderStringAndCompare(`[% data.merge(other).values().join(",") %]`, vars, `1,2,30,40`)
+	c.renderStringAndCompare(`[% n.keys().join(",") %]`, Vars{"n": map[int]string{10: "x", 9: "y"}}, `9,10`)
 }
 
 func TestTTerse_ArrayVariableSlotAccess(t *testing.T) {
@@ -131,6 +310,113 @@ func TestTTerse_ForeachLoopVar(t *testing.T) {
 	c.renderStringAndCompare(template, nil, `9,9,9,9,9,9,9,9,9,9,`)
 }
 
+// wordIterator implements vm.Iterator
+type wordIterator struct {
+	words []string
+	cur   string
+}
+
+func (i *wordIterator) Next() bool {
+	if len(i.words) == 0 {
+		return false
+	}
+	i.cur, i.words = i.words[0], i.words[1:]
+	return true
+}
+
+func (i *wordIterator) Value() interface{} {
+	return i.cur
+}
+
+func TestTTerse_ForeachLoopVarExtras(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`[% FOREACH i IN [1..4] %][% loop.odd %]/[% loop.even %]/[% loop.parity %],[% END %]`, nil, `true/false/odd,false/true/even,true/false/odd,false/true/even,`)
+	c.renderStringAndCompare(`[% FOREACH i IN [1..4] %][% loop.revindex %][% END %]`, nil, `3210`)
+	c.renderStringAndCompare(`[% FOREACH i IN [1..4] %][% loop.cycle("a", "b", "c") %][% END %]`, nil, `abca`)
+	c.renderStringAndCompare(`[% FOREACH i IN [1..3] %][% loop.prev %]<[% i %]>[% loop.next %],[% END %]`, nil, `<1>2,1<2>3,2<3>,`)
+	c.renderStringAndCompare(`[% FOREACH i IN [1..3] %][% loop.is_first %][% loop.is_last %][% loop.max_index %],[% END %]`, nil, `truefalse2,falsefalse2,falsetrue2,`)
+
+	template := `[% FOREACH a IN ["x", "y"] %][% FOREACH b IN [1, 2] %][% loop.parent.index %][% loop.parent.peek_next %][% b %],[% END %];[% END %]`
+	c.renderStringAndCompare(template, nil, `0y1,0y2,;11,12,;`)
+}
+
+func TestTTerse_MaxLoopCount(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	render := func(template string) error {
+		_, err := c.renderString(template, nil)
+		return err
+	}
+
+	if err := render(`[% FOREACH i IN [1..1001] %][% END %]`); err == nil {
+		t.Errorf("expected loop over 1001 items to be aborted")
+	}
+	c.renderStringAndCompare(`[% FOREACH i IN [1..2000] LIMIT 2000 %][% END %]done`, nil, `done`)
+	if err := render(`[% FOREACH i IN [1..10] LIMIT 5 %][% END %]`); err == nil {
+		t.Errorf("expected loop with LIMIT 5 to be aborted")
+	}
+	// The error reports the limit, and how many times the body ran
+	_, err := c.renderString(`[% FOREACH x IN list LIMIT 2 %][% x %][% END %]`, Vars{"list": []int{1, 2, 3, 4}})
+	if err == nil || !strings.Contains(err.Error(), "more than 2 items, aborting after 2 iterations") {
+		t.Errorf("expected loop over 4 items with LIMIT 2 to be aborted after 2 iterations, got %v", err)
+	}
+
+	c.XslateArgs["VM"] = Args{"MaxLoopCount": 3}
+	if err := render(`[% FOREACH i IN [1..4] %][% END %]`); err == nil {
+		t.Errorf("expected loop over 4 items to be aborted")
+	}
+	c.renderStringAndCompare(`[% FOREACH i IN [1..4] LIMIT 4 %][% i %][% END %]`, nil, `1234`)
+
+	c.XslateArgs["VM"] = Args{"MaxLoopCount": 0}
+	c.renderStringAndCompare(`[% FOREACH i IN [1..5000] %][% END %]done`, nil, `done`)
+}
+
+func TestTTerse_ForeachStreams(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	// Maps are iterated as key/value pairs, sorted by key
+	m := map[string]int{"b": 2, "c": 3, "a": 1}
+	c.renderStringAndCompare(`[% FOREACH p IN m %][% p.key %]=[% p.value %],[% END %]`, Vars{"m": m}, `a=1,b=2,c=3,`)
+	c.renderStringAndCompare(`[% FOREACH p IN m %][% loop.count %]/[% loop.size %][% END %]`, Vars{"m": m}, `1/32/33/3`)
+
+	ch := make(chan int, 3)
+	ch <- 1
+	ch <- 2
+	ch <- 3
+	close(ch)
+	c.renderStringAndCompare(`[% FOREACH i IN ch %][% i %][% IF loop.last %].[% ELSE %],[% END %][% END %]`, Vars{"ch": ch}, `1,2,3.`)
+
+	stopped := false
+	seq := func(yield func(int) bool) {
+		defer func() { stopped = true }()
+		for i := 1; ; i++ {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+	c.renderStringAndCompare(`[% FOREACH i IN seq %][% IF i > 3 %][% LAST %][% END %][% i %]([% loop.size %]),[% END %]`, Vars{"seq": seq}, `1(-1),2(-1),3(-1),`)
+	if !stopped {
+		t.Errorf("expected iter.Seq to be stopped after LAST")
+	}
+
+	seq2 := func(yield func(string, int) bool) {
+		for i, s := range []string{"x", "y"} {
+			if !yield(s, i) {
+				return
+			}
+		}
+	}
+	c.renderStringAndCompare(`[% FOREACH p IN seq2 %][% p.key %][% p.value %][% loop.next.key %],[% END %]`, Vars{"seq2": seq2}, `x0y,y1,`)
+
+	it := &wordIterator{words: []string{"foo", "bar", "baz"}}
+	c.renderStringAndCompare(`[% FOREACH w IN it %][% loop.index %]:[% w %],[% END %]`, Vars{"it": it}, `0:foo,1:bar,2:baz,`)
+}
+
 func TestTTerse_ForeachMakeArrayRange(t *testing.T) {
 	c := newTestCtx(t)
 	defer c.Cleanup()
@@ -164,6 +450,14 @@ func TestTTerse_If(t *testing.T) {
 	template := `[% IF (foo) %]Hello, World![% END %]`
 	c.renderStringAndCompare(template, Vars{"foo": true}, `Hello, World!`)
 	c.renderStringAndCompare(template, Vars{"foo": false}, ``)
+
+	// Values other than booleans have Perl-like truthiness
+	for _, v := range []interface{}{1, "Bob", "0.0", []int{}} {
+		c.renderStringAndCompare(template, Vars{"foo": v}, `Hello, World!`)
+	}
+	for _, v := range []interface{}{0, "", "0", []int(nil), nil} {
+		c.renderStringAndCompare(template, Vars{"foo": v}, ``)
+	}
 }
 
 func TestTTerse_IfElse(t *testing.T) {
@@ -305,6 +599,15 @@ func TestTTerse_Arithmetic(t *testing.T) {
 	c.renderStringAndCompare(template, nil, `2`)
 	template = `[% 6 / ( ( 4 - 1 ) - 1 ) %]`
 	c.renderStringAndCompare(template, nil, `3`)
+	template = `[% 1 + 2 + 3 %]`
+	c.renderStringAndCompare(template, nil, `6`)
+
+	// Operators of the same precedence are left associative, and
+	// multiplication binds tighter than addition
+	template = `[% 5 - 1 - 1 %],[% 8 / 2 / 2 %],[% 1 + 2 * 3 %],[% 2 * 3 + 1 %],[% 10 - 2 * 3 - 1 %]`
+	c.renderStringAndCompare(template, nil, `3,2,7,7,3`)
+	template = `[% 3 - 1 == 2 %],[% 2 == 3 - 1 %],[% 1 + 1 < 3 %],[% "a" ~ 1 + 2 == "a3" %],[% "-" ~ "ab" x 2 %]`
+	c.renderStringAndCompare(template, nil, `true,true,true,true,-abab`)
 
 	template = `[% x = 0 %][% CALL x += 1 %][% CALL x += 1 %][% x %]`
 	c.renderStringAndCompare(template, nil, `2`)
@@ -461,16 +764,24 @@ func TestTTerse_Macro(t *testing.T) {
 	c := newTestCtx(t)
 	defer c.Cleanup()
 	c.renderStringAndCompare(template, nil, `
-1: Hello
-2: Hello
-3: Hello
-4: Hello
-5: Hello
-6: Hello
-7: Hello
-8: Hello
-9: Hello
-10: Hello`)
+1: Hello!
+2: Hello!
+3: Hello!
+4: Hello!
+5: Hello!
+6: Hello!
+7: Hello!
+8: Hello!
+9: Hello!
+10: Hello!`)
+
+	// Arguments are bound to the parameters on top of the caller's
+	// variables. Missing arguments are nil, and parameters hide local
+	// variables of the same name
+	vars := Vars{"name": "Bob", "b": 100}
+	c.renderStringAndCompare(`[% MACRO add(a, b) BLOCK %][% a + b %][% END %][% add(1, 2) %]`, nil, `3`)
+	c.renderStringAndCompare(`[% MACRO greet(greeting) BLOCK %][% greeting %], [% name %][% END %][% greet("Hi") %]|[% CALL greet("Hello") %]`, vars, `Hi, Bob|Hello, Bob`)
+	c.renderStringAndCompare(`[% a = 5 %][% MACRO add(a, b) BLOCK %][% a %]+[% b %][% END %][% add(1) %],[% a %],[% b %]`, vars, `1+,5,100`)
 }
 
 func TestTTerse_NilOnIfBlock(t *testing.T) {
@@ -499,3 +810,521 @@ func TestTTerse_WrapperAndForeach(t *testing.T) {
 	c.renderAndCompare(tx, "wrapper/raw.tx", vars, "Hi! Bob, Freddie, ")
 	c.renderAndCompare(tx, "wrapper/index.tx", vars, "Hello World! Hi! Bob, Freddie, Hello World!")
 }
+
+func TestTTerse_Lambda(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{
+		"list":  []int{1, 3, 2},
+		"apply": func(f func(...interface{}) interface{}) interface{} { return f(4) },
+	}
+	c.renderStringAndCompare(`[% list.map(-> x { x * 2 }).join(",") %]`, vars, `2,6,4`)
+	c.renderStringAndCompare(`[% list.grep(-> x { x > 1 }).join(",") %]`, vars, `3,2`)
+	c.renderStringAndCompare(`[% list.sort(-> a, b { b - a }).join(",") %]`, vars, `3,2,1`)
+	c.renderStringAndCompare(`[% SET f = -> x { x + 1 } %][% f(2) %]`, vars, `3`)
+	c.renderStringAndCompare(`[% apply(-> (x) { x * 3 }) %]`, vars, `12`)
+
+	// Lambdas capture local variables at the time they are created
+	c.renderStringAndCompare(`[% FOREACH i IN [1, 2] %][% SET f = -> x { x + i } %][% f(10) %],[% END %]`, vars, `11,12,`)
+	c.renderStringAndCompare(`[% SET n = 5 %][% SET f = -> x { x + n } %][% SET n = 7 %][% f(1) %],[% n %]`, vars, `6,7`)
+	c.renderStringAndCompare(`[% SET add = -> x { -> y { x + y } } %][% SET add2 = add(2) %][% SET add10 = add(10) %][% add2(3) %],[% add10(1) %],[% add2(1) %]`, vars, `5,11,3`)
+	c.renderStringAndCompare(`[% SET k = 3 %][% list.map(-> x { [1].map(-> y { x * k + y }).join("") }).join(",") %]`, vars, `4,10,7`)
+}
+
+func TestTTerse_NestedForeach(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"as": []int{1, 2}, "bs": []int{3, 4}, "cs": []int{5}}
+	c.renderStringAndCompare(`[% FOREACH a IN as %][% FOREACH b IN bs %]([% a %],[% b %])[% END %][% END %]`, vars, `(1,3)(1,4)(2,3)(2,4)`)
+	c.renderStringAndCompare(`[% FOREACH a IN as %][% FOREACH c IN cs %][% loop.count %][% END %][% loop.count %][% END %]`, vars, `1112`)
+}
+
+func TestTTerse_LocalVarSlots(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`[% SET a = 1 %][% SET b = 2 %][% a %][% b %]`, nil, `12`)
+	c.renderStringAndCompare(`[% SET a = 1 %][% FOREACH x IN xs %][% SET b = x %][% END %][% a %]`, Vars{"xs": []int{5}}, `1`)
+}
+
+func TestTTerse_LoopControl(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`[% FOREACH i IN [1..10] %][% IF i > 3 %][% LAST %][% END %][% i %],[% END %]`, nil, `1,2,3,`)
+	c.renderStringAndCompare(`[% FOREACH i IN [1..6] %][% IF i == 2 %][% NEXT %][% END %][% IF i == 4 %][% NEXT %][% END %][% i %],[% END %]`, nil, `1,3,5,6,`)
+	c.renderStringAndCompare(`[% i = 0 %][% WHILE i < 10 %][% CALL i += 1 %][% IF i == 2 %][% NEXT %][% ELSE %][% IF i > 4 %][% LAST %][% END %][% END %][% i %],[% END %]`, nil, `1,3,4,`)
+
+	// LAST and NEXT apply to the loop over the given variable
+	template := `[% FOREACH row IN rows %][% FOREACH col IN row %][% IF col == 0 %][% NEXT row %][% END %][% IF col < 0 %][% LAST row %][% END %][% col %][% END %];[% END %]`
+	rows := [][]int{{1, 2}, {3, 0, 4}, {5}, {6, -1, 7}, {8}}
+	c.renderStringAndCompare(template, Vars{"rows": rows}, `12;35;6`)
+
+	// Frames and marks are unwound, so everything after the loops
+	// still works
+	template = `[% FOREACH a IN [1..3] %][% WHILE 1 %][% FOREACH b IN [1..3] %][% IF b == 2 %][% LAST a %][% END %][% END %][% END %][% END %][% FOREACH c IN [1..2] %][% c %][% END %][% f(1, 2) %]`
+	c.renderStringAndCompare(template, Vars{"f": func(a, b int64) int64 { return a + b }}, `123`)
+
+	for _, template := range []string{`[% LAST %]`, `[% FOREACH i IN [1] %][% NEXT j %][% END %]`, `[% FOREACH i IN [1] %][% MACRO m BLOCK %][% LAST %][% END %][% END %]`} {
+		if _, err := c.renderString(template, nil); err == nil {
+			t.Errorf("expected '%s' to fail", template)
+		}
+	}
+}
+
+func TestTTerse_HashLiteral(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`[% SET h = { name => "Bob", "age": 42, city = "Tokyo" } %][% h.name %],[% h.age %],[% h.city %]`, nil, `Bob,42,Tokyo`)
+	c.renderStringAndCompare(`[% { b => 2, a => 1, }.keys().join(",") %]`, nil, `a,b`)
+	c.renderStringAndCompare(`[% {}.size() %]`, nil, `0`)
+
+	// Nested with arrays
+	template := `[% SET h = { list => [1, { x: "y" }, [2, 3]] } %][% FOREACH v IN h.list %][% loop.index %],[% END %][% h.list.size() %]`
+	c.renderStringAndCompare(template, nil, `0,1,2,3`)
+	c.renderStringAndCompare(`[% FOREACH p IN [{ n => 1 }, { n => 2 }] %][% p.n %][% END %]`, nil, `12`)
+
+	// As FOREACH targets and function arguments
+	c.renderStringAndCompare(`[% FOREACH p IN { b => 2, a => 1 } %][% p.key %]=[% p.value %],[% END %]`, nil, `a=1,b=2,`)
+	f := func(m map[interface{}]interface{}) interface{} { return m["name"] }
+	c.renderStringAndCompare(`[% f({ name: "Alice" }) %]`, Vars{"f": f}, `Alice`)
+
+	// As INCLUDE variables
+	c.File("hash/parts.tx").WriteString(`[% name %]/[% user.name %]`)
+	c.File("hash/index.tx").WriteString(`[% INCLUDE "hash/parts.tx" WITH { name => "Bob" } %] [% INCLUDE "hash/parts.tx" WITH user = { name => "Carol" } %]`)
+	c.renderAndCompare(c.CreateTx(), "hash/index.tx", nil, `Bob/ /Carol`)
+}
+
+func TestTTerse_Conditional(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	var called []string
+	record := func(s string) string {
+		called = append(called, s)
+		return s
+	}
+	vars := Vars{"record": record, "yes": true, "no": false, "zero": 0, "name": "Bob", "empty": ""}
+
+	c.renderStringAndCompare(`[% yes ? record("a") : record("b") %]`, vars, `a`)
+	c.renderStringAndCompare(`[% no ? record("c") : record("d") %]`, vars, `d`)
+	if len(called) != 2 || called[0] != "a" || called[1] != "d" {
+		t.Errorf("expected only the selected operands to be evaluated, got %v", called)
+	}
+
+	c.renderStringAndCompare(`[% zero ? "t" : no ? "u" : "v" %]`, vars, `v`)
+	c.renderStringAndCompare(`[% (1 + 1 == 2) ? name : "nobody" %]`, vars, `Bob`)
+	c.renderStringAndCompare(`[% SET x = yes ? 1 + 2 : 4 %][% x %]`, vars, `3`)
+
+	// Defined-or only falls back on undefined values
+	called = nil
+	c.renderStringAndCompare(`[% missing // "x" %],[% zero // record("y") %],[% empty // "z" %]`, vars, `x,0,`)
+	c.renderStringAndCompare(`[% missing // also_missing // name %]`, vars, `Bob`)
+	c.renderStringAndCompare(`[% missing // no ? "t" : "f" %]`, vars, `f`)
+	if len(called) != 0 {
+		t.Errorf("expected right hand side of // not to be evaluated, got %v", called)
+	}
+
+	// The default filter also falls back on empty strings
+	c.renderStringAndCompare(`[% missing | default("x") %],[% empty | default("y") %],[% zero | default("z") %],[% name | default(record("w")) %]`, vars, `x,y,0,Bob`)
+	if len(called) != 0 {
+		t.Errorf("expected default value not to be evaluated, got %v", called)
+	}
+
+	// DEFAULT only assigns when the variable is undefined or false
+	c.renderStringAndCompare(`[% DEFAULT name = "Alice" %][% DEFAULT missing = "Carol" %][% DEFAULT no = "yes" %][% name %],[% missing %],[% no %]`, vars, `Bob,Carol,yes`)
+	c.renderStringAndCompare(`[% SET n = 0 %][% DEFAULT n = 10 %][% SET m = 5 %][% DEFAULT m = 10 %][% n %],[% m %]`, nil, `10,5`)
+}
+
+func TestTTerse_StringOperators(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"name": "Bob", "n": 3, "f": 1.5, "neg": -1}
+	c.renderStringAndCompare(`[% "Hello, " ~ name ~ "!" %]`, vars, `Hello, Bob!`)
+	c.renderStringAndCompare(`[% n ~ f ~ missing %]`, vars, `31.5`)
+	c.renderStringAndCompare(`[% SET s = "a" ~ 1 + 2 %][% s %]`, nil, `a3`)
+	c.renderStringAndCompare(`[% "ab" x 3 %],[% "-" x n %],[% "z" x "2" %],[% "z" x neg %]|`, vars, `ababab,---,zz,|`)
+
+	// "x" is still a valid variable name
+	c.renderStringAndCompare(`[% SET x = 2 %][% x %][% "=" x x %][% [1, 2].map(-> x { x x 2 }).join(",") %]`, nil, `2==11,22`)
+
+	// String comparisons
+	c.renderStringAndCompare(`[% IF "abc" lt "abd" %]lt[% END %][% IF "b" gt "abc" %]gt[% END %][% IF "a" le "a" %]le[% END %][% IF "a" ge "b" %]ge[% END %]`, nil, `ltgtle`)
+	c.renderStringAndCompare(`[% "10" lt "9" %],[% 10 lt 9 %],[% "a" cmp "b" %],[% "b" cmp "a" %],[% name cmp "Bob" %]`, vars, `true,true,-1,1,0`)
+
+	// The raw mark is preserved only when both operands are raw
+	c.renderStringAndCompare(`[% ("<b>" | mark_raw) ~ ("<i>" | mark_raw) %]`, nil, `<b><i>`)
+	c.renderStringAndCompare(`[% ("<b>" | mark_raw) ~ "<i>" %]`, nil, `&lt;b&gt;&lt;i&gt;`)
+	c.renderStringAndCompare(`[% ("<br>" | mark_raw) x 2 %]`, nil, `<br><br>`)
+
+	// ~ before the tag end is still a chomp
+	c.renderStringAndCompare("[% name ~%]\n  !", vars, `Bob!`)
+}
+
+func TestTTerse_IndexAndSlice(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{
+		"list":   []int{10, 20, 30, 40},
+		"array":  [3]string{"a", "b", "c"},
+		"nested": [][]string{{"a", "b"}, {"c", "d"}},
+		"users":  []map[string]string{{"name": "Bob"}},
+		"hash":   map[string]int{"one": 1, "two": 2},
+		"ids":    map[int]string{1: "first", 2: "second"},
+		"key":    "two",
+		"i":      1,
+		"word":   "héllo",
+	}
+
+	// Negative indexes count from the end
+	c.renderStringAndCompare(`[% list[0] %],[% list[-1] %],[% list[-4] %],[% list[i] %],[% list["2"] %]`, vars, `10,40,10,20,30`)
+	c.renderStringAndCompare(`[% array[-1] %],[% nested[1][0] %],[% nested[-1][-1] %],[% users[0].name %]`, vars, `c,c,d,Bob`)
+
+	// Slices are inclusive, like ranges
+	c.renderStringAndCompare(`[% list[1..2].join(",") %]|[% list[-2..-1].join(",") %]|[% array[0..1].join(",") %]|[% list[2..1].size() %]`, vars, `20,30|30,40|a,b|0`)
+	c.renderStringAndCompare(`[% FOREACH x IN list[i..-1] %][% x %];[% END %]`, vars, `20;30;40;`)
+
+	// Dynamic lookups on maps, with any key type
+	c.renderStringAndCompare(`[% hash[key] %],[% hash["one"] %],[% ids[1] %],[% ids["2"] %],[% { a => 1 }["a"] %]`, vars, `2,1,first,second,1`)
+
+	// Strings are indexed by character
+	c.renderStringAndCompare(`[% word[1] %],[% word[-1] %],[% word[1..3] %],[% "abc"[0] %]`, vars, `é,o,éll,a`)
+
+	// Out of range indexes are nil, with a warning
+	c.renderStringAndCompare(`[% list[4] // "none" %],[% list[-5] // "none" %],[% word[10] // "none" %],[% missing[0] // "none" %],[% hash["three"] // "none" %]`, vars, `none,none,none,none,none`)
+	c.renderStringAndCompare(`[% list[2..10].join(",") %]`, vars, `30,40`)
+	c.renderStringAndCompare(`[% list[5..6].size() %],[% [1,2,3][5..6].size() %],[% "abc"[100..120] %],[% word[5..2] %]`, vars, `0,0,,`)
+	c.renderStringAndCompare(`[% SET n = -2 %][% list[n] %],[% list[-(1)] %],[% 3 - -1 %]`, nil, `,,4`)
+
+	// A '-' right after the tag start is a chomp, otherwise it's a negation
+	c.renderStringAndCompare("[% -1 %],[% -i %],[% - 2 %],[% -1.5 %]", vars, `-1,-1,-2,-1.5`)
+	c.renderStringAndCompare("x \n[%-1 %]", vars, `x1`)
+
+	// Slices need both ends
+	tx := c.CreateTx()
+	for _, template := range []string{`[% list[1..] %]`, `[% list[..1] %]`, `[% list[1.. %]`} {
+		if _, err := tx.RenderString(template, vars); err == nil {
+			t.Errorf("Expected '%s' to fail to parse", template)
+		}
+	}
+}
+
+type fieldAddress struct {
+	City string
+}
+
+type fieldPerson struct {
+	*fieldAddress
+	First    string
+	Last     string
+	Nick     sql.NullString
+	Age      sql.NullInt64
+	Pet      fmt.Stringer
+	Manager  *fieldPerson
+	password string
+}
+
+func (p fieldPerson) FullName() string {
+	return p.First + " " + p.Last
+}
+
+func (p *fieldPerson) Initials() string {
+	return p.First[:1] + p.Last[:1]
+}
+
+func (p fieldPerson) Secret() (string, error) {
+	return "", errors.New("no access")
+}
+
+type fieldColor string
+
+func TestTTerse_FieldResolution(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	bob := &fieldPerson{
+		fieldAddress: &fieldAddress{City: "Tokyo"},
+		First:        "Bob",
+		Last:         "Smith",
+		Nick:         sql.NullString{String: "bobby", Valid: true},
+		Pet:          time.Second,
+		password:     "secret",
+	}
+	alice := fieldPerson{First: "Alice", Last: "Jones", Manager: bob}
+	vars := Vars{
+		"bob":    bob,
+		"alice":  alice,
+		"ptrptr": &bob,
+		"nobody": (*fieldPerson)(nil),
+		"colors": map[fieldColor]int{"red": 1},
+		"people": []interface{}{alice},
+	}
+
+	// Fields, promoted fields, and zero-arg methods as properties
+	c.renderStringAndCompare(`[% bob.first %] [% bob.city %] [% bob.fullName %] [% bob.initials %] [% bob.pet.string %]`, vars, `Bob Tokyo Bob Smith BS 1s`)
+	c.renderStringAndCompare(`[% alice.manager.first %],[% alice.fullName %],[% people[0].fullName %],[% ptrptr.first %]`, vars, `Bob,Alice Jones,Alice Jones,Bob`)
+
+	// Nil pointers, nil embedded structs and invalid sql.Null* values are nil
+	c.renderStringAndCompare(`[% nobody.first // "none" %],[% alice.manager.manager.first // "none" %],[% alice.city // "none" %]`, vars, `none,none,none`)
+	c.renderStringAndCompare(`[% bob.nick %],[% bob.age // "unknown" %]`, vars, `bobby,unknown`)
+
+	// Missing and unexported fields are nil
+	c.renderStringAndCompare(`[% bob.nosuch // "none" %],[% bob.password // "none" %],[% bob.first.length // "none" %]`, vars, `none,none,none`)
+
+	// Map keys are converted to the map's key type
+	c.renderStringAndCompare(`[% colors.red %]`, vars, `1`)
+}
+
+func TestTTerse_FunctionArguments(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{
+		"repeat": strings.Repeat,
+		"sum": func(label string, nums ...int) string {
+			total := 0
+			for _, n := range nums {
+				total += n
+			}
+			return label + strconv.Itoa(total)
+		},
+		"join":  func(list []string, sep string) string { return strings.Join(list, sep) },
+		"ratio": func(a, b float64) float64 { return a / b },
+		"bytes": func(b []byte) int { return len(b) },
+		"keys": func(m map[string]int) int {
+			total := 0
+			for _, v := range m {
+				total += v
+			}
+			return total
+		},
+		"u8": func(n uint8) uint8 { return n },
+	}
+
+	// Template numbers are int64, but can be passed as int, float64, etc
+	c.renderStringAndCompare(`[% repeat("ab", 3) %]|[% ratio(1, 4) %]|[% u8("7") %]`, vars, `ababab|0.25|7`)
+
+	// Variadic functions
+	c.renderStringAndCompare(`[% sum("total:") %]|[% sum("total:", 1) %]|[% sum("total:", 1, 2, 3) %]`, vars, `total:0|total:1|total:6`)
+
+	// Lists, hashes, strings as []byte, and nil
+	c.renderStringAndCompare(`[% join(["a", 1, 2.5], "-") %]|[% bytes("héllo") %]|[% keys({ a => 1, b => 2 }) %]|[% join(nothing, ",") %]`, vars, `a-1-2.5|6|3|`)
+
+	for template, expected := range map[string]string{
+		`[% u8(256) %]`:            "invalid argument 1 for function 'u8': 256 overflows uint8",
+		`[% repeat("ab", "x") %]`:  `invalid argument 2 for function 'repeat': "x" is not an integer`,
+		`[% join([[1]], ",") %]`:   "invalid argument 1 for function 'join': element 0: cannot convert []interface {} to string",
+		`[% sum("total:", 1.5) %]`: "invalid argument 2 for function 'sum': 1.5 is not an integer",
+	} {
+		if _, err := c.renderString(template, vars); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected '%s' to fail with '%s', got %v", template, expected, err)
+		}
+	}
+}
+
+type requestKey struct{}
+
+type contextGreeter struct{}
+
+func (contextGreeter) Greet(cc *vm.CallContext, name string) string {
+	return "Hello " + name + ", " + cc.Locale()
+}
+
+func TestTTerse_CallContext(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	lookups := 0
+	vars := Vars{
+		"base": "/app",
+		"uri_for": func(cc *vm.CallContext, path string) string {
+			base, _ := cc.Var("base").(string)
+			return base + path
+		},
+		"where": func(cc *vm.CallContext) string {
+			return cc.Template() + ":" + strconv.Itoa(cc.Line())
+		},
+		"user": func(cc *vm.CallContext) string {
+			if u, ok := cc.Load("user"); ok {
+				return u.(string)
+			}
+			lookups++
+			u, _ := cc.Value(requestKey{}).(string)
+			cc.Store("user", u)
+			return u
+		},
+		"request_user": func(ctx context.Context) string {
+			u, _ := ctx.Value(requestKey{}).(string)
+			return u
+		},
+		"csrf_field": func(cc *vm.CallContext, name string) {
+			fmt.Fprintf(cc.Writer(), `<input name="%s">`, name)
+		},
+	}
+
+	c.File("page.tx").WriteString("[% uri_for(\"/login\") %]|[% user() %][% INCLUDE \"part.tx\" %]|[% request_user() %]\n[% where() %]|[% csrf_field(\"token\") %]")
+	c.File("part.tx").WriteString(`,[% user() %]@[% where() %]`)
+
+	tx := c.CreateTx()
+	ctx := context.WithValue(context.Background(), requestKey{}, "bob")
+	output, err := tx.RenderContext(ctx, "page.tx", vars)
+	if err != nil {
+		t.Fatalf("Failed to render template: %s", err)
+	}
+	c.compareTemplateOutput(output, "/app/login|bob,bob@part.tx:1|bob\npage.tx:2|<input name=\"token\">")
+	if lookups != 1 {
+		t.Errorf("expected user to be looked up once, got %d", lookups)
+	}
+
+	// Without a context, functions get context.Background()
+	c.renderStringAndCompare(`[% request_user() %]|[% uri_for("/") %]`, vars, `|/app/`)
+
+	// Methods can take a CallContext too
+	c.renderStringAndCompare(`[% greeter.greet("Bob") %]`, Vars{"greeter": contextGreeter{}, "locale": "ja"}, `Hello Bob, ja`)
+}
+
+func TestTTerse_FunctionErrors(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	errBoom := errors.New("boom")
+	vars := Vars{
+		"half": func(n int64) (int64, error) {
+			if n%2 != 0 {
+				return 0, errBoom
+			}
+			return n / 2, nil
+		},
+		"divmod": func(a, b int64) (int64, int64) { return a / b, a % b },
+		"fail":   func() error { return errBoom },
+		"bob":    &fieldPerson{First: "Bob"},
+	}
+
+	// Functions returning (T, error) return T when there's no error, and
+	// multiple return values are a list
+	c.renderStringAndCompare(`[% half(10) %]`, vars, `5`)
+	c.renderStringAndCompare(`[% SET r = divmod(9, 4) %][% r[0] %],[% r[1] %]|[% r.join(":") %]`, vars, `2,1|2:1`)
+
+	// Errors abort the template, and report where they happened
+	for _, template := range []string{"ok\n[% half(3) %]", "ok\n[% fail() %]"} {
+		_, err := c.renderString(template, vars)
+		if !errors.Is(err, errBoom) {
+			t.Errorf("expected '%s' to fail with errBoom, got %v", template, err)
+			continue
+		}
+		var re *vm.RenderError
+		if !errors.As(err, &re) || re.Line != 2 {
+			t.Errorf("expected '%s' to fail at line 2, got %v", template, err)
+		}
+	}
+	if _, err := c.renderString(`[% bob.secret %]`, vars); err == nil || !strings.Contains(err.Error(), "method 'secret' failed: no access") {
+		t.Errorf("expected method error, got %v", err)
+	}
+	if _, err := c.renderString(`[% divmod(1) %]`, vars); err == nil || !strings.Contains(err.Error(), "wrong number of arguments for function 'divmod' (expected 2, got 1)") {
+		t.Errorf("expected argument count error, got %v", err)
+	}
+
+	// TRY discards the output of the block and runs CATCH instead
+	c.renderStringAndCompare(`[% TRY %]a[% half(3) %]b[% CATCH %]caught: [% error.message %][% END %]`, vars, `caught: function &#39;half&#39; failed: boom`)
+	c.renderStringAndCompare(`[% TRY %]a[% half(4) %]b[% CATCH %]caught[% END %]`, vars, `a2b`)
+	c.renderStringAndCompare(`[% TRY %]a[% TRY %]b[% fail() %][% CATCH %]c[% END %]d[% bob.secret %][% CATCH %]e[% error.line %][% END %]`, vars, `e1`)
+	c.renderStringAndCompare(`[% FOREACH i IN [1..4] %][% TRY %][% half(i) %][% CATCH %]-[% NEXT %][% END %];[% END %]`, vars, `-1;-2;`)
+	c.renderStringAndCompare(`[% FOREACH i IN [2..6] %][% TRY %][% IF i == 4 %][% LAST %][% END %][% half(i) %][% CATCH %][% END %];[% END %]after`, vars, `1;;after`)
+
+	// The caught error is local to the CATCH block, and doesn't replace a
+	// template variable named "error"
+	vars["error"] = "none"
+	c.renderStringAndCompare(`[% error %]|[% TRY %][% half(3) %][% CATCH %][% error.message %][% END %]|[% error %]`, vars, `none|function &#39;half&#39; failed: boom|none`)
+	delete(vars, "error")
+	c.renderStringAndCompare(`[% TRY %][% fail() %][% CATCH %][% END %][% error %]`, vars, ``)
+}
+
+type taggedUser struct {
+	UserID    int       `xslate:"uid"`
+	Email     string    `json:"mail,omitempty"`
+	CreatedAt time.Time `json:"-"`
+	Password  string    `xslate:"-"`
+}
+
+func (u taggedUser) DisplayName() string {
+	return "user" + strconv.Itoa(u.UserID)
+}
+
+func TestTTerse_FieldNames(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	users := []taggedUser{
+		{UserID: 1, Email: "a@example.com", CreatedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), Password: "x"},
+		{UserID: 2, Email: "b@example.com", CreatedAt: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), Password: "y"},
+	}
+	template := `[% FOREACH u IN users %][% u.uid %]:[% u.mail %]:[% u.created_at.format("%F") %]:[% u.display_name %]:[% u.password // "hidden" %];[% END %]`
+	c.renderStringAndCompare(template, Vars{"users": users}, `1:a@example.com:2024-01-02:user1:hidden;2:b@example.com:2024-03-04:user2:hidden;`)
+
+	// Go names still work
+	c.renderStringAndCompare(`[% u.UserID %]:[% u.email %]:[% u.user_id %]`, Vars{"u": users[0]}, `1:a@example.com:1`)
+}
+
+func TestTTerse_DateTime(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	tm := time.Date(2024, 3, 5, 9, 7, 3, 0, time.UTC)
+	vars := Vars{"t": tm, "s": "2024-03-05 09:07:03", "later": tm.Add(3 * time.Hour)}
+	c.renderStringAndCompare(`[% t | date("%Y-%m-%d %H:%M:%S") %]`, vars, `2024-03-05 09:07:03`)
+	c.renderStringAndCompare(`[% t | date("%a %b %-d %-I:%M %p, %j %u %s") %]`, vars, `Tue Mar 5 9:07 AM, 065 2 1709629623`)
+	c.renderStringAndCompare(`[% t | date %]|[% t | date("RFC3339") %]|[% t | date("Jan 2, 2006") %]`, vars, `2024-03-05 09:07:03|2024-03-05T09:07:03Z|Mar 5, 2024`)
+	c.renderStringAndCompare(`[% s | date("%d/%m/%Y") %]`, vars, `05/03/2024`)
+
+	// Time zones
+	c.renderStringAndCompare(`[% t | tz("Asia/Tokyo") | date("%H:%M %Z") %]`, vars, `18:07 JST`)
+	c.renderStringAndCompare(`[% t.in("America/New_York").format("%H:%M") %]`, vars, `04:07`)
+
+	// Relative time
+	c.renderStringAndCompare(`[% t | time_ago(later) %]|[% later.ago(t) %]`, vars, `3 hours ago|in 3 hours`)
+
+	// Arithmetic and comparisons
+	c.renderStringAndCompare(`[% t.add("36h").format("%F") %]|[% t.add_date(0, 1, 0).format("%F") %]`, vars, `2024-03-06|2024-04-05`)
+	c.renderStringAndCompare(`[% t.before(later) %]|[% t.after(later) %]|[% later.sub(t).hours() %]`, vars, `true|false|3`)
+
+	// Methods not provided by the time depot are the real methods
+	c.renderStringAndCompare(`[% t.year() %]/[% t.yearDay() %]`, vars, `2024/65`)
+}
+
+func TestTTerse_UserFilter(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{
+		"shout": func(s string, n int) string { return strings.ToUpper(s) + strings.Repeat("!", n) },
+	}
+	c.renderStringAndCompare(`[% "hello" | shout(3) %]`, vars, `HELLO!!!`)
+	c.renderStringAndCompare(`[% "hello" | shout(1) | html %]`, vars, `HELLO!`)
+}
+
+func TestTTerse_NumberFilters(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"n": 1234567.891, "price": 1234.56, "ratio": 0.256, "size": 1536, "neg": -9876}
+	template := `[% n | commify %]|[% price | number(2) %]|[% n | number %]|[% price | currency %]|[% price | currency("JPY") %]|[% ratio | percent(1) %]|[% size | bytes %]|[% neg | commify %]`
+	c.renderStringAndCompare(template, vars, `1,234,567.891|1,234.56|1,234,567.891|$1,234.56|¥1,235|25.6%|1.5 KB|-9,876`)
+
+	vars["locale"] = "de-DE"
+	c.renderStringAndCompare(template, vars, "1.234.567,891|1.234,56|1.234.567,891|1.234,56\u00a0€|1.235\u00a0¥|25,6\u00a0%|1,5 KB|-9.876")
+
+	vars["locale"] = "en_IN"
+	c.renderStringAndCompare(`[% 123456789 | commify %]|[% price | currency %]`, vars, `12,34,56,789|₹1,234.56`)
+
+	c.renderStringAndCompare(`[% "abc" | commify %]|[% 1 | bytes %]|[% 3221225472 | bytes(2) %]`, nil, `abc|1 byte|3.00 GB`)
+
+	// Halves are rounded away from zero, not to even
+	vars = Vars{"yen": -1234.5, "half": 2.5, "cents": 0.125, "negcents": -0.125, "neg": -0.4, "small": 0.0125}
+	c.renderStringAndCompare(`[% yen | currency("JPY") %]|[% half | currency("JPY") %]|[% neg | currency("JPY") %]|[% cents | currency %]|[% negcents | currency %]`, vars, `-¥1,235|¥3|¥0|$0.13|-$0.13`)
+	c.renderStringAndCompare(`[% cents | percent %]|[% small | percent(1) %]|[% negcents | percent %]|[% half | number(0) %]`, vars, `13%|1.3%|-13%|3`)
+}
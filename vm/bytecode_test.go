@@ -32,3 +32,21 @@ func TestByteCode_String(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, bc.String())
 	}
 }
+
+func TestOp_MarshalBinaryLiterals(t *testing.T) {
+	for _, arg := range []interface{}{"text", []byte("bytes")} {
+		o := NewOp(TXOPLiteral, arg).(*op)
+		b, err := o.MarshalBinary()
+		if err != nil {
+			t.Fatalf("failed to marshal %#v: %s", arg, err)
+		}
+
+		x := &op{}
+		if err := x.UnmarshalBinary(b); err != nil {
+			t.Fatalf("failed to unmarshal %#v: %s", arg, err)
+		}
+		if fmt.Sprintf("%T %s", x.Arg(), x.Arg()) != fmt.Sprintf("%T %s", arg, arg) {
+			t.Errorf("Expected %#v, got %#v", arg, x.Arg())
+		}
+	}
+}
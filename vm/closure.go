@@ -0,0 +1,252 @@
+package vm
+
+// Backend selects how the VM executes ByteCode
+type Backend int
+
+const (
+	// BackendInterpreter dispatches each op through the Op interface.
+	// This is the default
+	BackendInterpreter Backend = iota
+	// BackendClosure compiles the ByteCode into a list of Go closures, one
+	// per op, with the op arguments bound in advance and fast paths for
+	// common types. The ByteCode is compiled the first time it's run, so
+	// it must not be modified afterwards. The output is the same as with
+	// BackendInterpreter
+	BackendClosure
+)
+
+// opFunc is an op compiled for BackendClosure. Like OpHandler, it moves
+// st to the next op to execute
+type opFunc func(st *State)
+
+// closures returns the ops of b compiled for BackendClosure. The end op
+// is compiled to nil
+func (b *ByteCode) closures() []opFunc {
+	b.closureOnce.Do(func() {
+		if b.closureFuncs == nil {
+			b.closureFuncs = compileClosures(b.OpList)
+		}
+	})
+	return b.closureFuncs
+}
+
+// exec runs ops from the current position until the end op is reached
+func (st *State) exec() {
+	if st.backend == BackendClosure {
+		funcs := st.pc.closures()
+		for f := funcs[st.opidx]; f != nil; f = funcs[st.opidx] {
+			f(st)
+		}
+		return
+	}
+
+	for op := st.CurrentOp(); op.Type() != TXOPEnd; op = st.CurrentOp() {
+		op.Call(st)
+	}
+}
+
+func compileClosures(ops []Op) []opFunc {
+	funcs := make([]opFunc, len(ops))
+	for i, op := range ops {
+		funcs[i] = compileClosure(op)
+	}
+	return funcs
+}
+
+// compileClosure compiles op into an opFunc. Jumps are relative, like in
+// the ByteCode, so that the closures of MACROs can be run by themselves.
+// Ops without a specialized version use their OpHandler
+func compileClosure(op Op) opFunc {
+	switch op.Type() {
+	case TXOPEnd:
+		return nil
+	case TXOPNoop:
+		return func(st *State) { st.opidx++ }
+	case TXOPLiteral:
+		v := op.Arg()
+		return func(st *State) {
+			st.sa = v
+			st.opidx++
+		}
+	case TXOPMoveToSb:
+		return func(st *State) {
+			st.sb = st.sa
+			st.opidx++
+		}
+	case TXOPPush:
+		return func(st *State) {
+			st.StackPush(st.sa)
+			st.opidx++
+		}
+	case TXOPPop:
+		return func(st *State) {
+			st.sa = st.StackPop()
+			st.opidx++
+		}
+	case TXOPPushmark:
+		return func(st *State) {
+			st.Pushmark()
+			st.opidx++
+		}
+	case TXOPPopmark:
+		return func(st *State) {
+			st.Popmark()
+			st.opidx++
+		}
+	case TXOPFetchSymbol:
+		// The compiler emits symbol names as []byte
+		var key string
+		switch v := op.Arg().(type) {
+		case string:
+			key = v
+		case []byte:
+			key = string(v)
+		default:
+			return opFunc(op.Handler())
+		}
+		return func(st *State) {
+			st.sa = st.vars[key]
+			st.opidx++
+		}
+	case TXOPLoadLvar:
+		idx := op.ArgInt()
+		return func(st *State) {
+			v, err := st.CurrentFrame().GetLvar(idx)
+			if err != nil {
+				st.Warnf("failed to load variable: %s\n", err)
+				v = nil
+			}
+			st.sa = v
+			st.opidx++
+		}
+	case TXOPSaveToLvar:
+		idx := op.ArgInt()
+		return func(st *State) {
+			st.CurrentFrame().SetLvar(idx, st.sa)
+			st.opidx++
+		}
+	case TXOPPrintRawConst:
+		s := op.ArgString()
+		return func(st *State) {
+			st.AppendOutputString(s)
+			st.opidx++
+		}
+	case TXOPGoto:
+		offset := op.ArgInt()
+		return func(st *State) { st.opidx += offset }
+	case TXOPAnd:
+		offset := op.ArgInt()
+		return func(st *State) {
+			if fastBool(st.sa) {
+				st.opidx++
+			} else {
+				st.opidx += offset
+			}
+		}
+	case TXOPAdd, TXOPSub, TXOPMul:
+		return closureArithmetic(op.Type(), op.Handler())
+	case TXOPEquals, TXOPNotEquals, TXOPLessThan, TXOPGreaterThan:
+		return closureComparison(op.Type(), op.Handler())
+	}
+	return opFunc(op.Handler())
+}
+
+// fastBool is interfaceToBool, with fast paths for common types
+func fastBool(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case string:
+		return v != "" && v != "0"
+	}
+	return interfaceToBool(v)
+}
+
+// fastInts returns sb and sa as integers if they're both int or int64
+func fastInts(st *State) (int64, int64, bool) {
+	var l, r int64
+	switch v := st.sb.(type) {
+	case int64:
+		l = v
+	case int:
+		l = int64(v)
+	default:
+		return 0, 0, false
+	}
+	switch v := st.sa.(type) {
+	case int64:
+		r = v
+	case int:
+		r = int64(v)
+	default:
+		return 0, 0, false
+	}
+	return l, r, true
+}
+
+// closureArithmetic compiles add, sub and mul, with fast paths for
+// integers and floats. Anything else is left to h
+func closureArithmetic(t OpType, h OpHandler) opFunc {
+	return func(st *State) {
+		if l, r, ok := fastInts(st); ok {
+			switch t {
+			case TXOPAdd:
+				st.sa = l + r
+			case TXOPSub:
+				st.sa = l - r
+			case TXOPMul:
+				st.sa = l * r
+			}
+			st.opidx++
+			return
+		}
+		l, lok := st.sb.(float64)
+		r, rok := st.sa.(float64)
+		if !lok || !rok {
+			h(st)
+			return
+		}
+		switch t {
+		case TXOPAdd:
+			st.sa = l + r
+		case TXOPSub:
+			st.sa = l - r
+		case TXOPMul:
+			st.sa = l * r
+		}
+		st.opidx++
+	}
+}
+
+// closureComparison compiles numeric comparisons, with fast paths for
+// integers, and for strings in the case of equals and not_equals
+func closureComparison(t OpType, h OpHandler) opFunc {
+	return func(st *State) {
+		if l, r, ok := fastInts(st); ok {
+			switch t {
+			case TXOPEquals:
+				st.sa = l == r
+			case TXOPNotEquals:
+				st.sa = l != r
+			case TXOPLessThan:
+				st.sa = l < r
+			case TXOPGreaterThan:
+				st.sa = l > r
+			}
+			st.opidx++
+			return
+		}
+		if t == TXOPEquals || t == TXOPNotEquals {
+			l, lok := st.sb.(string)
+			r, rok := st.sa.(string)
+			if lok && rok {
+				st.sa = (l == r) == (t == TXOPEquals)
+				st.opidx++
+				return
+			}
+		}
+		h(st)
+	}
+}
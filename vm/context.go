@@ -0,0 +1,120 @@
+package vm
+
+import (
+	"context"
+	"io"
+	"reflect"
+)
+
+var callContextType = reflect.TypeOf((*CallContext)(nil))
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// CallContext gives Go functions called from templates access to the
+// render that they are called from. Functions and methods whose first
+// parameter is a *CallContext are passed one, followed by the arguments
+// given in the template:
+//
+//	func uriFor(c *vm.CallContext, path string) string {
+//	  base, _ := c.Var("base_uri").(string)
+//	  return base + path
+//	}
+//
+//	[% uri_for("/login") %]
+//
+// CallContext is also a context.Context: the one given to RunContext.
+// Functions whose first parameter is a context.Context get that context
+// instead. A CallContext is only valid until the function returns
+type CallContext struct {
+	context.Context
+	e *env
+}
+
+// callContext returns the CallContext for functions called from e
+func (e *env) callContext() *CallContext {
+	return &CallContext{Context: e.context(), e: e}
+}
+
+// Template returns the name of the template being rendered. Within
+// INCLUDEd templates, this is the name of the included template
+func (c *CallContext) Template() string {
+	template, _ := c.e.location()
+	return template
+}
+
+// Line returns the line of the template that the function is called from
+func (c *CallContext) Line() int {
+	_, line := c.e.location()
+	return line
+}
+
+// Vars returns the template variables
+func (c *CallContext) Vars() Vars {
+	return c.e.Vars()
+}
+
+// Var returns the template variable name, or nil if it does not exist
+func (c *CallContext) Var(name string) interface{} {
+	return c.e.vars[name]
+}
+
+// Locale returns the locale of the render, taken from the "locale"
+// template variable
+func (c *CallContext) Locale() string {
+	locale, _ := c.e.vars["locale"].(string)
+	return locale
+}
+
+// Writer returns the writer that the output of the template is being
+// written to. Anything written to it appears in place of the call
+func (c *CallContext) Writer() io.Writer {
+	return c.e.output
+}
+
+// Warnf emits a warning, like the ones the VM emits
+func (c *CallContext) Warnf(format string, args ...interface{}) {
+	c.e.Warnf(format, args...)
+}
+
+// Load returns the value stored under key by Store during this render.
+// Values are shared with INCLUDEd and WRAPPER templates, so they can be
+// used to cache things for the duration of the render
+func (c *CallContext) Load(key interface{}) (interface{}, bool) {
+	v, ok := c.e.root().values[key]
+	return v, ok
+}
+
+// Store stores value under key for the rest of the render
+func (c *CallContext) Store(key, value interface{}) {
+	e := c.e.root()
+	if e.values == nil {
+		e.values = make(map[interface{}]interface{})
+	}
+	e.values[key] = value
+}
+
+// newSubVM creates a VM to run templates called from this one, such as
+// INCLUDEd templates. They share the settings and the context of this
+// render
+func (st *State) newSubVM() *VM {
+	vm := NewVM()
+	vm.SetMaxLoopCount(st.MaxLoopCount)
+	vm.SetBackend(st.backend)
+	vm.st.parent = &st.env
+	return vm
+}
+
+// implicitArgs returns the arguments that are passed to fun in addition
+// to the template arguments: a *CallContext or context.Context, if that's
+// what its first parameter is
+func implicitArgs(e *env, ft reflect.Type) []reflect.Value {
+	if ft.NumIn() == 0 || (ft.IsVariadic() && ft.NumIn() == 1) {
+		return nil
+	}
+	switch ft.In(0) {
+	case callContextType:
+		return []reflect.Value{reflect.ValueOf(e.callContext())}
+	case contextType:
+		return []reflect.Value{reflect.ValueOf(e.context())}
+	}
+	return nil
+}
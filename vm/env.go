@@ -0,0 +1,123 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// env is the environment that a template is rendered in: where the
+// output goes, the template variables, and the settings and context of
+// the render. The State of the VM and the Runtime of templates compiled
+// to Go source both embed it, and what the ops do is written against it,
+// so that templates are rendered the same way by both
+type env struct {
+	// output
+	output io.Writer
+	warn   io.Writer
+
+	// numbuf is where numbers are formatted when printed
+	numbuf [32]byte
+
+	// template variables
+	vars Vars
+
+	// closureVars is the copy of vars shared by the lambdas created
+	// during the run, which may be called after vars is released
+	closureVars Vars
+
+	MaxLoopCount int
+
+	// loops are the loop variables of the FOREACH loops being run,
+	// innermost last. Used to find loop.parent
+	loops []*LoopVar
+
+	// iterators that FOREACH loops are pulling from. They are stopped
+	// when the loop is done, or when the template is done running
+	iterators []iterator
+
+	// ctx is the context of the render. parent is the environment of
+	// the template that INCLUDEd this one, if any, and values are the
+	// values stored with CallContext.Store, which are kept by the
+	// top-level environment
+	ctx    context.Context
+	parent *env
+	values map[interface{}]interface{}
+
+	// location returns the name of the template and the line being run,
+	// for errors
+	location func() (string, int)
+}
+
+// Vars returns the current set of variables
+func (e *env) Vars() Vars {
+	return e.vars
+}
+
+// Warnf is used to generate warnings while rendering
+func (e *env) Warnf(format string, args ...interface{}) {
+	e.warn.Write([]byte(fmt.Sprintf(format, args...)))
+}
+
+// AppendOutput appends the specified bytes to the output
+func (e *env) AppendOutput(b []byte) {
+	// XXX Error checking?
+	e.output.Write(b)
+}
+
+// AppendOutputString is the same as AppendOutput, but uses a string
+func (e *env) AppendOutputString(o string) {
+	io.WriteString(e.output, o)
+}
+
+// root returns the environment of the top-level template being rendered
+func (e *env) root() *env {
+	for e.parent != nil {
+		e = e.parent
+	}
+	return e
+}
+
+// context returns the context of the current render
+func (e *env) context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// pushLoop records that the FOREACH loop with loop variable lv has
+// started, and sets its parent. depth is the number of frames that
+// enclose the loop
+func (e *env) pushLoop(lv *LoopVar, depth int) {
+	// Forget about the loops that we have left
+	for len(e.loops) > 0 && e.loops[len(e.loops)-1].depth >= depth {
+		e.loops = e.loops[:len(e.loops)-1]
+	}
+
+	lv.depth = depth
+	if len(e.loops) > 0 {
+		lv.Parent = e.loops[len(e.loops)-1]
+	}
+	e.loops = append(e.loops, lv)
+}
+
+// stopIterator stops it, and forgets about it
+func (e *env) stopIterator(it iterator) {
+	for i, x := range e.iterators {
+		if x == it {
+			e.iterators = append(e.iterators[:i], e.iterators[i+1:]...)
+			break
+		}
+	}
+	it.stop()
+}
+
+// stopIterators stops the iterators of loops that were left before
+// they were exhausted, e.g. via LAST
+func (e *env) stopIterators() {
+	for _, it := range e.iterators {
+		it.stop()
+	}
+	e.iterators = nil
+}
@@ -0,0 +1,149 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/lestrrat/go-xslate/internal/rbpool"
+	"github.com/pkg/errors"
+)
+
+// RenderError is the error returned when running a template fails, such
+// as when a function called from it returns an error. Template and Line
+// are the location in the template where the error was raised
+type RenderError struct {
+	Template string
+	Line     int
+	Err      error
+}
+
+func (e *RenderError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s at %s line %d", e.Err, e.Template, e.Line)
+	}
+	return fmt.Sprintf("%s in %s", e.Err, e.Template)
+}
+
+// Message returns the error message, without the location. In CATCH
+// blocks, this is available as `error.message`
+func (e *RenderError) Message() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error, for github.com/pkg/errors
+func (e *RenderError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the underlying error, for errors.Is and errors.As
+func (e *RenderError) Unwrap() error {
+	return e.Err
+}
+
+// tryHandler records the state of the VM when a TRY block was entered,
+// so that it can be restored when an error is raised within the block
+type tryHandler struct {
+	catch     int // location of the CATCH block
+	stack     int
+	markstack int
+	frames    int
+	loops     int
+	iterators int
+	output    io.Writer
+	buf       *bytes.Buffer // output of the TRY block
+}
+
+// raise aborts the execution of the template with err. The error is
+// caught by the innermost TRY block, if any, and otherwise it is
+// returned from the render
+func (e *env) raise(err error) {
+	panic(e.renderError(err))
+}
+
+// renderError adds the current location to err. Errors that already
+// have a location, such as errors from included templates, are returned
+// as is
+func (e *env) renderError(err error) *RenderError {
+	if re, ok := err.(*RenderError); ok {
+		return re
+	}
+
+	template, line := e.location()
+	return &RenderError{Template: template, Line: line, Err: err}
+}
+
+// recovered converts a value recovered from a panic to a RenderError
+func (e *env) recovered(v interface{}) *RenderError {
+	if err, ok := v.(error); ok {
+		return e.renderError(err)
+	}
+	return e.renderError(errors.Errorf("%v", v))
+}
+
+// currentLocation returns the name of the template being run, and the
+// line of the current op
+func (st *State) currentLocation() (string, int) {
+	if st.opidx < len(st.pc.OpList) {
+		return st.pc.Name, st.CurrentOp().Line()
+	}
+	return st.pc.Name, 0
+}
+
+// txTry enters a TRY block. Its output is buffered until the block is
+// done, so that it can be discarded if an error is raised
+func txTry(st *State) {
+	h := &tryHandler{
+		catch:     st.CurrentPos() + st.CurrentOp().ArgInt(),
+		stack:     st.stack.Size(),
+		markstack: st.markstack.Size(),
+		frames:    st.frames.Size(),
+		loops:     len(st.loops),
+		iterators: len(st.iterators),
+		output:    st.output,
+		buf:       rbpool.Get(),
+	}
+	st.handlers = append(st.handlers, h)
+	st.output = h.buf
+	st.Advance()
+}
+
+// txEndTry leaves a TRY block, and writes out its output
+func txEndTry(st *State) {
+	h := st.handlers[len(st.handlers)-1]
+	st.handlers = st.handlers[:len(st.handlers)-1]
+
+	st.output = h.output
+	st.AppendOutput(h.buf.Bytes())
+	rbpool.Release(h.buf)
+	st.Advance()
+}
+
+// catch restores the state of the VM to when the innermost TRY block was
+// entered, and jumps to its CATCH block with the error in sa, where the
+// CATCH block stores it in its local variable `error`. It returns false
+// if we're not in a TRY block
+func (st *State) catch(err *RenderError) bool {
+	if len(st.handlers) == 0 {
+		return false
+	}
+	h := st.handlers[len(st.handlers)-1]
+	st.handlers = st.handlers[:len(st.handlers)-1]
+
+	st.stack.Truncate(h.stack)
+	st.markstack.Truncate(h.markstack)
+	st.frames.Truncate(h.frames)
+	if len(st.loops) > h.loops {
+		st.loops = st.loops[:h.loops]
+	}
+	for len(st.iterators) > h.iterators {
+		st.stopIterator(st.iterators[len(st.iterators)-1])
+	}
+	st.output = h.output
+	rbpool.Release(h.buf)
+
+	st.sa = err
+	st.sb = nil
+	st.AdvanceTo(h.catch)
+	return true
+}
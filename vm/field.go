@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"reflect"
+
+	"github.com/lestrrat/go-xslate/functions"
+	"github.com/lestrrat/go-xslate/functions/strings"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var loopVarType = reflect.TypeOf(LoopVar{})
+
+// fetchField returns the field name of container. Fields of nil are
+// nil, so that a.b.c does not need to check for each level, and fields
+// of a function namespace are its nested namespaces. Otherwise fields
+// are resolved as described in functions.LookupField. The fields of the
+// loop variable can also be accessed by their Template-Toolkit and
+// Text::Xslate names, and errors from methods used as properties are
+// raised.
+//
+// Fields that container does not have are nil, with a warning
+func (e *env) fetchField(container interface{}, name string) interface{} {
+	if container == nil {
+		return nil
+	}
+
+	if fd, ok := container.(*functions.FuncDepot); ok {
+		// Nested function namespace, as in `[% encoding.json.Marshal(x) %]`
+		if child, ok := fd.Depot(name); ok {
+			return child
+		}
+		return nil
+	}
+
+	rv := reflect.ValueOf(container)
+	if v := indirect(rv); v.IsValid() && v.Type() == loopVarType {
+		if alias, ok := loopVarAliases[strings.Ucfirst(name)]; ok {
+			name = alias
+		}
+	}
+
+	v, ok, err := functions.LookupField(rv, name)
+	if err != nil {
+		e.raise(err)
+	}
+	if !ok {
+		e.Warnf("Cannot fetch field '%s' from %T\n", name, container)
+	}
+	return v
+}
@@ -0,0 +1,30 @@
+package vm
+
+import (
+	"github.com/lestrrat/go-xslate/functions"
+	"github.com/lestrrat/go-xslate/functions/number"
+	txtime "github.com/lestrrat/go-xslate/functions/time"
+)
+
+// filters contains the filters that are available in addition to the
+// built-in html, uri and mark_raw filters. The value being filtered is
+// passed as the first argument, followed by the filter's arguments
+var filters = functions.NewFuncDepot("filters")
+
+func init() {
+	filters.Set("date", txtime.Format)
+	filters.Set("strftime", txtime.Strftime)
+	filters.Set("time_ago", txtime.Ago)
+	filters.Set("tz", txtime.In)
+}
+
+// localeFilters are filters whose output depends on the locale, which is
+// taken from the "locale" variable of the current render. Each entry
+// returns the filter function for the given locale
+var localeFilters = map[string]func(string) interface{}{
+	"bytes":    func(l string) interface{} { return number.For(l).Bytes },
+	"commify":  func(l string) interface{} { return number.For(l).Commify },
+	"currency": func(l string) interface{} { return number.For(l).Currency },
+	"number":   func(l string) interface{} { return number.For(l).Number },
+	"percent":  func(l string) interface{} { return number.For(l).Percent },
+}
@@ -1,8 +1,8 @@
 package vm
 
 import (
-	"io"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/lestrrat/go-xslate/internal/stack"
@@ -15,6 +15,11 @@ type ByteCode struct {
 	GeneratedOn time.Time
 	Name        string
 	Version     float32
+
+	// closureFuncs are the ops compiled for BackendClosure, the first
+	// time that they are run
+	closureOnce  sync.Once
+	closureFuncs []opFunc
 }
 
 // OpType is an integer identifying the type of op code
@@ -32,8 +37,10 @@ type Op interface {
 	Call(*State)
 	Comment() string
 	Handler() OpHandler
+	Line() int
 	SetArg(interface{})
 	SetComment(string)
+	SetLine(int)
 	String() string
 	Type() OpType
 }
@@ -43,23 +50,19 @@ type op struct {
 	OpHandler
 	uArg    interface{}
 	comment string
+	line    int
 }
 
 // State keeps track of Xslate Virtual Machine state
 type State struct {
+	env
+
 	opidx int
 	pc    *ByteCode
 
 	stack     stack.Stack
 	markstack stack.Stack
 
-	// output
-	output io.Writer
-	warn   io.Writer
-
-	// template variables
-	vars Vars
-
 	// registers
 	sa   interface{}
 	sb   interface{}
@@ -69,8 +72,13 @@ type State struct {
 	framestack stack.Stack
 	frames     stack.Stack
 
-	Loader       byteCodeLoader
-	MaxLoopCount int
+	Loader byteCodeLoader
+
+	// handlers are the TRY blocks being run, innermost last
+	handlers []*tryHandler
+
+	// backend is how ops are executed
+	backend Backend
 }
 
 // LoopVar is the variable available within FOREACH loops
@@ -78,12 +86,28 @@ type LoopVar struct {
 	Index    int           // 0 origin, current index
 	Count    int           // loop.Index + 1
 	Body     reflect.Value // alias to array
-	Size     int           // len(loop.Body)
+	Size     int           // len(loop.Body), -1 if iterating over a stream
 	MaxIndex int           // loop.Size - 1
 	PeekNext interface{}   // previous item. nil if not available
 	PeekPrev interface{}   // next item. nil if not available
 	IsFirst  bool          // true only if Index == 0
-	IsLast   bool          // true only if Index == MaxIndex
+	IsLast   bool          // true only if this is the last item
+	Revindex int           // loop.MaxIndex - loop.Index, -1 if not known
+	Even     bool          // true if Count is even
+	Odd      bool          // true if Count is odd
+	Parity   string        // "even" or "odd"
+	Parent   *LoopVar      // loop variable of the enclosing loop, or nil
+	MaxCount int           // loop is aborted after this many iterations
+
+	// For channels, iter.Seq and Iterators, items are pulled from iter,
+	// always reading one item ahead so that PeekNext and IsLast work.
+	// item is the current item, which becomes PeekPrev
+	iter    iterator
+	hasNext bool
+	item    interface{}
+	// depth is the number of frames when the loop started. Loops with
+	// more frames than the current number of frames have been exited
+	depth int
 }
 
 // Vars represents the variables passed into the Virtual Machine
@@ -151,6 +175,21 @@ const (
 	TXOPFilter
 	TXOPSaveWriter
 	TXOPRestoreWriter
+	TXOPMakeClosure
+	TXOPForLimit
+	TXOPDefinedOr
+	TXOPDefault
+	TXOPConcat
+	TXOPRepeat
+	TXOPStringLessThan
+	TXOPStringGreaterThan
+	TXOPStringLessThanEquals
+	TXOPStringGreaterThanEquals
+	TXOPStringCompare
+	TXOPFetchSlice
+	TXOPTry
+	TXOPEndTry
+	TXOPMakeMacro
 	TXOPEnd
 	TXOPMax
 )
@@ -0,0 +1,142 @@
+package vm
+
+import (
+	"iter"
+	"reflect"
+	"sort"
+
+	"github.com/lestrrat/go-xslate/functions"
+	"github.com/lestrrat/go-xslate/functions/hash"
+)
+
+// Iterator can be implemented by objects that FOREACH should iterate
+// over lazily. Next advances the iterator, and returns false when there
+// are no more items. Value returns the current item
+//
+//   [% FOREACH row IN rows %]...[% END %]  (rows implements Iterator)
+type Iterator interface {
+	Next() bool
+	Value() interface{}
+}
+
+// iterator produces the items of a FOREACH loop over something whose
+// size is not known beforehand
+type iterator interface {
+	next() (interface{}, bool)
+	stop()
+}
+
+type chanIterator struct {
+	ch reflect.Value
+}
+
+func (i *chanIterator) next() (interface{}, bool) {
+	v, ok := i.ch.Recv()
+	if !ok {
+		return nil, false
+	}
+	return v.Interface(), true
+}
+
+func (i *chanIterator) stop() {}
+
+type userIterator struct {
+	Iterator
+}
+
+func (i *userIterator) next() (interface{}, bool) {
+	if !i.Next() {
+		return nil, false
+	}
+	return i.Value(), true
+}
+
+func (i *userIterator) stop() {}
+
+// seqIterator pulls items from an iter.Seq or iter.Seq2. Items from an
+// iter.Seq2 are hash.Pairs
+type seqIterator struct {
+	pull  func() (interface{}, interface{}, bool)
+	cease func()
+	pairs bool
+}
+
+func (i *seqIterator) next() (interface{}, bool) {
+	k, v, ok := i.pull()
+	if !ok {
+		return nil, false
+	}
+	if i.pairs {
+		return hash.Pair{Key: k, Value: v}, true
+	}
+	return k, true
+}
+
+func (i *seqIterator) stop() {
+	i.cease()
+}
+
+// isSeq returns true if t is a function that can be used as an iter.Seq
+// or iter.Seq2, that is func(yield func(V) bool) or
+// func(yield func(K, V) bool)
+func isSeq(t reflect.Type) bool {
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 0 {
+		return false
+	}
+	yield := t.In(0)
+	if yield.Kind() != reflect.Func || yield.NumOut() != 1 || yield.Out(0).Kind() != reflect.Bool {
+		return false
+	}
+	return yield.NumIn() == 1 || yield.NumIn() == 2
+}
+
+func newSeqIterator(seq reflect.Value) *seqIterator {
+	yieldType := seq.Type().In(0)
+	next, stop := iter.Pull2(func(yield func(interface{}, interface{}) bool) {
+		fn := reflect.MakeFunc(yieldType, func(args []reflect.Value) []reflect.Value {
+			var k, v interface{}
+			k = args[0].Interface()
+			if len(args) > 1 {
+				v = args[1].Interface()
+			}
+			return []reflect.Value{reflect.ValueOf(yield(k, v))}
+		})
+		seq.Call([]reflect.Value{fn})
+	})
+	return &seqIterator{pull: next, cease: stop, pairs: yieldType.NumIn() == 2}
+}
+
+// newIterator returns an iterator for v, or nil if v cannot be iterated
+// lazily
+func newIterator(v reflect.Value) iterator {
+	if it, ok := v.Interface().(Iterator); ok {
+		return &userIterator{it}
+	}
+
+	switch v.Kind() {
+	case reflect.Chan:
+		if v.Type().ChanDir()&reflect.RecvDir != 0 {
+			return &chanIterator{v}
+		}
+	case reflect.Func:
+		if !v.IsNil() && isSeq(v.Type()) {
+			return newSeqIterator(v)
+		}
+	}
+	return nil
+}
+
+// mapToPairs returns the elements of a map as a slice of hash.Pairs,
+// sorted by key
+func mapToPairs(m reflect.Value) reflect.Value {
+	keys := m.MapKeys()
+	sort.SliceStable(keys, func(i, j int) bool {
+		return functions.Compare(keys[i].Interface(), keys[j].Interface()) < 0
+	})
+
+	pairs := make([]hash.Pair, len(keys))
+	for i, k := range keys {
+		pairs[i] = hash.Pair{Key: k.Interface(), Value: m.MapIndex(k).Interface()}
+	}
+	return reflect.ValueOf(pairs)
+}
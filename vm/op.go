@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"reflect"
 
+	"github.com/lestrrat/go-xslate/functions"
 	"github.com/lestrrat/go-xslate/internal/rbpool"
 	"github.com/lestrrat/go-xslate/node"
 	"github.com/pkg/errors"
@@ -23,6 +25,16 @@ func (o OpType) String() string {
 	return opnames[o]
 }
 
+// IsJump returns true if ops of type o refer to another position in the
+// ByteCode by their relative offset
+func (o OpType) IsJump() bool {
+	switch o {
+	case TXOPGoto, TXOPAnd, TXOPDefinedOr, TXOPDefault, TXOPForIter, TXOPTry, TXOPMakeClosure, TXOPMakeMacro:
+		return true
+	}
+	return false
+}
+
 // NewOp creates a new Op.
 func NewOp(o OpType, args ...interface{}) Op {
 	h := optypeToHandler(o)
@@ -75,6 +87,12 @@ func (o op) MarshalBinary() ([]byte, error) {
 		case reflect.Int64:
 			binary.Write(buf, binary.LittleEndian, int64(2))
 			binary.Write(buf, binary.LittleEndian, int64(o.uArg.(int64)))
+		case reflect.Float64:
+			binary.Write(buf, binary.LittleEndian, int64(3))
+			binary.Write(buf, binary.LittleEndian, o.uArg.(float64))
+		case reflect.Bool:
+			binary.Write(buf, binary.LittleEndian, int64(4))
+			binary.Write(buf, binary.LittleEndian, o.uArg.(bool))
 		case reflect.Slice:
 			if tArg.Elem().Kind() != reflect.Uint8 {
 				panic("Slice of what?")
@@ -104,6 +122,8 @@ func (o op) MarshalBinary() ([]byte, error) {
 		binary.Write(buf, binary.LittleEndian, int8(0))
 	}
 
+	binary.Write(buf, binary.LittleEndian, int64(o.line))
+
 	return buf.Bytes(), nil
 }
 
@@ -137,7 +157,19 @@ func (o *op) UnmarshalBinary(data []byte) error {
 				return errors.Wrap(err, "failed to read integer argument during UnmarshalBinary")
 			}
 			o.uArg = i
-		case 5:
+		case 3:
+			var f float64
+			if err := binary.Read(buf, binary.LittleEndian, &f); err != nil {
+				return errors.Wrap(err, "failed to read float argument during UnmarshalBinary")
+			}
+			o.uArg = f
+		case 4:
+			var b bool
+			if err := binary.Read(buf, binary.LittleEndian, &b); err != nil {
+				return errors.Wrap(err, "failed to read boolean argument during UnmarshalBinary")
+			}
+			o.uArg = b
+		case 5, 6:
 			var l int64
 			if err := binary.Read(buf, binary.LittleEndian, &l); err != nil {
 				return errors.Wrap(err, "failed to read length argument during UnmarshalBinary")
@@ -149,7 +181,11 @@ func (o *op) UnmarshalBinary(data []byte) error {
 					return errors.Wrap(err, "failed to read bytes from buffer during UnmarshalBinary")
 				}
 			}
-			o.uArg = b
+			if tArg == 6 {
+				o.uArg = string(b)
+			} else {
+				o.uArg = b
+			}
 		default:
 			panic(fmt.Sprintf("Unknown tArg: %d", tArg))
 		}
@@ -166,6 +202,13 @@ func (o *op) UnmarshalBinary(data []byte) error {
 		}
 	}
 
+	// Ops serialized by older versions do not have line numbers
+	var line int64
+	if err := binary.Read(buf, binary.LittleEndian, &line); err != nil && err != io.EOF {
+		return errors.Wrap(err, "failed to read line number during UnmarshalBinary")
+	}
+	o.line = int(line)
+
 	return nil
 }
 
@@ -183,6 +226,17 @@ func (o *op) SetComment(s string) {
 	o.comment = s
 }
 
+// Line returns the line of the template that this Op was compiled from,
+// or 0 if it's not known
+func (o op) Line() int {
+	return o.line
+}
+
+// SetLine sets the line of the template that this Op was compiled from
+func (o *op) SetLine(line int) {
+	o.line = line
+}
+
 // Arg returns the Op code's argument
 func (o op) Arg() interface{} {
 	return o.uArg
@@ -200,7 +254,7 @@ func (o op) ArgString() string {
 	if v, ok := o.uArg.(string); ok {
 		return v
 	}
-	return interfaceToString(o.uArg)
+	return functions.ToString(o.uArg)
 }
 
 func (o *op) String() string {
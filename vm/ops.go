@@ -1,22 +1,25 @@
 package vm
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"html"
 	"io"
+	"io/ioutil"
 	"reflect"
-	"strconv"
+	"runtime"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/lestrrat/go-xslate/functions"
 	"github.com/lestrrat/go-xslate/functions/array"
 	"github.com/lestrrat/go-xslate/functions/hash"
+	"github.com/lestrrat/go-xslate/functions/strings"
+	txtime "github.com/lestrrat/go-xslate/functions/time"
 	"github.com/lestrrat/go-xslate/internal/rbpool"
 	"github.com/lestrrat/go-xslate/internal/rvpool"
-	"github.com/lestrrat/go-xslate/node"
+	"github.com/pkg/errors"
 )
 
 func init() {
@@ -168,6 +171,51 @@ func init() {
 		case TXOPRestoreWriter:
 			h = txRestoreWriter
 			n = "restore_writer"
+		case TXOPMakeClosure:
+			h = txMakeClosure
+			n = "make_closure"
+		case TXOPForLimit:
+			h = txForLimit
+			n = "for_limit"
+		case TXOPDefinedOr:
+			h = txDefinedOr
+			n = "dor"
+		case TXOPDefault:
+			h = txDefault
+			n = "default"
+		case TXOPConcat:
+			h = txConcat
+			n = "concat"
+		case TXOPRepeat:
+			h = txRepeat
+			n = "repeat"
+		case TXOPStringLessThan:
+			h = txStringLessThan
+			n = "string_lt"
+		case TXOPStringGreaterThan:
+			h = txStringGreaterThan
+			n = "string_gt"
+		case TXOPStringLessThanEquals:
+			h = txStringLessThanEquals
+			n = "string_le"
+		case TXOPStringGreaterThanEquals:
+			h = txStringGreaterThanEquals
+			n = "string_ge"
+		case TXOPStringCompare:
+			h = txStringCompare
+			n = "string_cmp"
+		case TXOPFetchSlice:
+			h = txFetchSlice
+			n = "fetch_slice"
+		case TXOPTry:
+			h = txTry
+			n = "try"
+		case TXOPEndTry:
+			h = txEndTry
+			n = "end_try"
+		case TXOPMakeMacro:
+			h = txMakeMacro
+			n = "make_macro"
 		default:
 			panic("No such optype")
 		}
@@ -224,89 +272,165 @@ func txFetchSymbol(st *State) {
 }
 
 // pushmark
-// load_lvar 0
+// literal_i end
 // push
 // literal_i start
 // push
-// literal_i end
+// load_lvar 0
 // push
 // fetch_slice
-/*
+// popmark
+//
+// Fetches the elements from start to end (inclusive) of an array, slice
+// or string. Negative indexes count from the end. Parts of the range that
+// are out of bounds are ignored, with a warning
 func txFetchSlice(st *State) {
-  container := st.sa
-  if container == nil {
-    // XXX ? no op?
-    st.sa = nil
-  } else {
-    v := reflect.ValueOf(container)
-    v.Slice(
-*/
+	container := st.StackPop()
+	start := st.StackPop()
+	end := st.StackPop()
+	st.sa = st.fetchSlice(container, start, end)
+	st.Advance()
+}
 
-func txFetchField(st *State) {
-	container := st.sa
-	if container == nil {
-		// XXX ? no op?
-		st.sa = nil
-	} else {
-		t := reflect.TypeOf(container)
-		var f reflect.Value
-		var v reflect.Value
-		name := st.CurrentOp().ArgString()
-		switch t.Kind() {
-		case reflect.Ptr, reflect.Struct:
-			// Uppercase first character of field name
-			r, size := utf8.DecodeRuneInString(name)
-			name = string(unicode.ToUpper(r)) + name[size:]
-
-			v = reflect.ValueOf(container)
-			if t.Kind() == reflect.Ptr {
-				// dereference
-				v = v.Elem()
-			}
+// fetchSlice returns the elements of container from start to end. See
+// txFetchSlice
+func (e *env) fetchSlice(container, start, end interface{}) interface{} {
+	v := indirect(reflect.ValueOf(container))
+	if !v.IsValid() {
+		e.Warnf("Use of nil as a list in slice\n")
+		return nil
+	}
 
-			if v.Type().Name() == "LoopVar" {
-				// some special treatment here
-				switch name {
-				case "Max":
-					name = "MaxIndex"
-				case "Next":
-					name = "PeekNext"
-				case "Prev":
-					name = "PeeekPrev"
-				case "First":
-					name = "IsFirst"
-				case "Last":
-					name = "IsLast"
-				}
-			}
+	var runes []rune
+	var size int
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice:
+		size = v.Len()
+	case reflect.String:
+		runes = []rune(v.String())
+		size = len(runes)
+	default:
+		e.Warnf("Cannot slice %s\n", v.Type())
+		return nil
+	}
 
-			f = v.FieldByName(name)
-		case reflect.Map:
-			v = reflect.ValueOf(container)
-			f = v.MapIndex(reflect.ValueOf(name))
-		default:
-			panic(fmt.Sprintf("XXX Put proper error handling here: %s (%s)", container, t))
+	from, ok := toIndex(start)
+	if !ok {
+		e.Warnf("Invalid slice start '%v'\n", start)
+		return nil
+	}
+	to, ok := toIndex(end)
+	if !ok {
+		e.Warnf("Invalid slice end '%v'\n", end)
+		return nil
+	}
+	if from < 0 {
+		from += size
+	}
+	if to < 0 {
+		to += size
+	}
+	if from < 0 || from > size || to >= size {
+		e.Warnf("Slice [%v..%v] out of range (size %d)\n", start, end, size)
+		if from < 0 {
+			from = 0
 		}
+		if from > size {
+			from = size
+		}
+		if to >= size {
+			to = size - 1
+		}
+	}
+	if to < from {
+		// Empty slice
+		to = from - 1
+	}
 
-		st.sa = f.Interface()
+	switch v.Kind() {
+	case reflect.String:
+		return string(runes[from : to+1])
+	case reflect.Slice:
+		return v.Slice(from, to+1).Interface()
+	default:
+		// Arrays are not addressable, and so can't be sliced
+		list := make([]interface{}, 0, to-from+1)
+		for i := from; i <= to; i++ {
+			list = append(list, v.Index(i).Interface())
+		}
+		return list
 	}
+}
+
+// Fetches the field specified in op arg from the container in register
+// sa. See env.fetchField for how fields are resolved
+func txFetchField(st *State) {
+	st.sa = st.fetchField(st.sa, st.CurrentOp().ArgString())
 	st.Advance()
 }
 
+// Fetches an element of an array, slice or string by its index, or a
+// value from a map by its key. Negative indexes count from the end.
+// Indexes that are out of range result in nil, with a warning
 func txFetchArrayElement(st *State) {
-	defer st.Advance()
+	container := st.StackPop()
+	idx := st.StackPop()
+	st.sa = st.fetchElement(container, idx)
+	st.Advance()
+}
 
-	array := reflect.ValueOf(st.StackPop())
-	switch array.Kind() {
-	case reflect.Array, reflect.Slice:
+// fetchElement returns the element idx of container. See
+// txFetchArrayElement
+func (e *env) fetchElement(container, idx interface{}) interface{} {
+	v := indirect(reflect.ValueOf(container))
+	if !v.IsValid() {
+		e.Warnf("Use of nil as a container in element fetch\n")
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		key, ok := functions.MapKey(idx, v.Type().Key())
+		if !ok {
+			e.Warnf("Cannot use '%v' as a key of %s\n", idx, v.Type())
+			return nil
+		}
+		if x := v.MapIndex(key); x.IsValid() {
+			return x.Interface()
+		}
+		return nil
+	case reflect.Array, reflect.Slice, reflect.String:
 	default:
-		st.Warnf("cannot index into non-array/slice element")
-		return
+		e.Warnf("Cannot index into %s\n", v.Type())
+		return nil
 	}
 
-	idx := st.StackPop()
-	v := array.Index(int(idx.(int64)))
-	st.sa = v.Interface()
+	i, ok := toIndex(idx)
+	if !ok {
+		e.Warnf("Invalid index '%v'\n", idx)
+		return nil
+	}
+
+	if v.Kind() == reflect.String {
+		runes := []rune(v.String())
+		if i < 0 {
+			i += len(runes)
+		}
+		if i < 0 || i >= len(runes) {
+			e.Warnf("Index %v out of range (length %d)\n", idx, len(runes))
+			return nil
+		}
+		return string(runes[i])
+	}
+
+	if i < 0 {
+		i += v.Len()
+	}
+	if i < 0 || i >= v.Len() {
+		e.Warnf("Index %v out of range (size %d)\n", idx, v.Len())
+		return nil
+	}
+	return v.Index(i).Interface()
 }
 
 type rawString string
@@ -314,37 +438,41 @@ type rawString string
 func (s rawString) String() string { return string(s) }
 
 var rawStringType = reflect.TypeOf(new(rawString)).Elem()
+var timeType = reflect.TypeOf(time.Time{})
 
 // Wraps the contents of register sa with a "raw string" mark
 // Note that this effectively stringifies the contents of register sa
 func txMarkRaw(st *State) {
-	if reflect.ValueOf(st.sa).Type() != rawStringType {
-		st.sa = rawString(interfaceToString(st.sa))
-	}
+	st.sa = markRaw(st.sa)
 	st.Advance()
 }
 
+func markRaw(v interface{}) interface{} {
+	if _, ok := v.(rawString); ok {
+		return v
+	}
+	return rawString(functions.ToString(v))
+}
+
 // Sets the contents of register sa to a regular string, and removes
 // the "raw string" mark, forcing html escapes to be applied when printing.
 // Note that this effectively stringifies the contents of register sa
 func txUnmarkRaw(st *State) {
-	if reflect.ValueOf(st.sa).Type() == rawStringType {
-		st.sa = string(interfaceToString(st.sa))
-	}
+	st.sa = unmarkRaw(st.sa)
 	st.Advance()
 }
 
+func unmarkRaw(v interface{}) interface{} {
+	if _, ok := v.(rawString); ok {
+		return functions.ToString(v)
+	}
+	return v
+}
+
 // Prints the contents of register sa to Output.
 // Forcefully applies html escaping unless the variable in sa is marked "raw"
 func txPrint(st *State) {
-	arg := st.sa
-	if arg == nil {
-		st.Warnf("Use of nil to print\n")
-	} else if reflect.ValueOf(st.sa).Type() != rawStringType {
-		st.AppendOutputString(html.EscapeString(interfaceToString(arg)))
-	} else {
-		st.AppendOutputString(interfaceToString(arg))
-	}
+	st.print(st.sa, true)
 	st.Advance()
 }
 
@@ -356,12 +484,7 @@ func txPrintRawConst(st *State) {
 // Prints the contents of register sa, forcing raw string semantics
 func txPrintRaw(st *State) {
 	// XXX TODO: mark_raw handling
-	arg := st.sa
-	if arg == nil {
-		st.Warnf("Use of nil to print\n")
-	} else {
-		st.AppendOutputString(interfaceToString(arg))
-	}
+	st.print(st.sa, false)
 	st.Advance()
 }
 
@@ -372,10 +495,10 @@ func txSaveToLvar(st *State) {
 }
 
 func txLoadLvar(st *State) {
-	n := st.CurrentOp().Arg().(*node.LocalVarNode)
-	v, err := st.CurrentFrame().GetLvar(n.Offset)
+	v, err := st.CurrentFrame().GetLvar(st.CurrentOp().ArgInt())
 	if err != nil {
-		st.Warnf("failed to load variable '%s': %s\n", n.Name, err)
+		st.Warnf("failed to load variable: %s\n", err)
+		st.sa = nil
 	} else {
 		st.sa = v
 	}
@@ -383,66 +506,71 @@ func txLoadLvar(st *State) {
 }
 
 func txAdd(st *State) {
-	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
-	switch leftV.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		st.sa = leftV.Int() + rightV.Int()
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		st.sa = leftV.Uint() + rightV.Uint()
-	case reflect.Float32, reflect.Float64:
-		st.sa = leftV.Float() + rightV.Float()
-	}
-
-	// XXX: set to targ?
+	st.sa = arithmetic(TXOPAdd, st.sb, st.sa)
 	st.Advance()
 }
 
 func txSub(st *State) {
-	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
-	switch leftV.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		st.sa = leftV.Int() - rightV.Int()
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		st.sa = leftV.Uint() - rightV.Uint()
-	case reflect.Float32, reflect.Float64:
-		st.sa = leftV.Float() - rightV.Float()
-	}
-
-	// XXX: set to targ?
+	st.sa = arithmetic(TXOPSub, st.sb, st.sa)
 	st.Advance()
 }
 
 func txMul(st *State) {
-	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
-	switch leftV.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		st.sa = leftV.Int() * rightV.Int()
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		st.sa = leftV.Uint() * rightV.Uint()
-	case reflect.Float32, reflect.Float64:
-		st.sa = leftV.Float() * rightV.Float()
-	}
-
-	// XXX: set to targ?
+	st.sa = arithmetic(TXOPMul, st.sb, st.sa)
 	st.Advance()
 }
 
 func txDiv(st *State) {
-	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
+	st.sa = arithmetic(TXOPDiv, st.sb, st.sa)
+	st.Advance()
+}
+
+// arithmetic returns the result of `left op right`, where op is one of
+// add, sub, mul and div. The operands are converted to the same type
+// first, and anything that is not a number is treated as 0
+func arithmetic(op OpType, left, right interface{}) interface{} {
+	leftV, rightV := alignTypesForArithmetic(left, right)
 	switch leftV.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		// XXX This is a hack. We rely on interfaceToString() using FormatFloat(prec = -1)
-		// to get rid of the fractional portions when printing
-		typeF := reflect.TypeOf(0.1)
-		st.sa = leftV.Convert(typeF).Float() / rightV.Convert(typeF).Float()
+		l, r := leftV.Int(), rightV.Int()
+		switch op {
+		case TXOPAdd:
+			return l + r
+		case TXOPSub:
+			return l - r
+		case TXOPMul:
+			return l * r
+		default:
+			// XXX This is a hack. We rely on functions.ToString() using FormatFloat(prec = -1)
+			// to get rid of the fractional portions when printing
+			return float64(l) / float64(r)
+		}
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		st.sa = leftV.Uint() / rightV.Uint()
+		l, r := leftV.Uint(), rightV.Uint()
+		switch op {
+		case TXOPAdd:
+			return l + r
+		case TXOPSub:
+			return l - r
+		case TXOPMul:
+			return l * r
+		default:
+			return l / r
+		}
 	case reflect.Float32, reflect.Float64:
-		st.sa = leftV.Float() / rightV.Float()
+		l, r := leftV.Float(), rightV.Float()
+		switch op {
+		case TXOPAdd:
+			return l + r
+		case TXOPSub:
+			return l - r
+		case TXOPMul:
+			return l * r
+		default:
+			return l / r
+		}
 	}
-
-	// XXX: set to targ?
-	st.Advance()
+	return right
 }
 
 func txAnd(st *State) {
@@ -453,10 +581,57 @@ func txAnd(st *State) {
 	}
 }
 
+// txDefinedOr jumps if sa is not nil, leaving it as the result of
+// `a // b`. Otherwise the ops that follow evaluate b
+func txDefinedOr(st *State) {
+	if st.sa != nil {
+		st.AdvanceBy(st.CurrentOp().ArgInt())
+	} else {
+		st.Advance()
+	}
+}
+
+// txDefault is like txDefinedOr, but it treats empty strings as
+// missing values as well. Used for the `default` filter
+func txDefault(st *State) {
+	if !isEmpty(st.sa) {
+		st.AdvanceBy(st.CurrentOp().ArgInt())
+	} else {
+		st.Advance()
+	}
+}
+
 func txGoto(st *State) {
 	st.AdvanceBy(st.CurrentOp().ArgInt())
 }
 
+// loopVarAliases maps the names of the loop variable's fields in
+// Template-Toolkit and Text::Xslate to the names of LoopVar's fields
+var loopVarAliases = map[string]string{
+	"Max":       "MaxIndex",
+	"Max_index": "MaxIndex",
+	"Next":      "PeekNext",
+	"Peek_next": "PeekNext",
+	"Prev":      "PeekPrev",
+	"Peek_prev": "PeekPrev",
+	"First":     "IsFirst",
+	"Is_first":  "IsFirst",
+	"Last":      "IsLast",
+	"Is_last":   "IsLast",
+	"Number":    "Count",
+}
+
+// Cycle returns one of `values` in turn, starting with the first one
+// on the first iteration:
+//
+//   <tr class="[% loop.cycle("odd", "even") %]">
+func (lv *LoopVar) Cycle(values ...interface{}) interface{} {
+	if len(values) == 0 || lv.Index < 0 {
+		return nil
+	}
+	return values[lv.Index%len(values)]
+}
+
 // NewLoopVar creates the loop variable
 func NewLoopVar(idx int, array reflect.Value) *LoopVar {
 	lv := &LoopVar{
@@ -473,52 +648,114 @@ func NewLoopVar(idx int, array reflect.Value) *LoopVar {
 	return lv
 }
 
+// newStreamLoopVar creates the loop variable for loops over iterators
+func newStreamLoopVar(it iterator) *LoopVar {
+	return &LoopVar{
+		Index:    -1,
+		Size:     -1,
+		MaxIndex: -1,
+		iter:     it,
+	}
+}
+
 func txForStart(st *State) {
-	array := reflect.ValueOf(st.sa)
+	loop := st.forStart(st.sa, st.frames.Size())
 
+	idx := st.CurrentOp().ArgInt()
+	cf := st.CurrentFrame()
+	cf.SetLvar(idx, nil) // item
+	cf.SetLvar(idx+1, loop)
+
+	st.Advance()
+}
+
+// forStart creates the loop variable of a FOREACH loop over list, which
+// is enclosed by depth frames
+func (e *env) forStart(list interface{}, depth int) *LoopVar {
+	array := reflect.ValueOf(list)
+
+	var loop *LoopVar
 	switch array.Kind() {
 	case reflect.Array, reflect.Slice:
 		// Normal case. nothing to do
+	case reflect.Map:
+		// Iterate over key/value pairs, sorted by key
+		array = mapToPairs(array)
 	default:
+		if array.IsValid() {
+			if it := newIterator(array); it != nil {
+				e.iterators = append(e.iterators, it)
+				loop = newStreamLoopVar(it)
+				break
+			}
+		}
 		// Oh you silly goose. You didn't give me a array.
 		// Use a dummy array
 		array = reflect.ValueOf([]struct{}{})
 	}
 
-	cf := st.CurrentFrame()
-	cf.SetLvar(0, nil) // item
-	cf.SetLvar(1, NewLoopVar(-1, array))
-
-	st.Advance()
+	if loop == nil {
+		loop = NewLoopVar(-1, array)
+	}
+	loop.MaxCount = e.MaxLoopCount
+	e.pushLoop(loop, depth)
+	return loop
 }
 
 func txForIter(st *State) {
+	// sa contains the location of the item variable. The loop variable
+	// is stored right next to it
+	idx := int(interfaceToNumeric(st.sa).Int())
 	cf := st.CurrentFrame()
-	var loop *LoopVar
 
 	// The loop variable MUST exist. Not having one is a sure panic
-	v, err := cf.GetLvar(1)
+	v, err := cf.GetLvar(idx + 1)
 	if err != nil {
 		panic("loop var not found: " + err.Error())
 	}
 
-	var ok bool
-	if loop, ok = v.(*LoopVar); !ok {
+	loop, ok := v.(*LoopVar)
+	if !ok {
 		panic("failed to convert loop var")
 	}
 
+	item, more := st.forIter(loop)
+	if !more {
+		// loop done
+		st.AdvanceBy(st.CurrentOp().ArgInt())
+		return
+	}
+	cf.SetLvar(idx, item)
+	st.Advance()
+}
+
+// forIter moves loop to the next item, and returns it. It returns false
+// when there are no more items
+func (e *env) forIter(loop *LoopVar) (interface{}, bool) {
 	slice := loop.Body
 	loop.Index++
 	loop.Count++
-	if loop.Count > st.MaxLoopCount {
-		panic("looped for " + strconv.Itoa(loop.Count) + " times, aborting")
-	}
 
 	loop.IsFirst = loop.Index == 0
 	loop.IsLast = loop.Index == loop.MaxIndex
+	loop.Odd = loop.Count%2 == 1
+	loop.Even = !loop.Odd
+	if loop.Odd {
+		loop.Parity = "odd"
+	} else {
+		loop.Parity = "even"
+	}
+	loop.Revindex = -1
+	if loop.Size >= 0 {
+		loop.Revindex = loop.MaxIndex - loop.Index
+	}
 
-	if loop.Size > loop.Index {
-		cf.SetLvar(0, slice.Index(loop.Index).Interface())
+	more := false
+	if loop.iter != nil {
+		more = e.forIterStream(loop)
+	} else if loop.Size > loop.Index {
+		more = true
+		loop.item = slice.Index(loop.Index).Interface()
 
 		if loop.Size > loop.Index+1 {
 			loop.PeekNext = slice.Index(loop.Index + 1).Interface()
@@ -531,52 +768,139 @@ func txForIter(st *State) {
 		} else {
 			loop.PeekPrev = nil
 		}
-		st.Advance()
-		return
 	}
 
-	// loop done
-	st.AdvanceBy(st.CurrentOp().ArgInt())
+	if !more {
+		return nil, false
+	}
+
+	if loop.MaxCount > 0 && loop.Count > loop.MaxCount {
+		// The body has run MaxCount times, and there are more items
+		e.raise(errors.Errorf("loop has more than %d items, aborting after %d iterations", loop.MaxCount, loop.MaxCount))
+	}
+	return loop.item, true
+}
+
+// txForLimit overrides the maximum number of iterations of the loop
+// whose item variable is at the location in sa
+func txForLimit(st *State) {
+	idx := int(interfaceToNumeric(st.sa).Int())
+	if v, err := st.CurrentFrame().GetLvar(idx + 1); err == nil {
+		if loop, ok := v.(*LoopVar); ok {
+			loop.MaxCount = st.CurrentOp().ArgInt()
+		}
+	}
+	st.Advance()
+}
+
+// forIterStream sets the current item of loop to the next item pulled
+// from loop.iter. It returns false when there are no more items
+func (e *env) forIterStream(loop *LoopVar) bool {
+	var item interface{}
+	if loop.Index == 0 {
+		item, loop.hasNext = loop.iter.next()
+	} else {
+		loop.PeekPrev = loop.item
+		item = loop.PeekNext
+	}
+
+	if !loop.hasNext {
+		e.stopIterator(loop.iter)
+		return false
+	}
+
+	loop.item = item
+	loop.PeekNext, loop.hasNext = loop.iter.next()
+	loop.IsLast = !loop.hasNext
+	if loop.IsLast {
+		loop.Revindex = 0
+	}
+	return true
 }
 
 func txFilter(st *State) {
-	name := st.CurrentOp().Arg().(string)
+	// The value being filtered is the first argument, followed by
+	// arguments to the filter, if any
+	st.sa = st.filter(st.CurrentOp().ArgString(), popCallArgs(st))
+	st.Advance()
+}
+
+// filter applies the filter name to args[0], with the rest of args as
+// the arguments to the filter
+func (e *env) filter(name string, args []reflect.Value) interface{} {
+	var v interface{}
+	if args[0].IsValid() {
+		v = args[0].Interface()
+	}
 
 	// XXX Check for local vars first?
 	switch name {
 	case "html":
-		txHTMLEscape(st)
+		return htmlEscape(v)
 	case "uri":
-		txUriEscape(st)
+		return uriEscape(v)
 	case "mark_raw":
-		txMarkRaw(st)
-	default:
-		panic("User-specified filters not implemented yet")
+		return markRaw(v)
+	}
+	return e.invokeFilter(name, v, args)
+}
+
+// invokeFilter calls user-specified filters. Functions given as template
+// variables take precedence over the filters that come with xslate. v is
+// returned as is if there is no such filter
+func (e *env) invokeFilter(name string, v interface{}, args []reflect.Value) interface{} {
+	fun, ok := e.vars[name]
+	if !ok || reflect.ValueOf(fun).Kind() != reflect.Func {
+		if f, ok := filters.Get(name); ok {
+			fun = f.Interface()
+		} else if f, ok := localeFilters[name]; ok {
+			locale, _ := e.vars["locale"].(string)
+			fun = f(locale)
+		} else {
+			e.Warnf("Unknown filter '%s'\n", name)
+			return v
+		}
+	}
+
+	in := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg.IsValid() {
+			in[i] = arg.Interface()
+		}
 	}
+	return functions.Call(fun, in...)
 }
 
 func txUriEscape(st *State) {
-	v := interfaceToString(st.sa)
-	st.sa = escapeUriString(v)
+	st.sa = uriEscape(st.sa)
 	st.Advance()
 }
 
+func uriEscape(v interface{}) interface{} {
+	return escapeUriString(functions.ToString(v))
+}
+
 func txHTMLEscape(st *State) {
-	v := interfaceToString(st.sa)
-	st.sa = rawString(html.EscapeString(v))
+	st.sa = htmlEscape(st.sa)
 	st.Advance()
 }
 
-func _txEquals(st *State) bool {
+func htmlEscape(v interface{}) interface{} {
+	return rawString(html.EscapeString(functions.ToString(v)))
+}
+
+// equals returns the result of `left == right`. Numbers are compared as
+// numbers, and strings as strings
+func equals(left, right interface{}) bool {
 	var leftV, rightV interface{}
 
 	switch {
-	case isInterfaceNumeric(st.sb):
-		leftV, rightV = alignTypesForArithmetic(st.sb, st.sa)
-	case isInterfaceStringType(st.sb):
-		leftV, rightV = interfaceToString(st.sb), interfaceToString(st.sa)
+	case isInterfaceNumeric(left):
+		leftV, rightV = alignTypesForArithmetic(left, right)
+	case isInterfaceStringType(left):
+		leftV, rightV = functions.ToString(left), functions.ToString(right)
 	default:
-		leftV, rightV = st.sb, st.sa
+		leftV, rightV = left, right
 	}
 
 	switch leftV.(type) {
@@ -599,38 +923,134 @@ func _txEquals(st *State) bool {
 }
 
 func txEquals(st *State) {
-	st.sa = _txEquals(st)
+	st.sa = equals(st.sb, st.sa)
 	st.Advance()
 }
 
 func txNotEquals(st *State) {
-	st.sa = !_txEquals(st)
+	st.sa = !equals(st.sb, st.sa)
 	st.Advance()
 }
 
 func txLessThan(st *State) {
-	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
-	switch leftV.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		st.sa = leftV.Int() < rightV.Int()
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		st.sa = leftV.Uint() < rightV.Uint()
-	case reflect.Float32, reflect.Float64:
-		st.sa = leftV.Float() < rightV.Float()
-	}
+	st.sa = compareNumbers(TXOPLessThan, st.sb, st.sa)
 	st.Advance()
 }
 
 func txGreaterThan(st *State) {
-	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
+	st.sa = compareNumbers(TXOPGreaterThan, st.sb, st.sa)
+	st.Advance()
+}
+
+// compareNumbers returns the result of `left op right`, where op is
+// either less_than or greater_than
+func compareNumbers(op OpType, left, right interface{}) bool {
+	leftV, rightV := alignTypesForArithmetic(left, right)
 	switch leftV.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		st.sa = leftV.Int() > rightV.Int()
+		if op == TXOPLessThan {
+			return leftV.Int() < rightV.Int()
+		}
+		return leftV.Int() > rightV.Int()
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		st.sa = leftV.Uint() > rightV.Uint()
+		if op == TXOPLessThan {
+			return leftV.Uint() < rightV.Uint()
+		}
+		return leftV.Uint() > rightV.Uint()
 	case reflect.Float32, reflect.Float64:
-		st.sa = leftV.Float() > rightV.Float()
+		if op == TXOPLessThan {
+			return leftV.Float() < rightV.Float()
+		}
+		return leftV.Float() > rightV.Float()
+	}
+	return false
+}
+
+// stringOperand stringifies v for the string operator op. nil is
+// treated as an empty string, with a warning
+func (e *env) stringOperand(v interface{}, op string) string {
+	if v == nil {
+		e.Warnf("Use of nil in '%s'\n", op)
+		return ""
+	}
+	return functions.ToString(v)
+}
+
+func isRawString(v interface{}) bool {
+	_, ok := v.(rawString)
+	return ok
+}
+
+// txConcat concatenates the string representations of sb and sa. The
+// result is only marked raw if both operands are
+func txConcat(st *State) {
+	st.sa = st.concat(st.sb, st.sa)
+	st.Advance()
+}
+
+func (e *env) concat(left, right interface{}) interface{} {
+	s := e.stringOperand(left, "~") + e.stringOperand(right, "~")
+	if isRawString(left) && isRawString(right) {
+		return rawString(s)
+	}
+	return s
+}
+
+// txRepeat repeats the string representation of sb sa times. The result
+// is marked raw if sb is
+func txRepeat(st *State) {
+	st.sa = st.repeat(st.sb, st.sa)
+	st.Advance()
+}
+
+func (e *env) repeat(left, right interface{}) interface{} {
+	s := e.stringOperand(left, "x")
+	count := functions.ToInt(right)
+	if count < 0 {
+		count = 0
 	}
+	s = string(bytes.Repeat([]byte(s), count))
+	if isRawString(left) {
+		return rawString(s)
+	}
+	return s
+}
+
+// compareStrings compares the string representations of left and right
+// for the string operator op, returning -1, 0 or 1
+func (e *env) compareStrings(op string, left, right interface{}) int {
+	l, r := e.stringOperand(left, op), e.stringOperand(right, op)
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func txStringLessThan(st *State) {
+	st.sa = st.compareStrings("lt", st.sb, st.sa) < 0
+	st.Advance()
+}
+
+func txStringGreaterThan(st *State) {
+	st.sa = st.compareStrings("gt", st.sb, st.sa) > 0
+	st.Advance()
+}
+
+func txStringLessThanEquals(st *State) {
+	st.sa = st.compareStrings("le", st.sb, st.sa) <= 0
+	st.Advance()
+}
+
+func txStringGreaterThanEquals(st *State) {
+	st.sa = st.compareStrings("ge", st.sb, st.sa) >= 0
+	st.Advance()
+}
+
+func txStringCompare(st *State) {
+	st.sa = int64(st.compareStrings("cmp", st.sb, st.sa))
 	st.Advance()
 }
 
@@ -685,20 +1105,73 @@ func txPop(st *State) {
 
 var funcZero = reflect.Zero(reflect.ValueOf(func() {}).Type())
 
-func invokeFuncSingleReturn(st *State, fun reflect.Value, args []reflect.Value) {
-	if fun.Type().NumIn() != len(args) {
-		st.Warnf("Number of arguments for function does not match (expected %d, got %d)\n", fun.Type().NumIn(), len(args))
-		st.sa = ""
-	} else if fun.Type().NumOut() == 0 {
+// invokeFunc calls the function fun, named name, and returns its
+// return value. Arguments are converted to the types of the parameters
+// as described in functions.Convert. Functions that take a *CallContext
+// or context.Context as their first parameter are passed one. Functions
+// whose last return value is an error abort the template when it is not
+// nil. Functions that return more than one value (not counting the
+// error) return them as a list
+func (e *env) invokeFunc(name string, fun reflect.Value, args []reflect.Value) interface{} {
+	ft := fun.Type()
+	implicit := implicitArgs(e, ft)
+	nin := ft.NumIn() - len(implicit)
+	if !ft.IsVariadic() && nin != len(args) {
+		e.raise(errors.Errorf("wrong number of arguments for function '%s' (expected %d, got %d)", name, nin, len(args)))
+	}
+	if ft.IsVariadic() && nin-1 > len(args) {
+		e.raise(errors.Errorf("wrong number of arguments for function '%s' (expected at least %d, got %d)", name, nin-1, len(args)))
+	}
+
+	// Convert the arguments to the types that the function expects. Extra
+	// arguments of variadic functions are passed as the variadic parameter
+	for i, arg := range args {
+		var t reflect.Type
+		if ft.IsVariadic() && i >= nin-1 {
+			t = ft.In(ft.NumIn() - 1).Elem()
+		} else {
+			t = ft.In(len(implicit) + i)
+		}
+
+		v, err := functions.Convert(arg, t)
+		if err != nil {
+			e.raise(errors.Wrapf(err, "invalid argument %d for function '%s'", i+1, name))
+		}
+		args[i] = v
+	}
+	if implicit != nil {
+		args = append(implicit, args...)
+	}
+
+	ret := fun.Call(args)
+	if n := len(ret); n > 0 && ft.Out(n-1) == errorType {
+		if err := ret[n-1]; !err.IsNil() {
+			e.raise(errors.Wrapf(err.Interface().(error), "function '%s' failed", name))
+		}
+		ret = ret[:n-1]
+	}
+
+	switch len(ret) {
+	case 0:
 		// Purely for side effect
-		st.sa = ""
-	} else {
-		ret := fun.Call(args)
-		// grab only the first return value. If you need the
-		// entire return value set, you need to call invokeFunMultiReturn
-		// (to be implemented)
-		st.sa = ret[0].Interface()
+		return ""
+	case 1:
+		return ret[0].Interface()
+	default:
+		list := make([]interface{}, len(ret))
+		for i, v := range ret {
+			list[i] = v.Interface()
+		}
+		return list
+	}
+}
+
+// funcName returns the name of fun, for error messages
+func funcName(fun reflect.Value) string {
+	if f := runtime.FuncForPC(fun.Pointer()); f != nil {
+		return f.Name()
 	}
+	return "(anonymous)"
 }
 
 // Function calls (NOT to be confused with method calls, which are totally
@@ -720,125 +1193,153 @@ func invokeFuncSingleReturn(st *State, fun reflect.Value, args []reflect.Value)
 // possible. To avoid this, we can register an OBJECT named "time" before hand
 // so that it in turn calls the ordinary time.Now() function
 //
-//  // Exact usage TBD
-//  tx.RegisterFunctions(txtime.New())
+//  tx.RegisterFunctions(txtime.Depot())
 //  tx.Render(...)
-//  [% time.Now %]
+//  [% time.Now() %]
+//
 // ...And that's how we manage function calls
-// See also:
+// See also: txFunCallSymbol
 func txFunCall(st *State) {
-	// Everything in our lvars up to the current tip is our argument list
-	mark := st.CurrentMark()
-	tip := st.stack.Size() - 1
-	var args []reflect.Value
-
-	if tip-mark-1 > 0 {
-		args = make([]reflect.Value, tip-mark-1)
-		for i := mark + 1; tip > i; i++ {
-			v, _ := st.stack.Get(i)
-			args[i-mark] = reflect.ValueOf(v)
-		}
-	}
-
-	x := st.sa
-	st.sa = nil
-	if x == nil {
-		// Do nothing, just advance
-		st.Advance()
-		return
+	// Everything from the current mark up to the tip of the stack is
+	// our argument list. The function itself is in sa
+	args := popCallArgs(st)
+
+	// The name of the variable holding the function, if known
+	var name string
+	if arg := st.CurrentOp().Arg(); arg != nil {
+		name = st.CurrentOp().ArgString()
 	}
+	st.sa = st.funCall(st.sa, name, args)
+	st.Advance()
+}
 
+// funCall calls x, if it's a function. name is the name of the variable
+// holding it, if known
+func (e *env) funCall(x interface{}, name string, args []reflect.Value) interface{} {
 	v := reflect.ValueOf(x)
-	if v.Type().Kind() == reflect.Func {
-		fun := reflect.ValueOf(x)
-		invokeFuncSingleReturn(st, fun, args)
+	if v.Kind() != reflect.Func {
+		return nil
 	}
-	st.Advance()
+	if name == "" {
+		name = funcName(v)
+	}
+	return e.invokeFunc(name, v, args)
 }
 
+// txFunCallSymbol calls a function registered in a FuncDepot, as in
+// `[% time.Now() %]`. The compiler emits this op for any call whose
+// invocant is a plain (possibly dotted) symbol, so if the invocant turns out
+// not to be a FuncDepot, we fallback to an ordinary method call
 func txFunCallSymbol(st *State) {
-	// Everything in our lvars up to the current tip is our argument list
-	mark := st.CurrentMark()
-	tip := st.stack.Size() - 1
-	var args []reflect.Value
+	st.sa = st.funCallSymbol(st.CurrentOp().ArgString(), popCallArgs(st))
+	st.Advance()
+}
 
-	if tip-mark-1 > 0 {
-		args = make([]reflect.Value, tip-mark-1)
-		for i := mark + 1; tip > i; i++ {
-			v, _ := st.stack.Get(i)
-			args[i-mark] = reflect.ValueOf(v)
-		}
+// funCallSymbol calls the function name of the FuncDepot in args[0], or
+// the method name of args[0] if it is not a FuncDepot
+func (e *env) funCallSymbol(name string, args []reflect.Value) interface{} {
+	var fd *functions.FuncDepot
+	ok := false
+	if args[0].IsValid() {
+		fd, ok = args[0].Interface().(*functions.FuncDepot)
+	}
+	if !ok {
+		return e.callMethod(name, args)
 	}
 
-	x, _ := st.stack.Get(mark)
-	v := reflect.ValueOf(x)
-
-	st.sa = nil
-	if st.CurrentOp().Arg() != nil {
-		vtype := v.Type()
-		if vtype.Kind() == reflect.Ptr && vtype.Elem().Kind() == reflect.Struct && v.Elem().Type().Name() == "FuncDepot" {
-			name := interfaceToString(st.CurrentOp().Arg())
-			fd := x.(*functions.FuncDepot)
-			fun, ok := fd.Get(name)
-			if ok {
-				invokeFuncSingleReturn(st, fun, args)
-			}
-		}
+	fun, ok := fd.Get(name)
+	if !ok {
+		// Be lenient about the case of the first character, just like
+		// we are for methods and fields
+		r, size := utf8.DecodeRuneInString(name)
+		fun, ok = fd.Get(string(unicode.ToUpper(r)) + name[size:])
 	}
-	st.Advance()
+	if !ok {
+		e.Warnf("Function '%s' not found in namespace '%s'\n", name, fd.Namespace())
+		return nil
+	}
+	return e.invokeFunc(fd.Namespace()+"."+name, fun, args[1:])
 }
 
-func txMethodCall(st *State) {
-	defer st.Advance() // We advance, regardless of errors
-
-	name := interfaceToString(st.CurrentOp().Arg())
-	// Uppercase first character of field name
-	r, size := utf8.DecodeRuneInString(name)
-	name = string(unicode.ToUpper(r)) + name[size:]
-
+// popCallArgs pops everything from the current mark up to the tip of the
+// stack. The first element is the invocant, the rest are the arguments
+func popCallArgs(st *State) []reflect.Value {
 	mark := st.CurrentMark()
 	tip := st.stack.Size()
 
-	var invocant reflect.Value
 	args := make([]reflect.Value, tip-mark)
 	for i := mark; i < tip; i++ {
 		v := st.stack.Pop()
 		args[tip-i-1] = reflect.ValueOf(v)
-		if i == mark {
-			invocant = args[tip-i-1]
-		}
 	}
+	return args
+}
 
-	// For maps, arrays, slices, we call virtual methods, if they are available
+func txMethodCall(st *State) {
+	st.sa = st.callMethod(st.CurrentOp().ArgString(), popCallArgs(st))
+	st.Advance()
+}
+
+// callMethod calls the method name of args[0], with the rest of args as
+// the arguments. Maps, lists and strings have virtual methods
+func (e *env) callMethod(name string, args []reflect.Value) interface{} {
+	// Uppercase first character of field name
+	name = strings.Ucfirst(name)
+
+	invocant := args[0]
+
+	// For maps, arrays, slices, we call virtual methods, if they are available.
+	// Maps and Arrays/Slices cannot be passed as map[interface{}]interface{}
+	// or []interface{} or any other generic way, so we need to re-allocate
+	// the invocant to a more generic container before dispatching it
 	switch invocant.Kind() {
 	case reflect.Map:
-		fun, ok := hash.Depot().Get(name)
-		if ok {
-			invokeFuncSingleReturn(st, fun, args)
-		}
+		args[0] = reflect.ValueOf(functions.ToMap(invocant.Interface()))
+		return e.invokeVirtualMethod(hash.Depot(), name, args)
 	case reflect.Array, reflect.Slice:
-		// Array/Slices cannot be passed as []interface {} or any other
-		// generic way, so we need to re-allocate the argument to a more
-		// generic []interface {} container before dispatching it
-		list := make([]interface{}, invocant.Len())
-		for i := 0; i < invocant.Len(); i++ {
-			list[i] = invocant.Index(i).Interface()
-		}
-		args[0] = reflect.ValueOf(list)
-		fun, ok := array.Depot().Get(name)
-		if ok {
-			invokeFuncSingleReturn(st, fun, args)
-		}
+		args[0] = reflect.ValueOf(functions.ToList(invocant.Interface()))
+		return e.invokeVirtualMethod(array.Depot(), name, args)
+	case reflect.Invalid:
+		return nil
 	default:
-		method, ok := invocant.Type().MethodByName(name)
-		if !ok {
-			st.sa = nil
-		} else {
-			invokeFuncSingleReturn(st, method.Func, args)
+		// time.Time values get the functions from the time depot,
+		// which accept more liberal arguments than the real methods
+		if _, ok := txtime.Depot().Get(functions.Camelize(name)); ok && invocant.Type() == timeType {
+			return e.invokeVirtualMethod(txtime.Depot(), name, args)
+		}
+
+		method := invocant.MethodByName(name)
+		switch {
+		case method.IsValid():
+			return e.invokeFunc(name, method, args[1:])
+		case invocant.Kind() == reflect.String:
+			// Strings without a method of the same name get virtual methods
+			return e.invokeVirtualMethod(strings.Depot(), name, args)
 		}
+		return nil
 	}
 }
 
+// invokeVirtualMethod calls the function `name` from the given depot.
+// Method names may be in snake case (e.g. "sort_by" calls "SortBy").
+// Arguments that are not given are passed as zero values, so that
+// virtual methods may have optional arguments
+func (e *env) invokeVirtualMethod(fd *functions.FuncDepot, name string, args []reflect.Value) interface{} {
+	fun, ok := fd.Get(functions.Camelize(name))
+	if !ok {
+		e.Warnf("Unknown virtual method '%s'\n", name)
+		return nil
+	}
+
+	in := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg.IsValid() {
+			in[i] = arg.Interface()
+		}
+	}
+	return functions.Call(fun.Interface(), in...)
+}
+
 // XXX can I just push a []int to st.sa?
 func txRange(st *State) {
 	lhs := interfaceToNumeric(st.sb).Int()
@@ -858,8 +1359,9 @@ func txMakeArray(st *State) {
 	start := st.CurrentMark() // start
 	end := st.StackTip()      // end
 
-	if end <= start {
-		panic(fmt.Sprintf("MakeArray: list start (%d) >= end (%d)", start, end))
+	if end < start {
+		// Empty list
+		end = start - 1
 	}
 
 	list := make([]interface{}, end-start+1)
@@ -871,19 +1373,25 @@ func txMakeArray(st *State) {
 }
 
 func txMakeHash(st *State) {
-	start := st.CurrentMark() // start
-	end := st.StackTip()      // end
+	st.sa = makeHash(popCallArgs(st))
+	st.Advance()
+}
 
+// makeHash makes a hash of the keys and values in list. If a key is
+// given more than once, the first value is kept
+func makeHash(list []reflect.Value) map[interface{}]interface{} {
 	hash := make(map[interface{}]interface{})
-	for i := end; i > start; {
-		v := st.StackPop()
-		k := st.StackPop()
+	for i := len(list) - 2; i >= 0; i -= 2 {
+		var k, v interface{}
+		if list[i].IsValid() {
+			k = list[i].Interface()
+		}
+		if list[i+1].IsValid() {
+			v = list[i+1].Interface()
+		}
 		hash[k] = v
-		i -= 2
 	}
-
-	st.sa = hash
-	st.Advance()
+	return hash
 }
 
 func txInclude(st *State) {
@@ -894,31 +1402,21 @@ func txInclude(st *State) {
 	vars := Vars(rvpool.Get())
 	defer rvpool.Release(vars)
 	defer vars.Reset()
-	if x := st.Vars(); x != nil {
-		for k, v := range x {
-			vars.Set(k, v)
-		}
-	}
+	st.includeVars(vars, st.sb)
 
-	if x := st.sb; x != nil {
-		hash := x.(map[interface{}]interface{})
-		// Need to covert this to Vars (map[string]interface{})
-		for k, v := range hash {
-			vars.Set(interfaceToString(k), v)
-		}
-	}
-
-	target := interfaceToString(st.sa)
+	target := functions.ToString(st.sa)
 	bc, err := st.LoadByteCode(target)
 	if err != nil {
-		panic(fmt.Sprintf("Include: Failed to compile %s: %s", target, err))
+		st.raise(errors.Wrapf(err, "failed to include '%s'", target))
 	}
 
 	buf := rbpool.Get()
 	defer rbpool.Release(buf)
 
-	vm := NewVM()
-	vm.Run(bc, vars, buf)
+	vm := st.newSubVM()
+	if err := vm.RunContext(st.ctx, bc, vars, buf); err != nil {
+		st.raise(err)
+	}
 	st.AppendOutputString(buf.String())
 	st.Advance()
 }
@@ -928,45 +1426,48 @@ func txWrapper(st *State) {
 	vars := Vars(rvpool.Get())
 	defer rvpool.Release(vars)
 	defer vars.Reset()
-
-	if x := st.Vars(); x != nil {
-		for k, v := range x {
-			vars.Set(k, v)
-		}
-	}
-
-	if x := st.sb; x != nil {
-		hash := x.(map[interface{}]interface{})
-		// Need to covert this to Vars (map[string]interface{})
-		for k, v := range hash {
-			vars.Set(interfaceToString(k), v)
-		}
-	}
+	st.includeVars(vars, st.sb)
 	vars.Set("content", rawString(st.sa.(string)))
 
 	target := st.CurrentOp().ArgString()
 	bc, err := st.LoadByteCode(target)
 	if err != nil {
-		panic(fmt.Sprintf("Wrapper: Failed to compile %s: %s", target, err))
+		st.raise(errors.Wrapf(err, "failed to load wrapper '%s'", target))
 	}
 
-	vm := NewVM()
-	vm.Run(bc, vars, st.output)
+	vm := st.newSubVM()
+	if err := vm.RunContext(st.ctx, bc, vars, st.output); err != nil {
+		st.raise(err)
+	}
 	st.Advance()
 }
 
+// includeVars sets the variables of a template INCLUDEd from this one
+// to vars: the variables of this template, and the ones given with WITH,
+// which are in the hash with, if any
+func (e *env) includeVars(vars Vars, with interface{}) {
+	for k, v := range e.vars {
+		vars.Set(k, v)
+	}
+	if with != nil {
+		// Need to covert this to Vars (map[string]interface{})
+		for k, v := range with.(map[interface{}]interface{}) {
+			vars.Set(functions.ToString(k), v)
+		}
+	}
+}
+
 func txSaveWriter(st *State) {
 	st.StackPush(st.output)
 
 	buf := rbpool.Get()
 
 	st.StackPush(buf)
-	st.output = bufio.NewWriter(buf)
+	st.output = buf
 	st.Advance()
 }
 
 func txRestoreWriter(st *State) {
-	st.output.(*bufio.Writer).Flush()
 	buf := st.StackPop().(*bytes.Buffer)
 	st.output = st.StackPop().(io.Writer)
 
@@ -976,30 +1477,149 @@ func txRestoreWriter(st *State) {
 	st.Advance()
 }
 
-func txMacroCall(st *State) {
-	x := st.sa.(int)
-	bc := NewByteCode()
-	bc.OpList = st.pc.OpList[x:]
-	vars := Vars{"count": 10, "text": "Hello"}
+// macro is a MACRO defined in a template
+type macro struct {
+	entry int      // Location of the body
+	args  []string // Names of the parameters
+}
+
+// callMacro runs the macro m. The arguments are bound to the names of its
+// parameters, on top of the variables of the caller. Missing arguments
+// are nil
+func callMacro(st *State, m *macro, args []reflect.Value) {
+	vars := make(Vars, len(st.vars)+len(m.args))
+	for k, v := range st.vars {
+		vars[k] = v
+	}
+	for i, name := range m.args {
+		var v interface{}
+		if i < len(args) && args[i].IsValid() {
+			v = args[i].Interface()
+		}
+		vars[name] = v
+	}
 
-	vm := NewVM()
-	vm.Run(bc, vars, st.output)
+	// The macro is run from its location in this ByteCode, so that it
+	// shares the closures for it
+	vm := st.newSubVM()
+	if err := vm.runAt(st.ctx, st.pc, m.entry, vars, st.output); err != nil {
+		st.raise(err)
+	}
+}
+
+// txMakeMacro sets sa to a MACRO, whose body is at the relative position
+// in the op arg. The stack from the current mark contains the names of
+// its parameters. Calling it with funcall_omni runs the macro
+func txMakeMacro(st *State) {
+	mark := st.CurrentMark()
+	args := make([]string, st.stack.Size()-mark)
+	for i := len(args) - 1; i >= 0; i-- {
+		args[i] = functions.ToString(st.StackPop())
+	}
+	st.sa = &macro{entry: st.CurrentPos() + st.CurrentOp().ArgInt(), args: args}
 	st.Advance()
 }
 
 // Executes what's in st.sa
 func txFunCallOmni(st *State) {
+	if m, ok := st.sa.(*macro); ok {
+		callMacro(st, m, popCallArgs(st))
+		// The macro has written its output, so there's nothing more
+		// to print when it's called as [% m() %]
+		st.sa = rawString("")
+		st.Advance()
+		return
+	}
+
 	t := reflect.ValueOf(st.sa)
 	switch t.Kind() {
-	case reflect.Int:
-		// If it's an int, assume that it's a MACRO, which points to
-		// the location in the bytecode that contains the macro code
-		txMacroCall(st)
 	case reflect.Func:
 		txFunCall(st)
 	default:
+		popCallArgs(st)
 		st.Warnf("Unknown variable as function call: %s\n", st.sa)
 		st.sa = nil
 		st.Advance()
 	}
 }
+
+// txMakeClosure creates a lambda. The op arg is the (relative) location of
+// the lambda body, and the stack from the current mark contains the number
+// of arguments, the local variable slots for each of the lambda's
+// arguments, and then the slots of the local variables that the body uses
+// from enclosing scopes.
+//
+// The result is a plain func(...interface{}) interface{}, so it can be
+// called from templates, or passed to Go code as is. Captured local
+// variables and template variables are taken as they are at the time of
+// creation
+func txMakeClosure(st *State) {
+	entry := st.CurrentPos() + st.CurrentOp().ArgInt()
+
+	mark := st.CurrentMark()
+	slots := make([]int, st.stack.Size()-mark-1)
+	for i := len(slots) - 1; i >= 0; i-- {
+		slots[i] = int(interfaceToNumeric(st.StackPop()).Int())
+	}
+	nargs := int(interfaceToNumeric(st.StackPop()).Int())
+	args, captures := slots[:nargs], slots[nargs:]
+
+	cf := st.CurrentFrame()
+	captured := make([]interface{}, len(captures))
+	for i, slot := range captures {
+		v, err := cf.GetLvar(slot)
+		if err == nil {
+			captured[i] = v
+		}
+	}
+
+	// Template variables do not change while the template is being
+	// rendered, so a single copy is shared by all closures created
+	// during the run
+	if st.closureVars == nil {
+		st.closureVars = make(Vars, len(st.vars))
+		for k, v := range st.vars {
+			st.closureVars[k] = v
+		}
+	}
+	vars := st.closureVars
+
+	bc := st.pc
+	loader := st.Loader
+	warn := st.warn
+	maxLoopCount := st.MaxLoopCount
+	backend := st.backend
+	ctx := st.ctx
+	parent := st.root()
+
+	st.sa = func(values ...interface{}) interface{} {
+		cst := NewState()
+		cst.pc = bc
+		cst.opidx = entry
+		cst.vars = vars
+		cst.closureVars = vars
+		cst.output = ioutil.Discard
+		cst.warn = warn
+		cst.Loader = loader
+		cst.MaxLoopCount = maxLoopCount
+		cst.backend = backend
+		cst.ctx = ctx
+		cst.parent = parent
+
+		cf := cst.CurrentFrame()
+		for i, slot := range captures {
+			cf.SetLvar(slot, captured[i])
+		}
+		for i, slot := range args {
+			var v interface{}
+			if i < len(values) {
+				v = values[i]
+			}
+			cf.SetLvar(slot, v)
+		}
+
+		cst.exec()
+		return cst.sa
+	}
+	st.Advance()
+}
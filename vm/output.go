@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/lestrrat/go-xslate/functions"
+)
+
+// writeEscaped writes s to w, HTML escaped like html.EscapeString, without
+// building the escaped string
+func writeEscaped(w io.Writer, s string) {
+	last := 0
+	for i := 0; i < len(s); i++ {
+		var esc string
+		switch s[i] {
+		case '<':
+			esc = "&lt;"
+		case '>':
+			esc = "&gt;"
+		case '&':
+			esc = "&amp;"
+		case '\'':
+			esc = "&#39;"
+		case '"':
+			esc = "&#34;"
+		default:
+			continue
+		}
+		io.WriteString(w, s[last:i])
+		io.WriteString(w, esc)
+		last = i + 1
+	}
+	io.WriteString(w, s[last:])
+}
+
+// print writes v to the output. Unless v is a raw string, it's HTML
+// escaped if escape is true. Common types are written without being
+// converted to a string first. nil is not printed, with a warning
+func (e *env) print(v interface{}, escape bool) {
+	switch v := v.(type) {
+	case nil:
+		e.Warnf("Use of nil to print\n")
+	case string:
+		if escape {
+			writeEscaped(e.output, v)
+		} else {
+			io.WriteString(e.output, v)
+		}
+	case rawString:
+		io.WriteString(e.output, string(v))
+	case int:
+		e.output.Write(strconv.AppendInt(e.numbuf[:0], int64(v), 10))
+	case int64:
+		e.output.Write(strconv.AppendInt(e.numbuf[:0], v, 10))
+	case float64:
+		e.output.Write(strconv.AppendFloat(e.numbuf[:0], v, 'f', -1, 64))
+	case bool:
+		e.output.Write(strconv.AppendBool(e.numbuf[:0], v))
+	default:
+		if escape {
+			writeEscaped(e.output, functions.ToString(v))
+		} else {
+			io.WriteString(e.output, functions.ToString(v))
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+
+	"github.com/lestrrat/go-xslate/functions"
+	"github.com/lestrrat/go-xslate/internal/bwpool"
+	"github.com/lestrrat/go-xslate/internal/rbpool"
+	"github.com/pkg/errors"
+)
+
+// CompiledFunc is a template, or the body of a MACRO, compiled to Go
+// source code by `xslate gen`
+type CompiledFunc func(rt *Runtime, vars Vars)
+
+// CompiledLambda is the body of a lambda compiled to Go source code. lv
+// holds the local variables, including the captured ones and the
+// arguments. It returns the value of the lambda
+type CompiledLambda func(rt *Runtime, vars Vars, lv []interface{}) interface{}
+
+// Runtime is what templates compiled to Go source code by `xslate gen`
+// are rendered with. Its methods do what the corresponding ops do in the
+// VM, using the same code, so that compiled templates render the same
+// output as the VM.
+//
+// It is only meant to be used by generated code
+type Runtime struct {
+	env
+
+	template string
+
+	// Line is the line of the template being run, for errors. It's set
+	// by the generated code
+	Line int
+
+	// frames is the number of scopes entered, like the frames of the VM
+	frames int
+}
+
+// RenderOptions configures how a template compiled to Go source code is
+// rendered. NewRenderOptions returns the same settings as the VM's
+type RenderOptions struct {
+	// MaxLoopCount is the maximum number of iterations of a loop. Loops
+	// that exceed it are aborted. Zero or less means that there's no limit
+	MaxLoopCount int
+
+	// Warnings is where warnings, such as the use of nil, are written.
+	// They are discarded if it's nil
+	Warnings io.Writer
+}
+
+// NewRenderOptions returns the default RenderOptions
+func NewRenderOptions() *RenderOptions {
+	return &RenderOptions{
+		MaxLoopCount: 1000,
+		Warnings:     os.Stderr,
+	}
+}
+
+// RenderCompiled renders the compiled template fn, named name, with vars
+// to w. Functions called from the template that take a context.Context or
+// *CallContext are given ctx. If opts is nil, NewRenderOptions is used.
+// Errors are returned as *RenderError, like the VM does
+func RenderCompiled(ctx context.Context, w io.Writer, name string, fn CompiledFunc, vars Vars, opts *RenderOptions) error {
+	if opts == nil {
+		opts = NewRenderOptions()
+	}
+	if _, ok := w.(*bufio.Writer); !ok {
+		bw := bwpool.Get(w)
+		defer bwpool.Release(bw)
+		defer bw.Flush()
+		w = bw
+	}
+
+	rt := newRuntime(name, w)
+	rt.warn = opts.Warnings
+	if rt.warn == nil {
+		rt.warn = ioutil.Discard
+	}
+	rt.MaxLoopCount = opts.MaxLoopCount
+	rt.ctx = ctx
+	return rt.run(fn, vars)
+}
+
+func newRuntime(name string, w io.Writer) *Runtime {
+	rt := &Runtime{template: name}
+	rt.output = w
+	rt.location = func() (string, int) { return rt.template, rt.Line }
+	return rt
+}
+
+// sub creates a Runtime to run the template name, which is called from
+// this one, writing its output to w. It shares the settings and the
+// context of this render
+func (rt *Runtime) sub(name string, w io.Writer) *Runtime {
+	s := newRuntime(name, w)
+	s.warn = rt.warn
+	s.MaxLoopCount = rt.MaxLoopCount
+	s.ctx = rt.ctx
+	s.parent = &rt.env
+	return s
+}
+
+// run runs fn with vars, and returns the error raised by it, if any
+func (rt *Runtime) run(fn CompiledFunc, vars Vars) (err error) {
+	rt.vars = vars
+	defer rt.stopIterators()
+	defer func() {
+		if v := recover(); v != nil {
+			err = rt.recovered(v)
+		}
+	}()
+
+	fn(rt, vars)
+	return nil
+}
+
+// WriteString writes s to the output (print_raw_const)
+func (rt *Runtime) WriteString(s string) {
+	rt.AppendOutputString(s)
+}
+
+// Print prints v, escaping it unless it's marked raw (print)
+func (rt *Runtime) Print(v interface{}) {
+	rt.print(v, true)
+}
+
+// PrintRaw prints v as is (print_raw)
+func (rt *Runtime) PrintRaw(v interface{}) {
+	rt.print(v, false)
+}
+
+// HTMLEscape returns v escaped for HTML, marked raw (html_escape)
+func (rt *Runtime) HTMLEscape(v interface{}) interface{} {
+	return htmlEscape(v)
+}
+
+// URIEscape returns v escaped for URIs (uri_escape)
+func (rt *Runtime) URIEscape(v interface{}) interface{} {
+	return uriEscape(v)
+}
+
+// MarkRaw returns v marked raw (mark_raw)
+func (rt *Runtime) MarkRaw(v interface{}) interface{} {
+	return markRaw(v)
+}
+
+// UnmarkRaw returns v without the raw mark (unmark_raw)
+func (rt *Runtime) UnmarkRaw(v interface{}) interface{} {
+	return unmarkRaw(v)
+}
+
+// Field returns the field name of container (fetch_field_s)
+func (rt *Runtime) Field(container interface{}, name string) interface{} {
+	return rt.fetchField(container, name)
+}
+
+// Element returns the element idx of container (fetch_array_elem)
+func (rt *Runtime) Element(container, idx interface{}) interface{} {
+	return rt.fetchElement(container, idx)
+}
+
+// Slice returns the elements of container from start to end
+// (fetch_slice)
+func (rt *Runtime) Slice(container, start, end interface{}) interface{} {
+	return rt.fetchSlice(container, start, end)
+}
+
+// Add returns left + right (add)
+func (rt *Runtime) Add(left, right interface{}) interface{} {
+	return arithmetic(TXOPAdd, left, right)
+}
+
+// Sub returns left - right (sub)
+func (rt *Runtime) Sub(left, right interface{}) interface{} {
+	return arithmetic(TXOPSub, left, right)
+}
+
+// Mul returns left * right (mul)
+func (rt *Runtime) Mul(left, right interface{}) interface{} {
+	return arithmetic(TXOPMul, left, right)
+}
+
+// Div returns left / right (div)
+func (rt *Runtime) Div(left, right interface{}) interface{} {
+	return arithmetic(TXOPDiv, left, right)
+}
+
+// Equals returns left == right (equals)
+func (rt *Runtime) Equals(left, right interface{}) bool {
+	return equals(left, right)
+}
+
+// LessThan returns left < right (less_than)
+func (rt *Runtime) LessThan(left, right interface{}) bool {
+	return compareNumbers(TXOPLessThan, left, right)
+}
+
+// GreaterThan returns left > right (greater_than)
+func (rt *Runtime) GreaterThan(left, right interface{}) bool {
+	return compareNumbers(TXOPGreaterThan, left, right)
+}
+
+// Concat returns left ~ right (concat)
+func (rt *Runtime) Concat(left, right interface{}) interface{} {
+	return rt.concat(left, right)
+}
+
+// Repeat returns left x right (repeat)
+func (rt *Runtime) Repeat(left, right interface{}) interface{} {
+	return rt.repeat(left, right)
+}
+
+// StringCompare compares left and right as strings for the string
+// operator op ("lt", "cmp", ...), returning -1, 0 or 1
+func (rt *Runtime) StringCompare(op string, left, right interface{}) int {
+	return rt.compareStrings(op, left, right)
+}
+
+// Truthy returns true if v is true in a condition (and)
+func (rt *Runtime) Truthy(v interface{}) bool {
+	return interfaceToBool(v)
+}
+
+// IsEmpty returns true if v is replaced by the `default` filter
+// (default)
+func (rt *Runtime) IsEmpty(v interface{}) bool {
+	return isEmpty(v)
+}
+
+// Filter applies the filter name to args[0], with the rest of args as
+// the arguments to the filter (filter)
+func (rt *Runtime) Filter(name string, args []interface{}) interface{} {
+	return rt.filter(name, reflectValues(args))
+}
+
+// Call calls x, which is a MACRO or a function, with args. name is the
+// name of the variable holding x, if known (funcall_omni)
+func (rt *Runtime) Call(x interface{}, name string, args []interface{}) interface{} {
+	if m, ok := x.(*compiledMacro); ok {
+		vars := make(Vars, len(rt.vars)+len(m.args))
+		for k, v := range rt.vars {
+			vars[k] = v
+		}
+		for i, name := range m.args {
+			var v interface{}
+			if i < len(args) {
+				v = args[i]
+			}
+			vars[name] = v
+		}
+
+		if err := rt.sub(rt.template, rt.output).run(m.fn, vars); err != nil {
+			rt.raise(err)
+		}
+		// The macro has written its output, so there's nothing more
+		// to print when it's called as [% m() %]
+		return rawString("")
+	}
+
+	if reflect.ValueOf(x).Kind() == reflect.Func {
+		return rt.funCall(x, name, reflectValues(args))
+	}
+	rt.Warnf("Unknown variable as function call: %s\n", x)
+	return nil
+}
+
+// CallSymbol calls the function name of the FuncDepot in args[0], or the
+// method name of args[0] (funcall_symbol)
+func (rt *Runtime) CallSymbol(name string, args []interface{}) interface{} {
+	return rt.funCallSymbol(name, reflectValues(args))
+}
+
+// CallMethod calls the method name of args[0] (methodcall)
+func (rt *Runtime) CallMethod(name string, args []interface{}) interface{} {
+	return rt.callMethod(name, reflectValues(args))
+}
+
+// Hash makes a hash of the keys and values in pairs (make_hash)
+func (rt *Runtime) Hash(pairs []interface{}) interface{} {
+	return makeHash(reflectValues(pairs))
+}
+
+// ForStart starts a FOREACH loop over list. Its item variable is
+// lv[idx], and the loop variable is lv[idx+1] (for_start)
+func (rt *Runtime) ForStart(lv []interface{}, idx int, list interface{}) {
+	lv[idx] = nil
+	lv[idx+1] = rt.forStart(list, rt.frames)
+}
+
+// ForLimit overrides the maximum number of iterations of the loop whose
+// item variable is lv[idx] (for_limit)
+func (rt *Runtime) ForLimit(lv []interface{}, idx interface{}, n int) {
+	if loop, ok := lv[int(interfaceToNumeric(idx).Int())+1].(*LoopVar); ok {
+		loop.MaxCount = n
+	}
+}
+
+// ForIter sets the item variable lv[idx] to the next item of its loop.
+// It returns false when there are no more items (for_iter)
+func (rt *Runtime) ForIter(lv []interface{}, idx interface{}) bool {
+	i := int(interfaceToNumeric(idx).Int())
+	item, more := rt.forIter(lv[i+1].(*LoopVar))
+	if !more {
+		return false
+	}
+	lv[i] = item
+	return true
+}
+
+// PushFrame enters a scope (pushframe)
+func (rt *Runtime) PushFrame() {
+	rt.frames++
+}
+
+// PopFrame leaves a scope (popframe)
+func (rt *Runtime) PopFrame() {
+	rt.frames--
+}
+
+// Include renders the template target, which is looked up with lookup,
+// with the variables of this template and the ones in the hash with
+// (include)
+func (rt *Runtime) Include(lookup func(string) CompiledFunc, target, with interface{}) {
+	name := functions.ToString(target)
+	fn := lookup(name)
+	if fn == nil {
+		rt.raise(errors.Errorf("failed to include '%s': template not found", name))
+	}
+
+	vars := make(Vars)
+	rt.includeVars(vars, with)
+
+	buf := rbpool.Get()
+	defer rbpool.Release(buf)
+
+	if err := rt.sub(name, buf).run(fn, vars); err != nil {
+		rt.raise(err)
+	}
+	rt.AppendOutputString(buf.String())
+}
+
+// Wrapper renders the template fn, named name, with content as the
+// variable `content` (wrapper)
+func (rt *Runtime) Wrapper(name string, fn CompiledFunc, content, with interface{}) {
+	vars := make(Vars)
+	rt.includeVars(vars, with)
+	vars.Set("content", rawString(content.(string)))
+
+	if err := rt.sub(name, rt.output).run(fn, vars); err != nil {
+		rt.raise(err)
+	}
+}
+
+// SaveWriter makes the output go to a buffer, until RestoreWriter is
+// called (save_writer)
+func (rt *Runtime) SaveWriter(s *Stack) {
+	s.Push(rt.output)
+
+	buf := rbpool.Get()
+	s.Push(buf)
+	rt.output = buf
+}
+
+// RestoreWriter restores the output saved by SaveWriter, and pushes what
+// was written to the buffer (restore_writer)
+func (rt *Runtime) RestoreWriter(s *Stack) {
+	buf := s.Pop().(*bytes.Buffer)
+	rt.output = s.Pop().(io.Writer)
+
+	s.Push(buf.String())
+	rbpool.Release(buf)
+}
+
+// compiledMacro is a MACRO compiled to Go source code
+type compiledMacro struct {
+	fn   CompiledFunc
+	args []string // Names of the parameters
+}
+
+// Macro returns the MACRO whose body is fn, and whose parameters are
+// named names. Call runs it (make_macro)
+func (rt *Runtime) Macro(fn CompiledFunc, names []interface{}) interface{} {
+	args := make([]string, len(names))
+	for i, name := range names {
+		args[i] = functions.ToString(name)
+	}
+	return &compiledMacro{fn: fn, args: args}
+}
+
+// Lambda returns the lambda whose body is fn. slots holds the number of
+// arguments, the local variable slots of the arguments, and then the
+// slots of the local variables in lv that the body uses from enclosing
+// scopes (make_closure)
+func (rt *Runtime) Lambda(fn CompiledLambda, slots []interface{}, lv []interface{}) interface{} {
+	nargs := int(interfaceToNumeric(slots[0]).Int())
+	size := len(lv)
+	idx := make([]int, len(slots)-1)
+	for i, slot := range slots[1:] {
+		idx[i] = int(interfaceToNumeric(slot).Int())
+		if idx[i] >= size {
+			size = idx[i] + 1
+		}
+	}
+	args, captures := idx[:nargs], idx[nargs:]
+
+	captured := make([]interface{}, len(captures))
+	for i, slot := range captures {
+		if slot < len(lv) {
+			captured[i] = lv[slot]
+		}
+	}
+
+	// Template variables do not change while the template is being
+	// rendered, so a single copy is shared by all closures created
+	// during the run
+	if rt.closureVars == nil {
+		rt.closureVars = make(Vars, len(rt.vars))
+		for k, v := range rt.vars {
+			rt.closureVars[k] = v
+		}
+	}
+	vars := rt.closureVars
+
+	template := rt.template
+	warn := rt.warn
+	maxLoopCount := rt.MaxLoopCount
+	ctx := rt.ctx
+	parent := rt.root()
+
+	return func(values ...interface{}) interface{} {
+		crt := newRuntime(template, ioutil.Discard)
+		crt.vars = vars
+		crt.closureVars = vars
+		crt.warn = warn
+		crt.MaxLoopCount = maxLoopCount
+		crt.ctx = ctx
+		crt.parent = parent
+
+		clv := make([]interface{}, size)
+		for i, slot := range captures {
+			clv[slot] = captured[i]
+		}
+		for i, slot := range args {
+			if i < len(values) {
+				clv[slot] = values[i]
+			}
+		}
+		return fn(crt, vars, clv)
+	}
+}
+
+// Try runs fn, the body of a TRY block. Its output is buffered, and
+// discarded if an error is raised, in which case the state of the
+// template, including s, is restored to when the block was entered, and
+// the error is returned. Otherwise it returns what fn returns: the
+// position that the block jumps to when it's left with LAST or NEXT, or
+// -1 (try)
+func (rt *Runtime) Try(s *Stack, fn func() int) (next int, err *RenderError) {
+	values, marks := len(s.values), len(s.marks)
+	frames, loops, iterators := rt.frames, len(rt.loops), len(rt.iterators)
+	output := rt.output
+
+	buf := rbpool.Get()
+	defer rbpool.Release(buf)
+	rt.output = buf
+
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+
+		s.values = s.values[:values]
+		s.marks = s.marks[:marks]
+		rt.frames = frames
+		if len(rt.loops) > loops {
+			rt.loops = rt.loops[:loops]
+		}
+		for len(rt.iterators) > iterators {
+			rt.stopIterator(rt.iterators[len(rt.iterators)-1])
+		}
+		rt.output = output
+
+		next, err = -1, rt.recovered(v)
+	}()
+
+	next = fn()
+	rt.output = output
+	rt.AppendOutput(buf.Bytes())
+	return next, nil
+}
+
+// Stack is the stack, and the marks on it, of templates compiled to Go
+// source code. Its zero value is ready to use
+type Stack struct {
+	values []interface{}
+	marks  []int
+}
+
+// Push pushes v (push)
+func (s *Stack) Push(v interface{}) {
+	s.values = append(s.values, v)
+}
+
+// Pop pops the value at the top of the stack (pop)
+func (s *Stack) Pop() interface{} {
+	if len(s.values) == 0 {
+		return nil
+	}
+	v := s.values[len(s.values)-1]
+	s.values = s.values[:len(s.values)-1]
+	return v
+}
+
+// Pushmark records the current tip of the stack (pushmark)
+func (s *Stack) Pushmark() {
+	s.marks = append(s.marks, len(s.values))
+}
+
+// Popmark forgets the mark recorded last (popmark)
+func (s *Stack) Popmark() {
+	s.marks = s.marks[:len(s.marks)-1]
+}
+
+// Args pops everything from the current mark up to the tip of the
+// stack, and returns it as a list
+func (s *Stack) Args() []interface{} {
+	mark := 0
+	if len(s.marks) > 0 {
+		mark = s.marks[len(s.marks)-1]
+	}
+	list := make([]interface{}, len(s.values)-mark)
+	copy(list, s.values[mark:])
+	s.values = s.values[:mark]
+	return list
+}
+
+// PushRange pushes the numbers from `from` to `to` (range)
+func (s *Stack) PushRange(from, to interface{}) {
+	lhs := interfaceToNumeric(from).Int()
+	rhs := interfaceToNumeric(to).Int()
+	for i := lhs; i <= rhs; i++ {
+		s.Push(i)
+	}
+}
+
+// reflectValues returns the reflect.Values of args, which is what the
+// helpers shared with the VM take
+func reflectValues(args []interface{}) []reflect.Value {
+	values := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		values[i] = reflect.ValueOf(arg)
+	}
+	return values
+}
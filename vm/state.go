@@ -1,7 +1,6 @@
 package vm
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/lestrrat/go-xslate/internal/frame"
@@ -11,16 +10,19 @@ import (
 // NewState creates a new State struct
 func NewState() *State {
 	st := &State{
+		env: env{
+			vars:         make(Vars),
+			warn:         os.Stderr,
+			MaxLoopCount: 1000,
+		},
 		opidx:      0,
 		pc:         NewByteCode(),
 		stack:      stack.New(5),
 		markstack:  stack.New(5),
 		framestack: stack.New(5),
 		frames:     stack.New(5),
-		vars:       make(Vars),
-		warn:       os.Stderr,
-		MaxLoopCount: 1000,
 	}
+	st.location = st.currentLocation
 
 	st.Pushmark()
 	st.PushFrame()
@@ -47,11 +49,6 @@ func (st *State) CurrentPos() int {
 	return st.opidx
 }
 
-// Vars returns the current set of variables
-func (st *State) Vars() Vars {
-	return st.vars
-}
-
 // CurrentOp returns the current op code
 func (st *State) CurrentOp() Op {
 	return st.pc.Get(st.opidx)
@@ -59,9 +56,9 @@ func (st *State) CurrentOp() Op {
 
 // PushFrame pushes a new frame to the frame stack
 func (st *State) PushFrame() *frame.Frame {
-	f := frame.New(st.framestack)
+	f := frame.New(&st.framestack)
 	st.frames.Push(f)
-	f.SetMark(st.frames.Size())
+	f.SetMark(st.framestack.Size())
 	return f
 }
 
@@ -71,11 +68,10 @@ func (st *State) PopFrame() *frame.Frame {
 	if x == nil {
 		return nil
 	}
-	f := x.(*frame.Frame)
-	for i := st.framestack.Size(); i > f.Mark(); i-- {
-		st.framestack.Pop()
-	}
-	return f
+	// Local variables are addressed by the absolute slot number assigned
+	// by the parser, so we don't discard them here: slots are simply
+	// overwritten when they are reused
+	return x.(*frame.Frame)
 }
 
 // CurrentFrame returns the frame currently at the top of the frame stack
@@ -87,22 +83,6 @@ func (st *State) CurrentFrame() *frame.Frame {
 	return x.(*frame.Frame)
 }
 
-// Warnf is used to generate warnings during virtual machine execution
-func (st *State) Warnf(format string, args ...interface{}) {
-	st.warn.Write([]byte(fmt.Sprintf(format, args...)))
-}
-
-// AppendOutput appends the specified bytes to the output
-func (st *State) AppendOutput(b []byte) {
-	// XXX Error checking?
-	st.output.Write(b)
-}
-
-// AppendOutputString is the same as AppendOutput, but uses a string
-func (st *State) AppendOutputString(o string) {
-	st.output.Write([]byte(o))
-}
-
 // Pushmark records the current stack tip so we can remember
 // where the current context started
 func (st *State) Pushmark() {
@@ -145,6 +125,31 @@ func (st *State) LoadByteCode(key string) (*ByteCode, error) {
 	return st.Loader.Load(key)
 }
 
+// run runs the ops until the end op is reached. Errors raised by the
+// ops are caught by the innermost TRY block, if any
+func (st *State) run() error {
+	for {
+		err := st.runOps()
+		if err == nil {
+			return nil
+		}
+		if !st.catch(err) {
+			return err
+		}
+	}
+}
+
+func (st *State) runOps() (err *RenderError) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = st.recovered(v)
+		}
+	}()
+
+	st.exec()
+	return nil
+}
+
 // Reset resets the whole State object
 func (st *State) Reset() {
 	st.opidx = 0
@@ -154,6 +159,9 @@ func (st *State) Reset() {
 	st.markstack.Reset()
 	st.frames.Reset()
 	st.framestack.Reset()
+	st.loops = nil
+	st.closureVars = nil
+	st.handlers = nil
 
 	st.Pushmark()
 	st.PushFrame()
@@ -1,9 +1,9 @@
 package vm
 
 import (
-	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
 )
 
 var hexdigits = []byte("0123456789ABCDEF")
@@ -92,40 +92,71 @@ func alignTypesForArithmetic(left, right interface{}) (reflect.Value, reflect.Va
 	return leftV.Convert(alignTo), rightV.Convert(alignTo)
 }
 
-func interfaceToString(arg interface{}) string {
-	t := reflect.TypeOf(arg)
-	var v string
-	switch t.Kind() {
-	case reflect.String:
-		v = string(reflect.ValueOf(arg).String())
+// toIndex converts numbers and numeric strings to an index into a list
+func toIndex(v interface{}) (int, bool) {
+	if v == nil {
+		return 0, false
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		v = strconv.FormatInt(reflect.ValueOf(arg).Int(), 10)
+		return int(rv.Int()), true
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		v = strconv.FormatUint(reflect.ValueOf(arg).Uint(), 10)
+		return int(rv.Uint()), true
 	case reflect.Float32, reflect.Float64:
-		v = strconv.FormatFloat(reflect.ValueOf(arg).Float(), 'f', -1, 64)
-	case reflect.Bool:
-		if reflect.ValueOf(arg).Bool() {
-			v = "true"
-		} else {
-			v = "false"
+		return int(rv.Float()), true
+	case reflect.String:
+		if i, err := strconv.Atoi(strings.TrimSpace(rv.String())); err == nil {
+			return i, true
 		}
-	default:
-		v = fmt.Sprintf("%s", arg)
+	}
+	return 0, false
+}
+
+// indirect dereferences pointers and interfaces until it gets to a
+// concrete value
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
 	}
 	return v
 }
 
+// interfaceToBool returns the truthiness of arg. As in Perl, nil, false,
+// 0, "" and "0" are false. Nil pointers, maps, slices, etc are false,
+// and everything else is true
 func interfaceToBool(arg interface{}) bool {
 	if arg == nil {
 		return false
 	}
 
-	t := reflect.TypeOf(arg)
-	if t.Kind() == reflect.Bool {
-		return arg.(bool)
+	v := reflect.ValueOf(arg)
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() != 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() != 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() != 0
+	case reflect.String:
+		s := v.String()
+		return s != "" && s != "0"
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return !v.IsNil()
 	}
+	return true
+}
 
-	z := reflect.Zero(t)
-	return reflect.DeepEqual(z, t)
+// isEmpty returns true if arg is nil or an empty string
+func isEmpty(arg interface{}) bool {
+	if arg == nil {
+		return true
+	}
+	v := reflect.ValueOf(arg)
+	return v.Kind() == reflect.String && v.Len() == 0
 }
@@ -1,6 +1,10 @@
 package vm
 
 import (
+	"bufio"
+	"bytes"
+	"html"
+	"io/ioutil"
 	"reflect"
 	"testing"
 )
@@ -47,3 +51,100 @@ func TestAlignTypesForArithmetic(t *testing.T) {
 		t.Errorf("leftV should have been upgraded to Float64, but got %s", leftV.Kind())
 	}
 }
+
+func TestWriteEscaped(t *testing.T) {
+	for _, s := range []string{"", "plain", "<a href=\"x\">'&'</a>", "&&", "<", "tail>", "\u65e5\u672c<\u8a9e>"} {
+		buf := &bytes.Buffer{}
+		writeEscaped(buf, s)
+		if expected := html.EscapeString(s); buf.String() != expected {
+			t.Errorf("Expected %q to be escaped to %q, got %q", s, expected, buf.String())
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cases := []struct {
+		in       interface{}
+		escape   bool
+		expected string
+	}{
+		{"<b>", true, "&lt;b&gt;"},
+		{"<b>", false, "<b>"},
+		{rawString("<b>"), true, "<b>"},
+		{-42, true, "-42"},
+		{int64(1) << 40, true, "1099511627776"},
+		{int8(-3), true, "-3"},
+		{uint(7), true, "7"},
+		{1.5, true, "1.5"},
+		{float32(0.25), true, "0.25"},
+		{true, true, "true"},
+		{[]byte("<b>"), true, "&lt;b&gt;"},
+	}
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		st := NewState()
+		st.output = buf
+		st.print(c.in, c.escape)
+		if buf.String() != c.expected {
+			t.Errorf("Expected %#v to print as %q, got %q", c.in, c.expected, buf.String())
+		}
+	}
+}
+
+func TestPrint_Allocs(t *testing.T) {
+	st := NewState()
+	st.output = bufio.NewWriter(ioutil.Discard)
+
+	values := []interface{}{"Hello, <World>", rawString("<br>"), 12345, int64(-678), 3.25, false}
+	for _, v := range values {
+		st.sa = v
+		allocs := testing.AllocsPerRun(100, func() {
+			st.opidx = 0
+			txPrint(st)
+		})
+		if allocs != 0 {
+			t.Errorf("Expected printing %#v not to allocate, got %v allocs", v, allocs)
+		}
+	}
+}
+
+func TestInterfaceToBool(t *testing.T) {
+	var nilPtr *int
+	var nilSlice []int
+	var nilMap map[string]int
+	one := 1
+
+	cases := []struct {
+		in       interface{}
+		expected bool
+	}{
+		{nil, false},
+		{true, true},
+		{false, false},
+		{0, false},
+		{1, true},
+		{int64(-1), true},
+		{uint8(0), false},
+		{uint(3), true},
+		{0.0, false},
+		{float32(0.5), true},
+		{"", false},
+		{"0", false},
+		{"0.0", true},
+		{"false", true},
+		{" ", true},
+		{nilPtr, false},
+		{&one, true},
+		{nilSlice, false},
+		{[]int{}, true},
+		{[]int{0}, true},
+		{nilMap, false},
+		{map[string]int{}, true},
+		{struct{}{}, true},
+	}
+	for _, c := range cases {
+		if got := interfaceToBool(c.in); got != c.expected {
+			t.Errorf("Expected interfaceToBool(%#v) to be %t, got %t", c.in, c.expected, got)
+		}
+	}
+}
@@ -11,8 +11,14 @@ func (v Vars) Set(k string, x interface{}) {
 
 // Get returns the variable stored in slot `x`
 func (v Vars) Get(k interface{}) (interface{}, bool) {
-	key, ok := k.(string)
-	if !ok {
+	var key string
+	switch k := k.(type) {
+	case string:
+		key = k
+	case []byte:
+		x, ok := v[string(k)]
+		return x, ok
+	default:
 		key = fmt.Sprintf("%s", k)
 	}
 	x, ok := v[key]
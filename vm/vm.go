@@ -7,19 +7,23 @@ The virtual machine is an extremely simple one: each opcode in the
 bytecode sequence returns the next opcode to execute. The virtual machine
 just keeps on calling the opcode until we reach the "end" opcode.
 
-The virtual machine accepts the bytecode, and input variables:
+The virtual machine accepts the bytecode, input variables, and the
+writer to write the output to:
 
-  vm.Run(bytecode, variables)
+  err := vm.Run(bytecode, variables, output)
 
 */
 package vm
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
+	"context"
 	"io"
 
+	"github.com/lestrrat/go-xslate/internal/bwpool"
 	"github.com/lestrrat/go-xslate/internal/rvpool"
+	"github.com/pkg/errors"
 )
 
 // NewVM creates a new VM
@@ -31,10 +35,28 @@ func NewVM() *VM {
 	}
 }
 
+// SetFunctions sets the variables that are available to every template
+// executed by this VM, such as functions and function namespaces
 func (vm *VM) SetFunctions(vars Vars) {
 	vm.functions = vars
 }
 
+// SetMaxLoopCount sets the maximum number of iterations of a loop. Loops
+// that exceed it are aborted. Zero or less means that there's no limit
+func (vm *VM) SetMaxLoopCount(n int) {
+	vm.st.MaxLoopCount = n
+}
+
+// SetBackend selects how ByteCode is executed. See Backend
+func (vm *VM) SetBackend(b Backend) {
+	vm.st.backend = b
+}
+
+// Functions returns the variables set by SetFunctions
+func (vm *VM) Functions() Vars {
+	return vm.functions
+}
+
 // CurrentOp returns the current Op to be executed
 func (vm *VM) CurrentOp() Op {
 	return vm.st.CurrentOp()
@@ -49,23 +71,40 @@ func (vm *VM) IsSupportedByteCodeVersion(bc *ByteCode) bool {
 // Run executes the given vm.ByteCode using the given variables. For historical
 // reasons, it also allows re-executing the previous bytecode instructions
 // given to a virtual machine, but this will probably be removed in the future
-func (vm *VM) Run(bc *ByteCode, vars Vars, output io.Writer) {
+//
+// If running the template fails, such as when a function called from it
+// returns an error, a *RenderError describing where it happened is
+// returned
+func (vm *VM) Run(bc *ByteCode, vars Vars, output io.Writer) error {
+	return vm.RunContext(context.Background(), bc, vars, output)
+}
+
+// RunContext is like Run, but functions called from the template that
+// take a context.Context or *CallContext are given ctx
+func (vm *VM) RunContext(ctx context.Context, bc *ByteCode, vars Vars, output io.Writer) error {
+	return vm.runAt(ctx, bc, 0, vars, output)
+}
+
+// runAt runs bc starting with the op at position start
+func (vm *VM) runAt(ctx context.Context, bc *ByteCode, start int, vars Vars, output io.Writer) error {
 	if !vm.IsSupportedByteCodeVersion(bc) {
-		panic(fmt.Sprintf(
-			"error: ByteCode version %f no supported",
-			bc.Version,
-		))
+		return errors.Errorf("ByteCode version %f not supported", bc.Version)
 	}
 
 	st := vm.st
 
 	if _, ok := output.(*bufio.Writer); !ok {
-		output = bufio.NewWriter(output)
-		defer output.(*bufio.Writer).Flush()
+		bw := bwpool.Get(output)
+		defer bwpool.Release(bw)
+		defer bw.Flush()
+		output = bw
 	}
 	st.Reset()
 	st.pc = bc
+	st.opidx = start
 	st.output = output
+	st.ctx = ctx
+	st.values = nil
 	newvars := Vars(rvpool.Get())
 	defer rvpool.Release(newvars)
 	defer newvars.Reset()
@@ -83,9 +122,36 @@ func (vm *VM) Run(bc *ByteCode, vars Vars, output io.Writer) {
 		}
 	}
 	st.Loader = vm.Loader
+	defer st.stopIterators()
 
-	// This is the main loop
-	for op := st.CurrentOp(); op.Type() != TXOPEnd; op = st.CurrentOp() {
-		op.Call(st)
+	return st.run()
+}
+
+// EvalConst runs the single op o with registers sa and sb set to the given
+// values, as the VM would. It returns the resulting value of sa, and the
+// number of ops that the VM would advance by, which is other than 1 if o
+// is a jump that is taken.
+//
+// This is used by the optimizer to evaluate ops whose operands are
+// constants at compile time. ok is false if running o raised an error or
+// emitted a warning, in which case the op should be left to run when the
+// template is rendered. o must not depend on anything other than sa and sb
+func EvalConst(o Op, sa, sb interface{}) (result interface{}, advance int, ok bool) {
+	st := NewState()
+	warn := &bytes.Buffer{}
+	st.warn = warn
+	st.pc = NewByteCode()
+	st.pc.Append(o)
+	st.sa, st.sb = sa, sb
+
+	defer func() {
+		if recover() != nil {
+			result, advance, ok = nil, 0, false
+		}
+	}()
+	o.Call(st)
+	if warn.Len() > 0 {
+		return nil, 0, false
 	}
+	return st.sa, st.CurrentPos(), true
 }
@@ -2,6 +2,7 @@ package vm
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	txtime "github.com/lestrrat/go-xslate/functions/time"
 	"reflect"
@@ -11,24 +12,35 @@ import (
 	"time"
 )
 
+// assertOutput runs bc with each of the backends, and checks the output
 func assertOutput(t *testing.T, bc *ByteCode, vars Vars, expected interface{}) {
-	buf := &bytes.Buffer{}
-	vm := NewVM()
-	vm.Run(bc, vars, buf)
-	output := buf.String()
-
-	vtype := reflect.TypeOf(expected)
-	switch {
-	case vtype.Kind() == reflect.String:
-		if output != expected.(string) {
-			t.Errorf("Expected output '%s', got '%s'", expected, output)
+	for _, backend := range []Backend{BackendInterpreter, BackendClosure} {
+		// Tests modify ops between runs, which is not picked up by
+		// closures that have already been compiled
+		run := NewByteCode()
+		run.OpList = bc.OpList
+
+		buf := &bytes.Buffer{}
+		vm := NewVM()
+		vm.SetBackend(backend)
+		if err := vm.Run(run, vars, buf); err != nil {
+			t.Errorf("Failed to run bytecode (backend %d): %s", backend, err)
 		}
-	case vtype.Kind() == reflect.Ptr && vtype.Elem().Kind() == reflect.Struct && vtype.Elem().Name() == "Regexp":
-		if !expected.(*regexp.Regexp).MatchString(output) {
-			t.Errorf("Expected output to match '%s', got '%s'", expected, output)
+		output := buf.String()
+
+		vtype := reflect.TypeOf(expected)
+		switch {
+		case vtype.Kind() == reflect.String:
+			if output != expected.(string) {
+				t.Errorf("Expected output '%s', got '%s' (backend %d)", expected, output, backend)
+			}
+		case vtype.Kind() == reflect.Ptr && vtype.Elem().Kind() == reflect.Struct && vtype.Elem().Name() == "Regexp":
+			if !expected.(*regexp.Regexp).MatchString(output) {
+				t.Errorf("Expected output to match '%s', got '%s' (backend %d)", expected, output, backend)
+			}
+		default:
+			panic(fmt.Sprintf("Can't handle type %s", vtype.Kind()))
 		}
-	default:
-		panic(fmt.Sprintf("Can't handle type %s", vtype.Kind()))
 	}
 }
 
@@ -54,6 +66,51 @@ func TestFetchField(t *testing.T) {
 	assertOutput(t, bc, Vars{"foo": struct{ Value int }{100}}, "100")
 }
 
+func TestFetchFieldNonContainer(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPFetchSymbol, "foo")
+	bc.AppendOp(TXOPFetchFieldSymbol, "value")
+	bc.AppendOp(TXOPPrintRaw)
+	bc.AppendOp(TXOPEnd)
+
+	buf := &bytes.Buffer{}
+	vm := NewVM()
+	vm.st.warn = buf
+
+	vm.Run(bc, Vars{"foo": 1}, &bytes.Buffer{})
+
+	expected := "Cannot fetch field 'value' from int\nUse of nil to print\n"
+	if warnOutput := buf.String(); warnOutput != expected {
+		t.Errorf("Expected warning to be '%s', got '%s'", expected, warnOutput)
+	}
+}
+
+func TestRunError(t *testing.T) {
+	bc := NewByteCode()
+	bc.Name = "test.tx"
+	bc.AppendOp(TXOPLiteral, "Hello")
+	bc.AppendOp(TXOPPrintRaw)
+	bc.AppendOp(TXOPPushmark)
+	bc.AppendOp(TXOPFetchSymbol, "fail")
+	bc.AppendOp(TXOPFunCallOmni, "fail").SetLine(3)
+	bc.AppendOp(TXOPPopmark)
+	bc.AppendOp(TXOPEnd)
+
+	vars := Vars{"fail": func() (string, error) { return "", errors.New("boom") }}
+	err := NewVM().Run(bc, vars, &bytes.Buffer{})
+	re, ok := err.(*RenderError)
+	if !ok {
+		t.Fatalf("Expected a *RenderError, got %#v", err)
+	}
+	if re.Template != "test.tx" || re.Line != 3 {
+		t.Errorf("Expected error at test.tx line 3, got %s line %d", re.Template, re.Line)
+	}
+	expected := "function 'fail' failed: boom at test.tx line 3"
+	if re.Error() != expected {
+		t.Errorf("Expected error '%s', got '%s'", expected, re.Error())
+	}
+}
+
 func TestNonExistingSymbol(t *testing.T) {
 	bc := NewByteCode()
 	bc.AppendOp(TXOPFetchSymbol, "foo")
@@ -411,3 +468,37 @@ func TestVM_MakeHash(t *testing.T) {
 		}
 	}
 }
+
+func TestOpMarshalBinary(t *testing.T) {
+	for _, arg := range []interface{}{int64(10), 1.5, "hello", []byte("bytes"), true} {
+		o := NewOp(TXOPLiteral, arg)
+		o.SetLine(5)
+		b, err := o.(*op).MarshalBinary()
+		if err != nil {
+			t.Fatalf("Failed to marshal op: %s", err)
+		}
+
+		o2 := &op{}
+		if err := o2.UnmarshalBinary(b); err != nil {
+			t.Fatalf("Failed to unmarshal op: %s", err)
+		}
+		if !reflect.DeepEqual(o2.Arg(), arg) || o2.Line() != 5 {
+			t.Errorf("Expected %#v at line 5, got %#v at line %d", arg, o2.Arg(), o2.Line())
+		}
+	}
+}
+
+func TestEvalConst(t *testing.T) {
+	if v, advance, ok := EvalConst(NewOp(TXOPSub), int64(3), int64(10)); !ok || v != int64(7) || advance != 1 {
+		t.Errorf("Expected 10 - 3 to be 7, got %#v (advance %d, ok %t)", v, advance, ok)
+	}
+	if v, _, ok := EvalConst(NewOp(TXOPStringLessThan), "b", "a"); !ok || v != true {
+		t.Errorf("Expected a lt b to be true, got %#v (ok %t)", v, ok)
+	}
+	if _, advance, ok := EvalConst(NewOp(TXOPAnd, 5), int64(0), nil); !ok || advance != 5 {
+		t.Errorf("Expected and to jump by 5, got %d (ok %t)", advance, ok)
+	}
+	if _, _, ok := EvalConst(NewOp(TXOPConcat), nil, "a"); ok {
+		t.Errorf("Expected ops that warn not to be evaluated")
+	}
+}
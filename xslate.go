@@ -46,6 +46,7 @@ It is strongly recommended that you use the caching layer to boost performance.
 package xslate
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -53,8 +54,11 @@ import (
 	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/lestrrat/go-xslate/compiler"
+	"github.com/lestrrat/go-xslate/functions"
+	"github.com/lestrrat/go-xslate/i18n"
 	"github.com/lestrrat/go-xslate/internal/rbpool"
 	"github.com/lestrrat/go-xslate/loader"
 	"github.com/lestrrat/go-xslate/parser"
@@ -68,12 +72,21 @@ import (
 // environment variable.
 var Debug = false
 
+// DefaultBackend is the VM backend used when none is given in the "VM"
+// arguments. This can be set with the XSLATE_BACKEND environment variable.
+// See DefaultVM
+var DefaultBackend interface{} = vm.BackendInterpreter
+
 func init() {
 	tmp := os.Getenv("XSLATE_DEBUG")
 	boolVar, err := strconv.ParseBool(tmp)
 	if err == nil {
 		Debug = boolVar
 	}
+
+	if b := os.Getenv("XSLATE_BACKEND"); b != "" {
+		DefaultBackend = b
+	}
 }
 
 // Vars is an alias to vm.Vars, declared so that you (the end user) does
@@ -88,6 +101,14 @@ type Xslate struct {
 	Compiler compiler.Compiler
 	Parser   parser.Parser
 	Loader   loader.ByteCodeLoader
+	// Localizer provides the `loc`, `l` and `nloc` functions to templates.
+	// The locale is taken from the "locale" template variable
+	Localizer *i18n.Localizer
+	// namespaces holds this instance's own copy of the function
+	// namespaces given to RegisterFunctions, and their parents, by name.
+	// Depots passed in by the user are never modified
+	namespaces map[string]*functions.FuncDepot
+	registered map[string]bool
 	// XXX Need to make syntax pluggable
 }
 
@@ -105,29 +126,128 @@ type Args map[string]interface{}
 // Xslate. Given an unconfigured Xslate instance and arguments, sets up
 // the compiler of said Xslate instance. Current implementation
 // just uses compiler.New()
+//
+// "OptimizationLevel" selects the optimizations applied to the bytecode
+// (a compiler.OptimizationLevel, its integer value, or one of "none",
+// "basic", "full"). By default, all optimizations are applied
 func DefaultCompiler(tx *Xslate, args Args) error {
-	tx.Compiler = compiler.New()
+	c := compiler.New()
+	if v, ok := args.Get("OptimizationLevel"); ok {
+		level, err := optimizationLevelArg(v)
+		if err != nil {
+			return err
+		}
+		c.Optimizer = compiler.NewOptimizer(level)
+	}
+	tx.Compiler = c
 	return nil
 }
 
+func optimizationLevelArg(v interface{}) (compiler.OptimizationLevel, error) {
+	switch v := v.(type) {
+	case compiler.OptimizationLevel:
+		if v >= compiler.OptimizeNone && v <= compiler.OptimizeFull {
+			return v, nil
+		}
+	case int:
+		if l := compiler.OptimizationLevel(v); l >= compiler.OptimizeNone && l <= compiler.OptimizeFull {
+			return l, nil
+		}
+	case string:
+		switch v {
+		case "none":
+			return compiler.OptimizeNone, nil
+		case "basic":
+			return compiler.OptimizeBasic, nil
+		case "full":
+			return compiler.OptimizeFull, nil
+		}
+	}
+	return compiler.OptimizeNone, errors.Errorf("invalid value for OptimizationLevel: %v", v)
+}
+
 // DefaultParser sets up and assigns the default parser to be used by Xslate.
+//
+// Whitespace control can be configured with "PreChomp" and "PostChomp"
+// (a parser.ChompMode, its integer value, or one of "none", "one",
+// "collapse", "greedy"), and "Trim" (bool). These are equivalent to
+// Template-Toolkit's PRE_CHOMP, POST_CHOMP and TRIM options, and can be
+// overridden per tag using the '-', '~', '=' and '+' modifiers.
+//
+// The tag delimiters can be changed with "TagStart" and "TagEnd", and
+// line statements can be enabled by specifying their prefix in "LineStart"
 func DefaultParser(tx *Xslate, args Args) error {
 	syntax, ok := args.Get("Syntax")
 	if !ok {
 		syntax = "TTerse"
 	}
 
+	preChomp, err := chompModeArg(args, "PreChomp")
+	if err != nil {
+		return err
+	}
+	postChomp, err := chompModeArg(args, "PostChomp")
+	if err != nil {
+		return err
+	}
+	var doTrim bool
+	if v, ok := args.Get("Trim"); ok {
+		if doTrim, ok = v.(bool); !ok {
+			return errors.Errorf("invalid value for Trim: expected bool, got %T", v)
+		}
+	}
+
+	var delims [3]string
+	for i, key := range []string{"TagStart", "TagEnd", "LineStart"} {
+		v, ok := args.Get(key)
+		if !ok {
+			continue
+		}
+		if delims[i], ok = v.(string); !ok {
+			return errors.Errorf("invalid value for %s: expected string, got %T", key, v)
+		}
+	}
+
 	switch syntax {
 	case "TTerse":
-		tx.Parser = tterse.New()
+		p := tterse.New()
+		p.PreChomp, p.PostChomp, p.Trim = preChomp, postChomp, doTrim
+		p.TagStart, p.TagEnd, p.LineStart = delims[0], delims[1], delims[2]
+		tx.Parser = p
 	case "Kolon", "Kolonish":
-		tx.Parser = kolonish.New()
+		p := kolonish.New()
+		p.PreChomp, p.PostChomp, p.Trim = preChomp, postChomp, doTrim
+		p.TagStart, p.TagEnd, p.LineStart = delims[0], delims[1], delims[2]
+		tx.Parser = p
 	default:
 		return errors.New("sytanx '" + syntax.(string) + "' is not available")
 	}
 	return nil
 }
 
+func chompModeArg(args Args, key string) (parser.ChompMode, error) {
+	v, ok := args.Get(key)
+	if !ok {
+		return parser.ChompNone, nil
+	}
+
+	switch v := v.(type) {
+	case parser.ChompMode:
+		return v, nil
+	case int:
+		if m := parser.ChompMode(v); m >= parser.ChompNone && m <= parser.ChompGreedy {
+			return m, nil
+		}
+	case string:
+		m, err := parser.ParseChompMode(v)
+		if err != nil {
+			return parser.ChompNone, errors.Wrap(err, "invalid value for "+key)
+		}
+		return m, nil
+	}
+	return parser.ChompNone, errors.Errorf("invalid value for %s: %v", key, v)
+}
+
 // DefaultLoader sets up and assigns the default loader to be used by Xslate.
 func DefaultLoader(tx *Xslate, args Args) error {
 	var tmp interface{}
@@ -164,10 +284,38 @@ func DefaultLoader(tx *Xslate, args Args) error {
 	return nil
 }
 
-// DefaultVM sets up and assigns the default VM to be used by Xslate
+// DefaultVM sets up and assigns the default VM to be used by Xslate.
+// "MaxLoopCount" sets the maximum number of iterations of a loop (1000
+// by default, zero or less for no limit).
+//
+// "Backend" selects how the bytecode is executed: "interpreter" (or
+// vm.BackendInterpreter) runs each op in turn, and "closure" (or
+// vm.BackendClosure) compiles the bytecode into Go closures first, which
+// is faster for templates that are rendered many times. The default can
+// be changed with the XSLATE_BACKEND environment variable
 func DefaultVM(tx *Xslate, args Args) error {
 	dvm := vm.NewVM()
 	dvm.Loader = tx.Loader
+	if v, ok := args.Get("MaxLoopCount"); ok {
+		n, ok := v.(int)
+		if !ok {
+			return errors.Errorf("invalid value for MaxLoopCount: expected int, got %T", v)
+		}
+		dvm.SetMaxLoopCount(n)
+	}
+
+	v, ok := args.Get("Backend")
+	if !ok {
+		v = DefaultBackend
+	}
+	switch v {
+	case vm.BackendInterpreter, "interpreter":
+		dvm.SetBackend(vm.BackendInterpreter)
+	case vm.BackendClosure, "closure":
+		dvm.SetBackend(vm.BackendClosure)
+	default:
+		return errors.Errorf("invalid value for Backend: %v", v)
+	}
 	tx.VM = dvm
 	return nil
 }
@@ -197,8 +345,6 @@ func (tx *Xslate) configureGeneric(configuror interface{}, args Args) error {
 // Configure is called automatically from `New()` to configure the xslate
 // instance from arguments
 func (tx *Xslate) Configure(args ConfigureArgs) error {
-	// The compiler currently does not have any configurable options, but
-	// one may want to replace the entire compiler struct
 	defaults := map[string]func(*Xslate, Args) error{
 		"Compiler": DefaultCompiler,
 		"Parser":   DefaultParser,
@@ -226,7 +372,20 @@ func (tx *Xslate) Configure(args ConfigureArgs) error {
 
 	// Configure Functions
 	if funcs, ok := args.Get("Functions"); ok {
-		tx.VM.SetFunctions(vm.Vars(funcs.(Args)))
+		// Copy, as RegisterFunctions may add to this later
+		vars := make(vm.Vars)
+		for k, v := range funcs.(Args) {
+			vars[k] = v
+		}
+		tx.VM.SetFunctions(vars)
+	}
+
+	if l, ok := args.Get("Localizer"); ok {
+		localizer, ok := l.(*i18n.Localizer)
+		if !ok {
+			return errors.Errorf("Localizer must be an *i18n.Localizer, got %T", l)
+		}
+		tx.Localizer = localizer
 	}
 
 	if Debug {
@@ -251,6 +410,7 @@ func (tx *Xslate) Configure(args ConfigureArgs) error {
 //    * Loader: Arbitrary arguments passed to ConfigureLoader function
 //    * Compiler: Arbitrary arguments passed to ConfigureCompiler function
 //    * VM: Arbitrary arguments passed to ConfigureVM function
+//    * Localizer: *i18n.Localizer used for `loc`, `l` and `nloc`
 func New(args ...Args) (*Xslate, error) {
 	tx := &Xslate{}
 
@@ -297,10 +457,17 @@ func (tx *Xslate) DumpByteCode(b bool) {
 // `Render()` returns the resulting text from processing the template.
 // `err` is nil on success, otherwise it contains an `error` value.
 func (tx Xslate) Render(name string, vars Vars) (string, error) {
+	return tx.RenderContext(context.Background(), name, vars)
+}
+
+// RenderContext is like Render, but Go functions called from the template
+// that take a context.Context or *vm.CallContext as their first parameter
+// are given ctx. Use this to make request scoped values available to them
+func (tx Xslate) RenderContext(ctx context.Context, name string, vars Vars) (string, error) {
 	buf := rbpool.Get()
 	defer rbpool.Release(buf)
 
-	err := tx.RenderInto(buf, name, vars)
+	err := tx.RenderIntoContext(ctx, buf, name, vars)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to render template")
 	}
@@ -323,10 +490,16 @@ func (tx *Xslate) RenderString(template string, vars Vars) (string, error) {
 		return "", errors.Wrap(err, "failed to parse template string")
 	}
 
+	if err := tx.checkNamespaceConflicts(vars); err != nil {
+		return "", err
+	}
+
 	buf := rbpool.Get()
 	defer rbpool.Release(buf)
 
-	tx.VM.Run(bc, vm.Vars(vars), buf)
+	if err := tx.VM.Run(bc, vm.Vars(tx.localize(vars)), buf); err != nil {
+		return "", err
+	}
 	return buf.String(), nil
 }
 
@@ -334,10 +507,177 @@ func (tx *Xslate) RenderString(template string, vars Vars) (string, error) {
 // This is a convenience method for frameworks providing a Writer interface,
 // such as net/http's ServeHTTP()
 func (tx *Xslate) RenderInto(w io.Writer, template string, vars Vars) error {
+	return tx.RenderIntoContext(context.Background(), w, template, vars)
+}
+
+// RenderIntoContext is like RenderInto, but with a context. See
+// RenderContext
+func (tx *Xslate) RenderIntoContext(ctx context.Context, w io.Writer, template string, vars Vars) error {
 	bc, err := tx.Loader.Load(template)
 	if err != nil {
 		return err
 	}
-	tx.VM.Run(bc, vm.Vars(vars), w)
+	if err := tx.checkNamespaceConflicts(vars); err != nil {
+		return err
+	}
+	return tx.VM.RunContext(ctx, bc, vm.Vars(tx.localize(vars)), w)
+}
+
+// RegisterFunctions makes the functions in the given FuncDepot callable
+// from templates under the depot's namespace:
+//
+//    tx.RegisterFunctions(txtime.Depot())
+//    tx.RenderString(`[% time.Now() %]`, nil)
+//
+// Namespaces may be nested by separating them with a dot (e.g. a depot
+// created with functions.NewFuncDepot("encoding.json") is called as
+// `encoding.json.Marshal(x)`), and may be registered in any order. It is
+// an error to register the same namespace twice, or one that conflicts
+// with an existing function, or variable given in the "Functions"
+// argument to New().
+//
+// The functions are copied when registered, so the depot may be shared
+// between Xslate instances, but functions added to it afterwards are
+// not seen by this instance
+func (tx *Xslate) RegisterFunctions(fd *functions.FuncDepot) error {
+	ns := fd.Namespace()
+	path := strings.Split(ns, ".")
+	for _, name := range path {
+		if name == "" {
+			return errors.Errorf("invalid function namespace '%s'", ns)
+		}
+	}
+	if tx.registered[ns] {
+		return errors.Errorf("function namespace '%s' is already registered", ns)
+	}
+
+	funcs := tx.VM.Functions()
+	if funcs == nil {
+		funcs = make(vm.Vars)
+		tx.VM.SetFunctions(funcs)
+	}
+	if tx.namespaces == nil {
+		tx.namespaces = make(map[string]*functions.FuncDepot)
+		tx.registered = make(map[string]bool)
+	}
+
+	// Check everything before adding anything, so that a failed
+	// registration leaves no trace
+	var parent *functions.FuncDepot
+	for i, name := range path {
+		node, ok := tx.namespaces[strings.Join(path[:i+1], ".")]
+		if !ok {
+			if i == 0 {
+				if _, exists := funcs[name]; exists {
+					return errors.Errorf("function namespace '%s' conflicts with an existing name", name)
+				}
+			} else if _, exists := parent.Get(name); exists {
+				return errors.Errorf("function namespace '%s' conflicts with function '%s.%s'", ns, parent.Namespace(), name)
+			}
+			break
+		}
+		parent = node
+	}
+	if parent != nil && parent.Namespace() == ns {
+		if err := checkFunctions(parent, fd); err != nil {
+			return err
+		}
+	}
+
+	parent = nil
+	for i, name := range path {
+		prefix := strings.Join(path[:i+1], ".")
+		node, ok := tx.namespaces[prefix]
+		if !ok {
+			node = functions.NewFuncDepot(prefix)
+			if i == 0 {
+				funcs[name] = node
+			} else {
+				parent.SetDepot(name, node)
+			}
+			tx.namespaces[prefix] = node
+		}
+		parent = node
+	}
+	tx.copyFunctions(parent, fd)
+	tx.registered[ns] = true
 	return nil
 }
+
+// checkFunctions makes sure that the functions and nested namespaces in
+// src can be copied into dst without replacing any of dst's functions
+func checkFunctions(dst, src *functions.FuncDepot) error {
+	for name := range src.Map() {
+		if _, ok := dst.Get(name); ok {
+			return errors.Errorf("function '%s.%s' is already registered", dst.Namespace(), name)
+		}
+		if _, ok := dst.Depot(name); ok {
+			return errors.Errorf("function '%s.%s' conflicts with a function namespace", dst.Namespace(), name)
+		}
+	}
+	for name, child := range src.Depots() {
+		if _, ok := dst.Get(name); ok {
+			return errors.Errorf("function namespace '%s.%s' conflicts with function '%s.%s'", dst.Namespace(), name, dst.Namespace(), name)
+		}
+		if sub, ok := dst.Depot(name); ok {
+			if err := checkFunctions(sub, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyFunctions copies the functions and nested namespaces in src into
+// dst, which belongs to this instance. See checkFunctions
+func (tx *Xslate) copyFunctions(dst, src *functions.FuncDepot) {
+	for name, f := range src.Map() {
+		dst.Map()[name] = f
+	}
+	for name, child := range src.Depots() {
+		sub, ok := dst.Depot(name)
+		if !ok {
+			sub = functions.NewFuncDepot(dst.Namespace() + "." + name)
+			dst.SetDepot(name, sub)
+			tx.namespaces[sub.Namespace()] = sub
+		}
+		tx.copyFunctions(sub, child)
+	}
+}
+
+// checkNamespaceConflicts makes sure that none of the variables passed to
+// a template hide a registered function namespace
+func (tx *Xslate) checkNamespaceConflicts(vars Vars) error {
+	if len(vars) == 0 {
+		return nil
+	}
+	for name, v := range tx.VM.Functions() {
+		if _, ok := v.(*functions.FuncDepot); !ok {
+			continue
+		}
+		if _, ok := vars[name]; ok {
+			return errors.Errorf("variable '%s' conflicts with function namespace '%s'", name, name)
+		}
+	}
+	return nil
+}
+
+// localize adds the localization functions for the locale specified by
+// the "locale" variable, if a Localizer has been configured. Variables
+// of the same name given by the user take precedence
+func (tx *Xslate) localize(vars Vars) Vars {
+	if tx.Localizer == nil {
+		return vars
+	}
+
+	locale, _ := vars["locale"].(string)
+	funcs := tx.Localizer.Functions(locale)
+	ret := make(Vars, len(vars)+len(funcs))
+	for k, v := range funcs {
+		ret[k] = v
+	}
+	for k, v := range vars {
+		ret[k] = v
+	}
+	return ret
+}
@@ -2,7 +2,11 @@ package xslate
 
 import (
 	"fmt"
+	"github.com/lestrrat/go-xslate/compiler"
+	"github.com/lestrrat/go-xslate/functions"
+	"github.com/lestrrat/go-xslate/i18n"
 	"github.com/lestrrat/go-xslate/test"
+	"github.com/lestrrat/go-xslate/vm"
 	"log"
 	"os"
 	"reflect"
@@ -119,3 +123,230 @@ func TestXslate_New_ParserSyntax(t *testing.T) {
 		t.Errorf("Expected Syntax: TTerse to succeed, but got err: %s", err)
 	}
 }
+
+func TestXslate_RegisterFunctions(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.XslateArgs["Functions"] = Args{"greeting": "Hello"}
+	tx := c.CreateTx()
+
+	str := functions.NewFuncDepot("str")
+	str.Set("Join", func(a, b string) string { return a + ", " + b })
+	if err := tx.RegisterFunctions(str); err != nil {
+		t.Fatalf("failed to register functions: %s", err)
+	}
+
+	html := functions.NewFuncDepot("text.html")
+	html.Set("Bold", func(s string) string { return "*" + s + "*" })
+	if err := tx.RegisterFunctions(html); err != nil {
+		t.Fatalf("failed to register functions: %s", err)
+	}
+
+	output, err := tx.RenderString(`[% str.Join(greeting, name) %] [% text.html.Bold(name) %] [% obj.Size() %]`, Vars{"name": "Bob", "obj": []int{1, 2}})
+	if err != nil {
+		t.Fatalf("failed to render: %s", err)
+	}
+	c.compareTemplateOutput(output, "Hello, Bob *Bob* 2")
+
+	if _, err := tx.RenderString(`[% str.Join("a", "b") %]`, Vars{"str": "hidden"}); err == nil {
+		t.Errorf("expected variable conflicting with namespace to be an error")
+	}
+
+	// Calling a method on an undefined variable is not a function call
+	output, err = tx.RenderString(`[[% undefined.foo() %]]`, nil)
+	if err != nil {
+		t.Fatalf("failed to render: %s", err)
+	}
+	c.compareTemplateOutput(output, "[]")
+
+	for _, ns := range []string{"str", "greeting", "text.html", "str.Join", "text..x"} {
+		fd := functions.NewFuncDepot(ns)
+		if err := tx.RegisterFunctions(fd); err == nil {
+			t.Errorf("expected namespace '%s' to conflict", ns)
+		}
+	}
+}
+
+func TestXslate_RegisterFunctions_Shared(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	// Depots are usually package level singletons, shared by every
+	// instance that registers them
+	enc := functions.NewFuncDepot("enc")
+	enc.Set("Quote", func(s string) string { return "<" + s + ">" })
+	json := functions.NewFuncDepot("enc.json")
+	json.Set("Null", func() string { return "null" })
+
+	// Nested namespaces may be registered before or after their parents
+	for _, order := range [][]*functions.FuncDepot{{json, enc}, {enc, json}} {
+		tx := c.CreateTx()
+		for _, fd := range order {
+			if err := tx.RegisterFunctions(fd); err != nil {
+				t.Fatalf("failed to register '%s' functions: %s", fd.Namespace(), err)
+			}
+		}
+
+		output, err := tx.RenderString(`[% enc.Quote(s) %] [% enc.json.Null() %]`, Vars{"s": "a"})
+		if err != nil {
+			t.Fatalf("failed to render: %s", err)
+		}
+		c.compareTemplateOutput(output, `&lt;a&gt; null`)
+	}
+
+	if _, ok := enc.Depot("json"); ok {
+		t.Errorf("expected the shared depot to be left unchanged")
+	}
+
+	// An instance that didn't register enc.json can't see it
+	tx := c.CreateTx()
+	if err := tx.RegisterFunctions(enc); err != nil {
+		t.Fatalf("failed to register functions: %s", err)
+	}
+	output, err := tx.RenderString(`[% enc.json.Null() %]`, nil)
+	if err != nil {
+		t.Fatalf("failed to render: %s", err)
+	}
+	c.compareTemplateOutput(output, ``)
+}
+
+func TestXslate_Localizer(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	ja := i18n.NewMapCatalog(map[string]string{
+		"Hello, [_1]!": "こんにちは、[_1]さん!",
+		"Welcome":      "ようこそ",
+	})
+	ja.SetPluralForms("nplurals=1; plural=0;")
+	ja.Set("[_1] file", "[_1]個のファイル")
+
+	l := i18n.NewLocalizer("en")
+	l.AddCatalog("ja", ja)
+	c.XslateArgs["Localizer"] = l
+
+	template := `[% loc("Hello, [_1]!", name) %] [% "Welcome" | loc %] [% nloc("[_1] file", "[_1] files", count) %]`
+	c.renderStringAndCompare(template, Vars{"locale": "ja", "name": "Bob", "count": 3}, "こんにちは、Bobさん! ようこそ 3個のファイル")
+	c.renderStringAndCompare(template, Vars{"locale": "en", "name": "Bob", "count": 3}, "Hello, Bob! Welcome 3 files")
+	c.renderStringAndCompare(template, Vars{"name": "Bob", "count": 1}, "Hello, Bob! Welcome 1 file")
+
+	c.XslateArgs["Localizer"] = "ja"
+	if _, err := New(c.XslateArgs); err == nil {
+		t.Errorf("expected invalid Localizer to be an error")
+	}
+}
+
+func TestXslate_OptimizationLevel(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	templates := []struct {
+		template string
+		expected string
+	}{
+		{`a[% 1 + 2 * 3 %]b[% "x" ~ "y" %]c`, `a7bxyc`},
+		{`[% 10 - (2 + 3) %],[% 7 / 2 %],[% 1 == 1 %],[% "a" lt "b" %],[% "-" x 3 %]`, `5,3.5,true,true,---`},
+		{`[% IF 0 %]a[% ELSE %]b[% END %][% IF 1 %]c[% ELSE %]d[% END %][% IF "" %]e[% END %]`, `bc`},
+		{`[% 1 ? "y" : "n" %][% 0 ? "y" : "n" %][% 0 // 5 %][% "" | default("d") %]`, `yn0d`},
+		{`[% FOREACH i IN [1..5] %][% IF i == 2 %][% NEXT %][% END %][% IF i == 4 %][% LAST %][% END %][% i %],[% END %]`, `1,3,`},
+		{`[% i = 0 %][% WHILE 1 %][% CALL i += 1 %][% IF i > 3 %][% LAST %][% END %][% i %][% END %]`, `123`},
+		{`[% WHILE 0 %]never[% END %]done`, `done`},
+		{`[% MACRO greet BLOCK %]Hi[% IF 1 %]![% END %][% END %][% IF 1 %][% CALL greet() %][% END %]`, `Hi!`},
+		{`[% SET f = -> x { x * (2 + 3) } %][% f(2) %]`, `10`},
+		{`[% TRY %]a[% 1 + 1 %][% END %]`, `a2`},
+	}
+
+	for _, level := range []interface{}{"none", "basic", compiler.OptimizeFull, 2} {
+		c.XslateArgs["Compiler"] = Args{"OptimizationLevel": level}
+		for i, tmpl := range templates {
+			name := fmt.Sprintf("optimize%d.tx", i)
+			c.File(name).WriteString(tmpl.template)
+			// The second time around, the bytecode is read from the cache
+			for j := 0; j < 2; j++ {
+				c.renderAndCompare(c.CreateTx(), name, nil, tmpl.expected)
+			}
+			os.RemoveAll(c.Mkpath("cache"))
+		}
+	}
+
+	c.XslateArgs["Compiler"] = Args{}
+	tx := c.CreateTx()
+	ast, err := tx.Parser.ParseString("optimize", `a[% IF 3 == (1 + 1) %]x[% END %]b[% 2 * 3 %]`)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	bc, err := tx.Compiler.Compile(ast)
+	if err != nil {
+		t.Fatalf("failed to compile: %s", err)
+	}
+	for _, op := range bc.OpList {
+		switch op.Type() {
+		case vm.TXOPNoop, vm.TXOPAnd, vm.TXOPGoto, vm.TXOPAdd, vm.TXOPMul, vm.TXOPEquals:
+			t.Errorf("expected %s to be optimized away:\n%s", op.Type(), bc)
+		case vm.TXOPPrintRawConst:
+			if op.ArgString() != "ab" {
+				t.Errorf("expected prints to be merged, got %q", op.ArgString())
+			}
+		}
+	}
+
+	for _, level := range []interface{}{-1, 3, "fast", 1.5} {
+		c.XslateArgs["Compiler"] = Args{"OptimizationLevel": level}
+		if _, err := New(c.XslateArgs); err == nil {
+			t.Errorf("expected OptimizationLevel %v to be an error", level)
+		}
+	}
+}
+
+func TestXslate_Backend(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("header.tx").WriteString(`<h1>[% title %]</h1>`)
+	c.File("layout.tx").WriteString(`<body>[% content %]</body>`)
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{`[% INCLUDE "header.tx" WITH title = name %][% WRAPPER "layout.tx" %][% name %][% END %]`, `<h1>&lt;Bob&gt;</h1><body>&lt;Bob&gt;</body>`},
+		{`[% FOREACH i IN list %][% IF loop.is_last %]last[% END %][% i * 2 + 0.5 %],[% i - 1 == 1 %],[% END %]`, `2.5,false,4.5,true,last6.5,false,`},
+		{`[% i = 0 %][% WHILE i < 5 %][% CALL i += 1 %][% IF i == 2 %][% NEXT %][% END %][% i %][% END %]`, `1345`},
+		{`[% MACRO hello BLOCK %]Hello [% name %]![% FOREACH j IN [1..2] %][% j %][% END %][% END %][% CALL hello() %][% CALL hello() %]`, `Hello &lt;Bob&gt;!12Hello &lt;Bob&gt;!12`},
+		{`[% list.map(-> x { x * 10 }).join(",") %] [% list.grep(-> x { x != 2 }).size() %]`, `10,20,30 2`},
+		{`[% TRY %][% fail() %]not reached[% CATCH %]caught: [% error %][% END %]`, `caught: function &#39;fail&#39; failed: oops at backend5.tx line 1`},
+		{`[% MACRO add(a, b) BLOCK %][% a + b %]/[% name %][% END %][% add(1, 2) %] [% CALL add(list.size(), 0.5) %]`, `3/&lt;Bob&gt; 3.5/&lt;Bob&gt;`},
+		{`[% name == "<Bob>" ? "yes" : "no" %] [% missing // "default" %] [% "a" ~ name %] [% 1.5 + 2 %] [% nil_value %]`, `yes default a&lt;Bob&gt; 3.5 `},
+	}
+	vars := Vars{
+		"name":      "<Bob>",
+		"list":      []int{1, 2, 3},
+		"fail":      func() error { return fmt.Errorf("oops") },
+		"nil_value": nil,
+	}
+
+	for i, test := range tests {
+		name := fmt.Sprintf("backend%d.tx", i)
+		c.File(name).WriteString(test.template)
+
+		for _, backend := range []interface{}{"interpreter", vm.BackendClosure} {
+			c.XslateArgs["VM"] = Args{"Backend": backend}
+			tx := c.CreateTx()
+			// Render twice, as closures are compiled on the first run
+			for j := 0; j < 2; j++ {
+				output, err := tx.Render(name, vars)
+				if err != nil {
+					t.Fatalf("Failed to render %s with backend %v: %s", name, backend, err)
+				}
+				if output != test.expected {
+					t.Errorf("Expected '%s' to render %q with backend %v, got %q", test.template, test.expected, backend, output)
+				}
+			}
+		}
+	}
+
+	c.XslateArgs["VM"] = Args{"Backend": "jit"}
+	if _, err := New(c.XslateArgs); err == nil {
+		t.Errorf("expected invalid Backend to be an error")
+	}
+}